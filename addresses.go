@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// GuestInterface - a guest NIC and the addresses found for it
+type GuestInterface struct {
+	MAC       string         `json:"mac"`
+	Name      string         `json:"name,omitempty"`   // name inside the guest, as the agent reports it
+	Source    string         `json:"source,omitempty"` // host side: network, bridge or device
+	Addresses []GuestAddress `json:"addresses"`
+}
+
+// GuestAddress - one IP address of a guest NIC
+type GuestAddress struct {
+	Address string `json:"address"`
+	Prefix  uint   `json:"prefix"`
+	Family  string `json:"family"` // "ipv4" or "ipv6"
+	Origin  string `json:"origin"` // "lease" (libvirt DHCP) or "agent" (qemu-guest-agent)
+}
+
+// handleGetVMAddresses - GET /api/v1/vm/{name}/addresses
+// Combines the DHCP leases of libvirt networks with what the guest agent reports, so it
+// also covers bridged NICs and static addresses once the agent is up.
+func handleGetVMAddresses(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		ifaces, err := guestAddresses(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get guest addresses: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, ifaces)
+	})
+}
+
+// guestAddresses lists the domain's NICs with their addresses, in domain XML order,
+// followed by any further interfaces the guest agent knows about (loopback excepted)
+func guestAddresses(dom *libvirt.Domain) ([]GuestInterface, error) {
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domain XML: %v", err)
+	}
+	state, err := domainState(dom)
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := []GuestInterface{}
+	byMAC := map[string]int{}
+	for _, iface := range def.Devices.Interfaces {
+		source := iface.Source.Network
+		if source == "" {
+			source = iface.Source.Bridge
+		}
+		if source == "" {
+			source = iface.Source.Dev
+		}
+		byMAC[strings.ToLower(iface.MAC.Address)] = len(ifaces)
+		ifaces = append(ifaces, GuestInterface{MAC: iface.MAC.Address, Source: source, Addresses: []GuestAddress{}})
+	}
+	if state != "running" {
+		return ifaces, nil
+	}
+
+	merge := func(found []libvirt.DomainInterface, origin string) {
+		for _, fi := range found {
+			mac := strings.ToLower(fi.Hwaddr)
+			i, ok := byMAC[mac]
+			if !ok {
+				if fi.Name == "lo" || mac == "" || mac == "00:00:00:00:00:00" {
+					continue
+				}
+				i = len(ifaces)
+				byMAC[mac] = i
+				ifaces = append(ifaces, GuestInterface{MAC: mac, Addresses: []GuestAddress{}})
+			}
+			if origin == "agent" && fi.Name != "" {
+				ifaces[i].Name = fi.Name
+			}
+			for _, a := range fi.Addrs {
+				if hasAddress(ifaces[i].Addresses, a.Addr) {
+					continue
+				}
+				family := "ipv4"
+				if a.Type == libvirt.IP_ADDR_TYPE_IPV6 {
+					family = "ipv6"
+				}
+				ifaces[i].Addresses = append(ifaces[i].Addresses, GuestAddress{Address: a.Addr, Prefix: a.Prefix, Family: family, Origin: origin})
+			}
+		}
+	}
+
+	leases, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DHCP leases: %v", err)
+	}
+	merge(leases, "lease")
+
+	if def.guestAgentConnected() {
+		agent, err := dom.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+		if err != nil {
+			// The leases are still worth returning
+			log.Printf("Failed to query guest agent for addresses of VM %s: %v", def.Name, err)
+		} else {
+			merge(agent, "agent")
+		}
+	}
+	return ifaces, nil
+}
+
+func hasAddress(addrs []GuestAddress, addr string) bool {
+	for _, a := range addrs {
+		if a.Address == addr {
+			return true
+		}
+	}
+	return false
+}
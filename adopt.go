@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// AdoptRequest - optional JSON body of POST /api/v1/vm/{name}/adopt
+type AdoptRequest struct {
+	// Project - project to put the VM in. A domain not named "<project>.<name>" yet is
+	// renamed, which libvirt only does while it is shut off.
+	Project     string            `json:"project,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// handleAdoptVM - POST /api/v1/vm/{name}/adopt
+//
+// Takes a domain defined outside the service (virsh, virt-manager, another tool) into
+// management: it gets a record, like the VMs the service created, and the project,
+// labels and annotations given. Labels and annotations replace any the domain has.
+func handleAdoptVM(w http.ResponseWriter, r *http.Request) {
+	var req AdoptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Project != "" && !projectPattern.MatchString(req.Project) {
+		http.Error(w, fmt.Sprintf("invalid project %q", req.Project), http.StatusBadRequest)
+		return
+	}
+	if err := validateLabels(req.Labels, req.Annotations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		host := requestHost(r)
+		name, err := dom.GetName()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM name: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if _, ok := vmRecords.get(hostName(host), name); ok {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is already managed", name))
+			return
+		}
+
+		if req.Project != "" {
+			if current := domainProject(dom); current != "" && current != req.Project {
+				writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is in project %s", name, current))
+				return
+			}
+			if !strings.HasPrefix(name, req.Project+projectSeparator) {
+				qualified := req.Project + projectSeparator + name
+				if err := dom.Rename(qualified, 0); err != nil {
+					writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Failed to rename VM %q to %q, shut it down first: %v", name, qualified, err))
+					return
+				}
+				requestLog(r).Info(fmt.Sprintf("Renamed VM %s to %s for project %s", name, qualified, req.Project))
+				name = qualified
+			}
+			if err := setDomainProject(dom, req.Project); err != nil {
+				errMsg := fmt.Sprintf("Failed to set the VM's project: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+		}
+		if req.Labels != nil {
+			if err := setDomainKeyValues(dom, labelsNamespace, req.Labels); err != nil {
+				errMsg := fmt.Sprintf("Failed to set labels: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+		}
+		if req.Annotations != nil {
+			if err := setDomainKeyValues(dom, annotationsNamespace, req.Annotations); err != nil {
+				errMsg := fmt.Sprintf("Failed to set annotations: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+		}
+
+		recordVM(host, dom, "adopted", requestUser(r), nil)
+		requestLog(r).Info(fmt.Sprintf("Adopted VM %s on host %s", name, hostName(host)))
+		scope, _ := requestScope(r)
+		vm, err := describeVM(scope, host, dom)
+		if err != nil {
+			writeSuccessResponse(w, fmt.Sprintf("VM %s adopted", name))
+			return
+		}
+		writeDataResponse(w, vm)
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Limits for POST /api/v1/vm/{name}/agent/exec
+const (
+	defaultExecTimeout = 60 * time.Second
+	maxExecTimeout     = time.Hour
+)
+
+// AgentExecRequest - body of POST /api/v1/vm/{name}/agent/exec
+type AgentExecRequest struct {
+	Path  string   `json:"path"` // program to run, e.g. "/bin/sh" or "powershell.exe"
+	Args  []string `json:"args,omitempty"`
+	Env   []string `json:"env,omitempty"`   // "NAME=value" entries
+	Input string   `json:"input,omitempty"` // written to the program's stdin
+	// TimeoutSeconds - how long to wait for the program to exit (default 60, max 3600).
+	// A program still running then is left running and reported with exited=false.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// AgentExecResult - outcome of a guest-exec
+type AgentExecResult struct {
+	PID             int    `json:"pid"`
+	Exited          bool   `json:"exited"`
+	ExitCode        *int   `json:"exit_code,omitempty"`
+	Signal          *int   `json:"signal,omitempty"` // set if the program was killed by a signal
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
+
+// guestExecStatus - the "return" of guest-exec-status
+type guestExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     *int   `json:"exitcode"`
+	Signal       *int   `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+// handleAgentExec - POST /api/v1/vm/{name}/agent/exec
+// Runs a program in the guest through qemu-guest-agent and waits for it to finish.
+func handleAgentExec(w http.ResponseWriter, r *http.Request) {
+	var req AgentExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultExecTimeout
+	if req.TimeoutSeconds != 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	if timeout <= 0 || timeout > maxExecTimeout {
+		http.Error(w, fmt.Sprintf("timeout_seconds must be between 1 and %d", int(maxExecTimeout.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	withGuestAgent(w, r, func(dom *libvirt.Domain) {
+		args := map[string]interface{}{
+			"path":           req.Path,
+			"arg":            req.Args,
+			"env":            req.Env,
+			"capture-output": true,
+		}
+		if req.Input != "" {
+			args["input-data"] = base64.StdEncoding.EncodeToString([]byte(req.Input))
+		}
+		var started struct {
+			PID int `json:"pid"`
+		}
+		if err := agentCommand(dom, "guest-exec", args, &started); err != nil {
+			errMsg := fmt.Sprintf("guest-exec failed: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Started %s in VM %s as pid %d", req.Path, r.PathValue("name"), started.PID))
+
+		result := AgentExecResult{PID: started.PID}
+		deadline := time.Now().Add(timeout)
+		for {
+			var status guestExecStatus
+			if err := agentCommand(dom, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+				errMsg := fmt.Sprintf("guest-exec-status failed: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			if status.Exited {
+				stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+				stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+				result.Exited = true
+				result.ExitCode, result.Signal = status.ExitCode, status.Signal
+				result.Stdout, result.Stderr = string(stdout), string(stderr)
+				result.StdoutTruncated, result.StderrTruncated = status.OutTruncated, status.ErrTruncated
+				break
+			}
+			if time.Now().After(deadline) || r.Context().Err() != nil {
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		writeDataResponse(w, result)
+	})
+}
+
+// AgentStatus - answer of GET /api/v1/vm/{name}/agent/ping
+type AgentStatus struct {
+	Connected  bool         `json:"connected"`  // libvirt sees the agent channel as connected
+	Responding bool         `json:"responding"` // the agent answered guest-ping
+	Error      string       `json:"error,omitempty"`
+	OS         *GuestOSInfo `json:"os,omitempty"`
+}
+
+// GuestOSInfo - the "return" of guest-get-osinfo
+type GuestOSInfo struct {
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	PrettyName    string `json:"pretty-name,omitempty"`
+	Version       string `json:"version,omitempty"`
+	VersionID     string `json:"version-id,omitempty"`
+	KernelRelease string `json:"kernel-release,omitempty"`
+	KernelVersion string `json:"kernel-version,omitempty"`
+	Machine       string `json:"machine,omitempty"`
+}
+
+// handleAgentPing - GET /api/v1/vm/{name}/agent/ping
+// Reports whether the guest agent answers, so callers can poll until a VM is ready.
+// A VM without a responding agent is not an error; it just reports responding=false.
+func handleAgentPing(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		var status AgentStatus
+		status.Connected = def.guestAgentConnected()
+		if status.Connected {
+			if err := agentCommand(dom, "guest-ping", nil, nil); err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Responding = true
+				var osInfo GuestOSInfo
+				if err := agentCommand(dom, "guest-get-osinfo", nil, &osInfo); err != nil {
+					// Older agents lack guest-get-osinfo; the agent is still usable
+					requestLog(r).Warn(fmt.Sprintf("guest-get-osinfo failed for VM %s: %v", def.Name, err))
+				} else {
+					status.OS = &osInfo
+				}
+			}
+		}
+		writeDataResponse(w, status)
+	})
+}
+
+// withGuestAgent looks up the VM named in the URL like withDomain and hands it to fn,
+// answering 409 if it isn't running a connected guest agent
+func withGuestAgent(w http.ResponseWriter, r *http.Request, fn func(dom *libvirt.Domain)) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if !def.guestAgentConnected() {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q has no connected guest agent", def.Name))
+			return
+		}
+		fn(dom)
+	})
+}
+
+// agentCommand sends one QMP command to the guest agent and decodes its "return" value
+// into result (which may be nil)
+func agentCommand(dom *libvirt.Domain, command string, args interface{}, result interface{}) error {
+	msg := map[string]interface{}{"execute": command}
+	if args != nil {
+		msg["arguments"] = args
+	}
+	in, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	out, err := dom.QemuAgentCommand(string(in), libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT, 0)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	var resp struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil {
+		return fmt.Errorf("unexpected agent reply %q: %v", out, err)
+	}
+	return json.Unmarshal(resp.Return, result)
+}
+
+// Limits for /api/v1/vm/{name}/agent/file; the agent moves data one chunk per command
+const (
+	maxAgentFileSize = 1 << 20
+	agentFileChunk   = 48 << 10
+)
+
+// handleReadGuestFile - GET /api/v1/vm/{name}/agent/file?path=...
+// Answers with the file's raw content.
+func handleReadGuestFile(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	withGuestAgent(w, r, func(dom *libvirt.Domain) {
+		handle, err := openGuestFile(dom, path, "r")
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to open %s in guest: %v", path, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer closeGuestFile(dom, handle)
+
+		var content []byte
+		for {
+			var chunk struct {
+				Count int    `json:"count"`
+				Buf   string `json:"buf-b64"`
+				EOF   bool   `json:"eof"`
+			}
+			if err := agentCommand(dom, "guest-file-read", map[string]int{"handle": handle, "count": agentFileChunk}, &chunk); err != nil {
+				errMsg := fmt.Sprintf("Failed to read %s in guest: %v", path, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			data, err := base64.StdEncoding.DecodeString(chunk.Buf)
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to decode %s from guest: %v", path, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			content = append(content, data...)
+			if len(content) > maxAgentFileSize {
+				http.Error(w, fmt.Sprintf("%s is larger than %d bytes", path, maxAgentFileSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if chunk.EOF || chunk.Count == 0 {
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		_, _ = w.Write(content)
+	})
+}
+
+// handleWriteGuestFile - PUT /api/v1/vm/{name}/agent/file?path=...[&append=true]
+// Writes the raw request body to the file, creating or truncating it unless append is set.
+func handleWriteGuestFile(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "path query parameter is required", http.StatusBadRequest)
+		return
+	}
+	mode := "w"
+	if r.URL.Query().Get("append") == "true" {
+		mode = "a"
+	}
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAgentFileSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Body must be at most %d bytes", maxAgentFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	withGuestAgent(w, r, func(dom *libvirt.Domain) {
+		handle, err := openGuestFile(dom, path, mode)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to open %s in guest: %v", path, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer closeGuestFile(dom, handle)
+
+		for off := 0; off < len(content); off += agentFileChunk {
+			end := min(off+agentFileChunk, len(content))
+			args := map[string]interface{}{"handle": handle, "buf-b64": base64.StdEncoding.EncodeToString(content[off:end])}
+			if err := agentCommand(dom, "guest-file-write", args, nil); err != nil {
+				errMsg := fmt.Sprintf("Failed to write %s in guest: %v", path, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+		}
+		if err := agentCommand(dom, "guest-file-flush", map[string]int{"handle": handle}, nil); err != nil {
+			errMsg := fmt.Sprintf("Failed to flush %s in guest: %v", path, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Wrote %d bytes to %s in VM %s", len(content), path, r.PathValue("name")))
+		writeSuccessResponse(w, fmt.Sprintf("Wrote %d bytes to %s", len(content), path))
+	})
+}
+
+// openGuestFile opens path in the guest with an fopen(3) mode and returns the agent's handle
+func openGuestFile(dom *libvirt.Domain, path, mode string) (int, error) {
+	var handle int
+	err := agentCommand(dom, "guest-file-open", map[string]string{"path": path, "mode": mode}, &handle)
+	return handle, err
+}
+
+// closeGuestFile releases a handle from openGuestFile, logging failures
+func closeGuestFile(dom *libvirt.Domain, handle int) {
+	if err := agentCommand(dom, "guest-file-close", map[string]int{"handle": handle}, nil); err != nil {
+		log.Printf("Failed to close guest file handle %d: %v", handle, err)
+	}
+}
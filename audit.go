@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLogPath - the append-only audit log, one JSON record per line, overridable with
+// VM_SERVICE_AUDIT_LOG
+var auditLogPath = envOrDefault("VM_SERVICE_AUDIT_LOG", filepath.Join(stateDir, "audit.log"))
+
+const (
+	maxAuditBody     = 64 << 10 // larger request bodies are recorded by size only
+	maxAuditResponse = 4 << 10
+	defaultAuditRows = 100
+	maxAuditRows     = 1000
+)
+
+// auditRedactedFields - JSON keys whose values never reach the audit log
+var auditRedactedFields = map[string]bool{
+	"password": true, "passwd": true, "secret": true, "token": true, "api_key": true, "private_key": true,
+	"passphrase": true, "ceph_key": true,
+}
+
+// auditSizeOnly - whether only the size of the request's body is recorded, for bodies
+// that go into guests as they are and may hold anything
+func auditSizeOnly(r *http.Request) bool {
+	return r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/agent/file")
+}
+
+// AuditRecord - one state-changing API call
+type AuditRecord struct {
+	Time       time.Time       `json:"time"`
+	RequestID  string          `json:"request_id,omitempty"`
+	User       string          `json:"user"`
+	RemoteAddr string          `json:"remote_addr"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Query      string          `json:"query,omitempty"`
+	VM         string          `json:"vm,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`      // JSON bodies, secrets redacted
+	BodyInfo   string          `json:"body_info,omitempty"` // what was sent instead, for other bodies
+	Status     int             `json:"status"`              // HTTP status of the response
+	Message    string          `json:"message,omitempty"`   // the response's message, if any
+	DurationMS int64           `json:"duration_ms"`
+}
+
+var auditMu sync.Mutex
+
+// appendAudit writes the record as one line at the end of the audit log
+func appendAudit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(auditLogPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditRecorder keeps the start of the response so its message can be audited
+type auditRecorder struct {
+	*statusRecorder
+	body bytes.Buffer
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if room := maxAuditResponse - a.body.Len(); room > 0 {
+		a.body.Write(b[:min(room, len(b))])
+	}
+	return a.statusRecorder.Write(b)
+}
+
+// withAudit records every POST, PUT, PATCH and DELETE in the audit log once it has been
+// handled. Reads aren't audited, nor gRPC calls as such (see restAPI).
+func withAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/"+grpcService+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := AuditRecord{
+			Time:       start.UTC(),
+			RequestID:  requestID(r),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.RawQuery,
+		}
+		rec.Body, rec.BodyInfo = auditRequestBody(r)
+
+		ar := &auditRecorder{statusRecorder: &statusRecorder{ResponseWriter: w}}
+		next.ServeHTTP(ar, r)
+
+		rec.User = requestUser(r)
+		rec.VM = r.PathValue("name")
+		if rec.VM == "" && r.URL.Path == "/api/v1/vm" {
+			// Create names the VM in its body
+			var body struct {
+				Name string `json:"name"`
+			}
+			_ = json.Unmarshal(rec.Body, &body)
+			rec.VM = body.Name
+		}
+		rec.Status = ar.code
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Message = auditResponseMessage(ar.body.Bytes())
+		rec.DurationMS = time.Since(start).Milliseconds()
+		if err := appendAudit(rec); err != nil {
+			requestLog(r).Error(fmt.Sprintf("Failed to write audit record for %s %s: %v", r.Method, r.URL.Path, err))
+		}
+	})
+}
+
+// requestUser names the caller for the audit log: the authenticated identity, or else
+// the address it connected from
+func requestUser(r *http.Request) string {
+	if p := requestPrincipal(r); p != nil {
+		return p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditRequestBody returns a small JSON body with its secrets redacted, leaving the
+// request able to read it again. Other bodies, and those auditSizeOnly picks, are only
+// described.
+func auditRequestBody(r *http.Request) (json.RawMessage, string) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if auditSizeOnly(r) && mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	if auditSizeOnly(r) || (mediaType != "" && mediaType != "application/json") {
+		if r.ContentLength < 0 {
+			return nil, mediaType
+		}
+		return nil, fmt.Sprintf("%s, %d bytes", mediaType, r.ContentLength)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil {
+		return nil, fmt.Sprintf("unreadable body: %v", err)
+	}
+	if len(buf) > maxAuditBody {
+		return nil, fmt.Sprintf("JSON body over %d bytes", maxAuditBody)
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return nil, fmt.Sprintf("invalid JSON, %d bytes", len(buf))
+	}
+	redacted, _ := json.Marshal(redactSecrets(v))
+	return redacted, ""
+}
+
+// redactSecrets replaces the values of secret-bearing keys, at any depth
+func redactSecrets(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if auditRedactedFields[strings.ToLower(k)] {
+				t[k] = "[redacted]"
+			} else {
+				t[k] = redactSecrets(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactSecrets(t[i])
+		}
+	}
+	return v
+}
+
+// auditResponseMessage pulls the message out of a ResponseData body, or takes the text
+// http.Error wrote
+func auditResponseMessage(body []byte) string {
+	var resp ResponseData
+	if json.Unmarshal(body, &resp) == nil {
+		return resp.Message
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// handleQueryAudit - GET /api/v1/audit[?since=&until=&user=&vm=&method=&limit=]
+// Returns the most recent matching audit records, oldest first. since and until are
+// RFC 3339 times; limit defaults to 100, at most 1000.
+func handleQueryAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var since, until time.Time
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := q.Get(p.key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s must be an RFC 3339 time", p.key), http.StatusBadRequest)
+				return
+			}
+			*p.dst = t
+		}
+	}
+	limit := defaultAuditRows
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxAuditRows {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAuditRows), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	user, vm, method := q.Get("user"), q.Get("vm"), strings.ToUpper(q.Get("method"))
+
+	match := func(rec AuditRecord) bool {
+		return (since.IsZero() || !rec.Time.Before(since)) &&
+			(until.IsZero() || rec.Time.Before(until)) &&
+			(user == "" || rec.User == user) &&
+			(vm == "" || rec.VM == vm) &&
+			(method == "" || rec.Method == method)
+	}
+	records, err := readAudit(match, limit)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read audit log: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, records)
+}
+
+// readAudit scans the audit log and keeps the last limit records that match. Records
+// are appended a line at a time, so a half-written last line is simply skipped.
+func readAudit(match func(AuditRecord) bool, limit int) ([]AuditRecord, error) {
+	out := []AuditRecord{}
+	f, err := os.Open(auditLogPath)
+	if os.IsNotExist(err) {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || !match(rec) {
+			continue
+		}
+		out = append(out, rec)
+		if len(out) > limit {
+			out = out[1:]
+		}
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Principal - an authenticated caller
+type Principal struct {
+	Name    string `json:"name"`
+	Method  string `json:"method"`            // how it authenticated: "api-key", "oidc" or "client-cert"
+	Project string `json:"project,omitempty"` // see tenancy.go
+	Role    string `json:"role"`              // viewer, operator or admin, see rbac.go
+}
+
+// minAPIKeyLength - shorter keys are refused at startup
+const minAPIKeyLength = 16
+
+// apiKey - a configured key, kept only as its SHA-256 so lookups compare fixed-size values
+type apiKey struct {
+	identity string
+	sum      [sha256.Size]byte
+}
+
+// apiKeys - from VM_SERVICE_API_KEYS ("identity=key,identity=key,...") and the file named
+// by VM_SERVICE_API_KEYS_FILE (one identity=key per line, # for comments). With no keys,
+// OIDC issuer or client CA configured the service only starts if
+// VM_SERVICE_ALLOW_UNAUTHENTICATED is true, and the API is then open.
+var apiKeys []apiKey
+
+// allowUnauthenticated - VM_SERVICE_ALLOW_UNAUTHENTICATED, for running without any
+// credentials configured, e.g. behind a proxy that authenticates
+var allowUnauthenticated, _ = strconv.ParseBool(envOrDefault("VM_SERVICE_ALLOW_UNAUTHENTICATED", "false"))
+
+// unauthenticatedPaths - endpoints that check something else instead. The console
+// websocket is opened by browsers, which can't set headers on it; the single-use token
+// it takes is only handed out to authenticated callers. The API description is public so
+// SDK generators can fetch it, and the health probes so watchdogs need no credentials.
+var unauthenticatedPaths = map[string]bool{
+	"/api/v1/console/ws":   true,
+	"/api/v1/openapi.json": true,
+	"/api/v1/docs":         true,
+	"/healthz":             true,
+	"/readyz":              true,
+}
+
+// loadAPIKeys reads the configured API keys into apiKeys
+func loadAPIKeys() error {
+	entries := strings.Split(envOrDefault("VM_SERVICE_API_KEYS", ""), ",")
+	if path := envOrDefault("VM_SERVICE_API_KEYS_FILE", ""); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	var keys []apiKey
+	seen := map[[sha256.Size]byte]bool{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, key, ok := strings.Cut(entry, "=")
+		identity, key = strings.TrimSpace(identity), strings.TrimSpace(key)
+		if !ok || identity == "" || key == "" {
+			// Not quoting the entry, it may well be a bare key
+			return fmt.Errorf("an API key entry is not identity=key")
+		}
+		if len(key) < minAPIKeyLength {
+			return fmt.Errorf("API key for %q is shorter than %d characters", identity, minAPIKeyLength)
+		}
+		sum := sha256.Sum256([]byte(key))
+		if seen[sum] {
+			return fmt.Errorf("API key for %q is also used by another identity", identity)
+		}
+		seen[sum] = true
+		keys = append(keys, apiKey{identity: identity, sum: sum})
+	}
+	apiKeys = keys
+	return nil
+}
+
+// checkAuthConfigured refuses to serve an open API unless that was asked for
+func checkAuthConfigured() error {
+	if authEnabled() {
+		return nil
+	}
+	if !allowUnauthenticated {
+		return fmt.Errorf("no API keys, OIDC issuer or client CA configured; set VM_SERVICE_ALLOW_UNAUTHENTICATED=true to run without authentication")
+	}
+	log.Println("No API keys, OIDC issuer or client CA configured, the API accepts unauthenticated requests")
+	return nil
+}
+
+// lookupAPIKey returns the identity the key belongs to. Every configured key is compared,
+// in constant time, so the time taken doesn't hint at how close a guess was.
+func lookupAPIKey(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	identity, found := "", false
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare(sum[:], k.sum[:]) == 1 {
+			identity, found = k.identity, true
+		}
+	}
+	return identity, found
+}
+
+func authEnabled() bool {
+	return len(apiKeys) > 0 || oidcEnabled() || clientCertAuth()
+}
+
+// requestCredential returns the key from "Authorization: Bearer <key>" or X-API-Key
+func requestCredential(r *http.Request) string {
+	if v := r.Header.Get("Authorization"); v != "" {
+		scheme, token, ok := strings.Cut(v, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// withAuth requires a valid API key, OIDC token or client certificate on every request,
+// other than the unauthenticated paths, once any of them is configured. The caller's
+// identity is attached to the request for handlers and the logs.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cred := requestCredential(r)
+		if cred == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			// The TLS handshake already checked the certificate against the client CA
+			cert := r.TLS.VerifiedChains[0][0]
+			p := &Principal{Name: cert.Subject.CommonName, Method: "client-cert"}
+			assignRole(p, nil)
+			assignProject(p)
+			setRequestPrincipal(r, p)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cred == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vm-service"`)
+			writeErrorStatus(w, http.StatusUnauthorized, "Missing credentials")
+			return
+		}
+
+		if oidcEnabled() && looksLikeJWT(cred) {
+			p, err := verifyJWT(cred)
+			if err != nil {
+				requestLog(r).Warn("Rejected bearer token", "error", err, "remote_addr", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="vm-service", error="invalid_token"`)
+				writeErrorStatus(w, http.StatusUnauthorized, fmt.Sprintf("Invalid token: %v", err))
+				return
+			}
+			setRequestPrincipal(r, p)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, ok := lookupAPIKey(cred)
+		if !ok {
+			requestLog(r).Warn("Rejected invalid API key", "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vm-service", error="invalid_token"`)
+			writeErrorStatus(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+		p := &Principal{Name: identity, Method: "api-key"}
+		assignRole(p, nil)
+		assignProject(p)
+		setRequestPrincipal(r, p)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Incremental backups are built on libvirt checkpoints: creating a checkpoint adds a
+// persistent dirty bitmap to every qcow2 disk, and a backup "incremental" from it copies
+// only the clusters written since. Raw disks can't hold bitmaps and are left out of both.
+//
+// Backups run in push mode: libvirt writes one qcow2 per disk into the target directory.
+// An incremental image only holds the changed clusters; to restore, rebase it onto the
+// previous backup (qemu-img rebase -u -b <previous> <incremental>) and commit the chain.
+
+// CheckpointRequest - incoming JSON for POST /api/v1/vm/{name}/checkpoints
+type CheckpointRequest struct {
+	Name        string `json:"name,omitempty"` // defaults to a timestamp
+	Description string `json:"description,omitempty"`
+}
+
+// BackupRequest - incoming JSON for POST /api/v1/vm/{name}/backups
+type BackupRequest struct {
+	TargetDir string `json:"target_dir"`
+	// IncrementalFrom is the checkpoint to back up changes since; empty for a full backup
+	IncrementalFrom string `json:"incremental_from,omitempty"`
+	// Checkpoint names the checkpoint created together with the backup, which the next
+	// incremental backup starts from. Defaults to a timestamp.
+	Checkpoint string `json:"checkpoint,omitempty"`
+}
+
+// CheckpointInfo - one checkpoint as reported by the API
+type CheckpointInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Parent      string    `json:"parent,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Disks       []string  `json:"disks"` // disks carrying a bitmap for this checkpoint
+}
+
+// BackupResult - where a finished backup put each disk
+type BackupResult struct {
+	Checkpoint      string            `json:"checkpoint"`
+	IncrementalFrom string            `json:"incremental_from,omitempty"`
+	Files           map[string]string `json:"files"` // target dev -> image path
+}
+
+type checkpointXML struct {
+	XMLName      xml.Name             `xml:"domaincheckpoint"`
+	Name         string               `xml:"name"`
+	Description  string               `xml:"description,omitempty"`
+	CreationTime int64                `xml:"creationTime,omitempty"`
+	Parent       *checkpointParentXML `xml:"parent,omitempty"`
+	Disks        []checkpointDiskXML  `xml:"disks>disk"`
+}
+
+type checkpointParentXML struct {
+	Name string `xml:"name"`
+}
+
+type checkpointDiskXML struct {
+	Name       string `xml:"name,attr"`
+	Checkpoint string `xml:"checkpoint,attr"` // "bitmap" or "no"
+}
+
+type backupXML struct {
+	XMLName     xml.Name        `xml:"domainbackup"`
+	Mode        string          `xml:"mode,attr"`
+	Incremental string          `xml:"incremental,omitempty"`
+	Disks       []backupDiskXML `xml:"disks>disk"`
+}
+
+type backupDiskXML struct {
+	Name   string           `xml:"name,attr"`
+	Backup string           `xml:"backup,attr"` // "yes" or "no"
+	Type   string           `xml:"type,attr,omitempty"`
+	Target *backupTargetXML `xml:"target,omitempty"`
+	Driver *backupDriverXML `xml:"driver,omitempty"`
+}
+
+type backupTargetXML struct {
+	File string `xml:"file,attr"`
+}
+
+type backupDriverXML struct {
+	Type string `xml:"type,attr"`
+}
+
+// handleListCheckpoints - GET /api/v1/vm/{name}/checkpoints
+func handleListCheckpoints(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		cps, err := dom.ListAllCheckpoints(libvirt.DOMAIN_CHECKPOINT_LIST_TOPOLOGICAL)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to list checkpoints: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		infos := []CheckpointInfo{}
+		for i := range cps {
+			info, err := describeCheckpoint(&cps[i])
+			cps[i].Free()
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to read checkpoint: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			infos = append(infos, info)
+		}
+		writeDataResponse(w, infos)
+	})
+}
+
+// handleCreateCheckpoint - POST /api/v1/vm/{name}/checkpoints
+// Starts tracking changes on the VM's qcow2 disks from this point on.
+func handleCreateCheckpoint(w http.ResponseWriter, r *http.Request) {
+	var req CheckpointRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		if req.Name == "" {
+			req.Name = timestampName()
+		}
+		doc, err := buildCheckpointXML(def, req.Name, req.Description)
+		if err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cp, err := dom.CreateCheckpointXML(doc, 0)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to create checkpoint: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer cp.Free()
+
+		info, err := describeCheckpoint(cp)
+		if err != nil {
+			errMsg := fmt.Sprintf("Checkpoint created but failed to read it back: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Created checkpoint %s on VM %s", info.Name, def.Name))
+		writeDataResponse(w, info)
+	})
+}
+
+// handleDeleteCheckpoint - DELETE /api/v1/vm/{name}/checkpoints/{checkpoint}
+// Its bitmaps are merged into the parent, so later incrementals from the parent still work.
+func handleDeleteCheckpoint(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("checkpoint")
+		cp, err := dom.CheckpointLookupByName(name, 0)
+		if err != nil {
+			if isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN_CHECKPOINT) {
+				writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Checkpoint %q not found", name))
+				return
+			}
+			errMsg := fmt.Sprintf("Failed to look up checkpoint %q: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer cp.Free()
+
+		if err := cp.Delete(0); err != nil {
+			errMsg := fmt.Sprintf("Failed to delete checkpoint %q: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Deleted checkpoint %s on VM %s", name, r.PathValue("name")))
+		writeSuccessResponse(w, fmt.Sprintf("Checkpoint %s deleted", name))
+	})
+}
+
+// handleStartBackup - POST /api/v1/vm/{name}/backups
+// Starts a push backup of the running VM, creating a new checkpoint at the same instant,
+// and answers 202 with the job to poll at GET /api/v1/vm/{name}/backups/{id}.
+func handleStartBackup(w http.ResponseWriter, r *http.Request) {
+	var req BackupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(req.TargetDir) {
+		http.Error(w, "target_dir must be an absolute path", http.StatusBadRequest)
+		return
+	}
+	if err := validatePath("target_dir", req.TargetDir, true); err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		state, err := domainState(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if state != "running" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is %s, backups need a running VM", r.PathValue("name"), state))
+			return
+		}
+
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		if req.IncrementalFrom != "" {
+			cp, err := dom.CheckpointLookupByName(req.IncrementalFrom, 0)
+			if err != nil {
+				writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Checkpoint %q not found", req.IncrementalFrom))
+				return
+			}
+			cp.Free()
+		}
+
+		if req.Checkpoint == "" {
+			req.Checkpoint = timestampName()
+		}
+		cpDoc, err := buildCheckpointXML(def, req.Checkpoint, "backup")
+		if err != nil {
+			writeErrorStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		dir := filepath.Join(req.TargetDir, def.Name+"-"+req.Checkpoint)
+		if _, err := os.Stat(dir); err == nil {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("%s already exists", dir))
+			return
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			errMsg := fmt.Sprintf("Failed to create %s: %v", dir, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		backup := backupXML{Mode: "push", Incremental: req.IncrementalFrom}
+		result := BackupResult{Checkpoint: req.Checkpoint, IncrementalFrom: req.IncrementalFrom, Files: map[string]string{}}
+		for _, disk := range def.Devices.Disks {
+			if disk.Device != "disk" {
+				continue
+			}
+			bd := backupDiskXML{Name: disk.Target.Dev, Backup: "no"}
+			if disk.Driver.Type == "qcow2" {
+				path := filepath.Join(dir, disk.Target.Dev+".qcow2")
+				bd.Backup, bd.Type = "yes", "file"
+				bd.Target = &backupTargetXML{File: path}
+				bd.Driver = &backupDriverXML{Type: "qcow2"}
+				result.Files[disk.Target.Dev] = path
+			}
+			backup.Disks = append(backup.Disks, bd)
+		}
+		backupDoc, err := xml.Marshal(backup)
+		if err != nil {
+			writeErrorResponse(w, err.Error())
+			return
+		}
+
+		if err := dom.BackupBegin(string(backupDoc), cpDoc, 0); err != nil {
+			_ = os.Remove(dir)
+			errMsg := fmt.Sprintf("Failed to start backup: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Started backup of VM %s into %s (incremental from %q)", def.Name, dir, req.IncrementalFrom))
+
+		host, vmName := requestHost(r), def.Name
+		job := startJob("vm-backup", requestProject(r), vmName, func(j *jobHandle) (interface{}, error) {
+			if err := waitForDomainJob(j, host, vmName); err != nil {
+				return nil, err
+			}
+			return result, nil
+		})
+		writeJobAccepted(w, job)
+	})
+}
+
+// handleGetBackup - GET /api/v1/vm/{name}/backups/{id}
+func handleGetBackup(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r, "vm-backup")
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Backup %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// buildCheckpointXML describes a checkpoint covering the domain's qcow2 disks. It fails
+// if there are none, as there would be nothing to track.
+func buildCheckpointXML(def domainDefXML, name, description string) (string, error) {
+	cp := checkpointXML{Name: name, Description: description}
+	tracked := 0
+	for _, disk := range def.Devices.Disks {
+		if disk.Device != "disk" {
+			continue
+		}
+		mode := "no"
+		if disk.Driver.Type == "qcow2" {
+			mode = "bitmap"
+			tracked++
+		}
+		cp.Disks = append(cp.Disks, checkpointDiskXML{Name: disk.Target.Dev, Checkpoint: mode})
+	}
+	if tracked == 0 {
+		return "", fmt.Errorf("VM %q has no qcow2 disks, raw disks cannot track changes", def.Name)
+	}
+
+	doc, err := xml.Marshal(cp)
+	if err != nil {
+		return "", err
+	}
+	return string(doc), nil
+}
+
+// timestampName - default name for checkpoints and snapshots, sortable by time
+func timestampName() string {
+	return time.Now().UTC().Format("20060102T150405Z")
+}
+
+func describeCheckpoint(cp *libvirt.DomainCheckpoint) (CheckpointInfo, error) {
+	desc, err := cp.GetXMLDesc(libvirt.DOMAIN_CHECKPOINT_XML_NO_DOMAIN)
+	if err != nil {
+		return CheckpointInfo{}, err
+	}
+	var doc checkpointXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return CheckpointInfo{}, err
+	}
+
+	info := CheckpointInfo{
+		Name:        doc.Name,
+		Description: doc.Description,
+		CreatedAt:   time.Unix(doc.CreationTime, 0).UTC(),
+		Disks:       []string{},
+	}
+	if doc.Parent != nil {
+		info.Parent = doc.Parent.Name
+	}
+	for _, d := range doc.Disks {
+		if d.Checkpoint == "bitmap" {
+			info.Disks = append(info.Disks, d.Name)
+		}
+	}
+	return info, nil
+}
+
+// waitForDomainJob polls the domain's active job (the backup) until it ends, mirroring
+// its progress onto j. It uses its own connection, as the request's is closed by then.
+func waitForDomainJob(j *jobHandle, host, vmName string) error {
+	conn, err := connectHost(host)
+	if err != nil {
+		return fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to look up VM %q: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	for {
+		info, err := dom.GetJobStats(0)
+		if err != nil {
+			return fmt.Errorf("failed to get job stats: %v", err)
+		}
+		if info.Type == libvirt.DOMAIN_JOB_NONE {
+			break
+		}
+		if info.DataTotalSet && info.DataTotal > 0 {
+			j.setProgress(float64(info.DataProcessed) * 100 / float64(info.DataTotal))
+		}
+		time.Sleep(time.Second)
+	}
+
+	info, err := dom.GetJobStats(libvirt.DOMAIN_JOB_STATS_COMPLETED)
+	if err != nil {
+		return fmt.Errorf("failed to get job result: %v", err)
+	}
+	switch info.Type {
+	case libvirt.DOMAIN_JOB_COMPLETED:
+		return nil
+	case libvirt.DOMAIN_JOB_CANCELLED:
+		return fmt.Errorf("backup was cancelled")
+	default:
+		return fmt.Errorf("backup failed")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// The virtio memory balloon lets the host take memory back from a running guest: PUT
+// /api/v1/vm/{name}/balloon with a target below the VM's memory inflates the balloon,
+// the guest's driver handing pages to the host, and a higher target, up to the VM's
+// memory, deflates it again. The guest reports its own memory figures every stats
+// period, which GET /api/v1/vm/{name}/balloon and the VM's stats show. Memory of VMs
+// with VFIO devices or hugepages is pinned, and their balloon reclaims nothing.
+
+// defaultBalloonStatsPeriod - how often, in seconds, the guest reports its memory stats
+const defaultBalloonStatsPeriod = 10
+
+// minBalloonMB - a target below this leaves the guest too little to run
+const minBalloonMB = 128
+
+// BalloonSpec - the memory balloon of a create
+type BalloonSpec struct {
+	// Disabled - give the VM no balloon, so its memory can't be reclaimed
+	Disabled bool `json:"disabled,omitempty"`
+	// StatsPeriodSeconds - how often the guest reports memory stats, 0 for never;
+	// defaults to 10
+	StatsPeriodSeconds *int `json:"stats_period_seconds,omitempty"`
+	// AutoDeflate - deflate the balloon before the guest runs out of memory
+	AutoDeflate bool `json:"auto_deflate,omitempty"`
+	// FreePageReporting - the guest hands pages it frees back to the host by itself
+	FreePageReporting bool `json:"free_page_reporting,omitempty"`
+}
+
+// Balloon - the <memballoon> as the template writes it
+type Balloon struct {
+	Model             string // "virtio" or "none"
+	StatsPeriod       int
+	AutoDeflate       bool
+	FreePageReporting bool
+}
+
+// BalloonRequest - PUT /api/v1/vm/{name}/balloon; either or both may be set
+type BalloonRequest struct {
+	TargetMB           int  `json:"target_mb,omitempty"`
+	StatsPeriodSeconds *int `json:"stats_period_seconds,omitempty"`
+}
+
+// BalloonInfo - the balloon's current size and what the guest last reported, in MiB
+type BalloonInfo struct {
+	ActualMB     uint64 `json:"actual_mb"` // what the balloon currently gives the guest
+	MaximumMB    uint64 `json:"maximum_mb"`
+	UsableMB     uint64 `json:"usable_mb,omitempty"`
+	UnusedMB     uint64 `json:"unused_mb,omitempty"`
+	AvailableMB  uint64 `json:"available_mb,omitempty"`   // as the guest sees it
+	DiskCachesMB uint64 `json:"disk_caches_mb,omitempty"` // reclaimable page cache
+	SwapInMB     uint64 `json:"swap_in_mb,omitempty"`
+	SwapOutMB    uint64 `json:"swap_out_mb,omitempty"`
+	MajorFaults  uint64 `json:"major_faults,omitempty"`
+	MinorFaults  uint64 `json:"minor_faults,omitempty"`
+	RssMB        uint64 `json:"rss_mb,omitempty"`      // resident size of the QEMU process
+	LastUpdate   uint64 `json:"last_update,omitempty"` // Unix time of the guest's last report
+}
+
+type domainMemballoonXML struct {
+	Model string `xml:"model,attr"`
+}
+
+// validateBalloon checks the request's balloon
+func validateBalloon(req RequestData) error {
+	b := req.Balloon
+	if b == nil {
+		return nil
+	}
+	if b.StatsPeriodSeconds != nil && *b.StatsPeriodSeconds < 0 {
+		return fmt.Errorf("stats_period_seconds must be >= 0")
+	}
+	if b.Disabled && (b.StatsPeriodSeconds != nil || b.AutoDeflate || b.FreePageReporting) {
+		return fmt.Errorf("a disabled balloon takes no other settings")
+	}
+	return nil
+}
+
+// memBalloon - the template's balloon for the request
+func memBalloon(req RequestData) Balloon {
+	b := req.Balloon
+	if b == nil {
+		return Balloon{Model: "virtio", StatsPeriod: defaultBalloonStatsPeriod}
+	}
+	if b.Disabled {
+		return Balloon{Model: "none"}
+	}
+	balloon := Balloon{Model: "virtio", StatsPeriod: defaultBalloonStatsPeriod, AutoDeflate: b.AutoDeflate, FreePageReporting: b.FreePageReporting}
+	if b.StatsPeriodSeconds != nil {
+		balloon.StatsPeriod = *b.StatsPeriodSeconds
+	}
+	return balloon
+}
+
+// handleGetBalloon - GET /api/v1/vm/{name}/balloon
+func handleGetBalloon(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		if state, err := domainState(dom); err == nil && state != "running" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", name))
+			return
+		}
+		sample, err := sampleDomainStats(conn, dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get balloon stats for VM %s: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		var info BalloonInfo
+		if bal := sample.stats.Balloon; bal != nil {
+			// Balloon figures are in KiB
+			info.ActualMB = bal.Current / 1024
+			info.MaximumMB = bal.Maximum / 1024
+			info.UsableMB = bal.Usable / 1024
+			info.UnusedMB = bal.Unused / 1024
+			info.AvailableMB = bal.Available / 1024
+			info.DiskCachesMB = bal.DiskCaches / 1024
+			info.SwapInMB = bal.SwapIn / 1024
+			info.SwapOutMB = bal.SwapOut / 1024
+			info.MajorFaults = bal.MajorFault
+			info.MinorFaults = bal.MinorFault
+			info.RssMB = bal.Rss / 1024
+			info.LastUpdate = bal.LastUpdate
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleSetBalloon - PUT /api/v1/vm/{name}/balloon
+// Inflates or deflates the balloon of a running VM to target_mb and/or changes how often
+// the guest reports its stats. The guest's driver moves the balloon over the following
+// seconds; GET /api/v1/vm/{name}/balloon shows how far it got.
+func handleSetBalloon(w http.ResponseWriter, r *http.Request) {
+	var req BalloonRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.TargetMB == 0 && req.StatsPeriodSeconds == nil {
+		http.Error(w, "target_mb or stats_period_seconds is required", http.StatusBadRequest)
+		return
+	}
+	if req.TargetMB != 0 && req.TargetMB < minBalloonMB {
+		http.Error(w, fmt.Sprintf("target_mb must be at least %d", minBalloonMB), http.StatusBadRequest)
+		return
+	}
+	if req.StatsPeriodSeconds != nil && *req.StatsPeriodSeconds < 0 {
+		http.Error(w, "stats_period_seconds must be >= 0", http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		if state, err := domainState(dom); err == nil && state != "running" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", name))
+			return
+		}
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if b := def.Devices.Memballoon; b == nil || b.Model == "none" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q has no memory balloon", name))
+			return
+		}
+
+		if req.TargetMB != 0 {
+			maxKiB, err := dom.GetMaxMemory()
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to get VM memory: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			if uint64(req.TargetMB)*1024 > maxKiB {
+				writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("target_mb %d is more than the VM's %d MiB", req.TargetMB, maxKiB/1024))
+				return
+			}
+			if err := dom.SetMemoryFlags(uint64(req.TargetMB)*1024, libvirt.DOMAIN_MEM_LIVE); err != nil {
+				errMsg := fmt.Sprintf("Failed to set balloon of VM %s: %v", name, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			requestLog(r).Info(fmt.Sprintf("Set balloon of VM %s to %d MiB", name, req.TargetMB))
+		}
+		if p := req.StatsPeriodSeconds; p != nil {
+			if err := dom.SetMemoryStatsPeriod(*p, libvirt.DOMAIN_MEM_LIVE); err != nil {
+				errMsg := fmt.Sprintf("Failed to set balloon stats period of VM %s: %v", name, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			requestLog(r).Info(fmt.Sprintf("Set balloon stats period of VM %s to %ds", name, *p))
+		}
+		writeSuccessResponse(w, fmt.Sprintf("Balloon of VM %s updated", name))
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxBatchSize - VMs one batch request may create
+const maxBatchSize = 100
+
+// maxBatchParallelism - batch VMs checked and started at once; the disks are then
+// created within maxConcurrentCreates like any other create
+const maxBatchParallelism = 8
+
+// BatchRequest - incoming JSON for POST /api/v1/vm/batch: either a list of create
+// requests, or one spec with a count. name_pattern names the copies, "{index}" being
+// replaced by 1..count; it defaults to "<spec name>-{index}".
+type BatchRequest struct {
+	VMs         []json.RawMessage `json:"vms,omitempty"`
+	Spec        json.RawMessage   `json:"spec,omitempty"`
+	Count       int               `json:"count,omitempty"`
+	NamePattern string            `json:"name_pattern,omitempty"`
+	Parallelism int               `json:"parallelism,omitempty"` // default and maximum maxBatchParallelism
+}
+
+// BatchResult - what became of one VM of a batch: its create job, or why it was refused
+type BatchResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"` // HTTP status a single create would have answered with
+	Job    *Job   `json:"job,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleBatchCreateVM - POST /api/v1/vm/batch
+//
+// Each VM goes through the same checks as POST /api/v1/vm and, if they pass, gets its own
+// create job. One VM being refused doesn't stop the others; the response lists every
+// VM's result in request order.
+func handleBatchCreateVM(w http.ResponseWriter, r *http.Request) {
+	var batch BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	reqs, err := batch.requests()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	parallelism := batch.Parallelism
+	if parallelism <= 0 || parallelism > maxBatchParallelism {
+		parallelism = maxBatchParallelism
+	}
+
+	results := make([]BatchResult, len(reqs))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, req RequestData) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = batchCreate(r, req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	started := 0
+	for _, res := range results {
+		if res.Job != nil {
+			started++
+		}
+	}
+	requestLog(r).Info(fmt.Sprintf("Batch create: %d of %d VMs started", started, len(results)))
+	writeDataResponse(w, results)
+}
+
+// requests expands the batch into one create request per VM. Every copy of spec is
+// decoded afresh, so the copies share no pointers while they are created concurrently.
+func (b BatchRequest) requests() ([]RequestData, error) {
+	var docs []json.RawMessage
+	var names []string
+	switch {
+	case len(b.VMs) > 0 && b.Spec != nil:
+		return nil, fmt.Errorf("vms cannot be combined with spec")
+	case len(b.VMs) > 0:
+		docs = b.VMs
+	case b.Spec != nil:
+		if b.Count <= 0 {
+			return nil, fmt.Errorf("count must be positive")
+		}
+		if b.Count > maxBatchSize {
+			return nil, fmt.Errorf("count %d is over the maximum of %d", b.Count, maxBatchSize)
+		}
+		var spec RequestData
+		if err := json.Unmarshal(b.Spec, &spec); err != nil {
+			return nil, fmt.Errorf("invalid spec: %v", err)
+		}
+		pattern := b.NamePattern
+		if pattern == "" {
+			if spec.Name == "" {
+				return nil, fmt.Errorf("spec needs a name, or give name_pattern")
+			}
+			pattern = spec.Name + "-{index}"
+		}
+		if !strings.Contains(pattern, "{index}") {
+			return nil, fmt.Errorf("name_pattern must contain {index}")
+		}
+		for i := 1; i <= b.Count; i++ {
+			docs = append(docs, b.Spec)
+			names = append(names, strings.ReplaceAll(pattern, "{index}", strconv.Itoa(i)))
+		}
+	default:
+		return nil, fmt.Errorf("either vms or spec and count are required")
+	}
+	if len(docs) > maxBatchSize {
+		return nil, fmt.Errorf("%d VMs is over the maximum of %d", len(docs), maxBatchSize)
+	}
+
+	reqs := make([]RequestData, len(docs))
+	for i, doc := range docs {
+		if err := json.Unmarshal(doc, &reqs[i]); err != nil {
+			return nil, fmt.Errorf("vm %d: %v", i, err)
+		}
+		if names != nil {
+			reqs[i].Name = names[i]
+		}
+	}
+	return reqs, nil
+}
+
+// batchCreate runs one VM of a batch through startCreate, turning the response it
+// would have written into the VM's result
+func batchCreate(r *http.Request, req RequestData) BatchResult {
+	res := BatchResult{Name: req.Name}
+	var rec batchRecorder
+	job := startCreate(&rec, r, req)
+	if job != nil {
+		snap := job.snapshot()
+		res.Status, res.Job = http.StatusAccepted, &snap
+		return res
+	}
+	res.Status = rec.status
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	var resp ResponseData
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err == nil && resp.Message != "" {
+		res.Error = resp.Message
+	} else {
+		res.Error = strings.TrimSpace(rec.body.String())
+	}
+	return res
+}
+
+// batchRecorder - a ResponseWriter keeping what a handler writes: startCreate's answer
+// for a refused VM, or the REST answer to a gRPC call
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *batchRecorder) Header() http.Header {
+	if b.header == nil {
+		b.header = http.Header{}
+	}
+	return b.header
+}
+
+func (b *batchRecorder) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *batchRecorder) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
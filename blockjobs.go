@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// BlockCommitRequest - optional JSON for POST /api/v1/vm/{name}/disks/{disk}/blockcommit
+type BlockCommitRequest struct {
+	// Base is the image in the chain to commit into; empty means the bottom of the chain
+	Base string `json:"base,omitempty"`
+	// Top is the image to commit down from; empty means the active overlay, in which
+	// case the disk is switched over (pivoted) to Base once the copy has caught up
+	Top string `json:"top,omitempty"`
+}
+
+// BlockPullRequest - optional JSON for POST /api/v1/vm/{name}/disks/{disk}/blockpull
+type BlockPullRequest struct {
+	// Base is the image to keep as backing file; empty pulls everything into the
+	// active image, leaving it standalone
+	Base string `json:"base,omitempty"`
+}
+
+// handleBlockCommit - POST /api/v1/vm/{name}/disks/{disk}/blockcommit
+// Merges overlays (e.g. from external snapshots) down into their backing image while the
+// VM keeps running. Answers 202 with the job to poll at GET /api/v1/vm/{name}/blockjobs/{id}.
+func handleBlockCommit(w http.ResponseWriter, r *http.Request) {
+	var req BlockCommitRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var flags libvirt.DomainBlockCommitFlags
+	active := req.Top == ""
+	if active {
+		flags |= libvirt.DOMAIN_BLOCK_COMMIT_ACTIVE
+	}
+	startBlockJob(w, r, "block-commit", active, func(dom *libvirt.Domain, disk string) error {
+		return dom.BlockCommit(disk, req.Base, req.Top, 0, flags)
+	})
+}
+
+// handleBlockPull - POST /api/v1/vm/{name}/disks/{disk}/blockpull
+// Copies data from backing images up into the active image while the VM keeps running,
+// the opposite direction to blockcommit.
+func handleBlockPull(w http.ResponseWriter, r *http.Request) {
+	var req BlockPullRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+
+	startBlockJob(w, r, "block-pull", false, func(dom *libvirt.Domain, disk string) error {
+		return dom.BlockRebase(disk, req.Base, 0, 0)
+	})
+}
+
+// handleGetBlockJob - GET /api/v1/vm/{name}/blockjobs/{id}
+func handleGetBlockJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r, "block-commit", "block-pull")
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Block job %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// startBlockJob starts a libvirt block job on the disk named in the URL via begin and
+// tracks it with a service job. pivot says the job mirrors into another image and
+// only ends when told to switch the disk over, as an active commit does.
+func startBlockJob(w http.ResponseWriter, r *http.Request, jobType string, pivot bool, begin func(dom *libvirt.Domain, disk string) error) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		disk := r.PathValue("disk")
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		found := false
+		for _, d := range def.Devices.Disks {
+			if d.Target.Dev == disk {
+				found = true
+			}
+		}
+		if !found {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no disk %q", def.Name, disk))
+			return
+		}
+
+		if err := begin(dom, disk); err != nil {
+			errMsg := fmt.Sprintf("Failed to start %s on %s: %v", jobType, disk, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Started %s on %s of VM %s", jobType, disk, def.Name))
+
+		host, vmName := requestHost(r), def.Name
+		job := startJob(jobType, requestProject(r), vmName, func(j *jobHandle) (interface{}, error) {
+			if err := waitForBlockJob(j, host, vmName, disk, pivot); err != nil {
+				return nil, err
+			}
+			return map[string]string{"disk": disk}, nil
+		})
+		writeJobAccepted(w, job)
+	})
+}
+
+// waitForBlockJob polls the disk's block job until it is gone, mirroring progress onto j.
+// With pivot, the job is finished by switching the disk to the new image once it has
+// caught up. Like waitForDomainJob it uses its own connection.
+func waitForBlockJob(j *jobHandle, host, vmName, disk string, pivot bool) error {
+	conn, err := connectHost(host)
+	if err != nil {
+		return fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to look up VM %q: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	pivoted := false
+	for {
+		info, err := dom.GetBlockJobInfo(disk, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get block job info: %v", err)
+		}
+		if info.Type == libvirt.DOMAIN_BLOCK_JOB_TYPE_UNKNOWN {
+			// libvirt reports no job once it has completed (or been cancelled)
+			return nil
+		}
+		if info.End > 0 {
+			j.setProgress(float64(info.Cur) * 100 / float64(info.End))
+		}
+		if pivot && !pivoted && info.End > 0 && info.Cur == info.End {
+			if err := dom.BlockJobAbort(disk, libvirt.DOMAIN_BLOCK_JOB_ABORT_PIVOT); err != nil {
+				return fmt.Errorf("failed to pivot %s: %v", disk, err)
+			}
+			log.Printf("Pivoted %s of VM %s", disk, vmName)
+			pivoted = true
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image - a base disk image or ISO registered in the catalog, referenced by name
+// (or tag) from the create request's "image" field
+type Image struct {
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"` // "disk" or "iso"
+	Path         string    `json:"path"`
+	Format       string    `json:"format,omitempty"` // disk images only, "qcow2" or "raw"
+	OSFamily     string    `json:"os_family,omitempty"`
+	DefaultLogin string    `json:"default_login,omitempty"`
+	MinDiskGB    int       `json:"min_disk_gb,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ImageRequest - incoming JSON to register an image. Either Path (already on the host)
+// or URL (downloaded through the image cache, optionally verified with Checksum) is required.
+type ImageRequest struct {
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind,omitempty"` // "disk" (default) or "iso"
+	Path         string   `json:"path,omitempty"`
+	URL          string   `json:"url,omitempty"`
+	Checksum     string   `json:"checksum,omitempty"`
+	Format       string   `json:"format,omitempty"`
+	OSFamily     string   `json:"os_family,omitempty"`
+	DefaultLogin string   `json:"default_login,omitempty"`
+	MinDiskGB    int      `json:"min_disk_gb,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// TagsRequest - body of POST /api/v1/images/{name}/tags
+type TagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+var imageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+
+// imageStore - the catalog, kept in memory and persisted as JSON next to the image cache
+type imageStore struct {
+	mu     sync.Mutex
+	path   string
+	images map[string]*Image
+}
+
+var imageCatalog = &imageStore{
+	path:   filepath.Join(imageCacheDir, "catalog.json"),
+	images: map[string]*Image{},
+}
+
+// load reads the catalog file; a missing file is an empty catalog
+func (s *imageStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var images []*Image
+	if err := json.Unmarshal(content, &images); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, img := range images {
+		s.images[img.Name] = img
+	}
+	return nil
+}
+
+// saveLocked writes the catalog atomically; s.mu must be held
+func (s *imageStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns images sorted by name, optionally only those carrying tag
+func (s *imageStore) listLocked(tag string) []Image {
+	out := []Image{}
+	for _, img := range s.images {
+		if tag == "" || hasTag(img.Tags, tag) {
+			out = append(out, *img)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *imageStore) list(tag string) []Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked(tag)
+}
+
+func (s *imageStore) get(name string) (Image, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	if !ok {
+		return Image{}, false
+	}
+	return *img, true
+}
+
+// resolve finds an image by name, falling back to the newest image carrying that tag
+func (s *imageStore) resolve(ref string) (Image, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if img, ok := s.images[ref]; ok {
+		return *img, true
+	}
+	var best *Image
+	for _, img := range s.images {
+		if hasTag(img.Tags, ref) && (best == nil || img.CreatedAt.After(best.CreatedAt)) {
+			best = img
+		}
+	}
+	if best == nil {
+		return Image{}, false
+	}
+	return *best, true
+}
+
+func (s *imageStore) add(img Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.images[img.Name]; exists {
+		return fmt.Errorf("image %q already exists", img.Name)
+	}
+	s.images[img.Name] = &img
+	if err := s.saveLocked(); err != nil {
+		delete(s.images, img.Name)
+		return err
+	}
+	return nil
+}
+
+// update applies fn to the named image and persists the result
+func (s *imageStore) update(name string, fn func(img *Image)) (Image, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	if !ok {
+		return Image{}, false, nil
+	}
+	prev := *img
+	fn(img)
+	if err := s.saveLocked(); err != nil {
+		*img = prev
+		return Image{}, true, err
+	}
+	return *img, true, nil
+}
+
+func (s *imageStore) remove(name string) (Image, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	img, ok := s.images[name]
+	if !ok {
+		return Image{}, false, nil
+	}
+	delete(s.images, name)
+	if err := s.saveLocked(); err != nil {
+		s.images[name] = img
+		return Image{}, true, err
+	}
+	return *img, true, nil
+}
+
+// handleListImages - GET /api/v1/images[?tag=...]
+func handleListImages(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, imageCatalog.list(r.URL.Query().Get("tag")))
+}
+
+// handleGetImage - GET /api/v1/images/{name}
+func handleGetImage(w http.ResponseWriter, r *http.Request) {
+	img, ok := imageCatalog.get(r.PathValue("name"))
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Image %q not found", r.PathValue("name")))
+		return
+	}
+	writeDataResponse(w, img)
+}
+
+// handleRegisterImage - POST /api/v1/images
+func handleRegisterImage(w http.ResponseWriter, r *http.Request) {
+	var req ImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+
+	err := validateImageRequest(&req)
+	if err == nil && (req.Path == "") == (req.URL == "") {
+		err = fmt.Errorf("exactly one of path or url must be set")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if _, exists := imageCatalog.get(req.Name); exists {
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Image %q already exists", req.Name))
+		return
+	}
+
+	if req.Path != "" {
+		if err := validatePath("path", req.Path, true); err != nil {
+			writeErrorStatus(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	imgPath := req.Path
+	if req.URL != "" {
+		imgPath, err = fetchImage(r.Context(), req.URL, req.Checksum)
+		if err != nil {
+			if errors.Is(err, errImageNotStandalone) {
+				writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("url is not usable: %v", err))
+				return
+			}
+			errMsg := fmt.Sprintf("Failed to fetch image: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+	} else if _, err := os.Stat(imgPath); err != nil {
+		msg := fmt.Sprintf("Image path is not usable: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	img := Image{
+		Name:         req.Name,
+		Kind:         req.Kind,
+		Path:         imgPath,
+		Format:       req.Format,
+		OSFamily:     req.OSFamily,
+		DefaultLogin: req.DefaultLogin,
+		MinDiskGB:    req.MinDiskGB,
+		Tags:         uniqueTags(req.Tags),
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := imageCatalog.add(img); err != nil {
+		errMsg := fmt.Sprintf("Failed to register image: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Registered image %s (%s) at %s", img.Name, img.Kind, img.Path))
+	writeDataResponse(w, img)
+}
+
+// handleAddImageTags - POST /api/v1/images/{name}/tags
+func handleAddImageTags(w http.ResponseWriter, r *http.Request) {
+	var req TagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	for _, tag := range req.Tags {
+		if !imageNamePattern.MatchString(tag) {
+			http.Error(w, fmt.Sprintf("Invalid tag %q", tag), http.StatusBadRequest)
+			return
+		}
+	}
+
+	updateImage(w, r, r.PathValue("name"), func(img *Image) {
+		img.Tags = uniqueTags(append(img.Tags, req.Tags...))
+	})
+}
+
+// handleRemoveImageTag - DELETE /api/v1/images/{name}/tags/{tag}
+func handleRemoveImageTag(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	updateImage(w, r, r.PathValue("name"), func(img *Image) {
+		var kept []string
+		for _, t := range img.Tags {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		img.Tags = kept
+	})
+}
+
+// handleDeleteImage - DELETE /api/v1/images/{name}[?purge=true]
+// Only unregisters the image by default: existing linked clones still need the file.
+// purge=true also deletes the file if it lives in the service's image cache.
+func handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	img, ok, err := imageCatalog.remove(name)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Image %q not found", name))
+		return
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to delete image: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+
+	if r.URL.Query().Get("purge") == "true" && isInImageCache(img.Path) {
+		if err := os.Remove(img.Path); err != nil && !os.IsNotExist(err) {
+			requestLog(r).Error(fmt.Sprintf("Failed to remove image file %s: %v", img.Path, err))
+		}
+	}
+	requestLog(r).Info(fmt.Sprintf("Deleted image %s", name))
+	writeSuccessResponse(w, fmt.Sprintf("Image %s deleted", name))
+}
+
+func updateImage(w http.ResponseWriter, r *http.Request, name string, fn func(img *Image)) {
+	img, ok, err := imageCatalog.update(name, fn)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Image %q not found", name))
+		return
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to update image: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, img)
+}
+
+// validateImageRequest checks the metadata fields and fills in defaults; where the image
+// comes from (path, url or an upload) is up to the caller
+func validateImageRequest(req *ImageRequest) error {
+	if !imageNamePattern.MatchString(req.Name) {
+		return fmt.Errorf("name must match %s", imageNamePattern)
+	}
+	if req.Kind == "" {
+		req.Kind = "disk"
+	}
+	switch req.Kind {
+	case "disk":
+		if req.Format == "" {
+			req.Format = "qcow2"
+		}
+		if !supportedDiskFormats[req.Format] {
+			return fmt.Errorf("unsupported format %q", req.Format)
+		}
+	case "iso":
+		req.Format = ""
+	default:
+		return fmt.Errorf("kind must be disk or iso")
+	}
+	if req.MinDiskGB < 0 {
+		return fmt.Errorf("min_disk_gb must not be negative")
+	}
+	for _, tag := range req.Tags {
+		if !imageNamePattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// applyCatalogImage points the request at the catalog image it names: disk images become
+// the root disk's base image, ISOs are attached as the CD-ROM
+func applyCatalogImage(req *RequestData) error {
+	img, ok := imageCatalog.resolve(req.Image)
+	if !ok {
+		return fmt.Errorf("image %q not found in catalog", req.Image)
+	}
+
+	switch img.Kind {
+	case "iso":
+		if req.ISOImage != "" {
+			return fmt.Errorf("image %q is an ISO and cannot be combined with iso_image", img.Name)
+		}
+		req.ISOImage = img.Path
+	case "disk":
+		if req.BaseImage != "" || req.ImageURL != "" || req.PrebuiltDiskPath != "" {
+			return fmt.Errorf("image cannot be combined with base_image/image_url/prebuilt_disk_path")
+		}
+		if img.Format != "qcow2" {
+			return fmt.Errorf("image %q is %s, only qcow2 images can be used as a base", img.Name, img.Format)
+		}
+		rootSize := req.DiskSizeGB
+		if len(req.Disks) > 0 {
+			rootSize = req.Disks[0].SizeGB
+		}
+		if rootSize > 0 && rootSize < img.MinDiskGB {
+			return fmt.Errorf("image %q needs a root disk of at least %d GB", img.Name, img.MinDiskGB)
+		}
+		req.BaseImage = img.Path
+	}
+	return nil
+}
+
+// isInImageCache - whether path is a file the service downloaded itself
+func isInImageCache(path string) bool {
+	rel, err := filepath.Rel(imageCacheDir, path)
+	return err == nil && !strings.HasPrefix(rel, "..") && rel != "."
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueTags drops duplicates and sorts
+func uniqueTags(tags []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range tags {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// CloneRequest - incoming JSON for POST /api/v1/vm/{name}/clone
+type CloneRequest struct {
+	Name string `json:"name"`
+	// Linked clones copy only what the source disk holds on top of its backing image and
+	// share that image with the source; otherwise every disk is copied in full
+	Linked bool `json:"linked,omitempty"`
+	// FromSnapshot clones the disks as they were in this internal snapshot of the source
+	// instead of their current contents. The source may be running in that case.
+	FromSnapshot string `json:"from_snapshot,omitempty"`
+	Start        bool   `json:"start,omitempty"`
+}
+
+// handleCloneVM - POST /api/v1/vm/{name}/clone
+// Copies the source VM's disks into the pools they live in and defines a new domain from
+// the source's definition with a new name, UUID and MAC addresses. CD-ROMs keep pointing
+// at the same ISO.
+func handleCloneVM(w http.ResponseWriter, r *http.Request) {
+	if !isLocalHost(requestHost(r)) {
+		http.Error(w, "Clone copies the disks with qemu-img and is only supported on local hosts", http.StatusBadRequest)
+		return
+	}
+	var req CloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "Missing required field: name", http.StatusBadRequest)
+		return
+	}
+	if err := validateVMName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Linked && req.FromSnapshot != "" {
+		http.Error(w, "linked and from_snapshot cannot be combined", http.StatusBadRequest)
+		return
+	}
+	// The clone stays in the source's project, its metadata comes along with the XML
+	if scope, err := requestScope(r); err == nil {
+		req.Name = scope.domainName(req.Name)
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		if existing, err := conn.LookupDomainByName(req.Name); err == nil {
+			existing.Free()
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q already exists", req.Name))
+			return
+		}
+
+		state, err := domainState(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if state != "shutoff" && req.FromSnapshot == "" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is %s, shut it down or clone from a snapshot", r.PathValue("name"), state))
+			return
+		}
+
+		// The clone counts against the project like its source does
+		add, err := domainUsage(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to work out the VM's size: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		release, err := reserveQuota(domainProject(dom), add)
+		if err != nil {
+			writeQuotaError(w, r, err)
+			return
+		}
+
+		desc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE | libvirt.DOMAIN_XML_SECURE)
+		if err != nil {
+			release()
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		def, err := parseDomainDef(desc)
+		if err != nil {
+			release()
+			errMsg := fmt.Sprintf("Failed to parse domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		// Copying the disks can take minutes, so it runs as a job holding the reservation
+		host, owner := requestHost(r), requestUser(r)
+		job := startJob("vm-clone", domainProject(dom), def.Name, func(j *jobHandle) (interface{}, error) {
+			defer release()
+			return cloneVM(j, host, owner, desc, def, req)
+		})
+		requestLog(r).Info(fmt.Sprintf("Cloning VM %s to %s (job %s)", def.Name, req.Name, job.snapshot().ID))
+		writeJobStarted(w, r, job, func(interface{}) string {
+			return fmt.Sprintf("VM %s cloned to %s", def.Name, req.Name)
+		})
+	})
+}
+
+// cloneVM copies the disks of the VM described by desc and defines the clone, starting it
+// if asked to, and records it as owner's. Volumes copied for a clone that can't be
+// defined are removed again.
+func cloneVM(j *jobHandle, host, owner, desc string, def domainDefXML, req CloneRequest) (interface{}, error) {
+	releaseSlot, err := acquireCreateSlot(jobsCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+
+	conn, err := connectHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+
+	usedMACs, err := hostMACs(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MAC addresses in use: %v", err)
+	}
+	j.setProgress(5)
+
+	disks, err := cloneDisks(conn, def, req)
+	if err != nil {
+		deleteCopiedVolumes(disks)
+		return nil, fmt.Errorf("failed to clone disks: %v", err)
+	}
+	j.setProgress(90)
+
+	cloneXML := rewriteCloneXML(desc, req.Name, disks, usedMACs)
+	clone, err := conn.DomainDefineXML(cloneXML)
+	if err != nil {
+		deleteCopiedVolumes(disks)
+		return nil, fmt.Errorf("failed to define cloned domain: %v", err)
+	}
+	defer clone.Free()
+	for _, d := range disks {
+		d.vol.Free()
+	}
+
+	if req.Start {
+		if err := clone.Create(); err != nil {
+			return nil, fmt.Errorf("VM cloned but failed to start: %v", err)
+		}
+	}
+
+	log.Printf("Cloned VM %s to %s (%d disks)", def.Name, req.Name, len(disks))
+	recordVM(host, clone, "cloned", owner, nil)
+	return map[string]string{"name": req.Name, "source": def.Name}, nil
+}
+
+// cloneDisks copies every disk (not CD-ROM) of def. The returned slice holds the disks
+// copied so far even on error.
+func cloneDisks(conn *libvirt.Connect, def domainDefXML, req CloneRequest) ([]copiedVolume, error) {
+	var disks []copiedVolume
+	index := 0
+	for _, disk := range def.Devices.Disks {
+		if disk.Device != "disk" {
+			continue
+		}
+		if disk.Type != "file" && disk.Type != "block" {
+			return disks, fmt.Errorf("%s: cloning %s disks is not supported", disk.Target.Dev, disk.Type)
+		}
+		if disk.Encryption != nil && (req.Linked || req.FromSnapshot != "") {
+			return disks, fmt.Errorf("%s: encrypted disks can only be cloned in full from a stopped VM", disk.Target.Dev)
+		}
+
+		format := disk.Driver.Type
+		if format == "" {
+			format = "raw"
+		}
+		volName := newVolumeName(req.Name, index, format)
+		index++
+
+		d, err := cloneDisk(conn, disk.sourcePath(), volName, format, req)
+		if err != nil {
+			return disks, fmt.Errorf("%s: %v", disk.Target.Dev, err)
+		}
+		disks = append(disks, d)
+	}
+	return disks, nil
+}
+
+// cloneDisk copies one disk into a new volume named volName in the source's pool.
+// Full copies are done by libvirt; linked and snapshot copies need qemu-img and are
+// written next to the source, after which the pool is refreshed to pick them up.
+func cloneDisk(conn *libvirt.Connect, source, volName, format string, req CloneRequest) (copiedVolume, error) {
+	srcVol, err := conn.LookupStorageVolByPath(source)
+	if err != nil {
+		return copiedVolume{}, fmt.Errorf("%s is not a volume in any storage pool: %v", source, err)
+	}
+	defer srcVol.Free()
+	pool, err := srcVol.LookupPoolByVolume()
+	if err != nil {
+		return copiedVolume{}, fmt.Errorf("failed to find pool of %s: %v", source, err)
+	}
+	defer pool.Free()
+
+	if !req.Linked && req.FromSnapshot == "" {
+		srcDesc, err := srcVol.GetXMLDesc(0)
+		if err != nil {
+			return copiedVolume{}, fmt.Errorf("failed to read volume %s: %v", source, err)
+		}
+		var vol volumeXML
+		if err := xml.Unmarshal([]byte(srcDesc), &vol); err != nil {
+			return copiedVolume{}, fmt.Errorf("failed to parse volume %s: %v", source, err)
+		}
+		// Only carry over what describes the image; libvirt fills in the rest
+		vol.Name = volName
+		vol.Allocation = volumeSize{Unit: "bytes"}
+		vol.BackingStore = nil // a full copy stands on its own
+		volDoc, err := xml.Marshal(vol)
+		if err != nil {
+			return copiedVolume{}, err
+		}
+
+		log.Printf("Copying %s to volume %s", source, volName)
+		sv, err := pool.StorageVolCreateXMLFrom(string(volDoc), srcVol, 0)
+		if err != nil {
+			return copiedVolume{}, fmt.Errorf("StorageVolCreateXMLFrom failed: %v", err)
+		}
+		path, err := sv.GetPath()
+		if err != nil {
+			sv.Free()
+			return copiedVolume{}, fmt.Errorf("failed to get path of volume %s: %v", volName, err)
+		}
+		return copiedVolume{source: source, path: path, vol: sv}, nil
+	}
+
+	if !isRegularFile(source) {
+		return copiedVolume{}, fmt.Errorf("linked and snapshot clones need file-backed disks")
+	}
+	dest := filepath.Join(filepath.Dir(source), volName)
+	if _, err := os.Stat(dest); err == nil {
+		return copiedVolume{}, fmt.Errorf("%s already exists", dest)
+	}
+
+	args := []string{"convert", "-O", format}
+	switch {
+	case req.FromSnapshot != "":
+		args = append(args, "-U", "-l", "snapshot.name="+req.FromSnapshot)
+	case req.Linked:
+		if format != "qcow2" {
+			return copiedVolume{}, fmt.Errorf("linked clones need qcow2 disks, %s is %s", source, format)
+		}
+		backing, backingFormat, err := qemuImgBacking(source)
+		if err != nil {
+			return copiedVolume{}, err
+		}
+		if backing == "" {
+			return copiedVolume{}, fmt.Errorf("%s has no backing image to link to, clone it in full", source)
+		}
+		args = append(args, "-B", backing, "-F", backingFormat)
+	}
+	args = append(args, source, dest)
+
+	log.Printf("Copying %s to %s with qemu-img %s", source, dest, strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.Command(qemuImgPath, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		_ = os.Remove(dest)
+		return copiedVolume{}, fmt.Errorf("qemu-img convert failed: %v, output: %s", err, stderr.String())
+	}
+
+	if err := pool.Refresh(0); err != nil {
+		_ = os.Remove(dest)
+		return copiedVolume{}, fmt.Errorf("failed to refresh pool: %v", err)
+	}
+	sv, err := pool.LookupStorageVolByName(volName)
+	if err != nil {
+		_ = os.Remove(dest)
+		return copiedVolume{}, fmt.Errorf("copied %s but the pool doesn't list it: %v", dest, err)
+	}
+	return copiedVolume{source: source, path: dest, vol: sv}, nil
+}
+
+// qemuImgBacking - the backing file and its format of a qcow2 image, "" if it has none
+func qemuImgBacking(path string) (string, string, error) {
+	out, err := exec.Command(qemuImgPath, "info", "-U", "--output=json", path).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("qemu-img info %s failed: %v", path, err)
+	}
+	var info struct {
+		BackingFilename       string `json:"full-backing-filename"`
+		BackingFilenameFormat string `json:"backing-filename-format"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", "", fmt.Errorf("failed to parse qemu-img info for %s: %v", path, err)
+	}
+	if info.BackingFilenameFormat == "" {
+		info.BackingFilenameFormat = "qcow2"
+	}
+	return info.BackingFilename, info.BackingFilenameFormat, nil
+}
+
+func isRegularFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// rewriteCloneXML turns the source's inactive XML into the clone's: new name, no UUID
+// (libvirt generates one), fresh MAC addresses not in usedMACs, its own console log and
+// NVRAM, and the copied disks' paths
+func rewriteCloneXML(desc, name string, disks []copiedVolume, usedMACs map[string]string) string {
+	desc = setDomainName(desc, name)
+	desc = stripDomainUUID(desc)
+	desc = replaceMACs(desc, usedMACs, name, func(string) bool { return true })
+	desc = replaceConsoleLog(desc, name)
+	desc = replaceNVRAM(desc, name)
+	return replaceDiskSources(desc, sourceMap(disks))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// cloudInitDir - where NoCloud seed ISOs are written, overridable with VM_SERVICE_SEED_DIR
+var cloudInitDir = envOrDefault("VM_SERVICE_SEED_DIR", "/var/lib/libvirt/images/seeds")
+
+// CloudInit - the three NoCloud documents, passed through to the guest as-is
+type CloudInit struct {
+	UserData      string `json:"user_data,omitempty"`
+	MetaData      string `json:"meta_data,omitempty"`      // defaults to instance-id and local-hostname
+	NetworkConfig string `json:"network_config,omitempty"` // optional, cloud-init's own default is DHCP
+}
+
+// isoTools - ISO9660 writers we know how to drive, in order of preference. xorriso
+// needs its mkisofs emulation to accept the same arguments.
+var isoTools = [][]string{
+	{"genisoimage"},
+	{"mkisofs"},
+	{"xorriso", "-as", "mkisofs"},
+}
+
+// cloudConfig - the #cloud-config the service generates from first-class request fields.
+// It is written as JSON, which as a subset of YAML cloud-init reads just the same.
+type cloudConfig struct {
+	Hostname          string    `json:"hostname,omitempty"`
+	FQDN              string    `json:"fqdn,omitempty"`
+	SSHAuthorizedKeys []string  `json:"ssh_authorized_keys,omitempty"`
+	ChPasswd          *chpasswd `json:"chpasswd,omitempty"`
+}
+
+// chpasswd - cloud-init's password module; "user:$6$..." entries are taken as hashes
+type chpasswd struct {
+	Expire bool     `json:"expire"`
+	List   []string `json:"list"`
+}
+
+var (
+	hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+	sshKeyPattern   = regexp.MustCompile(`^(ssh-(rsa|ed25519|dss)|ecdsa-sha2-nistp(256|384|521)|sk-(ssh-ed25519|ecdsa-sha2-nistp256)@openssh\.com) [A-Za-z0-9+/=]+( .*)?$`)
+)
+
+// resolveCloudInit works out the seed documents for a create request, or nil if the VM
+// doesn't need a seed. hostname, ssh_authorized_keys and a cloud-init password become a
+// generated cloud-config;
+// when cloud_init.user_data is given too, both go into a multipart user-data, with the
+// caller's part last so it wins where cloud-init merges them. network becomes the
+// network-config for the NIC with the given MAC.
+func resolveCloudInit(req RequestData, mac string) (*CloudInit, error) {
+	passwordSeed := req.Password != nil && req.Password.Method == "cloud-init"
+	if req.CloudInit == nil && req.Hostname == "" && len(req.SSHAuthorizedKeys) == 0 && req.Network == nil && !passwordSeed {
+		return nil, nil
+	}
+	ci := CloudInit{}
+	if req.CloudInit != nil {
+		ci = *req.CloudInit
+	}
+
+	if req.Network != nil {
+		if ci.NetworkConfig != "" {
+			return nil, fmt.Errorf("network cannot be combined with cloud_init.network_config")
+		}
+		if err := req.Network.validate(); err != nil {
+			return nil, fmt.Errorf("network: %v", err)
+		}
+		networkConfig, err := req.Network.networkConfig(mac)
+		if err != nil {
+			return nil, err
+		}
+		ci.NetworkConfig = networkConfig
+	}
+
+	cfg := cloudConfig{Hostname: req.Hostname}
+	if req.Hostname != "" {
+		if !hostnamePattern.MatchString(req.Hostname) || len(req.Hostname) > 253 {
+			return nil, fmt.Errorf("invalid hostname %q", req.Hostname)
+		}
+		if i := strings.IndexByte(req.Hostname, '.'); i > 0 {
+			cfg.Hostname, cfg.FQDN = req.Hostname[:i], req.Hostname
+		}
+	}
+	for _, key := range req.SSHAuthorizedKeys {
+		key = strings.TrimSpace(key)
+		if !sshKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("ssh_authorized_keys: %q is not an OpenSSH public key", truncate(key, 40))
+		}
+		cfg.SSHAuthorizedKeys = append(cfg.SSHAuthorizedKeys, key)
+	}
+	if passwordSeed {
+		hash, err := req.Password.hashed()
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %v", err)
+		}
+		cfg.ChPasswd = &chpasswd{List: []string{req.Password.User + ":" + hash}}
+	}
+
+	if ci.MetaData == "" {
+		hostname := cfg.Hostname
+		if hostname == "" {
+			// The VM's own name, without its project
+			hostname = strings.TrimPrefix(req.Name, req.Project+projectSeparator)
+		}
+		// A unique instance-id makes cloud-init run its first-boot modules even if the
+		// image has been booted before
+		ci.MetaData = fmt.Sprintf("instance-id: %s-%s\nlocal-hostname: %s\n", req.Name, uuid.New().String(), hostname)
+	}
+
+	var generated string
+	if cfg.Hostname != "" || len(cfg.SSHAuthorizedKeys) > 0 || cfg.ChPasswd != nil {
+		doc, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		generated = "#cloud-config\n" + string(doc) + "\n"
+	}
+	switch {
+	case generated != "" && ci.UserData != "":
+		userData, err := multipartUserData(generated, ci.UserData)
+		if err != nil {
+			return nil, err
+		}
+		ci.UserData = userData
+	case generated != "":
+		ci.UserData = generated
+	case ci.UserData == "":
+		// NoCloud requires the file even when there is nothing to do
+		ci.UserData = "#cloud-config\n"
+	}
+	return &ci, nil
+}
+
+// multipartUserData combines user-data documents into the MIME multipart form cloud-init
+// accepts, typing each part by its first line
+func multipartUserData(parts ...string) (string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", mw.Boundary())
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", userDataContentType(part))
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.WriteString(w, part); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func userDataContentType(doc string) string {
+	switch {
+	case strings.HasPrefix(doc, "#cloud-config"):
+		return "text/cloud-config"
+	case strings.HasPrefix(doc, "#!"):
+		return "text/x-shellscript"
+	case strings.HasPrefix(doc, "#include"):
+		return "text/x-include-url"
+	case strings.HasPrefix(doc, "#cloud-boothook"):
+		return "text/cloud-boothook"
+	}
+	return "text/plain"
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// buildSeedISO writes a NoCloud seed ISO (volume label "cidata") for the VM and returns
+// its path. cloud-init in a fresh cloud image finds it on the attached CD-ROM at first boot.
+// ci is expected to come from resolveCloudInit, with user and meta data filled in.
+func buildSeedISO(vmName string, ci CloudInit) (string, error) {
+	tool, err := findISOTool()
+	if err != nil {
+		return "", err
+	}
+
+	workDir, err := os.MkdirTemp("", "cidata-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(workDir)
+
+	files := map[string]string{"user-data": ci.UserData, "meta-data": ci.MetaData}
+	if ci.NetworkConfig != "" {
+		files["network-config"] = ci.NetworkConfig
+	}
+
+	if err := os.MkdirAll(cloudInitDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create seed directory: %v", err)
+	}
+	dest := seedISOFile(vmName)
+	tmp := dest + ".tmp"
+
+	args := append([]string{}, tool[1:]...)
+	args = append(args, "-output", tmp, "-volid", "cidata", "-joliet", "-rational-rock")
+	for name, content := range files {
+		path := filepath.Join(workDir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return "", err
+		}
+		args = append(args, path)
+	}
+
+	if out, err := exec.Command(tool[0], args...).CombinedOutput(); err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("%s failed: %v, output: %s", tool[0], err, out)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
+	log.Printf("Built cloud-init seed %s", dest)
+	return dest, nil
+}
+
+// seedISOFile - where buildSeedISO writes the VM's seed
+func seedISOFile(vmName string) string {
+	return filepath.Join(cloudInitDir, vmName+"-seed.iso")
+}
+
+// uploadSeedISO copies a seed built by buildSeedISO into the default pool of a remote
+// host, replacing any earlier seed of the VM, and returns the volume's path there
+func uploadSeedISO(conn *libvirt.Connect, vmName, localPath string) (string, error) {
+	defer os.Remove(localPath)
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	pool, err := conn.LookupStoragePoolByName(defaultStoragePool)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up pool %q: %v", defaultStoragePool, err)
+	}
+	defer pool.Free()
+
+	volName := vmName + "-seed.iso"
+	if old, err := pool.LookupStorageVolByName(volName); err == nil {
+		_ = old.Delete(0)
+		old.Free()
+	}
+	volDoc, err := xml.Marshal(volumeXML{
+		Name:     volName,
+		Capacity: volumeSize{Unit: "bytes", Value: uint64(fi.Size())},
+		Target:   volumeTarget{Format: volumeFormat{Type: "raw"}},
+	})
+	if err != nil {
+		return "", err
+	}
+	vol, err := pool.StorageVolCreateXML(string(volDoc), 0)
+	if err != nil {
+		return "", fmt.Errorf("StorageVolCreateXML failed for %s: %v", volName, err)
+	}
+	defer vol.Free()
+	if err := uploadVolume(conn, vol, f, fi.Size()); err != nil {
+		_ = vol.Delete(0)
+		return "", err
+	}
+	path, err := vol.GetPath()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Uploaded cloud-init seed to %s", path)
+	return path, nil
+}
+
+func findISOTool() ([]string, error) {
+	for _, tool := range isoTools {
+		if _, err := exec.LookPath(tool[0]); err == nil {
+			return tool, nil
+		}
+	}
+	return nil, fmt.Errorf("no ISO tool found, install genisoimage or xorriso")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// A websocket client, just enough for the service's console websocket, and the terminal
+// handling around it
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// detachKey - Ctrl-], as with virsh console
+const detachKey = 0x1d
+
+const (
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+type wsClient struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// dialWebsocket opens a ws:// or wss:// URL, asking for the "binary" protocol
+func dialWebsocket(rawURL string, tlsConfig *tls.Config) (*wsClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			addr += ":80"
+		}
+		conn, err = net.Dial("tcp", addr)
+	case "wss":
+		if u.Port() == "" {
+			addr += ":443"
+		}
+		cfg := tlsConfig.Clone()
+		cfg.ServerName = u.Hostname()
+		conn, err = tls.Dial("tcp", addr, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported console URL %q", rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(raw)
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: binary\r\n\r\n",
+		u.RequestURI(), u.Host, key)
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		conn.Close()
+		return nil, fmt.Errorf("console refused: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("console websocket handshake failed")
+	}
+	return &wsClient{conn: conn, br: br}, nil
+}
+
+// writeFrame sends one masked frame, as clients must
+func (c *wsClient) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, 0x80|byte(n))
+	case n <= 0xffff:
+		header = append(header, 0x80|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 0x80|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	header = append(header, mask[:]...)
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	_, err := c.conn.Write(append(header, masked...))
+	return err
+}
+
+// readMessage returns the next data message, answering pings on the way
+func (c *wsClient) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsClose:
+			return nil, io.EOF
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsClient) close() {
+	_ = c.writeFrame(wsClose, nil)
+	c.conn.Close()
+}
+
+// attachConsole relays the terminal to the console websocket until either side closes
+// or the user presses the detach key
+func attachConsole(rawURL string, tlsConfig *tls.Config) error {
+	ws, err := dialWebsocket(rawURL, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer ws.close()
+
+	restore, err := rawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Fprint(os.Stderr, "Connected to the serial console, Ctrl-] to detach\r\n")
+
+	done := make(chan error, 2)
+	go func() {
+		for {
+			msg, err := ws.readMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			if _, err := os.Stdout.Write(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			if i := strings.IndexByte(string(buf[:n]), detachKey); i >= 0 {
+				if i > 0 {
+					_ = ws.writeFrame(wsBinary, buf[:i])
+				}
+				done <- nil
+				return
+			}
+			if err := ws.writeFrame(wsBinary, buf[:n]); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	err = <-done
+	fmt.Fprint(os.Stderr, "\r\n")
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// rawTerminal puts the terminal on stdin in raw mode with stty, returning the func that
+// puts it back. When stdin isn't a terminal nothing is changed.
+func rawTerminal() (func(), error) {
+	get := exec.Command("stty", "-g")
+	get.Stdin = os.Stdin
+	saved, err := get.Output()
+	if err != nil {
+		return func() {}, nil
+	}
+	set := exec.Command("stty", "raw", "-echo")
+	set.Stdin = os.Stdin
+	if err := set.Run(); err != nil {
+		return nil, fmt.Errorf("failed to put the terminal in raw mode: %v", err)
+	}
+	return func() {
+		reset := exec.Command("stty", strings.TrimSpace(string(saved)))
+		reset.Stdin = os.Stdin
+		_ = reset.Run()
+	}, nil
+}
@@ -0,0 +1,428 @@
+// ramanujctl - command line client for the VM service
+//
+//	ramanujctl [--server URL] [--token KEY] [--host NAME] <command> [flags] [args]
+//
+// The server and token default to RAMANUJCTL_SERVER (http://localhost:8080) and
+// RAMANUJCTL_TOKEN; --ca-cert (RAMANUJCTL_CA_CERT) names the CA to trust for https.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: ramanujctl [--server URL] [--token KEY] [--host NAME] <command> [flags] [args]
+
+Commands:
+  create -f SPEC [--wait]     create a VM from a YAML or JSON spec (the body of POST /api/v2/vm)
+  create -f SPEC --dry-run    check the spec and print the domain XML it renders to
+  list [--state S] [--label SELECTOR] [-o json]
+  get NAME                    show a VM as JSON
+  start NAME
+  stop NAME [--force]         shut down, or power off with --force
+  console NAME                attach to the serial console; Ctrl-] detaches
+  delete NAME                 delete the VM and the volumes created for it
+`
+
+// jobPollInterval - how often create --wait looks at the job
+const jobPollInterval = time.Second
+
+func main() {
+	global := flag.NewFlagSet("ramanujctl", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := global.String("server", envOrDefault("RAMANUJCTL_SERVER", "http://localhost:8080"), "service URL")
+	token := global.String("token", os.Getenv("RAMANUJCTL_TOKEN"), "API key or OIDC token")
+	host := global.String("host", "", "hypervisor host, default the service's default host")
+	caCert := global.String("ca-cert", os.Getenv("RAMANUJCTL_CA_CERT"), "CA certificate to trust for https")
+	_ = global.Parse(os.Args[1:])
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(*server, *token, *host, *caCert)
+	if err != nil {
+		fatal(err)
+	}
+	cmd, args := global.Arg(0), global.Args()[1:]
+	commands := map[string]func(*client, []string) error{
+		"create":  cmdCreate,
+		"list":    cmdList,
+		"get":     cmdGet,
+		"start":   cmdStart,
+		"stop":    cmdStop,
+		"console": cmdConsole,
+		"delete":  cmdDelete,
+	}
+	fn, ok := commands[cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", cmd)
+		global.Usage()
+		os.Exit(2)
+	}
+	if err := fn(c, args); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "ramanujctl: %v\n", err)
+	os.Exit(1)
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// client - the service's REST API
+type client struct {
+	server *url.URL
+	token  string
+	host   string
+	http   *http.Client
+}
+
+func newClient(server, token, host, caCert string) (*client, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("--server must be an http or https URL, not %q", server)
+	}
+	tlsConfig := &tls.Config{}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+	}
+	return &client{
+		server: u,
+		token:  token,
+		host:   host,
+		http:   &http.Client{Timeout: 5 * time.Minute, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// apiError - an error answer from the service
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.msg, e.status)
+}
+
+// do sends a request and decodes the data of the answer into out, when given. The
+// answer's message, if any, is returned.
+func (c *client) do(method, path string, query url.Values, body interface{}, out interface{}) (string, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.host != "" {
+		query.Set("host", c.host)
+	}
+	u := *c.server
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var envelope struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		// Validation errors come back as plain text
+		if resp.StatusCode >= 300 {
+			return "", &apiError{resp.StatusCode, strings.TrimSpace(string(data))}
+		}
+		return "", fmt.Errorf("unexpected answer from %s: %v", u.Path, err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", &apiError{resp.StatusCode, envelope.Message}
+	}
+	if out != nil && envelope.Data != nil {
+		if err := json.Unmarshal(envelope.Data, out); err != nil {
+			return "", err
+		}
+	}
+	return envelope.Message, nil
+}
+
+// parseArgs parses flags wherever they are among the arguments and returns the rest
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// oneName checks the command got exactly the VM's name
+func oneName(cmd string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s takes the VM's name", cmd)
+	}
+	return args[0], nil
+}
+
+func vmPath(name string, rest ...string) string {
+	return "/api/v2/vm/" + url.PathEscape(name) + strings.Join(rest, "")
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// job - the parts of the service's Job the CLI looks at
+type job struct {
+	ID       string          `json:"id"`
+	State    string          `json:"state"`
+	Progress float64         `json:"progress"`
+	Error    string          `json:"error"`
+	Result   json.RawMessage `json:"result"`
+}
+
+func cmdCreate(c *client, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	file := fs.String("f", "", "spec file, YAML or JSON; - for stdin")
+	wait := fs.Bool("wait", false, "wait until the VM is created")
+	dryRun := fs.Bool("dry-run", false, "print the domain XML instead of creating the VM")
+	if rest := parseArgs(fs, args); len(rest) > 0 || *file == "" {
+		return fmt.Errorf("create takes -f SPEC")
+	}
+
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	spec, err := parseYAML(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *file, err)
+	}
+	if _, ok := spec.(map[string]interface{}); !ok {
+		return fmt.Errorf("%s: the spec must be a mapping", *file)
+	}
+
+	if *dryRun {
+		var preview struct {
+			DomainXML string `json:"domain_xml"`
+		}
+		if _, err := c.do(http.MethodPost, "/api/v2/vm", url.Values{"dry_run": {"true"}}, spec, &preview); err != nil {
+			return err
+		}
+		fmt.Print(preview.DomainXML)
+		return nil
+	}
+
+	var j job
+	if _, err := c.do(http.MethodPost, "/api/v2/vm", nil, spec, &j); err != nil {
+		return err
+	}
+	fmt.Printf("Creating, job %s\n", j.ID)
+	if !*wait {
+		return nil
+	}
+	for j.State == "running" {
+		time.Sleep(jobPollInterval)
+		if _, err := c.do(http.MethodGet, "/api/v2/jobs/"+url.PathEscape(j.ID), nil, nil, &j); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\r%3.0f%%", j.Progress)
+	}
+	fmt.Fprintln(os.Stderr)
+	if j.State != "succeeded" {
+		return fmt.Errorf("create failed: %s", j.Error)
+	}
+	var result struct {
+		Name    string `json:"name"`
+		Host    string `json:"host"`
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(j.Result, &result)
+	fmt.Printf("Created VM %s on %s\n", result.Name, result.Host)
+	return nil
+}
+
+// vmInfo - a VM as listed by the service
+type vmInfo struct {
+	Name     string            `json:"name"`
+	Project  string            `json:"project,omitempty"`
+	Host     string            `json:"host"`
+	UUID     string            `json:"uuid"`
+	State    string            `json:"state"`
+	CPUs     int               `json:"cpus"`
+	MemoryMB uint64            `json:"memory_mb"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+func cmdList(c *client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	state := fs.String("state", "", "only VMs in this state, e.g. running")
+	label := fs.String("label", "", "label selector, e.g. env=prod,!legacy")
+	output := fs.String("o", "table", "output format, table or json")
+	if rest := parseArgs(fs, args); len(rest) > 0 {
+		return fmt.Errorf("list takes no arguments")
+	}
+	q := url.Values{}
+	if *state != "" {
+		q.Set("state", *state)
+	}
+	if *label != "" {
+		q.Set("label", *label)
+	}
+
+	var vms []vmInfo
+	if _, err := c.do(http.MethodGet, "/api/v2/vm", q, nil, &vms); err != nil {
+		return err
+	}
+	switch *output {
+	case "json":
+		return printJSON(vms)
+	case "table":
+	default:
+		return fmt.Errorf("-o must be table or json")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tCPUS\tMEMORY\tHOST")
+	for _, vm := range vms {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d MiB\t%s\n", vm.Name, vm.State, vm.CPUs, vm.MemoryMB, vm.Host)
+	}
+	return tw.Flush()
+}
+
+func cmdGet(c *client, args []string) error {
+	name, err := oneName("get", parseArgs(flag.NewFlagSet("get", flag.ExitOnError), args))
+	if err != nil {
+		return err
+	}
+	var vm json.RawMessage
+	if _, err := c.do(http.MethodGet, vmPath(name), nil, nil, &vm); err != nil {
+		return err
+	}
+	return printJSON(vm)
+}
+
+func cmdStart(c *client, args []string) error {
+	name, err := oneName("start", parseArgs(flag.NewFlagSet("start", flag.ExitOnError), args))
+	if err != nil {
+		return err
+	}
+	msg, err := c.do(http.MethodPost, vmPath(name, "/start"), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdStop(c *client, args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	force := fs.Bool("force", false, "power off instead of asking the guest to shut down")
+	name, err := oneName("stop", parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *force {
+		q.Set("force", "true")
+	}
+	msg, err := c.do(http.MethodPost, vmPath(name, "/stop"), q, nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdDelete(c *client, args []string) error {
+	name, err := oneName("delete", parseArgs(flag.NewFlagSet("delete", flag.ExitOnError), args))
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Name    string   `json:"name"`
+		Volumes []string `json:"volumes"`
+	}
+	if _, err := c.do(http.MethodDelete, vmPath(name), nil, nil, &res); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted VM %s\n", res.Name)
+	for _, v := range res.Volumes {
+		fmt.Printf("  removed %s\n", v)
+	}
+	return nil
+}
+
+func cmdConsole(c *client, args []string) error {
+	name, err := oneName("console", parseArgs(flag.NewFlagSet("console", flag.ExitOnError), args))
+	if err != nil {
+		return err
+	}
+	var info struct {
+		URL string `json:"url"`
+	}
+	if _, err := c.do(http.MethodGet, vmPath(name, "/console"), url.Values{"type": {"serial"}}, nil, &info); err != nil {
+		return err
+	}
+	tlsConfig := c.http.Transport.(*http.Transport).TLSClientConfig
+	return attachConsole(info.URL, tlsConfig)
+}
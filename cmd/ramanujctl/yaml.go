@@ -0,0 +1,471 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A YAML reader for spec files, covering the part of YAML they need: block mappings and
+// sequences, flow [..] and {..} collections, plain and quoted scalars, literal (|) and
+// folded (>) block scalars, and comments. Anchors, tags and multiple documents are not
+// supported. As JSON is YAML, JSON specs read too.
+
+var yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+
+type yamlParser struct {
+	lines []string
+	pos   int
+}
+
+// parseYAML reads the document into maps, slices and scalars that encoding/json can write
+func parseYAML(data []byte) (interface{}, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimPrefix(text, "---\n")
+	p := &yamlParser{lines: strings.Split(text, "\n")}
+	if strings.HasPrefix(strings.TrimSpace(text), "{") || strings.HasPrefix(strings.TrimSpace(text), "[") {
+		// A flow collection, JSON included, may span lines
+		v, rest, err := parseFlow(strings.TrimSpace(stripComments(text)))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after the document", truncate(rest, 20))
+		}
+		return v, nil
+	}
+	v, err := p.parseBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.pos+1)
+	}
+	return v, nil
+}
+
+// stripComments drops the comment lines of a flow document
+func stripComments(text string) string {
+	var kept []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// skipBlank moves past empty and comment-only lines
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) {
+		t := strings.TrimSpace(p.lines[p.pos])
+		if t != "" && !strings.HasPrefix(t, "#") && t != "---" {
+			return
+		}
+		p.pos++
+	}
+}
+
+// parseBlock reads the node starting at the next line, which must be indented at least
+// minIndent spaces
+func (p *yamlParser) parseBlock(minIndent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	line := p.lines[p.pos]
+	ind := indentOf(line)
+	if ind < minIndent {
+		return nil, nil
+	}
+	if strings.Contains(line[:ind], "\t") || strings.HasPrefix(line[ind:], "\t") {
+		return nil, fmt.Errorf("line %d: tabs can't be used for indentation", p.pos+1)
+	}
+	text := stripComment(line[ind:])
+	switch {
+	case text == "-" || strings.HasPrefix(text, "- "):
+		return p.parseSequence(ind)
+	case mappingColon(text) >= 0:
+		return p.parseMapping(ind)
+	}
+	p.pos++
+	return parseScalar(text)
+}
+
+func (p *yamlParser) parseSequence(ind int) (interface{}, error) {
+	items := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return items, nil
+		}
+		line := p.lines[p.pos]
+		text := stripComment(line[min(indentOf(line), len(line)):])
+		if indentOf(line) != ind || (text != "-" && !strings.HasPrefix(text, "- ")) {
+			return items, nil
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+		if rest == "" {
+			p.pos++
+			item, err := p.parseBlock(ind + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			continue
+		}
+		// The item starts on the dash's line: read it as if it began a line of its own
+		col := ind + len(text) - len(rest)
+		p.lines[p.pos] = strings.Repeat(" ", col) + rest
+		item, err := p.parseBlock(col)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+func (p *yamlParser) parseMapping(ind int) (interface{}, error) {
+	m := map[string]interface{}{}
+	for {
+		p.skipBlank()
+		if p.pos >= len(p.lines) {
+			return m, nil
+		}
+		line := p.lines[p.pos]
+		if indentOf(line) < ind {
+			return m, nil
+		}
+		if indentOf(line) > ind {
+			return nil, fmt.Errorf("line %d: unexpected indentation", p.pos+1)
+		}
+		if strings.HasPrefix(line[ind:], "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", p.pos+1)
+		}
+		text := stripComment(line[ind:])
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			return m, nil
+		}
+		colon := mappingColon(text)
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", p.pos+1)
+		}
+		key, err := parseKey(strings.TrimSpace(text[:colon]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", p.pos+1, err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", p.pos+1, key)
+		}
+		value := strings.TrimSpace(text[colon+1:])
+		lineNo := p.pos + 1
+		p.pos++
+
+		var v interface{}
+		switch {
+		case value == "":
+			p.skipBlank()
+			if p.pos < len(p.lines) {
+				next := p.lines[p.pos]
+				nextText := strings.TrimLeft(next, " ")
+				// A sequence may sit at its key's own indentation
+				if indentOf(next) > ind || (indentOf(next) == ind && (nextText == "-" || strings.HasPrefix(nextText, "- "))) {
+					v, err = p.parseBlock(ind)
+				}
+			}
+		case value[0] == '|' || value[0] == '>':
+			v, err = p.parseBlockScalar(ind, value)
+		default:
+			v, err = parseScalar(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		m[key] = v
+	}
+}
+
+// parseBlockScalar reads the lines of a | or > scalar, indented past its key's ind
+func (p *yamlParser) parseBlockScalar(ind int, header string) (interface{}, error) {
+	folded := header[0] == '>'
+	chomp := strings.TrimSpace(header[1:])
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, fmt.Errorf("unsupported block scalar header %q", header)
+	}
+
+	var lines []string
+	content := -1
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if content < 0 {
+			content = indentOf(line)
+			if content <= ind {
+				break
+			}
+		}
+		if indentOf(line) < content {
+			break
+		}
+		lines = append(lines, line[content:])
+		p.pos++
+	}
+	// Trailing blank lines belong to the scalar only for chomping
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+
+	var s string
+	if folded {
+		var b strings.Builder
+		for i, l := range lines {
+			// Lines join with spaces; each blank line stands for a line break
+			switch {
+			case l == "":
+				b.WriteString("\n")
+			case i > 0 && lines[i-1] != "":
+				b.WriteString(" ")
+			}
+			b.WriteString(l)
+		}
+		s = b.String()
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+	switch {
+	case len(lines) == 0:
+	case chomp == "-":
+	case chomp == "+":
+		s += strings.Repeat("\n", trailing+1)
+	default:
+		s += "\n"
+	}
+	return s, nil
+}
+
+// mappingColon finds the ": " (or final ":") ending a key, outside quotes, or -1
+func mappingColon(text string) int {
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return -1
+	}
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			switch {
+			case c == '\'' && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+				i++
+			case c == quote:
+				quote = 0
+			case c == '\\' && quote == '"':
+				i++
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment drops a " #" comment from a line, outside quotes
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			switch {
+			case c == '\'' && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+				// '' is a quote inside a single-quoted scalar
+				i++
+			case c == quote:
+				quote = 0
+			case c == '\\' && quote == '"':
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || text[i-1] == ' ' || text[i-1] == '[' || text[i-1] == '{' || text[i-1] == ',' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return strings.TrimRight(text, " ")
+}
+
+func parseKey(s string) (string, error) {
+	v, err := parseScalar(s)
+	if err != nil {
+		return "", err
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	return s, nil
+}
+
+// parseScalar reads a value that sits on one line
+func parseScalar(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	switch s[0] {
+	case '"', '\'', '[', '{':
+		v, rest, err := parseFlow(s)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after value", truncate(rest, 20))
+		}
+		return v, nil
+	}
+	return plainScalar(s), nil
+}
+
+// plainScalar types an unquoted scalar the way YAML 1.2's core schema does
+func plainScalar(s string) interface{} {
+	switch s {
+	case "null", "Null", "NULL", "~":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if yamlFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// parseFlow reads one flow value (a flow collection, quoted or plain scalar) from the
+// start of s, returning it and what follows
+func parseFlow(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " \n\t")
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+	switch s[0] {
+	case '"':
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\\' {
+				end++
+			} else if s[end] == '"' {
+				break
+			}
+		}
+		if end >= len(s) {
+			return nil, "", fmt.Errorf("unterminated string")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+		return v, s[end+1:], nil
+	case '\'':
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\'' {
+				if i+1 < len(s) && s[i+1] == '\'' {
+					b.WriteByte('\'')
+					i++
+					continue
+				}
+				return b.String(), s[i+1:], nil
+			}
+			b.WriteByte(s[i])
+		}
+		return nil, "", fmt.Errorf("unterminated string")
+	case '[':
+		items := []interface{}{}
+		rest := strings.TrimLeft(s[1:], " \n\t")
+		for {
+			if strings.HasPrefix(rest, "]") {
+				return items, rest[1:], nil
+			}
+			v, r, err := parseFlow(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, v)
+			if rest, err = flowSeparator(r, ']'); err != nil {
+				return nil, "", err
+			}
+		}
+	case '{':
+		m := map[string]interface{}{}
+		rest := strings.TrimLeft(s[1:], " \n\t")
+		for {
+			if strings.HasPrefix(rest, "}") {
+				return m, rest[1:], nil
+			}
+			k, r, err := parseFlow(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			r = strings.TrimLeft(r, " \n\t")
+			if !strings.HasPrefix(r, ":") {
+				return nil, "", fmt.Errorf("expected ':' after key %v", k)
+			}
+			v, r, err := parseFlow(r[1:])
+			if err != nil {
+				return nil, "", err
+			}
+			m[fmt.Sprint(k)] = v
+			if rest, err = flowSeparator(r, '}'); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	// A plain scalar runs to the next flow indicator
+	end := strings.IndexAny(s, ",]}\n")
+	if i := strings.Index(s, ": "); i >= 0 && (end < 0 || i < end) {
+		end = i
+	}
+	if end < 0 {
+		end = len(s)
+	}
+	return plainScalar(strings.TrimSpace(s[:end])), s[end:], nil
+}
+
+// flowSeparator consumes the ',' between flow items, leaving a closing bracket in place
+func flowSeparator(s string, closing byte) (string, error) {
+	s = strings.TrimLeft(s, " \n\t")
+	switch {
+	case strings.HasPrefix(s, ","):
+		return strings.TrimLeft(s[1:], " \n\t"), nil
+	case s != "" && s[0] == closing:
+		return s, nil
+	}
+	return "", fmt.Errorf("expected ',' or '%c'", closing)
+}
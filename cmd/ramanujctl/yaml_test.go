@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want interface{}
+	}{
+		{
+			name: "nested maps and lists",
+			doc: `name: web-1
+cpus: 2
+disks:
+  - size_gb: 20
+    boot: true
+  - size_gb: 100
+    cache: none
+labels:
+  tier: frontend
+  team:
+    owner: ops
+nics:
+- network: default
+`,
+			want: map[string]interface{}{
+				"name": "web-1",
+				"cpus": int64(2),
+				"disks": []interface{}{
+					map[string]interface{}{"size_gb": int64(20), "boot": true},
+					map[string]interface{}{"size_gb": int64(100), "cache": "none"},
+				},
+				"labels": map[string]interface{}{
+					"tier": "frontend",
+					"team": map[string]interface{}{"owner": "ops"},
+				},
+				"nics": []interface{}{map[string]interface{}{"network": "default"}},
+			},
+		},
+		{
+			name: "scalar types",
+			doc: `int: -3
+float: 1.5
+bool: false
+null: ~
+empty:
+version: 1.2.3
+`,
+			want: map[string]interface{}{
+				"int": int64(-3), "float": 1.5, "bool": false, "null": nil, "empty": nil, "version": "1.2.3",
+			},
+		},
+		{
+			name: "quoted scalars with colons and hashes",
+			doc: `# a comment line
+url: "http://mirror:8080/img.qcow2#frag"
+single: 'it''s: # not a comment'
+plain: value # a comment
+"quoted key: x": 1
+hash: a#b
+`,
+			want: map[string]interface{}{
+				"url":           "http://mirror:8080/img.qcow2#frag",
+				"single":        "it's: # not a comment",
+				"plain":         "value",
+				"quoted key: x": int64(1),
+				"hash":          "a#b",
+			},
+		},
+		{
+			name: "block scalars",
+			doc: `literal: |
+  #cloud-config
+  runcmd:
+    - echo hi
+
+keep: |+
+  a
+
+strip: |-
+  b
+folded: >
+  one
+  two
+
+  three
+next: 1
+`,
+			want: map[string]interface{}{
+				"literal": "#cloud-config\nruncmd:\n  - echo hi\n",
+				"keep":    "a\n\n",
+				"strip":   "b",
+				"folded":  "one two\nthree\n",
+				"next":    int64(1),
+			},
+		},
+		{
+			name: "flow collections",
+			doc:  "tags: [a, 'b, c', 3]\nmeta: {k: v, n: 2}\n",
+			want: map[string]interface{}{
+				"tags": []interface{}{"a", "b, c", int64(3)},
+				"meta": map[string]interface{}{"k": "v", "n": int64(2)},
+			},
+		},
+		{
+			name: "JSON document",
+			doc:  "{\n  \"name\": \"db\",\n  \"disks\": [{\"size_gb\": 10}]\n}\n",
+			want: map[string]interface{}{
+				"name":  "db",
+				"disks": []interface{}{map[string]interface{}{"size_gb": int64(10)}},
+			},
+		},
+		{
+			name: "document marker and top-level list",
+			doc:  "---\n- a\n- b\n",
+			want: []interface{}{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("parseYAML: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"duplicate key", "a: 1\na: 2\n"},
+		{"bad indentation", "a:\n    b: 1\n  c: 2\n"},
+		{"tab indentation", "a:\n\tb: 1\n"},
+		{"not a mapping", "a: 1\njust text\n"},
+		{"unterminated string", "a: \"open\n"},
+		{"unterminated flow", "a: [1, 2\n"},
+		{"text after a flow value", "a: [1] x\n"},
+		{"bad block scalar header", "a: |x\n  b\n"},
+		{"text after a JSON document", "{\"a\": 1} extra"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if v, err := parseYAML([]byte(tt.doc)); err == nil {
+				t.Errorf("parseYAML(%q) = %#v, want an error", tt.doc, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings come from VM_SERVICE_* environment variables and from a config file, the
+// environment winning. The file holds one "key = value" per line, the key being the
+// variable's name without the VM_SERVICE_ prefix, in lower case:
+//
+//	# /etc/vm-service/vm-service.conf
+//	listen = :8443
+//	image_dir = /srv/images/cache
+//	libvirt_uri = qemu:///system
+//	template = /etc/vm-service/vm-template.xml
+//	qemu_img = /usr/local/bin/qemu-img
+//
+// Values may be quoted, and # starts a comment line. VM_SERVICE_CONFIG names another
+// file; the default one may be missing. loadConfig checks every setting at startup, so
+// a typo stops the service instead of leaving it on a default.
+
+// defaultConfigPath - the config file read when VM_SERVICE_CONFIG is unset
+const defaultConfigPath = "/etc/vm-service/vm-service.conf"
+
+// configSettings - every setting the service reads, with the check its value must pass
+// (nil for free-form ones)
+var configSettings = map[string]func(string) error{
+	"VM_SERVICE_ALLOWED_PATHS":          nil,
+	"VM_SERVICE_ALLOW_PASSWORDS":        checkBool,
+	"VM_SERVICE_ALLOW_UNAUTHENTICATED":  checkBool,
+	"VM_SERVICE_ALLOW_XML_OVERRIDES":    checkBool,
+	"VM_SERVICE_API_KEYS":               nil,
+	"VM_SERVICE_API_KEYS_FILE":          checkFile,
+	"VM_SERVICE_AUDIT_LOG":              checkAbsPath,
+	"VM_SERVICE_CONSOLE_LOG_DIR":        checkAbsPath,
+	"VM_SERVICE_CPU_OVERCOMMIT":         checkPositiveFloat,
+	"VM_SERVICE_DEFAULT_ROLE":           nil,
+	"VM_SERVICE_FLAVORS_FILE":           checkAbsPath,
+	"VM_SERVICE_FORWARD_PORTS":          checkPortRange,
+	"VM_SERVICE_HOSTS":                  nil,
+	"VM_SERVICE_IMAGE_DIR":              checkAbsPath,
+	"VM_SERVICE_LIBVIRT_URI":            checkLibvirtURI,
+	"VM_SERVICE_LISTEN":                 checkListenAddr,
+	"VM_SERVICE_LOG_LEVEL":              checkLogLevel,
+	"VM_SERVICE_MAX_CONCURRENT_CREATES": checkPositiveInt,
+	"VM_SERVICE_MAX_CPUS":               checkNonNegativeInt,
+	"VM_SERVICE_MAX_DISK_GB":            checkNonNegativeInt,
+	"VM_SERVICE_MAX_MEMORY_MB":          checkNonNegativeInt,
+	"VM_SERVICE_NVRAM_DIR":              checkAbsPath,
+	"VM_SERVICE_OIDC_AUDIENCE":          nil,
+	"VM_SERVICE_OIDC_ISSUER":            checkURL,
+	"VM_SERVICE_OIDC_JWKS_URL":          checkURL,
+	"VM_SERVICE_OIDC_PROJECT_CLAIM":     nil,
+	"VM_SERVICE_OIDC_ROLE_CLAIM":        nil,
+	"VM_SERVICE_OIDC_USER_CLAIM":        nil,
+	"VM_SERVICE_OVMF_CODE":              checkAbsPath,
+	"VM_SERVICE_OVMF_SECBOOT_CODE":      checkAbsPath,
+	"VM_SERVICE_OVMF_SECBOOT_VARS":      checkAbsPath,
+	"VM_SERVICE_OVMF_VARS":              checkAbsPath,
+	"VM_SERVICE_PROJECTS":               nil,
+	"VM_SERVICE_QEMU_IMG":               checkCommand,
+	"VM_SERVICE_RATE_BURST":             checkPositiveFloat,
+	"VM_SERVICE_RATE_LIMIT":             checkNonNegativeFloat,
+	"VM_SERVICE_RECONCILE_INTERVAL":     checkDuration,
+	"VM_SERVICE_ROLES":                  nil,
+	"VM_SERVICE_SEED_DIR":               checkAbsPath,
+	"VM_SERVICE_SHUTDOWN_TIMEOUT":       checkDuration,
+	"VM_SERVICE_STATE_DIR":              checkAbsPath,
+	"VM_SERVICE_SWAGGER_UI_URL":         checkURL,
+	"VM_SERVICE_SWTPM_DIR":              checkAbsPath,
+	"VM_SERVICE_TEMPLATE":               checkFile,
+	"VM_SERVICE_TEMPLATE_DIR":           nil,
+	"VM_SERVICE_TLS_CERT":               checkFile,
+	"VM_SERVICE_TLS_CLIENT_AUTH":        nil,
+	"VM_SERVICE_TLS_CLIENT_CA":          checkFile,
+	"VM_SERVICE_TLS_KEY":                checkFile,
+	"VM_SERVICE_V1_SUNSET":              nil,
+}
+
+// configFile - the settings read from the config file, by variable name. It is read on
+// first use, which is while the package variables are initialised.
+var configFile struct {
+	once   sync.Once
+	path   string
+	values map[string]string
+	err    error
+}
+
+// envOrDefault - value of a setting from the environment or the config file, or def if
+// it is unset/empty in both
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	configFile.once.Do(readConfigFile)
+	if v := configFile.values[name]; v != "" {
+		return v
+	}
+	return def
+}
+
+// readConfigFile fills configFile; a missing default file leaves it empty
+func readConfigFile() {
+	configFile.path = os.Getenv("VM_SERVICE_CONFIG")
+	explicit := configFile.path != ""
+	if !explicit {
+		configFile.path = defaultConfigPath
+	}
+	data, err := os.ReadFile(configFile.path)
+	if err != nil {
+		if !explicit && errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		configFile.err = err
+		return
+	}
+	configFile.values, configFile.err = parseConfigFile(string(data))
+}
+
+// parseConfigFile parses the "key = value" lines of a config file
+func parseConfigFile(data string) (map[string]string, error) {
+	values := map[string]string{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d is not key = value", i+1)
+		}
+		name := "VM_SERVICE_" + strings.ToUpper(key)
+		if _, known := configSettings[name]; !known {
+			return nil, fmt.Errorf("line %d: unknown setting %q", i+1, key)
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, key)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				unquoted, err := strconv.Unquote(value)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// loadConfig reports a config file that couldn't be read and checks every setting that
+// is set. VM_SERVICE_* variables the service doesn't know are only warned about.
+func loadConfig() error {
+	configFile.once.Do(readConfigFile)
+	if configFile.err != nil {
+		return fmt.Errorf("%s: %v", configFile.path, configFile.err)
+	}
+
+	names := make([]string, 0, len(configSettings))
+	for name := range configSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check, v := configSettings[name], envOrDefault(name, "")
+		if check == nil || v == "" {
+			continue
+		}
+		if err := check(v); err != nil {
+			return fmt.Errorf("%s=%q: %v", name, v, err)
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, known := configSettings[name]; strings.HasPrefix(name, "VM_SERVICE_") && !known && name != "VM_SERVICE_CONFIG" {
+			log.Printf("Ignoring unknown setting %s", name)
+		}
+	}
+	return nil
+}
+
+func checkBool(v string) error {
+	_, err := strconv.ParseBool(v)
+	return err
+}
+
+func checkPositiveInt(v string) error {
+	n, err := strconv.Atoi(v)
+	if err == nil && n <= 0 {
+		err = fmt.Errorf("must be > 0")
+	}
+	return err
+}
+
+// checkNonNegativeInt - for limits where 0 turns the limit off
+func checkNonNegativeInt(v string) error {
+	n, err := strconv.Atoi(v)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("must be >= 0")
+	}
+	return err
+}
+
+func checkNonNegativeFloat(v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && !(f >= 0) {
+		err = fmt.Errorf("must be >= 0")
+	}
+	return err
+}
+
+func checkPositiveFloat(v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && !(f > 0) {
+		err = fmt.Errorf("must be > 0")
+	}
+	return err
+}
+
+func checkDuration(v string) error {
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be > 0")
+	}
+	return err
+}
+
+func checkAbsPath(v string) error {
+	if !filepath.IsAbs(v) {
+		return fmt.Errorf("must be an absolute path")
+	}
+	return nil
+}
+
+// checkFile - the file must exist; relative paths are taken from the working directory
+func checkFile(v string) error {
+	fi, err := os.Stat(v)
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("is a directory")
+	}
+	return err
+}
+
+func checkCommand(v string) error {
+	_, err := exec.LookPath(v)
+	return err
+}
+
+func checkListenAddr(v string) error {
+	_, port, err := net.SplitHostPort(v)
+	if err == nil {
+		_, err = net.LookupPort("tcp", port)
+	}
+	return err
+}
+
+func checkPortRange(v string) error {
+	_, err := parsePortRange(v)
+	return err
+}
+
+func checkURL(v string) error {
+	u, err := url.Parse(v)
+	if err == nil && (u.Scheme == "" || u.Host == "") {
+		err = fmt.Errorf("must be an absolute URL")
+	}
+	return err
+}
+
+func checkLibvirtURI(v string) error {
+	u, err := url.Parse(v)
+	if err == nil && u.Scheme == "" {
+		err = fmt.Errorf("must be a libvirt URI such as qemu:///system")
+	}
+	return err
+}
+
+func checkLogLevel(v string) error {
+	var level slog.Level
+	return level.UnmarshalText([]byte(v))
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// consoleTokenTTL - how long a console URL stays valid before it is first used
+const consoleTokenTTL = time.Minute
+
+// ConsoleInfo - answer of GET /api/v1/vm/{name}/console
+type ConsoleInfo struct {
+	Type      string    `json:"type"` // "vnc" or "serial"
+	URL       string    `json:"url"`  // websocket URL for noVNC or a terminal, usable once
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// consoleToken - a console URL handed out but not used yet
+type consoleToken struct {
+	host    string
+	vm      string
+	kind    string // "vnc" or "serial"
+	expires time.Time
+}
+
+var (
+	consoleTokensMu sync.Mutex
+	consoleTokens   = map[string]consoleToken{}
+)
+
+// issueConsoleToken creates a single-use token for the VM's console, dropping
+// expired ones on the way
+func issueConsoleToken(host, vm, kind string) (string, time.Time, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(raw)
+	expires := time.Now().Add(consoleTokenTTL)
+
+	consoleTokensMu.Lock()
+	defer consoleTokensMu.Unlock()
+	for t, ct := range consoleTokens {
+		if time.Now().After(ct.expires) {
+			delete(consoleTokens, t)
+		}
+	}
+	consoleTokens[token] = consoleToken{host: host, vm: vm, kind: kind, expires: expires}
+	return token, expires, nil
+}
+
+// redeemConsoleToken returns what a token was issued for and invalidates it
+func redeemConsoleToken(token string) (consoleToken, bool) {
+	consoleTokensMu.Lock()
+	defer consoleTokensMu.Unlock()
+	ct, ok := consoleTokens[token]
+	delete(consoleTokens, token)
+	if !ok || time.Now().After(ct.expires) {
+		return consoleToken{}, false
+	}
+	return ct, true
+}
+
+// handleGetConsole - GET /api/v1/vm/{name}/console[?type=serial]
+// Hands out a short-lived websocket URL for the VM's VNC server (the default, for
+// noVNC) or its serial console, so browsers can reach either without the hypervisor
+// exposing ports.
+func handleGetConsole(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("type")
+	if kind == "" {
+		kind = "vnc"
+	}
+	if kind != "vnc" && kind != "serial" {
+		http.Error(w, "type must be \"vnc\" or \"serial\"", http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if _, ok := vncGraphicsIndex(def); kind == "vnc" && !ok {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q has no VNC console", def.Name))
+			return
+		}
+		if active, err := dom.IsActive(); err != nil || !active {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", def.Name))
+			return
+		}
+
+		token, expires, err := issueConsoleToken(requestHost(r), def.Name, kind)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to generate console token: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		scheme := "ws"
+		if r.TLS != nil {
+			scheme = "wss"
+		}
+		writeDataResponse(w, ConsoleInfo{
+			Type:      kind,
+			URL:       fmt.Sprintf("%s://%s%s?token=%s", scheme, r.Host, apiPath(r, "/api/v1/console/ws"), token),
+			Token:     token,
+			ExpiresAt: expires.UTC(),
+		})
+	})
+}
+
+// handleConsoleWebsocket - GET /api/v1/console/ws?token=...
+// Upgrades to a websocket and relays it to the console the token was issued for:
+// the VNC server through a socket libvirt opens for us (so the VNC listen address
+// does not matter), or the serial console through a libvirt stream.
+func handleConsoleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ct, ok := redeemConsoleToken(r.URL.Query().Get("token"))
+	if !ok {
+		http.Error(w, "Invalid or expired console token", http.StatusForbidden)
+		return
+	}
+	vmName := ct.vm
+
+	conn, err := connectHost(ct.host)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to look up VM %q: %v", vmName, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer dom.Free()
+
+	var console io.ReadWriteCloser
+	if ct.kind == "serial" {
+		var serial *consoleStream
+		serial, err = openSerialConsole(conn, dom)
+		if err == nil {
+			// Freed only after Close has aborted it and the relay stopped reading
+			defer serial.stream.Free()
+			console = serial
+		}
+	} else {
+		console, err = openVNCConsole(dom)
+	}
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to open %s console of %s: %v", ct.kind, vmName, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer console.Close()
+
+	ws, err := upgradeWebsocket(w, r, "binary")
+	if err != nil {
+		requestLog(r).Error(fmt.Sprintf("Console websocket for %s: %v", vmName, err))
+		return
+	}
+	defer ws.Close()
+	requestLog(r).Info(fmt.Sprintf("%s console of %s opened from %s", ct.kind, vmName, r.RemoteAddr))
+	relayConsole(ws, console)
+	requestLog(r).Info(fmt.Sprintf("%s console of %s closed", ct.kind, vmName))
+}
+
+// relayConsole copies console output to the websocket and websocket messages (keystrokes
+// or VNC client traffic) to the console until either side ends
+func relayConsole(ws *wsConn, console io.ReadWriteCloser) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := console.Read(buf)
+			if n > 0 {
+				if werr := ws.WriteMessage(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		// Unblocks ReadMessage below once the console side has ended, or the service stops
+		select {
+		case <-done:
+		case <-serverStopping:
+		}
+		ws.conn.Close()
+	}()
+	for {
+		msg, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		if _, err := console.Write(msg); err != nil {
+			break
+		}
+	}
+	console.Close()
+	<-done
+}
+
+// openVNCConsole connects to the domain's VNC server through libvirt
+func openVNCConsole(dom *libvirt.Domain) (io.ReadWriteCloser, error) {
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return nil, err
+	}
+	idx, ok := vncGraphicsIndex(def)
+	if !ok {
+		return nil, fmt.Errorf("no VNC graphics device")
+	}
+	return dom.OpenGraphicsFD(idx, 0)
+}
+
+// openSerialConsole attaches a stream to the domain's first serial console, taking it
+// over from any other client (as virsh console --force does)
+func openSerialConsole(conn *libvirt.Connect, dom *libvirt.Domain) (*consoleStream, error) {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := dom.OpenConsole("", stream, libvirt.DOMAIN_CONSOLE_FORCE); err != nil {
+		stream.Free()
+		return nil, err
+	}
+	return &consoleStream{stream: stream}, nil
+}
+
+// consoleStream adapts a libvirt stream to io.ReadWriteCloser. Close aborts the
+// stream, which also wakes a blocked Read; the owner frees it afterwards.
+type consoleStream struct {
+	stream *libvirt.Stream
+	once   sync.Once
+}
+
+func (c *consoleStream) Read(p []byte) (int, error) {
+	n, err := c.stream.Recv(p)
+	if err == nil && n == 0 {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (c *consoleStream) Write(p []byte) (int, error) {
+	return c.stream.Send(p)
+}
+
+func (c *consoleStream) Close() error {
+	c.once.Do(func() {
+		_ = c.stream.Abort()
+	})
+	return nil
+}
+
+// vncGraphicsIndex finds the VNC entry among the domain's graphics devices; its
+// position is what virDomainOpenGraphicsFD takes
+func vncGraphicsIndex(def domainDefXML) (uint, bool) {
+	for i, g := range def.Devices.Graphics {
+		if g.Type == "vnc" {
+			return uint(i), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// consoleLogDir - where new VMs' serial output is logged; the default is a directory
+// the libvirt security drivers already let QEMU write to
+var consoleLogDir = envOrDefault("VM_SERVICE_CONSOLE_LOG_DIR", "/var/log/libvirt/qemu")
+
+// maxConsoleLogRead - most bytes GET /api/v1/vm/{name}/console-log returns at once
+const maxConsoleLogRead = 1 << 20
+
+// consoleLogPath - the serial log file of a new VM
+func consoleLogPath(vmName string) string {
+	return filepath.Join(consoleLogDir, vmName+"-serial.log")
+}
+
+type domainSerialXML struct {
+	Log *struct {
+		File string `xml:"file,attr"`
+	} `xml:"log"`
+}
+
+// handleGetConsoleLog - GET /api/v1/vm/{name}/console-log[?tail=N | ?offset=B]
+// Returns the VM's captured serial output as text: the last N lines with tail, or from
+// byte offset B on (for following the log), otherwise the end of the log. At most 1 MiB
+// is returned per call; X-Log-Size and X-Next-Offset tell where to continue.
+func handleGetConsoleLog(w http.ResponseWriter, r *http.Request) {
+	if !isLocalHost(requestHost(r)) {
+		http.Error(w, "Console logs can only be read on local hosts", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var tail int
+	var offset int64 = -1
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "tail must be a positive number of lines", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative byte offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if tail > 0 && offset >= 0 {
+		http.Error(w, "tail and offset cannot be combined", http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		var path string
+		for _, s := range def.Devices.Serials {
+			if s.Log != nil && s.Log.File != "" {
+				path = s.Log.File
+				break
+			}
+		}
+		if path == "" {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no console log configured", def.Name))
+			return
+		}
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// Configured, but the VM has not been started since
+			writeConsoleLog(w, nil, 0, 0)
+			return
+		}
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to open console log: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to stat console log: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		size := st.Size()
+
+		start := offset
+		if start < 0 || start > size {
+			// No offset (or a stale one from before the log was rotated): read the end
+			start = max(size-maxConsoleLogRead, 0)
+		}
+		data := make([]byte, min(size-start, maxConsoleLogRead))
+		if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+			errMsg := fmt.Sprintf("Failed to read console log: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		next := start + int64(len(data))
+		if tail > 0 {
+			data = lastLines(data, tail)
+		}
+		writeConsoleLog(w, data, size, next)
+	})
+}
+
+// writeConsoleLog sends a chunk of console log with the headers to continue from
+func writeConsoleLog(w http.ResponseWriter, data []byte, size, next int64) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Log-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Next-Offset", strconv.FormatInt(next, 10))
+	_, _ = w.Write(data)
+}
+
+// lastLines returns the last n lines of data
+func lastLines(data []byte, n int) []byte {
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for i := 0; i < n; i++ {
+		idx := bytes.LastIndexByte(data[:end], '\n')
+		if idx < 0 {
+			return data
+		}
+		end = idx
+	}
+	return data[end+1:]
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConvertRequest - incoming JSON to convert a foreign image to qcow2.
+// The source is either a host path or the name of a catalog image.
+type ConvertRequest struct {
+	Source       string `json:"source,omitempty"`
+	SourceImage  string `json:"source_image,omitempty"`
+	SourceFormat string `json:"source_format,omitempty"` // vmdk, vhd, vhdx, vdi, raw, qcow2; probed if empty
+	FileName     string `json:"file_name,omitempty"`     // output file in imageConvertDir, defaults to <source>.qcow2
+	Name         string `json:"name,omitempty"`          // register the result in the catalog under this name
+}
+
+// imageConvertDir - where conversions are written, apart from the download cache for the
+// same reason as imageUploadDir
+var imageConvertDir = filepath.Join(imageCacheDir, "converted")
+
+// qemuImgFormats maps the names users know to qemu-img's format names
+var qemuImgFormats = map[string]string{
+	"vmdk":  "vmdk",
+	"vhd":   "vpc",
+	"vpc":   "vpc",
+	"vhdx":  "vhdx",
+	"vdi":   "vdi",
+	"raw":   "raw",
+	"qcow2": "qcow2",
+}
+
+// qemu-img convert -p prints "    (12.34/100%)" progress lines separated by \r
+var convertProgressPattern = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// handleConvertImage - POST /api/v1/images/convert
+// Starts qemu-img convert in the background and answers 202 with the job to poll.
+func handleConvertImage(w http.ResponseWriter, r *http.Request) {
+	var req ConvertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+
+	var srcImage *Image
+	if req.SourceImage != "" {
+		img, ok := imageCatalog.resolve(req.SourceImage)
+		if !ok {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Image %q not found", req.SourceImage))
+			return
+		}
+		srcImage = &img
+		if req.Source == "" {
+			req.Source = img.Path
+		}
+		if req.SourceFormat == "" {
+			req.SourceFormat = img.Format
+		}
+	}
+
+	if err := validateConvertRequest(&req); err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	dest := filepath.Join(imageConvertDir, req.FileName)
+	if _, err := os.Stat(dest); err == nil {
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("%s already exists", dest))
+		return
+	}
+
+	job := startJob("image-convert", requestProject(r), "", func(j *jobHandle) (interface{}, error) {
+		if err := convertToQcow2(j, req.Source, req.SourceFormat, dest); err != nil {
+			return nil, err
+		}
+		if req.Name == "" {
+			return map[string]string{"path": dest}, nil
+		}
+
+		img := Image{
+			Name:      req.Name,
+			Kind:      "disk",
+			Path:      dest,
+			Format:    "qcow2",
+			CreatedAt: time.Now().UTC(),
+		}
+		if srcImage != nil {
+			img.OSFamily = srcImage.OSFamily
+			img.DefaultLogin = srcImage.DefaultLogin
+			img.MinDiskGB = srcImage.MinDiskGB
+		}
+		if err := imageCatalog.add(img); err != nil {
+			return nil, fmt.Errorf("converted to %s but failed to register image: %v", dest, err)
+		}
+		return img, nil
+	})
+
+	writeJobAccepted(w, job)
+}
+
+// handleGetConversion - GET /api/v1/images/conversions/{id}
+func handleGetConversion(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r, "image-convert")
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Conversion %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// validateConvertRequest checks fields and fills in defaults
+func validateConvertRequest(req *ConvertRequest) error {
+	if req.Source == "" {
+		return fmt.Errorf("one of source or source_image is required")
+	}
+	if err := validatePath("source", req.Source, true); err != nil {
+		return err
+	}
+	if _, err := os.Stat(req.Source); err != nil {
+		return fmt.Errorf("source is not usable: %v", err)
+	}
+	// Converting flattens the backing chain, which would copy the files it names
+	if err := checkQcow2Standalone(req.Source); err != nil {
+		return err
+	}
+	if req.SourceFormat != "" {
+		format, ok := qemuImgFormats[strings.ToLower(req.SourceFormat)]
+		if !ok {
+			return fmt.Errorf("unsupported source_format %q", req.SourceFormat)
+		}
+		req.SourceFormat = format
+	}
+	if req.FileName == "" {
+		base := filepath.Base(req.Source)
+		req.FileName = strings.TrimSuffix(base, filepath.Ext(base)) + ".qcow2"
+	}
+	req.FileName = sanitizeFileName(filepath.Base(req.FileName))
+	if req.Name != "" {
+		if !imageNamePattern.MatchString(req.Name) {
+			return fmt.Errorf("name must match %s", imageNamePattern)
+		}
+		if _, exists := imageCatalog.get(req.Name); exists {
+			return fmt.Errorf("image %q already exists", req.Name)
+		}
+	}
+	return nil
+}
+
+// convertToQcow2 runs qemu-img convert, reporting its progress on the job. The output is
+// written under a temporary name and only renamed to dest once complete.
+func convertToQcow2(j *jobHandle, src, srcFormat, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create image directory: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(dest), ".convert-"+j.snapshot().ID+".qcow2")
+	defer os.Remove(tmp)
+
+	args := []string{"convert", "-p"}
+	if srcFormat != "" {
+		args = append(args, "-f", srcFormat)
+	}
+	args = append(args, "-O", "qcow2", src, tmp)
+
+	cmd := exec.Command(qemuImgPath, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	log.Printf("Converting %s to %s", src, dest)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start qemu-img: %v", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(splitCROrLF)
+	for scanner.Scan() {
+		if m := convertProgressPattern.FindStringSubmatch(scanner.Text()); m != nil {
+			if pct, err := strconv.ParseFloat(m[1], 64); err == nil {
+				j.setProgress(pct)
+			}
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("qemu-img convert failed: %v, output: %s", err, stderr.String())
+	}
+	// Linked rather than renamed, so a conversion finishing first isn't overwritten
+	if err := os.Link(tmp, dest); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists", dest)
+		}
+		return err
+	}
+	return nil
+}
+
+// splitCROrLF is bufio.ScanLines that also breaks on bare \r, as progress output uses it
+func splitCROrLF(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
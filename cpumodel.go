@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "cpu_mode" picks the CPU the guest sees. host-passthrough, the default, hands it the
+// host's CPU as it is: the fastest, but the VM can only migrate to identical hosts.
+// host-model gives it libvirt's closest named model with the host's features, which
+// migrates to hosts at least as new. custom gives it exactly "cpu_model", for a pool of
+// mixed hosts to migrate within: pick the oldest model they all run. "cpu_features"
+// adds or removes single flags on top of any of them.
+
+// CPUFeatureSpec - a CPU flag, e.g. {"name": "avx512f", "policy": "disable"}
+type CPUFeatureSpec struct {
+	Name string `json:"name"`
+	// Policy - "require" (default), "disable", "force", "optional" or "forbid"
+	Policy string `json:"policy,omitempty"`
+}
+
+// GuestCPU - the <cpu> element as the template writes it
+type GuestCPU struct {
+	Mode       string
+	Match      string // custom only
+	Check      string
+	Migratable bool // host-passthrough only
+	Model      string
+	Features   []CPUFeatureSpec
+}
+
+const defaultCPUMode = "host-passthrough"
+
+var cpuModes = map[string]bool{
+	"host-passthrough": true,
+	"host-model":       true,
+	"custom":           true,
+}
+
+var cpuFeaturePolicies = map[string]bool{
+	"require":  true,
+	"disable":  true,
+	"force":    true,
+	"optional": true,
+	"forbid":   true,
+}
+
+// cpuNamePattern - CPU models and feature names as libvirt spells them, e.g.
+// "Skylake-Server-IBRS" or "tsc-deadline"
+var cpuNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// errCPUModelUnavailable - the host's libvirt doesn't know the custom model
+var errCPUModelUnavailable = errors.New("CPU model unavailable")
+
+// validateCPUModel checks the request's cpu_mode, cpu_model and cpu_features
+func validateCPUModel(req RequestData) error {
+	if req.CPUMode != "" && !cpuModes[req.CPUMode] {
+		return fmt.Errorf("unsupported cpu_mode %q, must be host-passthrough, host-model or custom", req.CPUMode)
+	}
+	if req.CPUMode == "custom" {
+		if !cpuNamePattern.MatchString(req.CPUModel) {
+			return fmt.Errorf("cpu_mode custom requires a cpu_model such as Skylake-Server-IBRS")
+		}
+	} else if req.CPUModel != "" {
+		return fmt.Errorf("cpu_model requires cpu_mode custom")
+	}
+	seen := map[string]bool{}
+	for i, f := range req.CPUFeatures {
+		if !cpuNamePattern.MatchString(f.Name) {
+			return fmt.Errorf("cpu_features %d: invalid name %q", i, f.Name)
+		}
+		if f.Policy != "" && !cpuFeaturePolicies[f.Policy] {
+			return fmt.Errorf("cpu_features %d: unsupported policy %q, must be require, disable, force, optional or forbid", i, f.Policy)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("cpu_features %d: %s is listed twice", i, f.Name)
+		}
+		seen[f.Name] = true
+	}
+	return nil
+}
+
+// checkCPUModel checks the host's libvirt knows a custom model, for KVM guests of the
+// host's architecture
+func checkCPUModel(conn *libvirt.Connect, req RequestData) error {
+	if req.CPUMode != "custom" {
+		return nil
+	}
+	capsDoc, err := conn.GetCapabilities()
+	if err != nil {
+		return fmt.Errorf("failed to get capabilities: %v", err)
+	}
+	var caps capabilitiesXML
+	if err := xml.Unmarshal([]byte(capsDoc), &caps); err != nil {
+		return fmt.Errorf("failed to parse capabilities: %v", err)
+	}
+	models, err := conn.GetCPUModelNames(caps.Host.CPU.Arch, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list CPU models: %v", err)
+	}
+	for _, m := range models {
+		if m == req.CPUModel {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no CPU model %q for %s, see virsh cpu-models %s", errCPUModelUnavailable, req.CPUModel, caps.Host.CPU.Arch, caps.Host.CPU.Arch)
+}
+
+// guestCPU - the template's <cpu> for the request
+func guestCPU(req RequestData) GuestCPU {
+	cpu := GuestCPU{Mode: req.CPUMode, Model: req.CPUModel}
+	if cpu.Mode == "" {
+		cpu.Mode = defaultCPUMode
+	}
+	switch cpu.Mode {
+	case "host-passthrough":
+		cpu.Check = "none"
+		cpu.Migratable = true
+	case "custom":
+		cpu.Match = "exact"
+		cpu.Check = "partial"
+	default:
+		cpu.Check = "partial"
+	}
+	for _, f := range req.CPUFeatures {
+		if f.Policy == "" {
+			f.Policy = "require"
+		}
+		cpu.Features = append(cpu.Features, f)
+	}
+	return cpu
+}
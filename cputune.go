@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "cputune" pins the VM's vCPUs, its emulator thread and its I/O threads to host CPUs,
+// so latency-sensitive guests don't wait for the scheduler or share caches with other
+// VMs. Pins are given as cpusets ("2", "4-7", "0-7,^3"), or the "isolate" policy picks
+// CPUs no other VM on the host is pinned to: one per vCPU, plus one the emulator and I/O
+// threads share. It leaves the core of CPU 0 to the host and keeps the VM on one NUMA
+// node when one has room. The picked CPUs are written into the domain, so a VM keeps
+// them across restarts; creates picking at the same time can pick the same CPUs.
+//
+// I/O threads take the virtio disks' I/O off the vCPUs, the disks spread over them in
+// turn.
+
+// CPUTuneSpec - CPU pinning for a create
+type CPUTuneSpec struct {
+	// Policy - "isolate" to have free CPUs picked, empty to pin as given below
+	Policy string `json:"policy,omitempty"`
+	// VCPUPins - the host cpuset of each vCPU, in order
+	VCPUPins []string `json:"vcpu_pins,omitempty"`
+	// EmulatorPin - the host cpuset of QEMU's own threads
+	EmulatorPin string `json:"emulator_pin,omitempty"`
+	// IOThreads - number of I/O threads; IOThreadPins - the host cpuset of each of them
+	IOThreads    int      `json:"iothreads,omitempty"`
+	IOThreadPins []string `json:"iothread_pins,omitempty"`
+}
+
+// CPUTune - the pinning as the template writes it
+type CPUTune struct {
+	VCPUPins     []CPUPin
+	EmulatorPin  string
+	IOThreads    int
+	IOThreadPins []CPUPin
+}
+
+// CPUPin - the host cpuset of vCPU or I/O thread ID
+type CPUPin struct {
+	ID     int
+	CPUSet string
+}
+
+// maxIOThreads - more is never useful for the disks a VM has
+const maxIOThreads = 16
+
+// errCPUsUnavailable - the host hasn't the CPUs the pinning asks for
+var errCPUsUnavailable = errors.New("host CPUs unavailable")
+
+// validateCPUTune checks the request's cputune as far as it can be without the host
+func validateCPUTune(req RequestData) error {
+	t := req.CPUTune
+	if t == nil {
+		return nil
+	}
+	switch t.Policy {
+	case "":
+		if len(t.VCPUPins) == 0 && t.EmulatorPin == "" && t.IOThreads == 0 {
+			return fmt.Errorf("cputune needs a policy, pins or iothreads")
+		}
+	case "isolate":
+		if len(t.VCPUPins) > 0 || t.EmulatorPin != "" || len(t.IOThreadPins) > 0 {
+			return fmt.Errorf("the isolate policy picks the CPUs, it cannot be combined with pins")
+		}
+	default:
+		return fmt.Errorf("unsupported cputune policy %q, must be isolate or empty", t.Policy)
+	}
+	if len(t.VCPUPins) > 0 && len(t.VCPUPins) != req.CPUs {
+		return fmt.Errorf("vcpu_pins has %d cpusets for %d vCPUs", len(t.VCPUPins), req.CPUs)
+	}
+	if t.IOThreads < 0 || t.IOThreads > maxIOThreads {
+		return fmt.Errorf("iothreads must be 0-%d", maxIOThreads)
+	}
+	if len(t.IOThreadPins) > 0 && len(t.IOThreadPins) != t.IOThreads {
+		return fmt.Errorf("iothread_pins has %d cpusets for %d iothreads", len(t.IOThreadPins), t.IOThreads)
+	}
+	for i, set := range t.VCPUPins {
+		if _, err := parseCPUSet(set); err != nil {
+			return fmt.Errorf("vcpu_pins %d: %v", i, err)
+		}
+	}
+	if t.EmulatorPin != "" {
+		if _, err := parseCPUSet(t.EmulatorPin); err != nil {
+			return fmt.Errorf("emulator_pin: %v", err)
+		}
+	}
+	for i, set := range t.IOThreadPins {
+		if _, err := parseCPUSet(set); err != nil {
+			return fmt.Errorf("iothread_pins %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// parseCPUSet parses a libvirt cpuset such as "0-3,8,^2" into its CPUs, in order
+func parseCPUSet(s string) ([]int, error) {
+	in := map[int]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		exclude := strings.HasPrefix(part, "^")
+		part = strings.TrimPrefix(part, "^")
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 0 || last < first || (exclude && isRange) {
+			return nil, fmt.Errorf("invalid cpuset %q, expected e.g. 2, 4-7 or 0-7,^3", s)
+		}
+		for c := first; c <= last; c++ {
+			if exclude {
+				delete(in, c)
+			} else {
+				in[c] = true
+			}
+		}
+	}
+	if len(in) == 0 {
+		return nil, fmt.Errorf("cpuset %q has no CPUs", s)
+	}
+	cpus := make([]int, 0, len(in))
+	for c := range in {
+		cpus = append(cpus, c)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// hostCPUCells reads the host's CPUs by NUMA node, and the siblings of each CPU
+func hostCPUCells(conn *libvirt.Connect) ([][]int, map[int]string, error) {
+	capsDoc, err := conn.GetCapabilities()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get capabilities: %v", err)
+	}
+	var caps capabilitiesXML
+	if err := xml.Unmarshal([]byte(capsDoc), &caps); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse capabilities: %v", err)
+	}
+	var cells [][]int
+	siblings := map[int]string{}
+	for _, cell := range caps.Host.Topology.Cells {
+		var cpus []int
+		for _, c := range cell.CPUs {
+			cpus = append(cpus, c.ID)
+			siblings[c.ID] = c.Siblings
+		}
+		sort.Ints(cpus)
+		cells = append(cells, cpus)
+	}
+	if len(cells) == 0 {
+		return nil, nil, fmt.Errorf("the host reports no CPU topology")
+	}
+	return cells, siblings, nil
+}
+
+// pinnedCPUs - the host CPUs other domains on the host are pinned to, with the domain
+func pinnedCPUs(conn *libvirt.Connect, vmName string) (map[int]string, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+
+	pinned := map[int]string{}
+	for i := range doms {
+		def, err := readDomainDef(&doms[i])
+		if err != nil {
+			return nil, err
+		}
+		if def.Name == vmName {
+			continue
+		}
+		sets := []string{}
+		for _, p := range def.CPUTune.VCPUPins {
+			sets = append(sets, p.CPUSet)
+		}
+		for _, p := range def.CPUTune.IOThreadPins {
+			sets = append(sets, p.CPUSet)
+		}
+		if p := def.CPUTune.EmulatorPin; p != nil {
+			sets = append(sets, p.CPUSet)
+		}
+		for _, set := range sets {
+			cpus, _ := parseCPUSet(set)
+			for _, c := range cpus {
+				pinned[c] = def.Name
+			}
+		}
+	}
+	return pinned, nil
+}
+
+// resolveCPUTune checks the request's pins against the host's CPUs, and for the
+// isolate policy picks them, replacing req.CPUTune with the explicit pinning
+func resolveCPUTune(conn *libvirt.Connect, req *RequestData) error {
+	t := req.CPUTune
+	if t == nil {
+		return nil
+	}
+	cells, siblings, err := hostCPUCells(conn)
+	if err != nil {
+		return err
+	}
+	host := map[int]bool{}
+	for _, cpus := range cells {
+		for _, c := range cpus {
+			host[c] = true
+		}
+	}
+
+	if t.Policy != "isolate" {
+		sets := append([]string{}, t.VCPUPins...)
+		sets = append(sets, t.IOThreadPins...)
+		if t.EmulatorPin != "" {
+			sets = append(sets, t.EmulatorPin)
+		}
+		for _, set := range sets {
+			cpus, _ := parseCPUSet(set)
+			for _, c := range cpus {
+				if !host[c] {
+					return fmt.Errorf("%w: the host has no CPU %d", errCPUsUnavailable, c)
+				}
+			}
+		}
+		return nil
+	}
+
+	pinned, err := pinnedCPUs(conn, req.Name)
+	if err != nil {
+		return err
+	}
+	housekeeping := map[int]bool{0: true}
+	if s, ok := siblings[0]; ok {
+		cpus, _ := parseCPUSet(s)
+		for _, c := range cpus {
+			housekeeping[c] = true
+		}
+	}
+	need := req.CPUs + 1
+	var all, picked []int
+	for _, cpus := range cells {
+		var free []int
+		for _, c := range cpus {
+			if pinned[c] == "" && !housekeeping[c] {
+				free = append(free, c)
+			}
+		}
+		if picked == nil && len(free) >= need {
+			picked = free[:need]
+		}
+		all = append(all, free...)
+	}
+	if picked == nil {
+		if len(all) < need {
+			return fmt.Errorf("%w: %d free CPUs, the VM needs %d (a CPU per vCPU and one for the emulator)", errCPUsUnavailable, len(all), need)
+		}
+		picked = all[:need]
+	}
+
+	isolated := CPUTuneSpec{IOThreads: t.IOThreads}
+	for _, c := range picked[:req.CPUs] {
+		isolated.VCPUPins = append(isolated.VCPUPins, strconv.Itoa(c))
+	}
+	isolated.EmulatorPin = strconv.Itoa(picked[req.CPUs])
+	for i := 0; i < t.IOThreads; i++ {
+		isolated.IOThreadPins = append(isolated.IOThreadPins, isolated.EmulatorPin)
+	}
+	req.CPUTune = &isolated
+	return nil
+}
+
+// cpuTune - the template's pinning for the request, nil without cputune
+func cpuTune(req RequestData) *CPUTune {
+	t := req.CPUTune
+	if t == nil {
+		return nil
+	}
+	tune := &CPUTune{EmulatorPin: t.EmulatorPin, IOThreads: t.IOThreads}
+	for i, set := range t.VCPUPins {
+		tune.VCPUPins = append(tune.VCPUPins, CPUPin{ID: i, CPUSet: set})
+	}
+	// I/O thread IDs start at 1
+	for i, set := range t.IOThreadPins {
+		tune.IOThreadPins = append(tune.IOThreadPins, CPUPin{ID: i + 1, CPUSet: set})
+	}
+	return tune
+}
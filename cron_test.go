@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronMatches(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expr  string
+		match []time.Time
+		miss  []time.Time
+	}{
+		{"* * * * *", []time.Time{at(1, 0, 0), at(31, 23, 59)}, nil},
+		{"30 2 * * *", []time.Time{at(5, 2, 30)}, []time.Time{at(5, 2, 31), at(5, 3, 30)}},
+		{"*/15 * * * *", []time.Time{at(1, 4, 0), at(1, 4, 45)}, []time.Time{at(1, 4, 10)}},
+		{"0-30/10 * * * *", []time.Time{at(1, 0, 20), at(1, 0, 30)}, []time.Time{at(1, 0, 40), at(1, 0, 5)}},
+		{"5/20 * * * *", []time.Time{at(1, 0, 5), at(1, 0, 25), at(1, 0, 45)}, []time.Time{at(1, 0, 0), at(1, 0, 15)}},
+		{"0 9 * * 1-5", []time.Time{at(1, 9, 0), at(5, 9, 0)}, []time.Time{at(6, 9, 0), at(7, 9, 0)}},
+		{"0 0 * * 0", []time.Time{at(7, 0, 0)}, []time.Time{at(1, 0, 0)}},
+		{"0 0 * * 7", []time.Time{at(7, 0, 0)}, []time.Time{at(6, 0, 0)}},
+		{"0 0 1,15 * *", []time.Time{at(1, 0, 0), at(15, 0, 0)}, []time.Time{at(2, 0, 0)}},
+		// Both day fields restricted: either one matching is enough
+		{"0 0 15 * 1", []time.Time{at(15, 0, 0), at(8, 0, 0)}, []time.Time{at(9, 0, 0)}},
+		// A day field starting with * counts as unrestricted, so both have to match
+		{"0 0 */2 * 1", []time.Time{at(1, 0, 0), at(15, 0, 0)}, []time.Time{at(8, 0, 0), at(3, 0, 0)}},
+		{"0 0 * 2 *", nil, []time.Time{at(1, 0, 0)}},
+		{"@hourly", []time.Time{at(3, 7, 0)}, []time.Time{at(3, 7, 1)}},
+		{"@daily", []time.Time{at(3, 0, 0)}, []time.Time{at(3, 1, 0)}},
+		{"@weekly", []time.Time{at(7, 0, 0)}, []time.Time{at(1, 0, 0)}},
+		{"@monthly", []time.Time{at(1, 0, 0)}, []time.Time{at(2, 0, 0)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			for _, m := range tt.match {
+				if !s.matches(m) {
+					t.Errorf("%q doesn't match %s", tt.expr, m.Format(time.RFC1123))
+				}
+			}
+			for _, m := range tt.miss {
+				if s.matches(m) {
+					t.Errorf("%q matches %s", tt.expr, m.Format(time.RFC1123))
+				}
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"1,,2 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"-5 * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// DiskSpec - one entry of the "disks" array in the create request.
+// Exactly one of Path (attach an existing image) or SizeGB (create a new image) must be set.
+type DiskSpec struct {
+	SizeGB int    `json:"size_gb,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Bus    string `json:"bus,omitempty"`    // "virtio" (default), "scsi" (virtio-scsi) or "sata"
+	Format string `json:"format,omitempty"` // "qcow2" (default) or "raw"
+	Boot   bool   `json:"boot,omitempty"`   // boot from this disk; defaults to the first disk if none is marked
+	Cache  string `json:"cache,omitempty"`  // "none", "writeback", "writethrough" or "directsync"; hypervisor default if empty
+	IO     string `json:"io,omitempty"`     // "native" or "threads"; hypervisor default if empty
+
+	// Preallocation - "off" (default, sparse), "metadata" (qcow2 only), "falloc" or "full"
+	Preallocation string `json:"preallocation,omitempty"`
+
+	// Discard - "unmap" (default) passes guest TRIM through so thin images shrink, "ignore" drops it.
+	// DetectZeroes - "off", "on" or "unmap" (turn zero writes into discards; needs discard=unmap).
+	Discard      string `json:"discard,omitempty"`
+	DetectZeroes string `json:"detect_zeroes,omitempty"`
+
+	IOTune *DiskIOTune `json:"iotune,omitempty"`
+
+	Encryption *DiskEncryption `json:"encryption,omitempty"`
+
+	// BackingFile - qcow2 image the new disk is a copy-on-write overlay of.
+	// Set from the request's base_image for the root disk, never from the disks array itself.
+	BackingFile string `json:"-"`
+}
+
+// DiskIOTune - per-disk throttling, rendered as <iotune>. Zero means "no limit".
+// As in libvirt, a total_* limit cannot be combined with the matching read_*/write_* limits.
+type DiskIOTune struct {
+	TotalIOPSSec  uint64 `json:"total_iops_sec,omitempty"`
+	ReadIOPSSec   uint64 `json:"read_iops_sec,omitempty"`
+	WriteIOPSSec  uint64 `json:"write_iops_sec,omitempty"`
+	TotalBytesSec uint64 `json:"total_bytes_sec,omitempty"`
+	ReadBytesSec  uint64 `json:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64 `json:"write_bytes_sec,omitempty"`
+}
+
+// validate - reject combinations libvirt would refuse at define time
+func (t *DiskIOTune) validate() error {
+	if t.TotalIOPSSec > 0 && (t.ReadIOPSSec > 0 || t.WriteIOPSSec > 0) {
+		return fmt.Errorf("total_iops_sec cannot be combined with read_iops_sec/write_iops_sec")
+	}
+	if t.TotalBytesSec > 0 && (t.ReadBytesSec > 0 || t.WriteBytesSec > 0) {
+		return fmt.Errorf("total_bytes_sec cannot be combined with read_bytes_sec/write_bytes_sec")
+	}
+	return nil
+}
+
+// DiskEncryption - asks for an encrypted volume. All encrypted disks of a VM share one
+// libvirt secret, so they must agree on the passphrase (or all leave it out to have one generated).
+// Attaching an existing encrypted image needs its passphrase.
+type DiskEncryption struct {
+	Format     string `json:"format,omitempty"` // "luks" (default)
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// DiskDevice - represents a disk in the final domain XML
+type DiskDevice struct {
+	Dev       string // e.g., "vda", "sdb"
+	Bus       string // "virtio", "scsi" or "sata"
+	Format    string // driver type, e.g. "qcow2"
+	Type      string // "file", "block" or "network"
+	Path      string // path to image/device on host, for "file" and "block" disks
+	BootOrder int    // 0 means "not bootable"
+	Cache     string // driver cache mode, empty to leave it out
+	IO        string // driver io mode, empty to leave it out
+	IOTune    *DiskIOTune
+	IOThread  int // I/O thread of a virtio disk, 0 for none
+
+	Discard      string // "unmap" or "ignore"
+	DetectZeroes string // empty to leave it out
+
+	// Set for encrypted disks
+	Encryption string // e.g. "luks"
+	SecretUUID string
+
+	// Set for "network" disks, e.g. RBD images
+	Protocol   string
+	SourceName string // e.g. "<ceph pool>/<image>"
+	Hosts      []DiskHost
+	Auth       *DiskAuth
+}
+
+// DiskHost - a server a network disk is reached through (e.g. a Ceph monitor)
+type DiskHost struct {
+	Name string
+	Port string
+}
+
+// DiskAuth - credentials QEMU uses to open a network disk
+type DiskAuth struct {
+	Username   string
+	SecretUUID string // libvirt secret holding the key
+}
+
+// Device name prefixes per bus: virtio disks are vdX, SCSI and SATA disks (and the CD-ROM)
+// share the sdX namespace
+var busDevPrefix = map[string]string{
+	"virtio": "vd",
+	"scsi":   "sd",
+	"sata":   "sd",
+}
+
+var supportedDiskFormats = map[string]bool{
+	"qcow2": true,
+	"raw":   true,
+}
+
+var supportedCacheModes = map[string]bool{
+	"none":         true,
+	"writeback":    true,
+	"writethrough": true,
+	"directsync":   true,
+}
+
+var supportedPreallocation = map[string]bool{
+	"off":      true,
+	"metadata": true,
+	"falloc":   true,
+	"full":     true,
+}
+
+var supportedDiscardModes = map[string]bool{
+	"unmap":  true,
+	"ignore": true,
+}
+
+var supportedDetectZeroes = map[string]bool{
+	"off":   true,
+	"on":    true,
+	"unmap": true,
+}
+
+var supportedIOModes = map[string]bool{
+	"native":  true,
+	"threads": true,
+}
+
+// resolveDiskSpecs returns the disks the request asks for, with defaults filled in.
+//
+// Older clients send prebuilt_disk_path/disk_size_gb instead of a disks array; those are
+// translated into the equivalent array so both shapes go through the same code path:
+//   - prebuilt_disk_path only         => one existing root disk
+//   - disk_size_gb only               => one new root disk
+//   - prebuilt_disk_path + disk_size  => existing root disk + new data disk
+//
+// With base_image set, the first disk is a new linked clone of that image; its size_gb
+// may be left out, in which case it inherits the size of the base.
+func resolveDiskSpecs(req RequestData) ([]DiskSpec, error) {
+	specs := append([]DiskSpec(nil), req.Disks...)
+	if len(specs) == 0 {
+		if req.BaseImage != "" {
+			if req.PrebuiltDiskPath != "" {
+				return nil, fmt.Errorf("base_image cannot be combined with prebuilt_disk_path")
+			}
+			specs = append(specs, DiskSpec{SizeGB: req.DiskSizeGB})
+		} else if req.PrebuiltDiskPath != "" {
+			specs = append(specs, DiskSpec{Path: req.PrebuiltDiskPath})
+		}
+		if req.DiskSizeGB > 0 && req.BaseImage == "" {
+			specs = append(specs, DiskSpec{SizeGB: req.DiskSizeGB})
+		}
+	} else if req.PrebuiltDiskPath != "" || req.DiskSizeGB > 0 {
+		return nil, fmt.Errorf("disks cannot be combined with prebuilt_disk_path/disk_size_gb")
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("at least one disk is required")
+	}
+
+	if req.BaseImage != "" {
+		if specs[0].Path != "" {
+			return nil, fmt.Errorf("disk 0: base_image cannot be used with an existing path")
+		}
+		specs[0].BackingFile = req.BaseImage
+	}
+
+	resolved := make([]DiskSpec, len(specs))
+	var passphrase *string
+	for i, spec := range specs {
+		if spec.BackingFile != "" {
+			if spec.SizeGB < 0 {
+				return nil, fmt.Errorf("disk %d: size_gb must not be negative", i)
+			}
+		} else if (spec.Path == "") == (spec.SizeGB <= 0) {
+			return nil, fmt.Errorf("disk %d: exactly one of path or size_gb must be set", i)
+		}
+		if spec.Bus == "" {
+			spec.Bus = "virtio"
+		}
+		if _, ok := busDevPrefix[spec.Bus]; !ok {
+			return nil, fmt.Errorf("disk %d: unsupported bus %q", i, spec.Bus)
+		}
+		if spec.Format == "" {
+			spec.Format = "qcow2"
+		}
+		if !supportedDiskFormats[spec.Format] {
+			return nil, fmt.Errorf("disk %d: unsupported format %q", i, spec.Format)
+		}
+		// Only qcow2 can carry a backing file, a raw linked clone isn't a thing
+		if spec.BackingFile != "" && spec.Format != "qcow2" {
+			return nil, fmt.Errorf("disk %d: base_image requires format qcow2", i)
+		}
+		if spec.Cache != "" && !supportedCacheModes[spec.Cache] {
+			return nil, fmt.Errorf("disk %d: unsupported cache mode %q", i, spec.Cache)
+		}
+		if spec.IO != "" && !supportedIOModes[spec.IO] {
+			return nil, fmt.Errorf("disk %d: unsupported io mode %q", i, spec.IO)
+		}
+		// QEMU only does native AIO on O_DIRECT files, which means cache=none or directsync
+		if spec.IO == "native" && spec.Cache != "none" && spec.Cache != "directsync" {
+			return nil, fmt.Errorf("disk %d: io=native requires cache=none or directsync", i)
+		}
+		if spec.Preallocation != "" {
+			if !supportedPreallocation[spec.Preallocation] {
+				return nil, fmt.Errorf("disk %d: unsupported preallocation %q", i, spec.Preallocation)
+			}
+			if spec.Path != "" {
+				return nil, fmt.Errorf("disk %d: preallocation only applies to new disks", i)
+			}
+			if spec.Preallocation == "metadata" && spec.Format != "qcow2" {
+				return nil, fmt.Errorf("disk %d: preallocation=metadata requires format qcow2", i)
+			}
+		}
+		if spec.Discard == "" {
+			spec.Discard = "unmap"
+		}
+		if !supportedDiscardModes[spec.Discard] {
+			return nil, fmt.Errorf("disk %d: unsupported discard mode %q", i, spec.Discard)
+		}
+		if spec.DetectZeroes != "" && !supportedDetectZeroes[spec.DetectZeroes] {
+			return nil, fmt.Errorf("disk %d: unsupported detect_zeroes mode %q", i, spec.DetectZeroes)
+		}
+		if spec.DetectZeroes == "unmap" && spec.Discard != "unmap" {
+			return nil, fmt.Errorf("disk %d: detect_zeroes=unmap requires discard=unmap", i)
+		}
+		if spec.IOTune != nil {
+			if err := spec.IOTune.validate(); err != nil {
+				return nil, fmt.Errorf("disk %d: iotune: %v", i, err)
+			}
+		}
+		if enc := spec.Encryption; enc != nil {
+			if enc.Format == "" {
+				enc.Format = "luks"
+			}
+			if enc.Format != "luks" {
+				return nil, fmt.Errorf("disk %d: unsupported encryption format %q", i, enc.Format)
+			}
+			if spec.Path != "" && enc.Passphrase == "" {
+				return nil, fmt.Errorf("disk %d: passphrase is required to attach an existing encrypted disk", i)
+			}
+			if passphrase != nil && *passphrase != enc.Passphrase {
+				return nil, fmt.Errorf("disk %d: all encrypted disks must use the same passphrase", i)
+			}
+			passphrase = &enc.Passphrase
+		}
+		resolved[i] = spec
+	}
+	return resolved, nil
+}
+
+// prepareDisks creates any new volumes the specs ask for through backend and returns the
+// devices to put into the domain XML. firstBootOrder is the boot order given to the first
+// bootable disk (the CD-ROM, if any, boots before the disks). The secret and every volume
+// it creates are added to rb, so a failure here or later in the create removes them again.
+func prepareDisks(conn *libvirt.Connect, backend storageBackend, vmName string, specs []DiskSpec, firstBootOrder int, rb *rollback) ([]DiskDevice, error) {
+	secretUUID, err := defineSecretForDisks(conn, vmName, specs)
+	if err != nil {
+		return nil, err
+	}
+	if secretUUID != "" {
+		rb.add(func() { undefineSecret(conn, secretUUID) })
+	}
+
+	return layoutDisks(specs, firstBootOrder, secretUUID, func(i int, spec DiskSpec, dev string) (DiskDevice, error) {
+		if spec.Path != "" {
+			log.Printf("Using existing disk %s as %s", spec.Path, dev)
+			return DiskDevice{Type: "file", Path: spec.Path}, nil
+		}
+		volName := newVolumeName(vmName, i, spec.Format)
+		disk, err := backend.createVolume(volName, spec, secretUUID)
+		if err != nil {
+			return disk, err
+		}
+		poolName := backend.name()
+		rb.add(func() { deletePoolVolume(conn, poolName, volName) })
+		return disk, nil
+	})
+}
+
+// planDisks returns the devices prepareDisks would, without creating any volume or the
+// secret. Encrypted disks reference a made-up secret UUID.
+func planDisks(backend storageBackend, vmName string, specs []DiskSpec, firstBootOrder int) ([]DiskDevice, error) {
+	var secretUUID string
+	for _, spec := range specs {
+		if spec.Encryption != nil {
+			secretUUID = uuid.New().String()
+			break
+		}
+	}
+	return layoutDisks(specs, firstBootOrder, secretUUID, func(i int, spec DiskSpec, dev string) (DiskDevice, error) {
+		if spec.Path != "" {
+			return DiskDevice{Type: "file", Path: spec.Path}, nil
+		}
+		return backend.plannedVolume(newVolumeName(vmName, i, spec.Format), spec)
+	})
+}
+
+// layoutDisks names, orders and configures the devices for specs; source gives each disk
+// its source fields (Type, Path or network source)
+func layoutDisks(specs []DiskSpec, firstBootOrder int, secretUUID string, source func(i int, spec DiskSpec, dev string) (DiskDevice, error)) ([]DiskDevice, error) {
+	anyBoot := false
+	for _, spec := range specs {
+		anyBoot = anyBoot || spec.Boot
+	}
+
+	var disks []DiskDevice
+	prefixCount := map[string]int{}
+	bootOrder := firstBootOrder
+
+	for i, spec := range specs {
+		prefix := busDevPrefix[spec.Bus]
+		dev, err := diskDevName(prefix, prefixCount[prefix])
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: %v", i, err)
+		}
+		prefixCount[prefix]++
+
+		disk, err := source(i, spec, dev)
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: %v", i, err)
+		}
+
+		disk.Dev = dev
+		disk.Bus = spec.Bus
+		disk.Format = spec.Format
+		disk.Cache = spec.Cache
+		disk.IO = spec.IO
+		disk.IOTune = spec.IOTune
+		disk.Discard = spec.Discard
+		disk.DetectZeroes = spec.DetectZeroes
+		if spec.Encryption != nil {
+			disk.Encryption = spec.Encryption.Format
+			disk.SecretUUID = secretUUID
+		}
+		if spec.Boot || (!anyBoot && i == 0) {
+			disk.BootOrder = bootOrder
+			bootOrder++
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// defineSecretForDisks registers the VM's disk encryption secret if any disk is encrypted,
+// returning "" otherwise. resolveDiskSpecs has already made sure the passphrases agree.
+func defineSecretForDisks(conn *libvirt.Connect, vmName string, specs []DiskSpec) (string, error) {
+	for _, spec := range specs {
+		if spec.Encryption == nil {
+			continue
+		}
+		passphrase := []byte(spec.Encryption.Passphrase)
+		if len(passphrase) == 0 {
+			var err error
+			if passphrase, err = generatePassphrase(); err != nil {
+				return "", fmt.Errorf("failed to generate disk passphrase: %v", err)
+			}
+		}
+		return defineDiskSecret(conn, vmName, passphrase)
+	}
+	return "", nil
+}
+
+// countPrefixDisks - how many disks in the list use the given device name prefix
+func countPrefixDisks(disks []DiskDevice, prefix string) int {
+	n := 0
+	for _, d := range disks {
+		if busDevPrefix[d.Bus] == prefix {
+			n++
+		}
+	}
+	return n
+}
+
+// hasBusDisk - whether any disk in the list sits on the given bus
+func hasBusDisk(disks []DiskDevice, bus string) bool {
+	for _, d := range disks {
+		if d.Bus == bus {
+			return true
+		}
+	}
+	return false
+}
+
+// newVolumeName - volume name for the i-th newly created disk of a VM, with the format
+// as extension. The first qcow2 disk keeps the historical "<name>.qcow2" name.
+func newVolumeName(vmName string, index int, format string) string {
+	if index == 0 {
+		return fmt.Sprintf("%s.%s", vmName, format)
+	}
+	return fmt.Sprintf("%s-disk%d.%s", vmName, index, format)
+}
+
+// diskDevName turns a prefix and index into a target dev, e.g. ("vd", 1) => "vdb"
+func diskDevName(prefix string, index int) (string, error) {
+	if index >= 26 {
+		return "", fmt.Errorf("too many disks on %sX bus", prefix)
+	}
+	return fmt.Sprintf("%s%c", prefix, 'a'+index), nil
+}
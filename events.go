@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// VMEvent - a domain lifecycle change reported by libvirt
+type VMEvent struct {
+	ID     uint64    `json:"id" pb:"1"`
+	Time   time.Time `json:"time" pb:"2"`
+	Host   string    `json:"host" pb:"3"`
+	VM     string    `json:"vm" pb:"4"`
+	Type   string    `json:"type" pb:"5"`             // "defined", "undefined", "started", "paused", "resumed", "stopped", "crashed", "migrated" or "pmsuspended"
+	Reason string    `json:"reason,omitempty" pb:"6"` // libvirt's detail, e.g. "booted", "shutdown", "destroyed"
+}
+
+const (
+	eventHistorySize   = 256
+	eventSubscriberBuf = 64
+	eventRetryInterval = 10 * time.Second
+	eventHeartbeat     = 30 * time.Second
+)
+
+// eventBus fans lifecycle events out to subscribers, keeping the most recent ones so
+// a client that reconnects with Last-Event-ID doesn't miss any
+var eventBus = struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []VMEvent
+	subs    map[chan VMEvent]struct{}
+}{subs: map[chan VMEvent]struct{}{}}
+
+// publishEvent numbers the event and hands it to every subscriber. A subscriber whose
+// buffer is full misses the event rather than holding up libvirt's event loop.
+func publishEvent(ev VMEvent) {
+	eventBus.mu.Lock()
+	defer eventBus.mu.Unlock()
+
+	eventBus.nextID++
+	ev.ID = eventBus.nextID
+	eventBus.history = append(eventBus.history, ev)
+	if len(eventBus.history) > eventHistorySize {
+		eventBus.history = eventBus.history[len(eventBus.history)-eventHistorySize:]
+	}
+	for ch := range eventBus.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribeEvents returns a channel of new events, together with the retained events
+// after ID since (none if since is 0)
+func subscribeEvents(since uint64) (chan VMEvent, []VMEvent) {
+	eventBus.mu.Lock()
+	defer eventBus.mu.Unlock()
+
+	ch := make(chan VMEvent, eventSubscriberBuf)
+	eventBus.subs[ch] = struct{}{}
+	var missed []VMEvent
+	if since > 0 {
+		for _, ev := range eventBus.history {
+			if ev.ID > since {
+				missed = append(missed, ev)
+			}
+		}
+	}
+	return ch, missed
+}
+
+func unsubscribeEvents(ch chan VMEvent) {
+	eventBus.mu.Lock()
+	defer eventBus.mu.Unlock()
+	delete(eventBus.subs, ch)
+}
+
+// startEventLoop registers libvirt's default event loop implementation and runs it.
+// It must be called before the first connection is opened, or that connection won't
+// deliver events.
+func startEventLoop() error {
+	if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := libvirt.EventRunDefaultImpl(); err != nil {
+				log.Printf("libvirt event loop: %v", err)
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchHostEvents keeps a connection to the host open for lifecycle callbacks,
+// reconnecting whenever it drops, until the service shuts down
+func watchHostEvents(host string) {
+	defer eventWatchers.Done()
+	for {
+		if err := watchHostEventsOnce(host); err != nil {
+			log.Printf("Events from host %s: %v, retrying in %s", host, err, eventRetryInterval)
+		}
+		select {
+		case <-serverStopping:
+			return
+		case <-time.After(eventRetryInterval):
+		}
+	}
+}
+
+func watchHostEventsOnce(host string) error {
+	conn, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Keepalives make a dead remote host show up as a closed connection
+	if err := conn.SetKeepAlive(5, 3); err != nil {
+		return err
+	}
+	closed := make(chan libvirt.ConnectCloseReason, 1)
+	if err := conn.RegisterCloseCallback(func(_ *libvirt.Connect, reason libvirt.ConnectCloseReason) {
+		select {
+		case closed <- reason:
+		default:
+		}
+	}); err != nil {
+		return err
+	}
+	defer func() { _ = conn.UnregisterCloseCallback() }()
+
+	id, err := conn.DomainEventLifecycleRegister(nil, func(_ *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventLifecycle) {
+		name, err := d.GetName()
+		if err != nil {
+			return
+		}
+		evType, reason := lifecycleEventNames(e)
+		if evType == "" {
+			return
+		}
+		publishEvent(VMEvent{Time: time.Now().UTC(), Host: hostName(host), VM: name, Type: evType, Reason: reason})
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.DomainEventDeregister(id) }()
+
+	log.Printf("Watching lifecycle events on host %s", hostName(host))
+	select {
+	case reason := <-closed:
+		return fmt.Errorf("connection closed (reason %d)", reason)
+	case <-serverStopping:
+		return nil
+	}
+}
+
+// lifecycleEventNames maps a libvirt lifecycle event onto the service's event type and
+// reason. A stop caused by a crash or by migrating away is reported as such rather than
+// as "stopped". Shutdown events are skipped: the stop that follows says the same.
+func lifecycleEventNames(e *libvirt.DomainEventLifecycle) (string, string) {
+	switch e.Event {
+	case libvirt.DOMAIN_EVENT_DEFINED:
+		switch libvirt.DomainEventDefinedDetailType(e.Detail) {
+		case libvirt.DOMAIN_EVENT_DEFINED_ADDED:
+			return "defined", "added"
+		case libvirt.DOMAIN_EVENT_DEFINED_RENAMED:
+			return "defined", "renamed"
+		case libvirt.DOMAIN_EVENT_DEFINED_FROM_SNAPSHOT:
+			return "defined", "from_snapshot"
+		}
+		return "defined", "updated"
+	case libvirt.DOMAIN_EVENT_UNDEFINED:
+		if libvirt.DomainEventUndefinedDetailType(e.Detail) == libvirt.DOMAIN_EVENT_UNDEFINED_RENAMED {
+			return "undefined", "renamed"
+		}
+		return "undefined", "removed"
+	case libvirt.DOMAIN_EVENT_STARTED:
+		switch libvirt.DomainEventStartedDetailType(e.Detail) {
+		case libvirt.DOMAIN_EVENT_STARTED_MIGRATED:
+			return "started", "migrated"
+		case libvirt.DOMAIN_EVENT_STARTED_RESTORED:
+			return "started", "restored"
+		case libvirt.DOMAIN_EVENT_STARTED_FROM_SNAPSHOT:
+			return "started", "from_snapshot"
+		case libvirt.DOMAIN_EVENT_STARTED_WAKEUP:
+			return "started", "wakeup"
+		}
+		return "started", "booted"
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		switch libvirt.DomainEventSuspendedDetailType(e.Detail) {
+		case libvirt.DOMAIN_EVENT_SUSPENDED_MIGRATED, libvirt.DOMAIN_EVENT_SUSPENDED_POSTCOPY:
+			return "paused", "migrating"
+		case libvirt.DOMAIN_EVENT_SUSPENDED_IOERROR:
+			return "paused", "io_error"
+		case libvirt.DOMAIN_EVENT_SUSPENDED_WATCHDOG:
+			return "paused", "watchdog"
+		}
+		return "paused", "paused"
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		if libvirt.DomainEventResumedDetailType(e.Detail) == libvirt.DOMAIN_EVENT_RESUMED_MIGRATED {
+			return "resumed", "migrated"
+		}
+		return "resumed", "unpaused"
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		switch libvirt.DomainEventStoppedDetailType(e.Detail) {
+		case libvirt.DOMAIN_EVENT_STOPPED_CRASHED:
+			return "crashed", "crashed"
+		case libvirt.DOMAIN_EVENT_STOPPED_FAILED:
+			return "crashed", "failed"
+		case libvirt.DOMAIN_EVENT_STOPPED_MIGRATED:
+			return "migrated", "migrated"
+		case libvirt.DOMAIN_EVENT_STOPPED_DESTROYED:
+			return "stopped", "destroyed"
+		case libvirt.DOMAIN_EVENT_STOPPED_SAVED:
+			return "stopped", "saved"
+		case libvirt.DOMAIN_EVENT_STOPPED_FROM_SNAPSHOT:
+			return "stopped", "from_snapshot"
+		}
+		return "stopped", "shutdown"
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		return "crashed", "panicked"
+	case libvirt.DOMAIN_EVENT_PMSUSPENDED:
+		return "pmsuspended", ""
+	}
+	return "", ""
+}
+
+// eventFilter - the events one subscriber asked for and may see; vm is the libvirt name
+type eventFilter struct {
+	scope            tenantScope
+	host, vm, evType string
+}
+
+// apply says whether the subscriber gets the event, and returns it with the VM named as
+// the subscriber knows it
+func (f eventFilter) apply(ev VMEvent) (VMEvent, bool) {
+	if (f.host != "" && ev.Host != f.host) || (f.vm != "" && ev.VM != f.vm) || (f.evType != "" && ev.Type != f.evType) {
+		return ev, false
+	}
+	// Going by name: the domain of an undefined event is gone, metadata and all
+	if !f.scope.ownsName(ev.VM) {
+		return ev, false
+	}
+	ev.VM = f.scope.vmName(ev.VM)
+	return ev, true
+}
+
+// handleEvents - GET /api/v1/events[?host=&vm=&type=]
+// Streams lifecycle events as server-sent events, one "data:" JSON object per event with
+// the event ID as the SSE id. Without host, events from every host are sent. A client
+// reconnecting with Last-Event-ID gets the events it missed, as far as the service still
+// remembers them. Callers in a project only get the events of the project's VMs.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorResponse(w, "Streaming is not supported")
+		return
+	}
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	host, vm, evType := q.Get("host"), q.Get("vm"), q.Get("type")
+	if vm != "" {
+		vm = scope.domainName(vm)
+	}
+	var since uint64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		since, _ = strconv.ParseUint(v, 10, 64)
+	}
+
+	ch, missed := subscribeEvents(since)
+	defer unsubscribeEvents(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	filter := eventFilter{scope: scope, host: host, vm: vm, evType: evType}
+	send := func(ev VMEvent) error {
+		ev, ok := filter.apply(ev)
+		if !ok {
+			return nil
+		}
+		data, _ := json.Marshal(ev)
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		return err
+	}
+	for _, ev := range missed {
+		if send(ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-serverStopping:
+			return
+		case ev := <-ch:
+			if send(ev) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// Comment line, keeps proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// An export bundle is a tar archive (gzipped when compressed) holding
+//
+//	manifest.json     bundleManifest
+//	domain.xml        the inactive domain definition
+//	disks/<dev>.<fmt> one standalone image per disk, backing chains flattened
+const (
+	bundleManifestFile = "manifest.json"
+	bundleDomainFile   = "domain.xml"
+	bundleDiskDir      = "disks/"
+)
+
+// ExportRequest - incoming JSON for POST /api/v1/vm/{name}/export.
+// Without target_dir the bundle is streamed back as the response body.
+type ExportRequest struct {
+	TargetDir string `json:"target_dir,omitempty"`
+	Compress  bool   `json:"compress,omitempty"`
+}
+
+// bundleManifest - describes what an export bundle contains
+type bundleManifest struct {
+	Name       string       `json:"name"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Disks      []bundleDisk `json:"disks"`
+}
+
+type bundleDisk struct {
+	Target string `json:"target"` // device name in the domain, e.g. "vda"
+	File   string `json:"file"`   // path inside the bundle
+	Format string `json:"format"`
+	Source string `json:"source"` // path on the exporting host, rewritten on import
+}
+
+// exportDisk - a disk to write into the bundle, read from path
+type exportDisk struct {
+	bundleDisk
+	path string
+	size int64
+}
+
+// handleExportVM - POST /api/v1/vm/{name}/export
+// The VM must be shut off so the disks are consistent. With target_dir the bundle is
+// written there in the background and the answer is 202 with the job to poll; otherwise
+// it is streamed as application/x-tar (or application/gzip when compressed).
+func handleExportVM(w http.ResponseWriter, r *http.Request) {
+	if !isLocalHost(requestHost(r)) {
+		http.Error(w, "Export reads the disks directly and is only supported on local hosts", http.StatusBadRequest)
+		return
+	}
+	var req ExportRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.TargetDir != "" && !filepath.IsAbs(req.TargetDir) {
+		http.Error(w, "target_dir must be an absolute path", http.StatusBadRequest)
+		return
+	}
+	if req.TargetDir != "" {
+		if err := validatePath("target_dir", req.TargetDir, true); err != nil {
+			writeErrorStatus(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		state, err := domainState(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if state != "shutoff" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is %s, shut it down before exporting", r.PathValue("name"), state))
+			return
+		}
+
+		desc, err := dom.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE | libvirt.DOMAIN_XML_SECURE)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		def, err := parseDomainDef(desc)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to parse domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		var disks []bundleDisk
+		for _, disk := range def.Devices.Disks {
+			if disk.Device != "disk" {
+				continue
+			}
+			if disk.Type != "file" && disk.Type != "block" {
+				writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("%s: exporting %s disks is not supported", disk.Target.Dev, disk.Type))
+				return
+			}
+			format := disk.Driver.Type
+			if format == "" {
+				format = "raw"
+			}
+			disks = append(disks, bundleDisk{
+				Target: disk.Target.Dev,
+				File:   bundleDiskDir + disk.Target.Dev + "." + format,
+				Format: format,
+				Source: disk.sourcePath(),
+			})
+		}
+		manifest := bundleManifest{Name: def.Name, ExportedAt: time.Now().UTC(), Disks: disks}
+
+		if req.TargetDir == "" {
+			ext, contentType := ".tar", "application/x-tar"
+			if req.Compress {
+				ext, contentType = ".tar.gz", "application/gzip"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", def.Name+ext))
+			if err := writeBundle(w, manifest, desc, req.Compress, nil); err != nil {
+				// Headers are gone, all we can do is cut the stream short
+				requestLog(r).Error(fmt.Sprintf("Export of %s failed mid-stream: %v", def.Name, err))
+				panic(http.ErrAbortHandler)
+			}
+			requestLog(r).Info(fmt.Sprintf("Exported VM %s to HTTP client", def.Name))
+			return
+		}
+
+		job := startJob("vm-export", requestProject(r), def.Name, func(j *jobHandle) (interface{}, error) {
+			return exportToDir(j, manifest, desc, req)
+		})
+		writeJobAccepted(w, job)
+	})
+}
+
+// handleGetExport - GET /api/v1/vm/{name}/exports/{id}
+func handleGetExport(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r, "vm-export")
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Export %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// exportToDir writes the bundle to <target_dir>/<vm>-<timestamp>.tar[.gz] via a temporary
+// file, so a failed export doesn't leave a truncated bundle behind
+func exportToDir(j *jobHandle, manifest bundleManifest, domainXML string, req ExportRequest) (interface{}, error) {
+	if err := os.MkdirAll(req.TargetDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", req.TargetDir, err)
+	}
+	name := fmt.Sprintf("%s-%s.tar", manifest.Name, manifest.ExportedAt.Format("20060102T150405Z"))
+	if req.Compress {
+		name += ".gz"
+	}
+	dest := filepath.Join(req.TargetDir, name)
+
+	tmp, err := os.CreateTemp(req.TargetDir, ".export-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := writeBundle(tmp, manifest, domainXML, req.Compress, j); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, err
+	}
+	log.Printf("Exported VM %s to %s", manifest.Name, dest)
+	return map[string]string{"path": dest}, nil
+}
+
+// writeBundle writes the tar archive to out. Disks with a backing chain are flattened with
+// qemu-img into a temporary file first, so the bundle doesn't depend on images that only
+// exist on this host. When j is set it receives progress as a share of the disk bytes written.
+func writeBundle(out io.Writer, manifest bundleManifest, domainXML string, compress bool, j *jobHandle) error {
+	tmpDir, err := os.MkdirTemp("", "vm-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var disks []exportDisk
+	var total int64
+	for _, d := range manifest.Disks {
+		ed, err := prepareExportDisk(d, tmpDir)
+		if err != nil {
+			return err
+		}
+		disks = append(disks, ed)
+		total += ed.size
+	}
+
+	if compress {
+		gz := gzip.NewWriter(out)
+		defer gz.Close()
+		out = gz
+	}
+	tw := tar.NewWriter(out)
+
+	manifestDoc, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, bundleManifestFile, manifestDoc); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, bundleDomainFile, []byte(domainXML)); err != nil {
+		return err
+	}
+
+	var written int64
+	for _, d := range disks {
+		f, err := os.Open(d.path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: d.File, Mode: 0o644, Size: d.size, ModTime: manifest.ExportedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		var dst io.Writer = tw
+		if j != nil && total > 0 {
+			dst = progressWriter{w: tw, done: &written, total: total, job: j}
+		}
+		_, err = io.CopyN(dst, f, d.size)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", d.File, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz, ok := out.(*gzip.Writer); ok {
+		return gz.Close()
+	}
+	return nil
+}
+
+// prepareExportDisk finds out what to read for one disk and how big it is. qcow2 images
+// with a backing file are flattened into tmpDir; everything else is read in place.
+func prepareExportDisk(d bundleDisk, tmpDir string) (exportDisk, error) {
+	ed := exportDisk{bundleDisk: d, path: d.Source}
+	if d.Format == "qcow2" {
+		backing, _, err := qemuImgBacking(d.Source)
+		if err != nil {
+			return ed, err
+		}
+		if backing != "" {
+			flat := filepath.Join(tmpDir, strings.TrimPrefix(d.File, bundleDiskDir))
+			log.Printf("Flattening %s for export", d.Source)
+			if out, err := exec.Command(qemuImgPath, "convert", "-O", "qcow2", d.Source, flat).CombinedOutput(); err != nil {
+				return ed, fmt.Errorf("qemu-img convert %s failed: %v, output: %s", d.Source, err, out)
+			}
+			ed.path = flat
+		}
+	}
+
+	// Seek rather than Stat so block devices report their real size
+	f, err := os.Open(ed.path)
+	if err != nil {
+		return ed, err
+	}
+	defer f.Close()
+	ed.size, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return ed, fmt.Errorf("failed to get size of %s: %v", ed.path, err)
+	}
+	return ed, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: time.Now().UTC()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// progressWriter reports done/total on the job as bytes pass through
+type progressWriter struct {
+	w     io.Writer
+	done  *int64
+	total int64
+	job   *jobHandle
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	*p.done += int64(n)
+	p.job.setProgress(float64(*p.done) * 100 / float64(p.total))
+	return n, err
+}
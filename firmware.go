@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+)
+
+// VMs boot SeaBIOS unless the create asks for "firmware": "uefi", which gives them OVMF
+// and an NVRAM file of their own for the UEFI variables. libvirt makes the NVRAM from
+// the vars template on first start, and a delete removes it with the domain
+// (DOMAIN_UNDEFINE_NVRAM). The paths are the hypervisor's, which is where libvirt
+// reads them.
+//
+// "secure_boot": true takes the Secure Boot build of OVMF instead, which needs SMM so
+// the guest can't write the variables behind the firmware's back, and starts from vars
+// with Microsoft's keys enrolled, which Windows and the shim of signed Linux images
+// need.
+
+// Firmware files and the NVRAM directory, from VM_SERVICE_OVMF_CODE, VM_SERVICE_OVMF_VARS
+// and VM_SERVICE_NVRAM_DIR; the defaults are Debian's and libvirt's
+var (
+	ovmfCodePath = envOrDefault("VM_SERVICE_OVMF_CODE", "/usr/share/OVMF/OVMF_CODE_4M.fd")
+	ovmfVarsPath = envOrDefault("VM_SERVICE_OVMF_VARS", "/usr/share/OVMF/OVMF_VARS_4M.fd")
+	nvramDir     = envOrDefault("VM_SERVICE_NVRAM_DIR", "/var/lib/libvirt/qemu/nvram")
+
+	// VM_SERVICE_OVMF_SECBOOT_CODE, VM_SERVICE_OVMF_SECBOOT_VARS
+	ovmfSecureCodePath = envOrDefault("VM_SERVICE_OVMF_SECBOOT_CODE", "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd")
+	ovmfSecureVarsPath = envOrDefault("VM_SERVICE_OVMF_SECBOOT_VARS", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd")
+)
+
+var supportedFirmware = map[string]bool{
+	"bios": true,
+	"uefi": true,
+}
+
+// UEFIFirmware - the loader and NVRAM of a UEFI VM, for the template
+type UEFIFirmware struct {
+	Loader       string // read-only firmware code
+	VarsTemplate string // what the NVRAM starts as
+	NVRAM        string // the VM's own variables
+	Secure       bool   // Secure Boot, with SMM
+}
+
+// nvramPath - the NVRAM file of a UEFI VM
+func nvramPath(vmName string) string {
+	return filepath.Join(nvramDir, vmName+"_VARS.fd")
+}
+
+// validateFirmware checks the request's firmware, empty meaning BIOS, and that Secure
+// Boot only comes with UEFI
+func validateFirmware(req RequestData) error {
+	if req.Firmware != "" && !supportedFirmware[req.Firmware] {
+		return fmt.Errorf("unsupported firmware %q, must be bios or uefi", req.Firmware)
+	}
+	if req.SecureBoot && req.Firmware != "uefi" {
+		return fmt.Errorf("secure_boot requires firmware uefi")
+	}
+	return nil
+}
+
+// uefiFirmware - the template's UEFI data for the request, nil if it boots BIOS
+func uefiFirmware(req RequestData) *UEFIFirmware {
+	if req.Firmware != "uefi" {
+		return nil
+	}
+	if req.SecureBoot {
+		return &UEFIFirmware{Loader: ovmfSecureCodePath, VarsTemplate: ovmfSecureVarsPath, NVRAM: nvramPath(req.Name), Secure: true}
+	}
+	return &UEFIFirmware{Loader: ovmfCodePath, VarsTemplate: ovmfVarsPath, NVRAM: nvramPath(req.Name)}
+}
+
+// replaceNVRAM points a UEFI domain's NVRAM at VM name's own file, so a copy of the
+// domain doesn't share the original's variables. The copy starts from the vars
+// template; boot entries the original's guest added are not carried over.
+func replaceNVRAM(desc, name string) string {
+	var pathBuf bytes.Buffer
+	_ = xml.EscapeText(&pathBuf, []byte(nvramPath(name)))
+	return nvramPattern.ReplaceAllStringFunc(desc, func(m string) string {
+		return "<nvram" + nvramPattern.FindStringSubmatch(m)[1] + ">" + pathBuf.String() + "</nvram>"
+	})
+}
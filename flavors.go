@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Flavor - a preset VM size a create can name instead of spelling it out, as
+// "flavor": "m1.large". Whatever the request sets itself wins over the flavor.
+type Flavor struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	CPUs        int    `json:"cpus"`
+	MemoryMB    int    `json:"memory_mb"`
+
+	// Disks - the VM's disks when the request has none; new disks only, the first one
+	// carrying the base image if the request has one
+	Disks []DiskSpec `json:"disks,omitempty"`
+
+	// NICModel - model of the NICs the request doesn't give one
+	NICModel string `json:"nic_model,omitempty"`
+
+	// Template - the domain template variant when the request names none, see templates.go
+	Template string `json:"template,omitempty"`
+}
+
+// defaultFlavors - the flavors until the catalog is first changed or the file written
+var defaultFlavors = []Flavor{
+	{Name: "m1.small", CPUs: 1, MemoryMB: 2048, Disks: []DiskSpec{{SizeGB: 20}}},
+	{Name: "m1.medium", CPUs: 2, MemoryMB: 4096, Disks: []DiskSpec{{SizeGB: 40}}},
+	{Name: "m1.large", CPUs: 4, MemoryMB: 8192, Disks: []DiskSpec{{SizeGB: 80}}},
+}
+
+// flavorStore - the flavor catalog by name, persisted as JSON. The file can be written
+// by hand or by configuration management as well as through the API; it is read at
+// startup.
+type flavorStore struct {
+	mu      sync.Mutex
+	path    string
+	flavors map[string]Flavor
+}
+
+var flavors = &flavorStore{
+	path:    envOrDefault("VM_SERVICE_FLAVORS_FILE", filepath.Join(stateDir, "flavors.json")),
+	flavors: map[string]Flavor{},
+}
+
+// load reads the flavors file; without one the catalog holds defaultFlavors
+func (s *flavorStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := defaultFlavors
+	content, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		list = nil
+		if err := json.Unmarshal(content, &list); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", s.path, err)
+		}
+	}
+	for _, f := range list {
+		if err := validateFlavor(f); err != nil {
+			return fmt.Errorf("%s: flavor %q: %v", s.path, f.Name, err)
+		}
+		s.flavors[f.Name] = f
+	}
+	return nil
+}
+
+// saveLocked writes the flavors atomically; s.mu must be held
+func (s *flavorStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns the flavors ordered by name
+func (s *flavorStore) listLocked() []Flavor {
+	out := []Flavor{}
+	for _, f := range s.flavors {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *flavorStore) list() []Flavor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *flavorStore) get(name string) (Flavor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.flavors[name]
+	return f, ok
+}
+
+func (s *flavorStore) put(f Flavor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flavors[f.Name] = f
+	return s.saveLocked()
+}
+
+func (s *flavorStore) remove(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.flavors[name]; !ok {
+		return false, nil
+	}
+	delete(s.flavors, name)
+	return true, s.saveLocked()
+}
+
+// validateFlavor checks a flavor as far as it can be without a request: its disks must
+// be new ones, as a path would be shared by every VM of the flavor, and hold no secrets
+func validateFlavor(f Flavor) error {
+	if !vmNamePattern.MatchString(f.Name) {
+		return fmt.Errorf("name %q must be 1-63 letters, digits, '.', '_' or '-', starting with a letter or digit", f.Name)
+	}
+	if f.CPUs <= 0 || f.MemoryMB <= 0 {
+		return fmt.Errorf("cpus and memory_mb must be > 0")
+	}
+	for i, d := range f.Disks {
+		if d.Path != "" {
+			return fmt.Errorf("disk %d: flavors can only have new disks, not a path", i)
+		}
+		if d.Encryption != nil && d.Encryption.Passphrase != "" {
+			return fmt.Errorf("disk %d: flavors cannot hold a passphrase", i)
+		}
+	}
+	if len(f.Disks) > 0 {
+		specs, err := resolveDiskSpecs(RequestData{Disks: f.Disks})
+		if err != nil {
+			return err
+		}
+		if err := validateCreateLimits(RequestData{CPUs: f.CPUs, MemoryMB: f.MemoryMB}, specs); err != nil {
+			return err
+		}
+	}
+	if f.NICModel != "" && !supportedNICModels[f.NICModel] {
+		return fmt.Errorf("unsupported nic_model %q", f.NICModel)
+	}
+	if f.Template != "" {
+		if _, err := lookupTemplate(f.Template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFlavor fills in what the request leaves out from the flavor it names
+func applyFlavor(req *RequestData) error {
+	if req.Flavor == "" {
+		return nil
+	}
+	f, ok := flavors.get(req.Flavor)
+	if !ok {
+		return fmt.Errorf("unknown flavor %q, see GET /api/v1/flavors", req.Flavor)
+	}
+	if req.CPUs == 0 {
+		req.CPUs = f.CPUs
+	}
+	if req.MemoryMB == 0 {
+		req.MemoryMB = f.MemoryMB
+	}
+	if len(req.Disks) == 0 && req.PrebuiltDiskPath == "" && req.DiskSizeGB == 0 {
+		req.Disks = append([]DiskSpec(nil), f.Disks...)
+	}
+	if f.NICModel != "" {
+		if len(req.NICs) == 0 {
+			req.NICs = []NICSpec{{}}
+		} else {
+			req.NICs = append([]NICSpec(nil), req.NICs...)
+		}
+		for i := range req.NICs {
+			if req.NICs[i].Model == "" && req.NICs[i].SRIOV == nil {
+				req.NICs[i].Model = f.NICModel
+			}
+		}
+	}
+	if req.Template == "" {
+		req.Template = f.Template
+	}
+	return nil
+}
+
+// handleListFlavors - GET /api/v1/flavors
+func handleListFlavors(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, flavors.list())
+}
+
+// handleGetFlavor - GET /api/v1/flavors/{name}
+func handleGetFlavor(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	f, ok := flavors.get(name)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Flavor %q not found", name))
+		return
+	}
+	writeDataResponse(w, f)
+}
+
+// handlePutFlavor - PUT /api/v1/flavors/{name}
+// Creates or replaces the flavor. VMs already made from it keep what they were given.
+func handlePutFlavor(w http.ResponseWriter, r *http.Request) {
+	var f Flavor
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	f.Name = r.PathValue("name")
+	if err := validateFlavor(f); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid flavor: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := flavors.put(f); err != nil {
+		errMsg := fmt.Sprintf("Failed to save flavors: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Set flavor %s: %d vCPUs, %d MiB, %d disks", f.Name, f.CPUs, f.MemoryMB, len(f.Disks)))
+	writeDataResponse(w, f)
+}
+
+// handleDeleteFlavor - DELETE /api/v1/flavors/{name}
+func handleDeleteFlavor(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	removed, err := flavors.remove(name)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to save flavors: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Flavor %q not found", name))
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Removed flavor %s", name))
+	writeSuccessResponse(w, fmt.Sprintf("Flavor %s removed", name))
+}
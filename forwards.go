@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Chains holding our rules, hooked into the built-in ones by ensureForwardChains. Owning
+// whole chains lets applyPortForwards rebuild them from the store in one go.
+const (
+	forwardNATChain    = "VMSVC-DNAT"
+	forwardFilterChain = "VMSVC-FWD"
+)
+
+// forwardPorts - the host ports forwards may take, from VM_SERVICE_FORWARD_PORTS
+// ("first-last"), kept clear of the ports the host's own services such as sshd and this
+// one listen on
+var forwardPorts, _ = parsePortRange(envOrDefault("VM_SERVICE_FORWARD_PORTS", "20000-29999"))
+
+// portRange - host ports first to last, inclusive
+type portRange struct{ first, last int }
+
+// PortForward - a host port forwarded to a port on a VM behind a NAT network
+type PortForward struct {
+	ID        string    `json:"id"`
+	VM        string    `json:"vm"`
+	Protocol  string    `json:"protocol"`          // "tcp" or "udp"
+	HostIP    string    `json:"host_ip,omitempty"` // host address to listen on; all if empty
+	HostPort  int       `json:"host_port"`
+	GuestIP   string    `json:"guest_ip"`
+	GuestPort int       `json:"guest_port"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PortForwardRequest - body of POST /api/v1/vm/{name}/port-forwards
+type PortForwardRequest struct {
+	Protocol  string `json:"protocol,omitempty"` // defaults to "tcp"
+	HostIP    string `json:"host_ip,omitempty"`
+	HostPort  int    `json:"host_port"`
+	GuestPort int    `json:"guest_port"`
+	// GuestIP - one of the VM's DHCP leases from a libvirt network, defaults to the first
+	GuestIP string `json:"guest_ip,omitempty"`
+}
+
+// forwardStore - port forwards by ID, persisted as JSON in the state directory.
+// iptables rules don't survive a reboot, so the store is the source of truth.
+type forwardStore struct {
+	mu       sync.Mutex
+	path     string
+	forwards map[string]*PortForward
+}
+
+var portForwards = &forwardStore{
+	path:     filepath.Join(stateDir, "port-forwards.json"),
+	forwards: map[string]*PortForward{},
+}
+
+// load reads the forwards file; a missing file means no forwards
+func (s *forwardStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var forwards []*PortForward
+	if err := json.Unmarshal(content, &forwards); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, f := range forwards {
+		s.forwards[f.ID] = f
+	}
+	return nil
+}
+
+// saveLocked writes the forwards atomically; s.mu must be held
+func (s *forwardStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(""), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns the forwards of vm, or all of them if vm is empty
+func (s *forwardStore) listLocked(vm string) []PortForward {
+	out := []PortForward{}
+	for _, f := range s.forwards {
+		if vm == "" || f.VM == vm {
+			out = append(out, *f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].VM != out[j].VM {
+			return out[i].VM < out[j].VM
+		}
+		return out[i].HostPort < out[j].HostPort
+	})
+	return out
+}
+
+func (s *forwardStore) list(vm string) []PortForward {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked(vm)
+}
+
+// add stores f unless another forward already claims its host address, port and protocol
+func (s *forwardStore) add(f PortForward) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.forwards {
+		if other.Protocol == f.Protocol && other.HostPort == f.HostPort &&
+			(other.HostIP == "" || f.HostIP == "" || other.HostIP == f.HostIP) {
+			return fmt.Errorf("host port %d/%s is already forwarded to VM %q", f.HostPort, f.Protocol, other.VM)
+		}
+	}
+	s.forwards[f.ID] = &f
+	return s.saveLocked()
+}
+
+// remove deletes the forward with the ID, if it belongs to vm
+func (s *forwardStore) remove(vm, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.forwards[id]
+	if !ok || f.VM != vm {
+		return false, nil
+	}
+	delete(s.forwards, id)
+	return true, s.saveLocked()
+}
+
+// removeVM deletes every forward of vm and returns how many there were
+func (s *forwardStore) removeVM(vm string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, f := range s.forwards {
+		if f.VM == vm {
+			delete(s.forwards, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.saveLocked()
+}
+
+// handleListPortForwards - GET /api/v1/vm/{name}/port-forwards
+func handleListPortForwards(w http.ResponseWriter, r *http.Request) {
+	vm, ok := requestVMName(w, r)
+	if !ok {
+		return
+	}
+	writeDataResponse(w, portForwards.list(vm))
+}
+
+// handleAddPortForward - POST /api/v1/vm/{name}/port-forwards
+func handleAddPortForward(w http.ResponseWriter, r *http.Request) {
+	if !isDefaultHost(requestHost(r)) {
+		http.Error(w, "Port forwards are only supported on the default host", http.StatusBadRequest)
+		return
+	}
+	var req PortForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+	if err := req.validate(); err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		ips, err := leaseIPv4s(dom)
+		if err != nil {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Cannot determine guest_ip for VM %q: %v", r.PathValue("name"), err))
+			return
+		}
+		// Forwards only go to the VM's own addresses, not to other VMs or the host's networks
+		guestIP := ips[0]
+		if req.GuestIP != "" {
+			guestIP = ""
+			for _, ip := range ips {
+				if ip == req.GuestIP {
+					guestIP = ip
+					break
+				}
+			}
+			if guestIP == "" {
+				writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("guest_ip %s is not an address of VM %q, its leases are %s", req.GuestIP, r.PathValue("name"), strings.Join(ips, ", ")))
+				return
+			}
+		}
+
+		vm, _ := dom.GetName()
+		f := PortForward{
+			ID:        uuid.New().String(),
+			VM:        vm,
+			Protocol:  req.Protocol,
+			HostIP:    req.HostIP,
+			HostPort:  req.HostPort,
+			GuestIP:   guestIP,
+			GuestPort: req.GuestPort,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err := portForwards.add(f); err != nil {
+			writeErrorStatus(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err := applyPortForwards(); err != nil {
+			errMsg := fmt.Sprintf("Failed to apply port forwards: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Forwarding host port %d/%s to %s:%d (VM %s)", f.HostPort, f.Protocol, f.GuestIP, f.GuestPort, f.VM))
+		writeDataResponse(w, f)
+	})
+}
+
+// handleRemovePortForward - DELETE /api/v1/vm/{name}/port-forwards/{id}
+func handleRemovePortForward(w http.ResponseWriter, r *http.Request) {
+	vm, ok := requestVMName(w, r)
+	if !ok {
+		return
+	}
+	removed, err := portForwards.remove(vm, r.PathValue("id"))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to save port forwards: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Port forward %q not found", r.PathValue("id")))
+		return
+	}
+	if err := applyPortForwards(); err != nil {
+		errMsg := fmt.Sprintf("Failed to apply port forwards: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Port forward %s removed", r.PathValue("id")))
+}
+
+func (req PortForwardRequest) validate() error {
+	if req.Protocol != "tcp" && req.Protocol != "udp" {
+		return fmt.Errorf("protocol must be \"tcp\" or \"udp\"")
+	}
+	if req.HostPort < forwardPorts.first || req.HostPort > forwardPorts.last {
+		return fmt.Errorf("host_port must be between %d and %d", forwardPorts.first, forwardPorts.last)
+	}
+	if req.GuestPort < 1 || req.GuestPort > 65535 {
+		return fmt.Errorf("guest_port must be between 1 and 65535")
+	}
+	if req.HostIP != "" && net.ParseIP(req.HostIP).To4() == nil {
+		return fmt.Errorf("host_ip must be an IPv4 address")
+	}
+	if req.GuestIP != "" && net.ParseIP(req.GuestIP).To4() == nil {
+		return fmt.Errorf("guest_ip must be an IPv4 address")
+	}
+	return nil
+}
+
+// parsePortRange parses "first-last" host ports
+func parsePortRange(v string) (portRange, error) {
+	lo, hi, _ := strings.Cut(v, "-")
+	first, err := strconv.Atoi(strings.TrimSpace(lo))
+	last := first
+	if err == nil && hi != "" {
+		last, err = strconv.Atoi(strings.TrimSpace(hi))
+	}
+	if err != nil || first < 1 || last < first || last > 65535 {
+		return portRange{}, fmt.Errorf("must be a port range such as 20000-29999")
+	}
+	return portRange{first, last}, nil
+}
+
+// leaseIPv4s - the IPv4 addresses handed out to the VM by a libvirt network, in NIC order.
+// Only leases count: what the guest agent reports comes from the guest, which could claim
+// another VM's address.
+func leaseIPv4s(dom *libvirt.Domain) ([]string, error) {
+	ifaces, err := guestAddresses(dom)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, iface := range ifaces {
+		for _, a := range iface.Addresses {
+			if a.Family == "ipv4" && a.Origin == "lease" {
+				ips = append(ips, a.Address)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no DHCP lease found, is the VM running on a libvirt network?")
+	}
+	return ips, nil
+}
+
+// applyPortForwards rebuilds our iptables chains from the store. It is called at startup
+// (iptables rules are lost on reboot) and after every change.
+func applyPortForwards() error {
+	portForwards.mu.Lock()
+	defer portForwards.mu.Unlock()
+
+	if err := ensureForwardChains(); err != nil {
+		return err
+	}
+	if err := iptables("-t", "nat", "-F", forwardNATChain); err != nil {
+		return err
+	}
+	if err := iptables("-t", "filter", "-F", forwardFilterChain); err != nil {
+		return err
+	}
+	for _, f := range portForwards.listLocked("") {
+		comment := "vm-service:" + f.VM + ":" + f.ID
+		dnat := []string{"-t", "nat", "-A", forwardNATChain, "-p", f.Protocol}
+		if f.HostIP != "" {
+			dnat = append(dnat, "-d", f.HostIP)
+		}
+		dnat = append(dnat, "--dport", strconv.Itoa(f.HostPort), "-m", "comment", "--comment", comment,
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(f.GuestIP, strconv.Itoa(f.GuestPort)))
+		if err := iptables(dnat...); err != nil {
+			return err
+		}
+		// libvirt's own FORWARD rules only let replies into a NAT network, so accept the
+		// new connections explicitly
+		if err := iptables("-t", "filter", "-A", forwardFilterChain, "-p", f.Protocol, "-d", f.GuestIP,
+			"--dport", strconv.Itoa(f.GuestPort), "-m", "conntrack", "--ctstate", "NEW",
+			"-m", "comment", "--comment", comment, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureForwardChains creates our chains and the jumps into them if they are missing.
+// The jumps go first so our rules run before libvirt's.
+func ensureForwardChains() error {
+	hooks := []struct{ table, chain, builtin string }{
+		{"nat", forwardNATChain, "PREROUTING"},
+		{"nat", forwardNATChain, "OUTPUT"},
+		{"filter", forwardFilterChain, "FORWARD"},
+	}
+	for _, h := range hooks {
+		// -N fails if the chain exists, which is fine
+		_ = iptables("-t", h.table, "-N", h.chain)
+		jump := []string{h.builtin}
+		if h.builtin == "OUTPUT" {
+			// Connections from the host itself, to its own addresses only
+			jump = append(jump, "-m", "addrtype", "--dst-type", "LOCAL")
+		}
+		jump = append(jump, "-j", h.chain)
+		if err := iptables(append([]string{"-t", h.table, "-C"}, jump...)...); err == nil {
+			continue
+		}
+		if err := iptables(append([]string{"-t", h.table, "-I"}, jump...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iptables runs iptables, waiting for the xtables lock if another process holds it.
+// On nftables hosts the iptables-nft shim translates the rules.
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// removeVMPortForwards drops all forwards of a VM that is gone
+func removeVMPortForwards(vm string) error {
+	n, err := portForwards.removeVM(vm)
+	if err != nil || n == 0 {
+		return err
+	}
+	log.Printf("Removed %d port forwards of deleted VM %s", n, vm)
+	return applyPortForwards()
+}
+
+// runPortForwardJanitor removes the forwards of VMs that no longer exist, however they
+// were deleted, once a minute
+func runPortForwardJanitor() {
+	for {
+		time.Sleep(time.Minute)
+
+		vms := map[string]bool{}
+		for _, f := range portForwards.list("") {
+			vms[f.VM] = true
+		}
+		if len(vms) == 0 {
+			continue
+		}
+
+		conn, err := connectLibvirt()
+		if err != nil {
+			log.Printf("Port forward cleanup: failed to connect libvirt: %v", err)
+			continue
+		}
+		for vm := range vms {
+			dom, err := conn.LookupDomainByName(vm)
+			if err == nil {
+				dom.Free()
+				continue
+			}
+			if !isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN) {
+				continue
+			}
+			if err := removeVMPortForwards(vm); err != nil {
+				log.Printf("Port forward cleanup for VM %s failed: %v", vm, err)
+			}
+		}
+		conn.Close()
+	}
+}
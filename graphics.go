@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// VNCSpec - VNC console for the VM, replacing the default SPICE display
+type VNCSpec struct {
+	// Listen - host address the server binds to; empty uses qemu.conf's vnc_listen
+	// (127.0.0.1 unless changed)
+	Listen string `json:"listen,omitempty"`
+	// Port - fixed TCP port (5900-65535); 0 lets libvirt pick a free one
+	Port int `json:"port,omitempty"`
+	// Password - optional, at most 8 characters (the VNC protocol ignores the rest)
+	Password string `json:"password,omitempty"`
+}
+
+// validate checks the spec before anything is rendered into the domain XML
+func (v *VNCSpec) validate() error {
+	if len(v.Password) > 8 {
+		return fmt.Errorf("password must be at most 8 characters")
+	}
+	return validateDisplay(v.Listen, v.Port, v.Password)
+}
+
+// SPICESpec - SPICE display for desktop guests; an empty spec gives the default display
+type SPICESpec struct {
+	Listen   string `json:"listen,omitempty"` // empty uses qemu.conf's spice_listen
+	Port     int    `json:"port,omitempty"`   // 0 lets libvirt pick a free one
+	Password string `json:"password,omitempty"`
+	// Video - "qxl" or "virtio"; empty leaves the choice to libvirt
+	Video string `json:"video,omitempty"`
+	// Audio - add an ICH9 sound card played back over the SPICE connection
+	Audio bool `json:"audio,omitempty"`
+	// Clipboard - add the spice-vdagent channel so copy/paste works with the client
+	Clipboard bool `json:"clipboard,omitempty"`
+}
+
+// spiceVideoModels - video devices that work well with SPICE
+var spiceVideoModels = map[string]bool{"qxl": true, "virtio": true}
+
+// validate checks the spec before anything is rendered into the domain XML
+func (s *SPICESpec) validate() error {
+	if s.Video != "" && !spiceVideoModels[s.Video] {
+		return fmt.Errorf("video must be \"qxl\" or \"virtio\"")
+	}
+	return validateDisplay(s.Listen, s.Port, s.Password)
+}
+
+// validateDisplay checks the settings VNC and SPICE have in common
+func validateDisplay(listen string, port int, password string) error {
+	if listen != "" && net.ParseIP(listen) == nil {
+		return fmt.Errorf("listen %q is not an IP address", listen)
+	}
+	if port != 0 && (port < 5900 || port > 65535) {
+		return fmt.Errorf("port must be between 5900 and 65535")
+	}
+	if strings.ContainsAny(password, "'\"<>&") {
+		return fmt.Errorf("password must not contain quotes, '<', '>' or '&'")
+	}
+	return nil
+}
+
+// GraphicsInfo - one graphical console of a VM, as libvirt allocated it
+type GraphicsInfo struct {
+	Type     string `json:"type"` // "vnc" or "spice"
+	Listen   string `json:"listen,omitempty"`
+	Port     int    `json:"port,omitempty"` // 0 while the VM is not running
+	TLSPort  int    `json:"tls_port,omitempty"`
+	Autoport bool   `json:"autoport"`
+}
+
+type domainGraphicsXML struct {
+	Type     string `xml:"type,attr"`
+	Port     int    `xml:"port,attr"`
+	TLSPort  int    `xml:"tlsPort,attr"`
+	Autoport string `xml:"autoport,attr"`
+	Listen   string `xml:"listen,attr"`
+	Listens  []struct {
+		Type    string `xml:"type,attr"`
+		Address string `xml:"address,attr"`
+	} `xml:"listen"`
+}
+
+// handleGetVMGraphics - GET /api/v1/vm/{name}/graphics
+// Lists the VM's VNC/SPICE consoles with the ports libvirt allocated for them.
+func handleGetVMGraphics(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		infos := []GraphicsInfo{}
+		for _, g := range def.Devices.Graphics {
+			info := GraphicsInfo{
+				Type:     g.Type,
+				Listen:   g.Listen,
+				Autoport: g.Autoport == "yes",
+			}
+			for _, l := range g.Listens {
+				if l.Address != "" {
+					info.Listen = l.Address
+					break
+				}
+			}
+			// Inactive domains report -1 for autoport-allocated ports
+			if g.Port > 0 {
+				info.Port = g.Port
+			}
+			if g.TLSPort > 0 {
+				info.TLSPort = g.TLSPort
+			}
+			infos = append(infos, info)
+		}
+		writeDataResponse(w, infos)
+	})
+}
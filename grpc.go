@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The gRPC API, proto/vmservice/v1/vmservice.proto, served on the REST listener at
+// /vmservice.v1.VMService/<method>. gRPC needs HTTP/2, which the listener only speaks
+// over TLS, so it is there when VM_SERVICE_TLS_CERT is set.
+//
+// The unary calls go through the REST handlers, with the same authentication, RBAC,
+// tenancy and validation; Call reaches any REST endpoint that has no RPC of its own.
+// WatchJob and WatchEvents stream instead of being polled.
+
+// grpcService - the full name of the service in the proto
+const grpcService = "vmservice.v1.VMService"
+
+// restAPI - the REST routes as a gRPC call reaches them, v2 and v1 alike. Authentication,
+// rate limiting and the rest of the outer chain have already seen the gRPC request; the
+// audit log records the REST request it became instead of the call.
+var restAPI = withAPIVersion(withAudit(withRBAC(http.DefaultServeMux, withHostCheck(http.DefaultServeMux))))
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// maxGRPCMessage - the largest request message accepted, gRPC's usual default
+const maxGRPCMessage = 4 << 20
+
+// jobWatchInterval - how often WatchJob looks at the job for progress
+const jobWatchInterval = 500 * time.Millisecond
+
+// grpcError - a failed call, with its gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// CreateVMRequest - spec is the JSON body of POST /api/v2/vm
+type CreateVMRequest struct {
+	Spec           []byte `pb:"1"`
+	IdempotencyKey string `pb:"2"`
+}
+
+type GetVMRequest struct {
+	Name string `pb:"1"`
+	Host string `pb:"2"`
+}
+
+// ListVMsRequest - the query parameters of GET /api/v2/vm
+type ListVMsRequest struct {
+	Host       string `pb:"1"`
+	State      string `pb:"2"`
+	Label      string `pb:"3"`
+	NamePrefix string `pb:"4"`
+	Sort       string `pb:"5"`
+	Limit      int    `pb:"6"`
+	Offset     int    `pb:"7"`
+}
+
+type ListVMsResponse struct {
+	VMs   []VMInfo `pb:"1"`
+	Total int      `pb:"2"` // matching VMs before limit and offset
+}
+
+// DeleteVMsRequest - the query parameters of DELETE /api/v2/vm
+type DeleteVMsRequest struct {
+	Host     string `pb:"1"`
+	Selector string `pb:"2"`
+	Prefix   string `pb:"3"`
+	DryRun   bool   `pb:"4"`
+}
+
+type DeleteVMsResponse struct {
+	VMs []DeletedVM `pb:"1"`
+}
+
+type GetJobRequest struct {
+	ID string `pb:"1"`
+}
+
+// WatchEventsRequest - the filters of GET /api/v2/events; since is the ID of the last
+// event seen, so a client reconnecting gets the ones it missed
+type WatchEventsRequest struct {
+	Host  string `pb:"1"`
+	VM    string `pb:"2"`
+	Type  string `pb:"3"`
+	Since uint64 `pb:"4"`
+}
+
+// CallRequest - a REST request, for endpoints without an RPC of their own. query is
+// URL-encoded, body is sent as given.
+type CallRequest struct {
+	Method      string `pb:"1"`
+	Path        string `pb:"2"`
+	Query       string `pb:"3"`
+	Body        []byte `pb:"4"`
+	ContentType string `pb:"5"`
+}
+
+// CallResponse - the REST answer to a successful Call
+type CallResponse struct {
+	Status      int    `pb:"1"`
+	Body        []byte `pb:"2"`
+	ContentType string `pb:"3"`
+}
+
+// grpcUnary - the unary RPCs, by method name
+var grpcUnary = map[string]func(r *http.Request, msg []byte) (interface{}, error){
+	"CreateVM":  grpcCreateVM,
+	"GetVM":     grpcGetVM,
+	"ListVMs":   grpcListVMs,
+	"DeleteVMs": grpcDeleteVMs,
+	"GetJob":    grpcGetJob,
+	"Call":      grpcCall,
+}
+
+// grpcStreaming - the server-streaming RPCs, by method name
+var grpcStreaming = map[string]func(r *http.Request, msg []byte, send func(interface{}) error) error{
+	"WatchJob":    grpcWatchJob,
+	"WatchEvents": grpcWatchEvents,
+}
+
+// handleGRPC - POST /vmservice.v1.VMService/{method}
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		writeErrorStatus(w, http.StatusHTTPVersionNotSupported, "gRPC needs HTTP/2, which is only served over TLS")
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		writeErrorStatus(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported gRPC content type %q", ct))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		finishGRPC(w, err)
+		return
+	}
+	method := r.PathValue("method")
+	if fn, ok := grpcUnary[method]; ok {
+		resp, err := fn(r, msg)
+		if err == nil {
+			err = writeGRPCMessage(w, resp)
+		}
+		finishGRPC(w, err)
+		return
+	}
+	if fn, ok := grpcStreaming[method]; ok {
+		finishGRPC(w, fn(r, msg, func(m interface{}) error { return writeGRPCMessage(w, m) }))
+		return
+	}
+	finishGRPC(w, &grpcError{grpcUnimplemented, fmt.Sprintf("Unknown method %s", method)})
+}
+
+// readGRPCMessage reads the one length-prefixed message of a unary or server-streaming call
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("Failed to read request message: %v", err)}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "Compressed messages are not supported"}
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxGRPCMessage {
+		return nil, &grpcError{grpcResourceExhausted, fmt.Sprintf("Request message of %d bytes is over the maximum of %d", n, maxGRPCMessage)}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("Failed to read request message: %v", err)}
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, m interface{}) error {
+	data := marshalProto(m)
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(append(prefix[:], data...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// finishGRPC sends the call's status in the trailers
+func finishGRPC(w http.ResponseWriter, err error) {
+	code, msg := grpcOK, ""
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if ge, ok := err.(*grpcError); ok {
+			code = ge.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// grpcCode maps the status of a REST answer to a gRPC status code
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcFailedPrecondition
+	case http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed:
+		return grpcUnimplemented
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// callREST runs a REST request as the gRPC caller, through the route table with RBAC and
+// the host check (restAPI), and returns what it answered
+func callREST(r *http.Request, method, path string, query url.Values, body []byte, header http.Header) (*batchRecorder, error) {
+	u := url.URL{Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(r.Context(), method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.RemoteAddr, req.TLS = r.RemoteAddr, r.TLS
+
+	rec := &batchRecorder{}
+	restAPI.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 300 {
+		msg := strings.TrimSpace(rec.body.String())
+		var resp ResponseData
+		if json.Unmarshal(rec.body.Bytes(), &resp) == nil && resp.Message != "" {
+			msg = resp.Message
+		}
+		return nil, &grpcError{grpcCode(rec.status), msg}
+	}
+	return rec, nil
+}
+
+// restData decodes the data of a REST answer's ResponseData into v
+func restData(rec *batchRecorder, v interface{}) error {
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Data, v)
+}
+
+func decodeGRPCRequest(msg []byte, v interface{}) error {
+	if err := unmarshalProto(msg, v); err != nil {
+		return &grpcError{grpcInvalidArgument, fmt.Sprintf("Invalid request message: %v", err)}
+	}
+	return nil
+}
+
+func hostQuery(host string) url.Values {
+	q := url.Values{}
+	if host != "" {
+		q.Set("host", host)
+	}
+	return q
+}
+
+func grpcCreateVM(r *http.Request, msg []byte) (interface{}, error) {
+	var req CreateVMRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if req.IdempotencyKey != "" {
+		header.Set("Idempotency-Key", req.IdempotencyKey)
+	}
+	rec, err := callREST(r, http.MethodPost, "/api/v2/vm", nil, req.Spec, header)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	return &job, restData(rec, &job)
+}
+
+func grpcGetVM(r *http.Request, msg []byte) (interface{}, error) {
+	var req GetVMRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		return nil, &grpcError{grpcInvalidArgument, "name is required"}
+	}
+	rec, err := callREST(r, http.MethodGet, "/api/v2/vm/"+url.PathEscape(req.Name), hostQuery(req.Host), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var vm VMInfo
+	return &vm, restData(rec, &vm)
+}
+
+func grpcListVMs(r *http.Request, msg []byte) (interface{}, error) {
+	var req ListVMsRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	q := hostQuery(req.Host)
+	for k, v := range map[string]string{"state": req.State, "label": req.Label, "name-prefix": req.NamePrefix, "sort": req.Sort} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if req.Limit > 0 {
+		q.Set("limit", strconv.Itoa(req.Limit))
+	}
+	if req.Offset > 0 {
+		q.Set("offset", strconv.Itoa(req.Offset))
+	}
+	rec, err := callREST(r, http.MethodGet, "/api/v2/vm", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp ListVMsResponse
+	resp.Total, _ = strconv.Atoi(rec.Header().Get("X-Total-Count"))
+	return &resp, restData(rec, &resp.VMs)
+}
+
+func grpcDeleteVMs(r *http.Request, msg []byte) (interface{}, error) {
+	var req DeleteVMsRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	q := hostQuery(req.Host)
+	if req.Selector != "" {
+		q.Set("selector", req.Selector)
+	}
+	if req.Prefix != "" {
+		q.Set("prefix", req.Prefix)
+	}
+	if req.DryRun {
+		q.Set("dry_run", "true")
+	}
+	rec, err := callREST(r, http.MethodDelete, "/api/v2/vm", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp DeleteVMsResponse
+	return &resp, restData(rec, &resp.VMs)
+}
+
+func grpcGetJob(r *http.Request, msg []byte) (interface{}, error) {
+	var req GetJobRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	rec, err := callREST(r, http.MethodGet, "/api/v2/jobs/"+url.PathEscape(req.ID), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	return &job, restData(rec, &job)
+}
+
+func grpcCall(r *http.Request, msg []byte) (interface{}, error) {
+	var req CallRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(req.Path, "/api/") {
+		return nil, &grpcError{grpcInvalidArgument, "path must be a REST endpoint under /api/"}
+	}
+	query, err := url.ParseQuery(req.Query)
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("Invalid query: %v", err)}
+	}
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	header := http.Header{}
+	if req.ContentType != "" {
+		header.Set("Content-Type", req.ContentType)
+	}
+	rec, err := callREST(r, method, req.Path, query, req.Body, header)
+	if err != nil {
+		return nil, err
+	}
+	return &CallResponse{Status: rec.status, Body: rec.body.Bytes(), ContentType: rec.Header().Get("Content-Type")}, nil
+}
+
+// grpcWatchJob streams the job each time it moves on, ending with it finished
+func grpcWatchJob(r *http.Request, msg []byte, send func(interface{}) error) error {
+	var req GetJobRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return err
+	}
+	jr := r.Clone(r.Context())
+	jr.SetPathValue("id", req.ID)
+	j, ok := lookupRequestJob(jr)
+	if !ok {
+		return &grpcError{grpcNotFound, fmt.Sprintf("Job %q not found", req.ID)}
+	}
+
+	ticker := time.NewTicker(jobWatchInterval)
+	defer ticker.Stop()
+	var last Job
+	for first := true; ; first = false {
+		job := j.snapshot()
+		if first || job.State != last.State || job.Progress != last.Progress {
+			if err := send(&job); err != nil {
+				return err
+			}
+			last = job
+		}
+		if job.State != "running" {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// grpcWatchEvents streams lifecycle events, as GET /api/v2/events does
+func grpcWatchEvents(r *http.Request, msg []byte, send func(interface{}) error) error {
+	var req WatchEventsRequest
+	if err := decodeGRPCRequest(msg, &req); err != nil {
+		return err
+	}
+	scope, err := requestScope(r)
+	if err != nil {
+		return &grpcError{grpcPermissionDenied, err.Error()}
+	}
+	if req.Host != "" {
+		if _, ok := lookupHost(req.Host); !ok {
+			return &grpcError{grpcNotFound, fmt.Sprintf("Host %q not found", req.Host)}
+		}
+	}
+	filter := eventFilter{scope: scope, host: req.Host, evType: req.Type}
+	if req.VM != "" {
+		filter.vm = scope.domainName(req.VM)
+	}
+
+	ch, missed := subscribeEvents(req.Since)
+	defer unsubscribeEvents(ch)
+	for _, ev := range missed {
+		if ev, ok := filter.apply(ev); ok {
+			if err := send(&ev); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-serverStopping:
+			return nil
+		case ev := <-ch:
+			if ev, ok := filter.apply(ev); ok {
+				if err := send(&ev); err != nil {
+					requestLog(r).Warn(fmt.Sprintf("gRPC event stream ended: %v", err))
+					return err
+				}
+			}
+		}
+	}
+}
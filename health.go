@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Probes for Kubernetes and systemd watchdogs. /healthz is the liveness probe: it fails
+// when the service has lost its link to the default hypervisor, which a restart mends.
+// /readyz is the readiness probe and checks everything a create needs: every host,
+// the domain template and the directories the service writes to. Neither needs
+// credentials, and both are logged at debug level like /metrics.
+
+// healthCheckTimeout - how long one check may take; a hung libvirtd would otherwise
+// hang the probe until the watchdog gives up on it without saying why
+const healthCheckTimeout = 5 * time.Second
+
+// HealthCheck - the outcome of one probe check
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleHealthz - GET /healthz
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, []HealthCheck{checkLibvirt(hypervisorHosts[0].Name)})
+}
+
+// handleReadyz - GET /readyz
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var checks []HealthCheck
+	for _, h := range hypervisorHosts {
+		checks = append(checks, checkLibvirt(h.Name))
+	}
+	checks = append(checks, runHealthCheck("template", checkTemplate))
+	for name, dir := range map[string]string{"image_dir": imageCacheDir, "seed_dir": cloudInitDir, "state_dir": stateDir} {
+		checks = append(checks, runHealthCheck(name, func() error { return checkWritableDir(dir) }))
+	}
+	writeHealth(w, checks)
+}
+
+// writeHealth answers 200 when every check passed and 503 naming the failed ones otherwise,
+// with the checks as data either way
+func writeHealth(w http.ResponseWriter, checks []HealthCheck) {
+	var failed []string
+	for _, c := range checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	if len(failed) == 0 {
+		writeDataResponse(w, checks)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	resp := ResponseData{Status: "error", Message: "Failed checks: " + strings.Join(failed, ", "), Data: checks}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// runHealthCheck runs check with healthCheckTimeout. A check that times out is left
+// running; it only holds a connection attempt.
+func runHealthCheck(name string, check func() error) HealthCheck {
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(healthCheckTimeout):
+		err = fmt.Errorf("timed out after %s", healthCheckTimeout)
+	}
+	hc := HealthCheck{Name: name, OK: err == nil}
+	if err != nil {
+		hc.Error = err.Error()
+	}
+	return hc
+}
+
+// checkLibvirt connects to the host and asks libvirtd for its version, which a dead
+// daemon or a broken ssh/TLS link fails
+func checkLibvirt(host string) HealthCheck {
+	return runHealthCheck("libvirt:"+host, func() error {
+		conn, err := connectHost(host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.GetLibVersion()
+		return err
+	})
+}
+
+// checkTemplate renders a one-disk, one-NIC domain through every loaded template, which
+// also checks the XML each gives comes out as asked, see checkDomainXML
+func checkTemplate() error {
+	disks := []DiskDevice{{Type: "file", Path: "/dev/null", Format: "qcow2", Dev: "vda", Bus: "virtio", BootOrder: 1}}
+	nics := []NICDevice{{Type: "network", Source: "default", MAC: "52:54:00:00:00:01", Model: "virtio"}}
+	for _, t := range templateNames() {
+		req := RequestData{Name: "healthz", MemoryMB: 512, CPUs: 1, Template: t.Name}
+		if _, err := generateDomainXML(req, disks, nics, ""); err != nil {
+			return fmt.Errorf("%s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkWritableDir creates and removes a file in dir, creating dir if need be as the
+// code writing there does
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".healthz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
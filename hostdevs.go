@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// PCI passthrough: a create's "hostdevs", or POST /api/v1/vm/{name}/hostdevs later, hand
+// host PCI devices such as GPUs to the guest through VFIO. They are managed, so libvirt
+// unbinds a device from its host driver and binds it to vfio-pci when the VM starts, and
+// gives it back to the host driver when the VM stops. A device can only go to a VM with
+// the rest of its IOMMU group: GET /api/v1/host/pci lists the groups, and the other
+// endpoints of a group (e.g. a GPU's audio function) should be passed through with it.
+
+// HostdevSpec - a host PCI device to pass through
+type HostdevSpec struct {
+	Address string `json:"address"` // e.g. "0000:01:00.0"
+}
+
+// PCIDevice - a PCI device in the host inventory
+type PCIDevice struct {
+	Address string `json:"address"`
+	Vendor  string `json:"vendor,omitempty"`
+	Product string `json:"product,omitempty"`
+	Class   string `json:"class,omitempty"`  // PCI class code, e.g. "0x030200" for a 3D controller
+	Driver  string `json:"driver,omitempty"` // bound host driver; vfio-pci while a VM has the device
+
+	// IOMMUGroup - nil without an IOMMU, when the device can't be passed through;
+	// IOMMUGroupMembers - the other devices of its group
+	IOMMUGroup        *int     `json:"iommu_group,omitempty"`
+	IOMMUGroupMembers []string `json:"iommu_group_members,omitempty"`
+
+	UsedBy string `json:"used_by,omitempty"` // VM the device is given to
+}
+
+var (
+	// errHostdevUnavailable - the device, or another one of its IOMMU group, is another VM's
+	errHostdevUnavailable = errors.New("PCI device unavailable")
+	// errHostdevUnusable - there is no such device, or no IOMMU to pass it through with
+	errHostdevUnusable = errors.New("PCI device cannot be passed through")
+)
+
+// handleListPCIDevices - GET /api/v1/host/pci
+func handleListPCIDevices(w http.ResponseWriter, r *http.Request) {
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	devs, err := pciInventory(conn)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read PCI inventory: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, devs)
+}
+
+// pciInventory lists the host's PCI devices with their IOMMU groups and which VM, if
+// any, each one is given to
+func pciInventory(conn *libvirt.Connect) ([]PCIDevice, error) {
+	pciDevs, err := listNodeDevices(conn, libvirt.CONNECT_LIST_NODE_DEVICES_CAP_PCI_DEV)
+	if err != nil {
+		return nil, err
+	}
+	used, err := hostPCIUsers(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := []PCIDevice{}
+	for _, nd := range pciDevs {
+		for _, c := range nd.Capabilities {
+			if c.Type != "pci" {
+				continue
+			}
+			dev := PCIDevice{
+				Address: fmt.Sprintf("%04x:%02x:%02x.%x", c.Domain, c.Bus, c.Slot, c.Function),
+				Vendor:  strings.TrimSpace(c.Vendor),
+				Product: strings.TrimSpace(c.Product),
+				Class:   c.Class,
+				Driver:  nd.Driver.Name,
+			}
+			dev.UsedBy = used[dev.Address]
+			if g := c.IOMMUGroup; g != nil {
+				number := g.Number
+				dev.IOMMUGroup = &number
+				for _, a := range g.Addresses {
+					if member := a.String(); member != dev.Address {
+						dev.IOMMUGroupMembers = append(dev.IOMMUGroupMembers, member)
+					}
+				}
+			}
+			devs = append(devs, dev)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Address < devs[j].Address })
+	return devs, nil
+}
+
+// resolveHostdevs parses the addresses of the hostdevs, refusing duplicates
+func resolveHostdevs(specs []HostdevSpec) ([]pciAddressXML, error) {
+	addrs := make([]pciAddressXML, len(specs))
+	seen := map[string]bool{}
+	for i, s := range specs {
+		addr, err := parsePCIAddress(s.Address)
+		if err != nil {
+			return nil, fmt.Errorf("hostdev %d: %v", i, err)
+		}
+		if seen[addr.String()] {
+			return nil, fmt.Errorf("hostdev %d: %s is listed twice", i, addr)
+		}
+		seen[addr.String()] = true
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+// checkHostdevs checks that every device exists, is behind an IOMMU and is free, with no
+// other VM holding a device of its group
+func checkHostdevs(conn *libvirt.Connect, vmName string, addrs []pciAddressXML) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	inventory, err := pciInventory(conn)
+	if err != nil {
+		return err
+	}
+	byAddr := map[string]PCIDevice{}
+	for _, d := range inventory {
+		byAddr[d.Address] = d
+	}
+
+	for i, a := range addrs {
+		dev, ok := byAddr[a.String()]
+		switch {
+		case !ok:
+			return fmt.Errorf("hostdev %d: %w: no device %s on the host", i, errHostdevUnusable, a)
+		case dev.IOMMUGroup == nil:
+			return fmt.Errorf("hostdev %d: %w: %s is in no IOMMU group, is the IOMMU on (intel_iommu=on or amd_iommu=on)?", i, errHostdevUnusable, a)
+		case dev.UsedBy != "" && dev.UsedBy != vmName:
+			return fmt.Errorf("hostdev %d: %w: %s is given to VM %q", i, errHostdevUnavailable, a, dev.UsedBy)
+		}
+		for _, m := range dev.IOMMUGroupMembers {
+			if other := byAddr[m].UsedBy; other != "" && other != vmName {
+				return fmt.Errorf("hostdev %d: %w: %s shares IOMMU group %d with %s, which VM %q has", i, errHostdevUnavailable, a, *dev.IOMMUGroup, m, other)
+			}
+		}
+	}
+	return nil
+}
+
+// hostdevXML - the <hostdev> element for a managed PCI device, as the template writes it
+func hostdevXML(a pciAddressXML) string {
+	return fmt.Sprintf("<hostdev mode='subsystem' type='pci' managed='yes'><source><address domain='%s' bus='%s' slot='%s' function='%s'/></source></hostdev>",
+		a.Domain, a.Bus, a.Slot, a.Function)
+}
+
+// hostdevModifyFlags - change the VM's definition, and the running VM too if it runs
+func hostdevModifyFlags(dom *libvirt.Domain) (libvirt.DomainDeviceModifyFlags, error) {
+	active, err := dom.IsActive()
+	if err != nil {
+		return 0, err
+	}
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	if active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	return flags, nil
+}
+
+// handleAttachHostdev - POST /api/v1/vm/{name}/hostdevs
+// Passes a host PCI device through, hot-plugging it if the VM runs.
+func handleAttachHostdev(w http.ResponseWriter, r *http.Request) {
+	var spec HostdevSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	addr, err := parsePCIAddress(spec.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		domName, err := dom.GetName()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM name: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if err := checkHostdevs(conn, domName, []pciAddressXML{addr}); err != nil {
+			if errors.Is(err, errHostdevUnavailable) {
+				writeErrorStatus(w, http.StatusConflict, err.Error())
+				return
+			}
+			if errors.Is(err, errHostdevUnusable) {
+				writeErrorStatus(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			errMsg := fmt.Sprintf("Failed to check PCI device: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		flags, err := hostdevModifyFlags(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if err := dom.AttachDeviceFlags(hostdevXML(addr), flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to attach PCI device %s: %v", addr, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Attached PCI device %s to VM %s", addr, name))
+		writeDataResponse(w, HostdevSpec{Address: addr.String()})
+	})
+}
+
+// handleDetachHostdev - DELETE /api/v1/vm/{name}/hostdevs/{address}
+// Takes a passed-through PCI device away from the VM, unplugging it if the VM runs;
+// libvirt then gives it back to its host driver.
+func handleDetachHostdev(w http.ResponseWriter, r *http.Request) {
+	addr, err := parsePCIAddress(r.PathValue("address"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		attached := false
+		for _, hd := range def.Devices.Hostdevs {
+			if hd.Type == "pci" && hd.Source.Address != nil && hd.Source.Address.String() == addr.String() {
+				attached = true
+			}
+		}
+		if !attached {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no PCI device %s", name, addr))
+			return
+		}
+		flags, err := hostdevModifyFlags(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if err := dom.DetachDeviceFlags(hostdevXML(addr), flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to detach PCI device %s: %v", addr, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Detached PCI device %s from VM %s", addr, name))
+		writeSuccessResponse(w, fmt.Sprintf("PCI device %s detached from VM %s", addr, name))
+	})
+}
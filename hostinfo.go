@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// HostCapacity - answer of GET /api/v1/hosts/{name}, what a scheduler needs to place VMs
+type HostCapacity struct {
+	HypervisorHost
+	Hostname string `json:"hostname"`
+
+	CPU    HostCPU    `json:"cpu"`
+	Memory HostMemory `json:"memory"`
+	// AllocatedVCPUs / VMs - vCPUs of, and number of, the domains currently running
+	AllocatedVCPUs int `json:"allocated_vcpus"`
+	VMs            int `json:"vms"`
+
+	Pools        []PoolInfo `json:"pools"`
+	MachineTypes []string   `json:"machine_types"` // for x86_64 KVM guests, e.g. "pc-q35-7.2", "q35"
+}
+
+// HostCPU - the host's CPU topology
+type HostCPU struct {
+	Model   string `json:"model"`
+	Arch    string `json:"arch"`
+	CPUs    int    `json:"cpus"` // logical CPUs online
+	MHz     int    `json:"mhz"`
+	Nodes   int    `json:"numa_nodes"`
+	Sockets int    `json:"sockets_per_node"`
+	Cores   int    `json:"cores_per_socket"`
+	Threads int    `json:"threads_per_core"`
+}
+
+// HostMemory - in MiB; allocated is the current memory of running domains
+type HostMemory struct {
+	TotalMB     uint64 `json:"total_mb"`
+	FreeMB      uint64 `json:"free_mb"`
+	AllocatedMB uint64 `json:"allocated_mb"`
+}
+
+// capabilitiesXML - the parts of virConnectGetCapabilities we read
+type capabilitiesXML struct {
+	Host struct {
+		CPU struct {
+			Arch  string `xml:"arch"`
+			Model string `xml:"model"`
+		} `xml:"cpu"`
+		Topology struct {
+			Cells []struct {
+				ID   int `xml:"id,attr"`
+				CPUs []struct {
+					ID       int    `xml:"id,attr"`
+					Siblings string `xml:"siblings,attr"`
+				} `xml:"cpus>cpu"`
+			} `xml:"cells>cell"`
+		} `xml:"topology"`
+	} `xml:"host"`
+	Guests []struct {
+		OSType string `xml:"os_type"`
+		Arch   struct {
+			Name     string `xml:"name,attr"`
+			Machines []struct {
+				Name      string `xml:",chardata"`
+				Canonical string `xml:"canonical,attr"`
+			} `xml:"machine"`
+			Domains []struct {
+				Type string `xml:"type,attr"`
+			} `xml:"domain"`
+		} `xml:"arch"`
+	} `xml:"guest"`
+}
+
+// handleGetHost - GET /api/v1/hosts/{name}
+func handleGetHost(w http.ResponseWriter, r *http.Request) {
+	h, ok := lookupHost(r.PathValue("name"))
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Host %q not found", r.PathValue("name")))
+		return
+	}
+	conn, err := connectHost(h.Name)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt on %s: %v", h.Name, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	hc, err := hostCapacity(conn)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read capacity of %s: %v", h.Name, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	hc.HypervisorHost = h
+	writeDataResponse(w, hc)
+}
+
+// hostCapacity gathers CPU, memory, storage and machine-type information from the host
+func hostCapacity(conn *libvirt.Connect) (HostCapacity, error) {
+	var hc HostCapacity
+	var err error
+	if hc.Hostname, err = conn.GetHostname(); err != nil {
+		return hc, fmt.Errorf("failed to get hostname: %v", err)
+	}
+
+	node, err := conn.GetNodeInfo()
+	if err != nil {
+		return hc, fmt.Errorf("failed to get node info: %v", err)
+	}
+	hc.CPU = HostCPU{
+		Model:   node.Model,
+		CPUs:    int(node.Cpus),
+		MHz:     int(node.MHz),
+		Nodes:   int(node.Nodes),
+		Sockets: int(node.Sockets),
+		Cores:   int(node.Cores),
+		Threads: int(node.Threads),
+	}
+	hc.Memory.TotalMB = node.Memory / 1024 // KiB
+	free, err := conn.GetFreeMemory()
+	if err != nil {
+		return hc, fmt.Errorf("failed to get free memory: %v", err)
+	}
+	hc.Memory.FreeMB = free >> 20 // bytes
+
+	doms, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return hc, fmt.Errorf("failed to list domains: %v", err)
+	}
+	for i := range doms {
+		info, err := doms[i].GetInfo()
+		doms[i].Free()
+		if err != nil {
+			// Domains can stop between listing and GetInfo
+			continue
+		}
+		hc.VMs++
+		hc.AllocatedVCPUs += int(info.NrVirtCpu)
+		hc.Memory.AllocatedMB += info.Memory / 1024 // KiB
+	}
+
+	pools, err := conn.ListAllStoragePools(libvirt.CONNECT_LIST_STORAGE_POOLS_ACTIVE)
+	if err != nil {
+		return hc, fmt.Errorf("failed to list storage pools: %v", err)
+	}
+	hc.Pools = []PoolInfo{}
+	for i := range pools {
+		info, err := describePool(&pools[i])
+		pools[i].Free()
+		if err != nil {
+			return hc, fmt.Errorf("failed to inspect storage pool: %v", err)
+		}
+		hc.Pools = append(hc.Pools, info)
+	}
+
+	capsDoc, err := conn.GetCapabilities()
+	if err != nil {
+		return hc, fmt.Errorf("failed to get capabilities: %v", err)
+	}
+	var caps capabilitiesXML
+	if err := xml.Unmarshal([]byte(capsDoc), &caps); err != nil {
+		return hc, fmt.Errorf("failed to parse capabilities: %v", err)
+	}
+	hc.CPU.Arch = caps.Host.CPU.Arch
+	if caps.Host.CPU.Model != "" {
+		hc.CPU.Model = caps.Host.CPU.Model
+	}
+	hc.MachineTypes = kvmMachineTypes(caps, "x86_64")
+	return hc, nil
+}
+
+// kvmMachineTypes lists the machine types KVM guests of arch can use, aliases included
+func kvmMachineTypes(caps capabilitiesXML, arch string) []string {
+	seen := map[string]bool{}
+	for _, g := range caps.Guests {
+		if g.OSType != "hvm" || g.Arch.Name != arch {
+			continue
+		}
+		kvm := false
+		for _, d := range g.Arch.Domains {
+			kvm = kvm || d.Type == "kvm"
+		}
+		if !kvm {
+			continue
+		}
+		for _, m := range g.Arch.Machines {
+			seen[m.Name] = true
+			if m.Canonical != "" {
+				seen[m.Canonical] = true
+			}
+		}
+	}
+	types := []string{}
+	for t := range seen {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// HypervisorHost - a libvirt host this service manages
+type HypervisorHost struct {
+	Name    string `json:"name"`
+	URI     string `json:"uri"` // e.g. "qemu+ssh://root@node2/system" or "qemu+tls://node3/system"
+	Default bool   `json:"default,omitempty"`
+}
+
+// hypervisorHosts - the host registry, from VM_SERVICE_HOSTS ("name=uri,name=uri,...").
+// The first entry is the default host, used when a request names none. Without the
+// variable the service manages just the local hypervisor, as "local".
+var hypervisorHosts []HypervisorHost
+
+var errUnknownHost = errors.New("unknown host")
+
+// loadHosts parses VM_SERVICE_HOSTS into hypervisorHosts
+func loadHosts() error {
+	spec := envOrDefault("VM_SERVICE_HOSTS", "local="+libvirtURI)
+	var list []HypervisorHost
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, uri, ok := strings.Cut(entry, "=")
+		name, uri = strings.TrimSpace(name), strings.TrimSpace(uri)
+		if !ok || name == "" || uri == "" {
+			return fmt.Errorf("VM_SERVICE_HOSTS entry %q is not name=uri", entry)
+		}
+		if seen[name] {
+			return fmt.Errorf("VM_SERVICE_HOSTS lists host %q twice", name)
+		}
+		seen[name] = true
+		list = append(list, HypervisorHost{Name: name, URI: uri, Default: len(list) == 0})
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("VM_SERVICE_HOSTS names no hosts")
+	}
+	hypervisorHosts = list
+	return nil
+}
+
+// lookupHost finds a host by name; "" is the default host
+func lookupHost(name string) (HypervisorHost, bool) {
+	if name == "" {
+		return hypervisorHosts[0], true
+	}
+	for _, h := range hypervisorHosts {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return HypervisorHost{}, false
+}
+
+// connectHost opens a connection to the named host ("" for the default one)
+func connectHost(name string) (*libvirt.Connect, error) {
+	h, ok := lookupHost(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownHost, name)
+	}
+	return libvirt.NewConnect(h.URI)
+}
+
+// isLocalHost says whether the named host is this machine's hypervisor, so files the
+// service writes (seed ISOs, the image cache) or reads (disks, console logs) are visible to it
+func isLocalHost(name string) bool {
+	h, ok := lookupHost(name)
+	return ok && (strings.HasPrefix(h.URI, "qemu:///") || strings.HasPrefix(h.URI, "qemu+unix:///"))
+}
+
+// requestHost - the host a request is for, from its ?host= parameter ("" for the default)
+func requestHost(r *http.Request) string {
+	return r.URL.Query().Get("host")
+}
+
+// hostName resolves "" to the default host's name
+func hostName(name string) string {
+	if name == "" {
+		return hypervisorHosts[0].Name
+	}
+	return name
+}
+
+// isDefaultHost says whether name refers to the default host, the one background
+// features (snapshot policies, port forwards) work on
+func isDefaultHost(name string) bool {
+	return hostName(name) == hypervisorHosts[0].Name
+}
+
+// withHostCheck answers 404 for requests whose ?host= is not in the registry, so the
+// handlers behind it can pass requestHost straight to connectHost
+func withHostCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := requestHost(r); name != "" {
+			if _, ok := lookupHost(name); !ok {
+				writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Host %q not found", name))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListHosts - GET /api/v1/hosts
+func handleListHosts(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, hypervisorHosts)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "hugepages": true backs the VM's memory with host hugepages, which cuts TLB misses
+// for latency-sensitive guests and is what DPDK's vhost-user needs. The pages must be
+// reserved on the host beforehand (hugepages= on the kernel command line, or
+// /sys/kernel/mm/hugepages); a create is refused unless enough of them are free.
+// Running VMs hold theirs, stopped ones don't, so starting several VMs sized for the
+// same free pages can still fail.
+
+// hugepageSizes - the page sizes "hugepage_size" takes, in KiB
+var hugepageSizes = map[string]int{
+	"2M": 2048,
+	"1G": 1024 * 1024,
+}
+
+// defaultHugepageSize - the page size when the request gives none
+const defaultHugepageSize = "2M"
+
+// hugepageKiB returns the request's hugepage size in KiB, 0 without hugepages, checking
+// the memory is a whole number of pages
+func hugepageKiB(req RequestData) (int, error) {
+	if !req.Hugepages {
+		if req.HugepageSize != "" {
+			return 0, fmt.Errorf("hugepage_size requires hugepages")
+		}
+		return 0, nil
+	}
+	size := req.HugepageSize
+	if size == "" {
+		size = defaultHugepageSize
+	}
+	kib, ok := hugepageSizes[size]
+	if !ok {
+		return 0, fmt.Errorf("unsupported hugepage_size %q, must be 2M or 1G", size)
+	}
+	if (req.MemoryMB*1024)%kib != 0 {
+		return 0, fmt.Errorf("memory_mb must be a multiple of the %s hugepage size", size)
+	}
+	return kib, nil
+}
+
+// checkHugepages checks the host has enough free pages of pageKiB, over all its NUMA
+// nodes, for memoryMB
+func checkHugepages(conn *libvirt.Connect, pageKiB, memoryMB int) error {
+	if pageKiB == 0 {
+		return nil
+	}
+	node, err := conn.GetNodeInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get node info: %v", err)
+	}
+	counts, err := conn.GetFreePages([]uint64{uint64(pageKiB)}, 0, uint(node.Nodes), 0)
+	if err != nil {
+		return fmt.Errorf("failed to get free hugepages: %v", err)
+	}
+	var free uint64
+	for _, n := range counts {
+		free += n
+	}
+	if need := uint64(memoryMB * 1024 / pageKiB); free < need {
+		return fmt.Errorf("%d free %d KiB hugepages, the VM needs %d", free, pageKiB, need)
+	}
+	return nil
+}
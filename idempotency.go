@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL - how long a create request's Idempotency-Key is remembered
+const idempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLen - longer keys are refused
+const maxIdempotencyKeyLen = 255
+
+// idempotencyEntry - what a key was first used for. jobID stays empty while that first
+// request is still being checked.
+type idempotencyEntry struct {
+	fingerprint string
+	jobID       string
+	created     time.Time
+}
+
+var idempotencyKeys = struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	swept   time.Time
+}{entries: map[string]*idempotencyEntry{}}
+
+// idempotencyClaim - a request's hold on its Idempotency-Key. A nil claim (no key sent)
+// does nothing.
+type idempotencyClaim struct {
+	key       string
+	committed bool
+}
+
+// claimIdempotencyKey handles the Idempotency-Key header of a create request with the
+// given body. Keys are per client. A key seen before with the same body answers with the
+// job the first request started, so a client retrying after a timeout gets the original
+// result instead of a 409 for the name or a second set of disks; with a different body,
+// or while the first request is still being checked, it is refused. It writes the
+// response and returns false when the request must not go ahead.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, body []byte) (*idempotencyClaim, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return nil, true
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		http.Error(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen), http.StatusBadRequest)
+		return nil, false
+	}
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	key = rateClient(r) + "\x00" + key
+	now := time.Now()
+
+	idempotencyKeys.mu.Lock()
+	if now.Sub(idempotencyKeys.swept) > time.Hour {
+		for k, e := range idempotencyKeys.entries {
+			if now.Sub(e.created) > idempotencyTTL {
+				delete(idempotencyKeys.entries, k)
+			}
+		}
+		idempotencyKeys.swept = now
+	}
+	e, ok := idempotencyKeys.entries[key]
+	if ok && now.Sub(e.created) > idempotencyTTL {
+		ok = false
+	}
+	if !ok {
+		idempotencyKeys.entries[key] = &idempotencyEntry{fingerprint: fingerprint, created: now}
+		idempotencyKeys.mu.Unlock()
+		return &idempotencyClaim{key: key}, true
+	}
+	entry := *e
+	idempotencyKeys.mu.Unlock()
+
+	switch {
+	case entry.fingerprint != fingerprint:
+		writeErrorStatus(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+	case entry.jobID == "":
+		writeErrorStatus(w, http.StatusConflict, "A request with this Idempotency-Key is still being processed")
+	default:
+		job, ok := lookupJob(entry.jobID)
+		if !ok {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Job %q of the original request not found", entry.jobID))
+			return nil, false
+		}
+		requestLog(r).Info("Replaying create for Idempotency-Key", "job", entry.jobID)
+		writeCreateStarted(w, r, job)
+	}
+	return nil, false
+}
+
+// commit ties the key to the job the request started, for retries to find
+func (c *idempotencyClaim) commit(jobID string) {
+	if c == nil {
+		return
+	}
+	idempotencyKeys.mu.Lock()
+	defer idempotencyKeys.mu.Unlock()
+	if e, ok := idempotencyKeys.entries[c.key]; ok {
+		e.jobID = jobID
+	}
+	c.committed = true
+}
+
+// release drops a key whose request was refused before starting a job, so a corrected
+// retry with the same key is checked afresh; meant to be deferred
+func (c *idempotencyClaim) release() {
+	if c == nil || c.committed {
+		return
+	}
+	idempotencyKeys.mu.Lock()
+	defer idempotencyKeys.mu.Unlock()
+	delete(idempotencyKeys.entries, c.key)
+}
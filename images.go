@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// imageCacheDir - where images fetched by URL are kept, overridable with VM_SERVICE_IMAGE_DIR
+var imageCacheDir = envOrDefault("VM_SERVICE_IMAGE_DIR", "/var/lib/libvirt/images/cache")
+
+// qemuImgPath - the qemu-img clones, conversions and exports run, overridable with
+// VM_SERVICE_QEMU_IMG
+var qemuImgPath = envOrDefault("VM_SERVICE_QEMU_IMG", "qemu-img")
+
+// imageLocks serialises downloads per cache file, so concurrent creates from the same
+// image_url fetch it once
+var (
+	imageLocksMu sync.Mutex
+	imageLocks   = map[string]*sync.Mutex{}
+)
+
+// errImageNotStandalone - a qcow2 image that reads another file on the host: a backing
+// file or an external data file named in its header, which QEMU would open for the guest
+var errImageNotStandalone = errors.New("qcow2 image refers to another file")
+
+// qcow2 header extension holding the name of an external data file
+const qcow2DataFileExtension = 0x44415441
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// fetchImage makes sure the image at url is in the local cache and returns its path.
+//
+// checksum is "<algo>:<hex>" (sha256 or sha512; a bare hex string means sha256). When given,
+// the cache file is named after it and the download is verified before it is used; without
+// it the file is named after the URL and trusted as-is once complete.
+// Interrupted downloads are kept as "<file>.part" and resumed with a Range request. A qcow2
+// image naming a backing or data file is refused, so a guest can't be handed host files.
+func fetchImage(ctx context.Context, url, checksum string) (string, error) {
+	algo, want, err := parseChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+	dest, _ := imageCachePath(url, checksum)
+
+	lock := imageLock(dest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := os.Stat(dest); err == nil {
+		log.Printf("Using cached image %s for %s", dest, url)
+		return dest, nil
+	}
+
+	if err := os.MkdirAll(imageCacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create image directory: %v", err)
+	}
+
+	partial := dest + ".part"
+	if err := downloadWithResume(ctx, url, partial); err != nil {
+		return "", err
+	}
+
+	if want != "" {
+		got, err := fileChecksum(partial, algo)
+		if err != nil {
+			return "", err
+		}
+		if got != want {
+			// Don't resume from a corrupt file next time
+			_ = os.Remove(partial)
+			return "", fmt.Errorf("checksum mismatch for %s: expected %s:%s, got %s:%s", url, algo, want, algo, got)
+		}
+	}
+	if err := checkQcow2Standalone(partial); err != nil {
+		_ = os.Remove(partial)
+		return "", err
+	}
+
+	if err := os.Rename(partial, dest); err != nil {
+		return "", fmt.Errorf("failed to move image into cache: %v", err)
+	}
+	log.Printf("Downloaded %s to %s", url, dest)
+	return dest, nil
+}
+
+// imageCachePath - the cache file fetchImage keeps the image at url in, whether or not
+// it has been downloaded yet
+func imageCachePath(url, checksum string) (string, error) {
+	algo, want, err := parseChecksum(checksum)
+	if err != nil {
+		return "", err
+	}
+	var key string
+	if want != "" {
+		key = algo + "-" + want
+	} else {
+		sum := sha256.Sum256([]byte(url))
+		key = "url-" + hex.EncodeToString(sum[:8])
+	}
+	return filepath.Join(imageCacheDir, key+"-"+sanitizeFileName(path.Base(url))), nil
+}
+
+// downloadWithResume fetches url into partial, continuing from its current size if it exists
+func downloadWithResume(ctx context.Context, url, partial string) error {
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid image_url: %v", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+		log.Printf("Resuming download of %s at byte %d", url, offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file already holds everything
+		return nil
+	case resp.StatusCode == http.StatusOK:
+		// Server ignored the Range header (or there was nothing to resume), start over
+		flags |= os.O_TRUNC
+	default:
+		return fmt.Errorf("failed to download %s: HTTP %s", url, resp.Status)
+	}
+
+	f, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", partial, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("download of %s interrupted (will resume next time): %v", url, err)
+	}
+	return f.Close()
+}
+
+// parseChecksum splits "<algo>:<hex>" into its parts; "" is allowed and means "don't verify"
+func parseChecksum(checksum string) (string, string, error) {
+	if checksum == "" {
+		return "", "", nil
+	}
+	algo, sum := "sha256", checksum
+	if i := strings.IndexByte(checksum, ':'); i >= 0 {
+		algo, sum = checksum[:i], checksum[i+1:]
+	}
+	algo, sum = strings.ToLower(algo), strings.ToLower(sum)
+	if _, ok := checksumAlgorithms[algo]; !ok {
+		return "", "", fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || sum == "" {
+		return "", "", fmt.Errorf("checksum must be hex encoded")
+	}
+	return algo, sum, nil
+}
+
+// fileChecksum - hex digest of a file with the given algorithm
+func fileChecksum(path, algo string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := checksumAlgorithms[algo]()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to checksum %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// qcow2VirtualSize reads the virtual disk size from a local qcow2 header.
+// Returns an error if the file isn't qcow2.
+func qcow2VirtualSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Header: magic "QFI\xfb" at 0, big-endian virtual size at offset 24
+	var header [32]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return 0, fmt.Errorf("%s is not a qcow2 image: %v", path, err)
+	}
+	if string(header[:4]) != "QFI\xfb" {
+		return 0, fmt.Errorf("%s is not a qcow2 image", path)
+	}
+	return binary.BigEndian.Uint64(header[24:32]), nil
+}
+
+// checkQcow2Standalone refuses a qcow2 image whose header names a backing file or an
+// external data file. Files that aren't qcow2 pass, they don't refer to others.
+func checkQcow2Standalone(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Header: magic at 0, version at 4, backing file offset at 8, and from version 3 the
+	// header length at 100, the header extensions following the header
+	var header [104]byte
+	n, err := io.ReadFull(f, header[:])
+	if n < 16 || string(header[:4]) != "QFI\xfb" {
+		return nil
+	}
+	if binary.BigEndian.Uint64(header[8:16]) != 0 {
+		return fmt.Errorf("%w: %s has a backing file", errImageNotStandalone, path)
+	}
+	if binary.BigEndian.Uint32(header[4:8]) < 3 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s has a truncated qcow2 header: %v", path, err)
+	}
+	offset := int64(binary.BigEndian.Uint32(header[100:104]))
+	for {
+		var ext [8]byte
+		if _, err := f.ReadAt(ext[:], offset); err != nil {
+			return fmt.Errorf("%s has a truncated qcow2 header: %v", path, err)
+		}
+		switch binary.BigEndian.Uint32(ext[:4]) {
+		case 0:
+			return nil
+		case qcow2DataFileExtension:
+			return fmt.Errorf("%w: %s has an external data file", errImageNotStandalone, path)
+		}
+		// Extension data is padded to a multiple of 8 bytes
+		offset += 8 + (int64(binary.BigEndian.Uint32(ext[4:8]))+7)/8*8
+	}
+}
+
+func imageLock(path string) *sync.Mutex {
+	imageLocksMu.Lock()
+	defer imageLocksMu.Unlock()
+	if imageLocks[path] == nil {
+		imageLocks[path] = &sync.Mutex{}
+	}
+	return imageLocks[path]
+}
+
+// sanitizeFileName keeps a URL's last path element usable as a file name
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "image"
+	}
+	return name
+}
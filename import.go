@@ -0,0 +1,597 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// ImportRequest - incoming JSON for POST /api/v1/vm/import
+type ImportRequest struct {
+	Bundle      string `json:"bundle"`                 // path of an export bundle on this host
+	Name        string `json:"name,omitempty"`         // defaults to the exported VM's name
+	StoragePool string `json:"storage_pool,omitempty"` // where the disks go, defaults to "default"
+}
+
+// handleImportVM - POST /api/v1/vm/import
+//
+// Defines a VM from a bundle made by POST /api/v1/vm/{name}/export. The bundle is either
+// named by path in a JSON body, or is itself the request body (application/x-tar or
+// application/gzip) with name and storage_pool in the query string.
+//
+// Disks are uploaded into new volumes in the storage pool. If the VM's name is taken and
+// no name was asked for, the import is called "<name>-restore-N"; a UUID or MAC address
+// already used by another domain on this host is replaced.
+//
+// A bundle is whatever the caller sends, so its domain XML is held to what a create could
+// ask for (see checkImportXML), unless the caller may use XML overrides.
+func handleImportVM(w http.ResponseWriter, r *http.Request) {
+	var req ImportRequest
+	var body io.Reader
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-tar", "application/gzip":
+		req.Name = r.URL.Query().Get("name")
+		req.StoragePool = r.URL.Query().Get("storage_pool")
+		body = r.Body
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+		if req.Bundle == "" {
+			http.Error(w, "Missing required field: bundle", http.StatusBadRequest)
+			return
+		}
+		if err := validatePath("bundle", req.Bundle, true); err != nil {
+			writeErrorStatus(w, http.StatusForbidden, err.Error())
+			return
+		}
+		f, err := os.Open(req.Bundle)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot open bundle: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+	if req.StoragePool == "" {
+		req.StoragePool = defaultStoragePool
+	}
+	if req.Name != "" {
+		if err := validateVMName(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	tr, err := openBundle(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid bundle: %v", err), http.StatusBadRequest)
+		return
+	}
+	manifest, domainXML, err := readBundleHeader(tr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid bundle: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	checked := !xmlOverridesAllowed(r)
+	local := isLocalHost(requestHost(r))
+	if checked {
+		sources := map[string]bool{}
+		for _, d := range manifest.Disks {
+			sources[d.Source] = true
+		}
+		if err := checkImportXML(domainXML, sources, local); err != nil {
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("Bundle refused: %v", err))
+			return
+		}
+	}
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	// Names are the importing project's; an export of one of its own VMs keeps its name
+	requested := req.Name
+	if requested != "" {
+		requested = scope.domainName(requested)
+	}
+	name, err := importName(conn, requested, scope.domainName(scope.vmName(manifest.Name)))
+	if err != nil {
+		writeErrorStatus(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	pool, err := conn.LookupStoragePoolByName(req.StoragePool)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("Storage pool %q not found", req.StoragePool))
+		return
+	}
+	defer pool.Free()
+	if doc, err := readPoolXML(pool); err != nil || doc.Type == "rbd" {
+		writeErrorStatus(w, http.StatusBadRequest, fmt.Sprintf("Storage pool %q can't take imported disks, use a file-based pool", req.StoragePool))
+		return
+	}
+
+	releaseSlot, err := acquireCreateSlot(r.Context())
+	if err != nil {
+		requestLog(r).Warn(err.Error())
+		writeErrorStatus(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer releaseSlot()
+
+	disks, err := importDisks(conn, pool, tr, manifest, name)
+	if err != nil {
+		deleteCopiedVolumes(disks)
+		errMsg := fmt.Sprintf("Failed to import disks: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+
+	domainXML, err = rewriteImportXML(conn, domainXML, name, disks)
+	if err != nil {
+		deleteCopiedVolumes(disks)
+		errMsg := fmt.Sprintf("Failed to prepare domain XML: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if checked {
+		// Again on the rewritten XML: each disk has to be on one of the new volumes now,
+		// and none of the disk images may pull in a file of the host
+		imported := map[string]bool{}
+		for _, d := range disks {
+			imported[d.path] = true
+		}
+		err := checkImportXML(domainXML, imported, local)
+		for i := 0; err == nil && i < len(disks); i++ {
+			err = checkImportedVolume(disks[i], local)
+		}
+		if err != nil {
+			deleteCopiedVolumes(disks)
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("Bundle refused: %v", err))
+			return
+		}
+	}
+
+	dom, err := conn.DomainDefineXML(domainXML)
+	if err != nil {
+		deleteCopiedVolumes(disks)
+		errMsg := fmt.Sprintf("Failed to define imported domain: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer dom.Free()
+	if !scope.all {
+		// The bundle's metadata names the exporting project, the VM is the importer's now
+		if err := setDomainProject(dom, scope.project); err != nil {
+			_ = dom.Undefine()
+			deleteCopiedVolumes(disks)
+			errMsg := fmt.Sprintf("Failed to set the imported VM's project: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		// Only now is the VM's size known; the check leaves it out of the usage it adds to
+		if err := checkImportQuota(scope.project, dom); err != nil {
+			_ = dom.Undefine()
+			deleteCopiedVolumes(disks)
+			writeQuotaError(w, r, err)
+			return
+		}
+	}
+	for _, d := range disks {
+		d.vol.Free()
+	}
+
+	requestLog(r).Info(fmt.Sprintf("Imported VM %s (exported as %s) with %d disks into pool %s", name, manifest.Name, len(disks), req.StoragePool))
+	recordVM(requestHost(r), dom, "imported", requestUser(r), nil)
+	writeSuccessResponse(w, fmt.Sprintf("VM %s imported", name))
+}
+
+// importCheckXML - the parts of a bundle's domain XML checkImportXML looks at
+type importCheckXML struct {
+	OS struct {
+		Kernel string `xml:"kernel"`
+		Initrd string `xml:"initrd"`
+		DTB    string `xml:"dtb"`
+		Loader string `xml:"loader"`
+		NVRAM  struct {
+			Template string `xml:"template,attr"`
+		} `xml:"nvram"`
+	} `xml:"os"`
+	Devices struct {
+		Disks []struct {
+			Device string `xml:"device,attr"`
+			Source struct {
+				File     string `xml:"file,attr"`
+				Dev      string `xml:"dev,attr"`
+				Dir      string `xml:"dir,attr"`
+				Protocol string `xml:"protocol,attr"`
+				Pool     string `xml:"pool,attr"`
+			} `xml:"source"`
+			Target struct {
+				Dev string `xml:"dev,attr"`
+			} `xml:"target"`
+			BackingStore *struct {
+				Source *struct{} `xml:"source"`
+			} `xml:"backingStore"`
+		} `xml:"disk"`
+		Hostdevs    []struct{} `xml:"hostdev"`
+		Filesystems []struct{} `xml:"filesystem"`
+		Interfaces  []struct {
+			Type   string    `xml:"type,attr"`
+			Script *struct{} `xml:"script"`
+		} `xml:"interface"`
+		Chardevs []importChardevXML `xml:",any"`
+	} `xml:"devices"`
+}
+
+// importChardevXML - a serial, console, parallel or channel device, or another device
+type importChardevXML struct {
+	XMLName xml.Name
+	Type    string `xml:"type,attr"`
+	Source  []struct {
+		Mode string `xml:"mode,attr"`
+		Path string `xml:"path,attr"`
+	} `xml:"source"`
+	Log *struct {
+		File string `xml:"file,attr"`
+	} `xml:"log"`
+}
+
+// importChardevTypes - the character devices a bundle may have, none reaching a file,
+// device, socket or address of the host; unix sockets only as libvirt places them
+var importChardevTypes = map[string]bool{
+	"pty": true, "unix": true, "spicevmc": true, "spiceport": true, "null": true, "vc": true, "qemu-vdagent": true,
+}
+
+// checkImportXML refuses domain XML reaching host resources a create couldn't: a disk
+// whose source isn't one of sources (CD-ROMs may have an image under the allowed paths),
+// a backing chain, host devices, shared directories, boot files outside the allowed paths,
+// firmware other than this host's, character devices on host files or sockets, console
+// logs outside the console log directory, interface scripts and anything in the qemu
+// namespace
+func checkImportXML(desc string, sources map[string]bool, local bool) error {
+	d := xml.NewDecoder(strings.NewReader(desc))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid domain XML: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Space == qemuNamespace {
+			return fmt.Errorf("<qemu:%s> needs XML overrides", el.Name.Local)
+		}
+	}
+
+	var def importCheckXML
+	if err := xml.Unmarshal([]byte(desc), &def); err != nil {
+		return fmt.Errorf("invalid domain XML: %v", err)
+	}
+	if len(def.Devices.Hostdevs) > 0 {
+		return fmt.Errorf("host devices need XML overrides, pass them through after the import")
+	}
+	if len(def.Devices.Filesystems) > 0 {
+		return fmt.Errorf("shared directories (<filesystem>) need XML overrides")
+	}
+	for field, path := range map[string]string{"kernel": def.OS.Kernel, "initrd": def.OS.Initrd, "dtb": def.OS.DTB} {
+		if path != "" {
+			if err := validatePath(field, path, local); err != nil {
+				return err
+			}
+		}
+	}
+	if l := def.OS.Loader; l != "" && l != ovmfCodePath && l != ovmfSecureCodePath {
+		return fmt.Errorf("loader %s is not this host's firmware", l)
+	}
+	if t := def.OS.NVRAM.Template; t != "" && t != ovmfVarsPath && t != ovmfSecureVarsPath {
+		return fmt.Errorf("nvram template %s is not this host's firmware", t)
+	}
+	for _, iface := range def.Devices.Interfaces {
+		if iface.Type == "hostdev" || iface.Script != nil {
+			return fmt.Errorf("interfaces of type hostdev or with a script need XML overrides")
+		}
+	}
+	for _, c := range def.Devices.Chardevs {
+		switch c.XMLName.Local {
+		case "serial", "console", "parallel", "channel":
+		default:
+			continue
+		}
+		if !importChardevTypes[c.Type] {
+			return fmt.Errorf("%s of type %s needs XML overrides", c.XMLName.Local, c.Type)
+		}
+		for _, src := range c.Source {
+			if src.Path != "" || (c.Type == "unix" && src.Mode != "" && src.Mode != "bind") {
+				return fmt.Errorf("%s sockets are placed by libvirt, the bundle can't name one", c.XMLName.Local)
+			}
+		}
+		if c.Log != nil {
+			if rel, err := filepath.Rel(consoleLogDir, c.Log.File); err != nil || rel == "." || strings.HasPrefix(rel, "..") || strings.Contains(rel, "/") {
+				return fmt.Errorf("%s log %s is not in %s", c.XMLName.Local, c.Log.File, consoleLogDir)
+			}
+		}
+	}
+	for _, disk := range def.Devices.Disks {
+		src := disk.Source
+		path := src.File + src.Dev
+		if src.Dir != "" || src.Protocol != "" || src.Pool != "" || (src.File != "" && src.Dev != "") {
+			return fmt.Errorf("disk %s: only file and block device disks can be imported", disk.Target.Dev)
+		}
+		if disk.BackingStore != nil && disk.BackingStore.Source != nil {
+			return fmt.Errorf("disk %s: backing chains can't be imported", disk.Target.Dev)
+		}
+		switch {
+		case disk.Device == "cdrom":
+			if path != "" {
+				if err := validatePath(fmt.Sprintf("disk %s", disk.Target.Dev), path, local); err != nil {
+					return err
+				}
+			}
+		case !sources[path]:
+			return fmt.Errorf("disk %s (%s) is not in the bundle", disk.Target.Dev, path)
+		}
+	}
+	return nil
+}
+
+// checkImportedVolume refuses an imported disk image that names a backing or data file.
+// libvirt shows the backing file of a volume on any host; the data file is only found
+// reading the image on this one.
+func checkImportedVolume(d copiedVolume, local bool) error {
+	desc, err := d.vol.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("failed to read volume %s: %v", d.path, err)
+	}
+	var vol volumeXML
+	if err := xml.Unmarshal([]byte(desc), &vol); err != nil {
+		return fmt.Errorf("failed to parse volume %s: %v", d.path, err)
+	}
+	if vol.BackingStore != nil && vol.BackingStore.Path != "" {
+		return fmt.Errorf("%w: the bundle's image for %s has a backing file", errImageNotStandalone, d.source)
+	}
+	if local {
+		return checkQcow2Standalone(d.path)
+	}
+	return nil
+}
+
+// openBundle returns a tar reader for a bundle, unpacking it if it is gzipped
+func openBundle(r io.Reader) (*tar.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gz), nil
+	}
+	return tar.NewReader(br), nil
+}
+
+// readBundleHeader reads the manifest and domain XML, which export writes ahead of the disks
+func readBundleHeader(tr *tar.Reader) (bundleManifest, string, error) {
+	var manifest bundleManifest
+	var domainXML string
+	for _, want := range []string{bundleManifestFile, bundleDomainFile} {
+		hdr, err := tr.Next()
+		if err != nil {
+			return manifest, "", fmt.Errorf("missing %s: %v", want, err)
+		}
+		if hdr.Name != want {
+			return manifest, "", fmt.Errorf("expected %s, found %s", want, hdr.Name)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, 16<<20))
+		if err != nil {
+			return manifest, "", err
+		}
+		if want == bundleManifestFile {
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return manifest, "", fmt.Errorf("bad manifest: %v", err)
+			}
+		} else {
+			domainXML = string(data)
+		}
+	}
+	return manifest, domainXML, nil
+}
+
+// importName picks the name for the imported VM. An explicitly requested name must be free;
+// otherwise the exported name is used, suffixed if a domain already has it.
+func importName(conn *libvirt.Connect, requested, exported string) (string, error) {
+	taken := func(name string) bool {
+		dom, err := conn.LookupDomainByName(name)
+		if err != nil {
+			return false
+		}
+		dom.Free()
+		return true
+	}
+
+	if requested != "" {
+		if taken(requested) {
+			return "", fmt.Errorf("VM %q already exists", requested)
+		}
+		return requested, nil
+	}
+	if !taken(exported) {
+		return exported, nil
+	}
+	for i := 1; i < 100; i++ {
+		name := fmt.Sprintf("%s-restore-%d", exported, i)
+		if !taken(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free name for %q, pass one explicitly", exported)
+}
+
+// importDisks uploads every disk entry of the bundle into a new volume. Each volume is
+// created raw with the entry's exact size and the image uploaded byte for byte; the pool
+// refresh afterwards makes libvirt pick up qcow2 images as such. The returned slice holds
+// the volumes created so far even on error.
+func importDisks(conn *libvirt.Connect, pool *libvirt.StoragePool, tr *tar.Reader, manifest bundleManifest, name string) ([]copiedVolume, error) {
+	byFile := map[string]int{}
+	for i, d := range manifest.Disks {
+		byFile[d.File] = i
+	}
+
+	var disks []copiedVolume
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return disks, fmt.Errorf("corrupt bundle: %v", err)
+		}
+		i, ok := byFile[hdr.Name]
+		if !ok {
+			continue
+		}
+		bd := manifest.Disks[i]
+		volName := newVolumeName(name, i, bd.Format)
+
+		vol := volumeXML{
+			Name:     volName,
+			Capacity: volumeSize{Unit: "bytes", Value: uint64(hdr.Size)},
+			Target:   volumeTarget{Format: volumeFormat{Type: "raw"}},
+		}
+		volDoc, err := xml.Marshal(vol)
+		if err != nil {
+			return disks, err
+		}
+		sv, err := pool.StorageVolCreateXML(string(volDoc), 0)
+		if err != nil {
+			return disks, fmt.Errorf("StorageVolCreateXML failed for %s: %v", volName, err)
+		}
+		path, err := sv.GetPath()
+		if err != nil {
+			sv.Free()
+			return disks, fmt.Errorf("failed to get path of volume %s: %v", volName, err)
+		}
+		disks = append(disks, copiedVolume{source: bd.Source, path: path, vol: sv})
+
+		log.Printf("Uploading %s (%d bytes) into %s", bd.File, hdr.Size, path)
+		if err := uploadVolume(conn, sv, tr, hdr.Size); err != nil {
+			return disks, fmt.Errorf("failed to upload %s: %v", bd.File, err)
+		}
+	}
+
+	if len(disks) != len(manifest.Disks) {
+		return disks, fmt.Errorf("bundle holds %d of the %d disks in its manifest", len(disks), len(manifest.Disks))
+	}
+	if err := pool.Refresh(0); err != nil {
+		return disks, fmt.Errorf("failed to refresh pool: %v", err)
+	}
+	return disks, nil
+}
+
+// uploadVolume streams size bytes from r into the volume
+func uploadVolume(conn *libvirt.Connect, vol *libvirt.StorageVol, r io.Reader, size int64) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	if err := vol.Upload(stream, 0, uint64(size), 0); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	for remaining := size; remaining > 0; {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), remaining)])
+		if err != nil {
+			_ = stream.Abort()
+			return err
+		}
+		for sent := 0; sent < n; {
+			m, err := stream.Send(buf[sent:n])
+			if err != nil {
+				_ = stream.Abort()
+				return err
+			}
+			sent += m
+		}
+		remaining -= int64(n)
+	}
+	return stream.Finish()
+}
+
+// rewriteImportXML renames the domain and its serial log, points its disks at the imported
+// volumes and replaces the UUID and MAC addresses if another domain on this host already uses them
+func rewriteImportXML(conn *libvirt.Connect, desc, name string, disks []copiedVolume) (string, error) {
+	def, err := parseDomainDef(desc)
+	if err != nil {
+		return "", err
+	}
+
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return "", err
+	}
+	usedMACs := map[string]string{}
+	uuidTaken := false
+	for i := range doms {
+		other, err := readDomainDef(&doms[i])
+		doms[i].Free()
+		if err != nil {
+			return "", err
+		}
+		if other.UUID == def.UUID {
+			uuidTaken = true
+		}
+		for _, iface := range other.Devices.Interfaces {
+			usedMACs[iface.MAC.Address] = other.Name
+		}
+	}
+
+	desc = setDomainName(desc, name)
+	desc = replaceNVRAM(desc, name)
+	desc = replaceConsoleLog(desc, name)
+	if uuidTaken {
+		desc = stripDomainUUID(desc)
+	}
+	desc = replaceMACs(desc, usedMACs, name, func(mac string) bool {
+		_, taken := usedMACs[mac]
+		return taken
+	})
+	return replaceDiskSources(desc, sourceMap(disks)), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job - a long-running operation executed in the background
+type Job struct {
+	ID         string      `json:"id" pb:"1"`
+	Type       string      `json:"type" pb:"2"`
+	Project    string      `json:"project,omitempty" pb:"3"`
+	State      string      `json:"state" pb:"4"`    // "running", "succeeded" or "failed"
+	Progress   float64     `json:"progress" pb:"5"` // percent, 0-100
+	Error      string      `json:"error,omitempty" pb:"6"`
+	Result     interface{} `json:"result,omitempty" pb:"7"`
+	CreatedAt  time.Time   `json:"created_at" pb:"8"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty" pb:"9"`
+	VM         string      `json:"-"` // domain name of the VM the job works on, if any
+}
+
+// jobHandle - the running side of a Job; the worker updates progress through it
+type jobHandle struct {
+	mu   sync.Mutex
+	job  Job
+	done chan struct{} // closed once the job has finished
+}
+
+// jobTTL - how long a finished job is kept for its result to be fetched, as long as the
+// Idempotency-Key that may replay it
+const jobTTL = idempotencyTTL
+
+var (
+	jobsMu    sync.Mutex
+	jobs      = map[string]*jobHandle{}
+	jobsSwept time.Time
+)
+
+// startJob registers a job of the given type in project ("" for none), working on the
+// VM vmName ("" for none), and runs fn in its own goroutine. fn's return values become the job's result or error. Jobs finished
+// more than jobTTL ago are dropped on the way.
+func startJob(jobType, project, vmName string, fn func(j *jobHandle) (interface{}, error)) *jobHandle {
+	j := &jobHandle{job: Job{
+		ID:        uuid.New().String(),
+		Type:      jobType,
+		Project:   project,
+		VM:        vmName,
+		State:     "running",
+		CreatedAt: time.Now().UTC(),
+	}, done: make(chan struct{})}
+
+	jobsMu.Lock()
+	if now := time.Now(); now.Sub(jobsSwept) > time.Hour {
+		for id, old := range jobs {
+			if job := old.snapshot(); job.FinishedAt != nil && now.Sub(*job.FinishedAt) > jobTTL {
+				delete(jobs, id)
+			}
+		}
+		jobsSwept = now
+	}
+	jobs[j.job.ID] = j
+	jobsMu.Unlock()
+
+	go func() {
+		result, err := fn(j)
+		j.finish(result, err)
+	}()
+	return j
+}
+
+// runningJobs - how many jobs haven't finished yet
+func runningJobs() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	n := 0
+	for _, j := range jobs {
+		if j.snapshot().State == "running" {
+			n++
+		}
+	}
+	return n
+}
+
+// lookupJob finds a job by ID
+func lookupJob(id string) (*jobHandle, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j, ok := jobs[id]
+	return j, ok
+}
+
+// lookupRequestJob finds the job named by the request's {id}, if it is of one of the
+// given types (any type when none are given) and the request's scope may see it. Under
+// /vm/{name} it must also be a job of that VM.
+func lookupRequestJob(r *http.Request, types ...string) (*jobHandle, bool) {
+	j, ok := lookupJob(r.PathValue("id"))
+	if !ok {
+		return nil, false
+	}
+	job := j.snapshot()
+	scope, err := requestScope(r)
+	if err != nil || (!scope.all && job.Project != scope.project) {
+		return nil, false
+	}
+	if name := r.PathValue("name"); name != "" && job.VM != scope.domainName(name) {
+		return nil, false
+	}
+	if len(types) == 0 {
+		return j, true
+	}
+	for _, t := range types {
+		if job.Type == t {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// handleGetJob - GET /api/v1/jobs/{id}
+// Any job: VM creations and clones as well as the exports, migrations, backups, block
+// jobs and conversions that also have their own endpoints
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Job %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// writeJobAccepted answers 202 with the job just started, pointing Location at it
+func writeJobAccepted(w http.ResponseWriter, j *jobHandle) {
+	job := j.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(ResponseData{Status: "accepted", Data: job})
+}
+
+// writeJobStarted answers a request that started j. v2 gets the job to poll. Creates and
+// clones ran synchronously before they became jobs, so v1 requests for them wait for the
+// job and get the answer they always did: message(result), or a 500 with the job's error.
+func writeJobStarted(w http.ResponseWriter, r *http.Request, j *jobHandle, message func(result interface{}) string) {
+	if apiVersion(r) != 1 {
+		writeJobAccepted(w, j)
+		return
+	}
+	job, ok := j.wait(r.Context())
+	if !ok {
+		return // the client went away, the job carries on
+	}
+	if job.State == "failed" {
+		writeErrorResponse(w, job.Error)
+		return
+	}
+	writeSuccessResponse(w, message(job.Result))
+}
+
+// wait blocks until the job has finished and returns it, or returns false once ctx is done
+func (j *jobHandle) wait(ctx context.Context) (Job, bool) {
+	select {
+	case <-j.done:
+		return j.snapshot(), true
+	case <-ctx.Done():
+		return Job{}, false
+	}
+}
+
+// setProgress records how far along the job is, in percent
+func (j *jobHandle) setProgress(pct float64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Progress = pct
+}
+
+func (j *jobHandle) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job
+}
+
+func (j *jobHandle) finish(result interface{}, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	defer close(j.done)
+
+	now := time.Now().UTC()
+	j.job.FinishedAt = &now
+	if err != nil {
+		j.job.State = "failed"
+		j.job.Error = err.Error()
+		log.Printf("Job %s (%s) failed: %v", j.job.ID, j.job.Type, err)
+		return
+	}
+	j.job.State = "succeeded"
+	j.job.Progress = 100
+	j.job.Result = result
+	log.Printf("Job %s (%s) succeeded", j.job.ID, j.job.Type)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// labelsNamespace, annotationsNamespace - URIs of the labels and annotations elements in
+// the domain <metadata>
+const (
+	labelsNamespace      = "https://github.com/rockybhanu/ramanuj-vm-service/labels"
+	annotationsNamespace = "https://github.com/rockybhanu/ramanuj-vm-service/annotations"
+)
+
+// Labels are short key/value pairs VMs can be selected by (owner, environment, expiry);
+// annotations hold longer notes that aren't. Keys look like Kubernetes ones: an optional
+// DNS prefix and "/", then a name of up to 63 characters.
+var (
+	labelKeyPattern   = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?/)?[A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+const (
+	maxLabels           = 64
+	maxAnnotationsBytes = 64 << 10
+)
+
+// keyValuesXML - our labels or annotations element in the domain <metadata>, one
+// <label>/<annotation> child per pair
+type keyValuesXML struct {
+	XMLName xml.Name
+	Entries []struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:"value,attr"`
+	} `xml:",any"`
+}
+
+// validateLabels checks the labels and annotations of a create request
+func validateLabels(labels, annotations map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("label %s: value %q must be at most 63 letters, digits, '.', '_' or '-', starting and ending with a letter or digit", k, v)
+		}
+	}
+	size := 0
+	for k, v := range annotations {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid annotation key %q", k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxAnnotationsBytes {
+		return fmt.Errorf("annotations take %d bytes, at most %d are allowed", size, maxAnnotationsBytes)
+	}
+	return nil
+}
+
+// domainLabels reads a domain's labels from its metadata
+func domainLabels(dom *libvirt.Domain) map[string]string {
+	return domainKeyValues(dom, labelsNamespace)
+}
+
+// domainAnnotations reads a domain's annotations from its metadata
+func domainAnnotations(dom *libvirt.Domain) map[string]string {
+	return domainKeyValues(dom, annotationsNamespace)
+}
+
+func domainKeyValues(dom *libvirt.Domain, namespace string) map[string]string {
+	values := map[string]string{}
+	doc, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, namespace, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		if !isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN_METADATA) {
+			log.Printf("Failed to read %s metadata: %v", namespace, err)
+		}
+		return values
+	}
+	var kv keyValuesXML
+	if err := xml.Unmarshal([]byte(doc), &kv); err != nil {
+		log.Printf("Failed to parse %s metadata: %v", namespace, err)
+		return values
+	}
+	for _, e := range kv.Entries {
+		values[e.Key] = e.Value
+	}
+	return values
+}
+
+// setDomainKeyValues writes labels or annotations into the domain's persistent
+// metadata, for domains defined from XML the service didn't generate (adopted ones)
+func setDomainKeyValues(dom *libvirt.Domain, namespace string, values map[string]string) error {
+	root, child := "labels", "label"
+	if namespace == annotationsNamespace {
+		root, child = "annotations", "annotation"
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var doc strings.Builder
+	doc.WriteString("<" + root + ">")
+	for _, k := range keys {
+		fmt.Fprintf(&doc, "<%s key='%s' value='%s'/>", child, xmlEscape(k), xmlEscape(values[k]))
+	}
+	doc.WriteString("</" + root + ">")
+	return dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, doc.String(), "vmsvc", namespace, libvirt.DOMAIN_AFFECT_CONFIG)
+}
+
+// labelRequirement - one comma-separated term of a label selector
+type labelRequirement struct {
+	key   string
+	op    string // "=", "!=", "exists" or "!exists"
+	value string
+}
+
+// labelSelector - all of its requirements have to hold
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses "key=value", "key!=value", "key" and "!key" terms joined by
+// commas, e.g. "env=ci,owner!=alice,expiry"
+func parseLabelSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req labelRequirement
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			req = labelRequirement{key: key, op: "!=", value: value}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			req = labelRequirement{key: key, op: "=", value: value}
+		} else if key, ok := strings.CutPrefix(term, "!"); ok {
+			req = labelRequirement{key: key, op: "!exists"}
+		} else {
+			req = labelRequirement{key: term, op: "exists"}
+		}
+		req.key, req.value = strings.TrimSpace(req.key), strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, fmt.Errorf("label selector term %q has no key", term)
+		}
+		sel = append(sel, req)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty label selector")
+	}
+	return sel, nil
+}
+
+// matches says whether labels satisfy every requirement of the selector
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		value, ok := labels[req.key]
+		switch req.op {
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Logging is structured JSON on stderr, through log/slog. Handlers log through
+// requestLog(r), so their records carry the request ID. The plain log.Printf calls left
+// in background work (jobs, janitors, schedulers) go through the same handler, as
+// records at level INFO.
+
+type requestInfoKey struct{}
+
+// requestInfo - what the middlewares learn about a request. withRequestID creates it and
+// withAuth fills in the caller. It is changed in place rather than by deriving a new
+// request, as the outer middlewares read what the mux recorded on theirs (r.Pattern).
+type requestInfo struct {
+	mu        sync.Mutex
+	id        string
+	logger    *slog.Logger
+	principal *Principal
+}
+
+// requestIDPattern - what a caller-supplied X-Request-ID may look like; anything else is
+// replaced rather than copied into logs and responses
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// initLogging installs the JSON handler as the default for slog and for the log package.
+// VM_SERVICE_LOG_LEVEL sets the minimum level: debug, info (the default), warn or error.
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(envOrDefault("VM_SERVICE_LOG_LEVEL", "info"))); err != nil {
+		log.Fatalf("Invalid VM_SERVICE_LOG_LEVEL: %v", err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// withRequestID gives every request an ID, taken from X-Request-ID if the caller sent a
+// usable one, echoes it in the X-Request-ID response header, makes a logger carrying it
+// available to handlers through requestLog, and logs the request once it's done.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		logger := slog.Default().With("request_id", id)
+		info := &requestInfo{id: id, logger: logger}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+
+		// Scrapes and probes would drown everything else
+		level := slog.LevelInfo
+		if r.URL.Path == "/metrics" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			level = slog.LevelDebug
+		}
+		attrs := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.code,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		}
+		if p := requestPrincipal(r); p != nil {
+			attrs = append(attrs, "user", p.Name)
+		}
+		logger.Log(r.Context(), level, "request", attrs...)
+	})
+}
+
+// requestID returns the ID withRequestID gave the request, "" outside a request
+func requestID(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// requestLog returns the request's logger, tagged with its request ID and, once known,
+// the caller
+func requestLog(r *http.Request) *slog.Logger {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// setRequestPrincipal records who is calling, for handlers and the access and audit logs
+func setRequestPrincipal(r *http.Request, p *Principal) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		info.principal = p
+		info.logger = info.logger.With("user", p.Name)
+	}
+}
+
+// requestPrincipal returns the authenticated caller, nil if there is none (auth is off,
+// or the endpoint doesn't need it)
+func requestPrincipal(r *http.Request) *Principal {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		defer info.mu.Unlock()
+		return info.principal
+	}
+	return nil
+}
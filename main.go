@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
 	"text/template"
 	"time"
 
@@ -15,232 +20,1290 @@ import (
 	libvirt "github.com/libvirt/libvirt-go"
 )
 
-var domainXMLTemplate *template.Template
+// domainTemplateFuncs - "xml" escapes a value for the domain XML; the template runs every
+// value through it, so request strings can't close an attribute or element and add
+// markup of their own
+var domainTemplateFuncs = template.FuncMap{
+	"xml": func(v interface{}) string { return xmlEscape(fmt.Sprint(v)) },
+}
+
+// xmlEscape escapes s for XML text and attribute values
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
 
 // RequestData - incoming JSON to define how the VM should be created
 type RequestData struct {
-	Name             string `json:"name"`
-	PrebuiltDiskPath string `json:"prebuilt_disk_path,omitempty"`
-	ISOImage         string `json:"iso_image,omitempty"`
-	MemoryMB         int    `json:"memory_mb"`
-	CPUs             int    `json:"cpus"`
-	DiskSizeGB       int    `json:"disk_size_gb"`
-}
+	Name     string     `json:"name"`
+	Host     string     `json:"host,omitempty"` // registered host to create the VM on, see placeVM if empty
+	ISOImage string     `json:"iso_image,omitempty"`
+	MemoryMB int        `json:"memory_mb"`
+	CPUs     int        `json:"cpus"`
+	Disks    []DiskSpec `json:"disks,omitempty"`
+	NICs     []NICSpec  `json:"nics,omitempty"`
+
+	// BaseImage - optional qcow2 golden image; the root disk is created as a linked clone of it
+	BaseImage string `json:"base_image,omitempty"`
+
+	// Image - name or tag of a catalog image: disk images become base_image, ISOs iso_image
+	Image string `json:"image,omitempty"`
+
+	// ImageURL - qcow2 image to download (and cache) and use as base_image.
+	// ImageChecksum - optional "sha256:<hex>" / "sha512:<hex>" the download must match.
+	ImageURL      string `json:"image_url,omitempty"`
+	ImageChecksum string `json:"image_checksum,omitempty"`
+
+	// StoragePool - libvirt pool new disks are allocated in (defaults to "default")
+	StoragePool string `json:"storage_pool,omitempty"`
+
+	// CloudInit - NoCloud user/meta/network data, attached to the VM as a seed ISO
+	CloudInit *CloudInit `json:"cloud_init,omitempty"`
+
+	// SSHAuthorizedKeys, Hostname - shortcuts rendered into cloud-init user-data for the
+	// image's default user, so callers don't have to write cloud-config themselves
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+	Hostname          string   `json:"hostname,omitempty"`
+
+	// Network - static address for the first NIC, written to cloud-init network-config
+	Network *NetworkSpec `json:"network,omitempty"`
+
+	// AntiAffinity - placement groups of the VM: it is never placed on a host with another
+	// VM of the same group
+	AntiAffinity []string `json:"anti_affinity,omitempty"`
+
+	// Labels - key/value pairs to find the VM by, e.g. in GET /api/v1/vm?label=;
+	// Annotations - free-form notes. Both are kept in the domain <metadata>, see labels.go.
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Password - initial guest password, only accepted with VM_SERVICE_ALLOW_PASSWORDS=true
+	Password *PasswordSpec `json:"password,omitempty"`
+
+	// Flavor - preset size and devices for whatever the request leaves out, see flavors.go
+	Flavor string `json:"flavor,omitempty"`
+
+	// Firmware - "bios" (default) or "uefi", see firmware.go
+	Firmware string `json:"firmware,omitempty"`
+	// SecureBoot - boot the UEFI firmware with Secure Boot enforced
+	SecureBoot bool `json:"secure_boot,omitempty"`
+	// TPM - add an emulated TPM 2.0, see tpm.go
+	TPM bool `json:"tpm,omitempty"`
+
+	// Hugepages - back the memory with host hugepages of HugepageSize ("2M" default,
+	// or "1G"), see hugepages.go
+	Hugepages    bool   `json:"hugepages,omitempty"`
+	HugepageSize string `json:"hugepage_size,omitempty"`
+
+	// CPUTune - vCPU, emulator and I/O thread pinning, see cputune.go
+	CPUTune *CPUTuneSpec `json:"cputune,omitempty"`
+	// NUMA - guest NUMA nodes and host memory binding, see numa.go
+	NUMA *NUMASpec `json:"numa,omitempty"`
+
+	// CPUMode - "host-passthrough" (default), "host-model" or "custom" with CPUModel;
+	// CPUFeatures - flags added or removed on top, see cpumodel.go
+	CPUMode     string           `json:"cpu_mode,omitempty"`
+	CPUModel    string           `json:"cpu_model,omitempty"`
+	CPUFeatures []CPUFeatureSpec `json:"cpu_features,omitempty"`
+	// Nested - expose vmx/svm so the guest can run VMs itself, see nested.go
+	Nested bool `json:"nested,omitempty"`
+
+	// Balloon - the memory balloon's settings, see balloon.go; without it the VM gets a
+	// virtio balloon with guest stats
+	Balloon *BalloonSpec `json:"balloon,omitempty"`
 
-// DiskDevice - represents a disk in the final domain XML
-type DiskDevice struct {
-	Dev  string // e.g., "vda", "vdb"
-	Path string // path to qcow2 on host
+	// MaxMemoryMB - what memory can grow to by hot-adding DIMMs into MemorySlots
+	// (default 16), see memhotplug.go
+	MaxMemoryMB int `json:"max_memory_mb,omitempty"`
+	MemorySlots int `json:"memory_slots,omitempty"`
+
+	// Hostdevs - host PCI devices passed through to the VM, see hostdevs.go
+	Hostdevs []HostdevSpec `json:"hostdevs,omitempty"`
+	// USBDevices - host USB devices passed through to the VM, see usb.go
+	USBDevices []USBDeviceSpec `json:"usb_devices,omitempty"`
+
+	// Template - the domain template variant to render, see templates.go; empty for the
+	// default one
+	Template string `json:"template,omitempty"`
+
+	// XML - raw domain XML merged into the generated document, only accepted with
+	// VM_SERVICE_ALLOW_XML_OVERRIDES=true, see xmloverride.go
+	XML *XMLOverride `json:"xml,omitempty"`
+
+	// VNC, SPICE - graphical consoles; with neither the VM gets a default SPICE display,
+	// with only VNC it gets no SPICE one
+	VNC   *VNCSpec   `json:"vnc,omitempty"`
+	SPICE *SPICESpec `json:"spice,omitempty"`
+
+	// Project - the caller's project, which the VM is created in; Name is then the
+	// domain name, qualified with the project, see tenancy.go
+	Project string `json:"-"`
+	// Owner - who is creating the VM (see requestUser), for its record
+	Owner string `json:"-"`
+
+	// Deprecated: use Disks. Kept so existing callers keep working,
+	// see resolveDiskSpecs for how these map onto the disks array.
+	PrebuiltDiskPath string `json:"prebuilt_disk_path,omitempty"`
+	DiskSizeGB       int    `json:"disk_size_gb,omitempty"`
 }
 
 // TemplateData - all fields we inject into vm-template.xml
 type TemplateData struct {
-	Name       string
-	UUID       string
-	MemoryKiB  int
-	CPUs       int
-	MacAddress string
+	Name      string
+	UUID      string
+	MemoryKiB int
+	CPUs      int
 
-	// Disks: a slice for one (root) + optional second
+	// Disks: every disk from the request, in order
 	Disks []DiskDevice
+	// Any disk on bus "scsi" needs a virtio-scsi controller
+	HasSCSI bool
+
+	// NICs: every network interface, in order
+	NICs []NICDevice
 
 	// If user specified an ISO, we attach a CDROM
 	HasISO   bool
 	ISOImage string
+	ISODev   string
+
+	// cloud-init NoCloud seed, a second (non-bootable) CD-ROM
+	HasSeed bool
+	SeedISO string
+	SeedDev string
+
+	// Graphics: either or both of a VNC and a SPICE console
+	VNC   *VNCSpec
+	SPICE *SPICESpec
+
+	// OVMF loader and NVRAM, for UEFI VMs
+	UEFI *UEFIFirmware
+	// swtpm-backed TPM 2.0
+	TPM bool
+
+	// Hugepage size backing the memory, 0 for normal pages
+	HugepageKiB int
+
+	// Pinning of the vCPUs, emulator and I/O threads
+	CPUTune *CPUTune
+	// Guest NUMA nodes and host NUMA binding
+	NUMA *GuestNUMA
+	// CPU mode, model and features
+	CPU GuestCPU
+	// Memory balloon
+	Balloon Balloon
+	// Memory hotplug limit and DIMM slots
+	MaxMemory *MaxMemory
+
+	// Host PCI devices passed through with VFIO
+	Hostdevs []pciAddressXML
+	// Host USB devices
+	USBDevices []USBDevice
+
+	// File the serial console output is copied to
+	ConsoleLog string
+
+	// Anti-affinity groups, kept in the domain <metadata> for the scheduler
+	AntiAffinity []string
+
+	// Project owning the VM, also kept in the <metadata>
+	Project string
+
+	// Labels and annotations, kept in the <metadata>
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 type ResponseData struct {
-	Status  string `json:"status"`
-	Message string `json:"message,omitempty"`
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
 }
 
+// libvirtURI - the local hypervisor, the only host unless VM_SERVICE_HOSTS is set.
+// VM_SERVICE_LIBVIRT_URI changes it, e.g. to qemu:///session.
+var libvirtURI = envOrDefault("VM_SERVICE_LIBVIRT_URI", "qemu:///system")
+
+// templatePath - the domain XML template, VM_SERVICE_TEMPLATE; relative paths are taken
+// from the working directory
+var templatePath = envOrDefault("VM_SERVICE_TEMPLATE", "vm-template.xml")
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	initLogging()
 
-	// Load the external XML template at startup
-	content, err := os.ReadFile("vm-template.xml")
-	if err != nil {
-		log.Fatalf("Failed to read vm-template.xml: %v", err)
+	if err := loadHosts(); err != nil {
+		log.Fatalf("Invalid host configuration: %v", err)
 	}
-	domainXMLTemplate, err = template.New("domainXML").Parse(string(content))
-	if err != nil {
-		log.Fatalf("Failed to parse vm-template.xml as template: %v", err)
+	if err := loadAPIKeys(); err != nil {
+		log.Fatalf("Invalid API key configuration: %v", err)
+	}
+	if err := loadRoles(); err != nil {
+		log.Fatalf("Invalid role configuration: %v", err)
+	}
+	if err := loadProjects(); err != nil {
+		log.Fatalf("Invalid project configuration: %v", err)
+	}
+	if err := loadAPIVersioning(); err != nil {
+		log.Fatalf("Invalid API version configuration: %v", err)
+	}
+
+	// Load the external XML templates at startup
+	if err := loadTemplates(); err != nil {
+		log.Fatalf("Failed to load domain templates: %v", err)
+	}
+
+	if err := imageCatalog.load(); err != nil {
+		log.Fatalf("Failed to load image catalog: %v", err)
+	}
+	if err := snapshotPolicies.load(); err != nil {
+		log.Fatalf("Failed to load snapshot policies: %v", err)
+	}
+	if err := portForwards.load(); err != nil {
+		log.Fatalf("Failed to load port forwards: %v", err)
+	}
+	if err := webhooks.load(); err != nil {
+		log.Fatalf("Failed to load webhooks: %v", err)
+	}
+	if err := quotas.load(); err != nil {
+		log.Fatalf("Failed to load quotas: %v", err)
+	}
+	if err := flavors.load(); err != nil {
+		log.Fatalf("Failed to load flavors: %v", err)
+	}
+	if err := vmRecords.load(); err != nil {
+		log.Fatalf("Failed to load VM records: %v", err)
 	}
 }
 
 func main() {
+	if err := checkAuthConfigured(); err != nil {
+		log.Fatalf("Refusing to start: %v", err)
+	}
+
+	// Before anything connects to libvirt, so every connection can deliver events
+	if err := startEventLoop(); err != nil {
+		log.Fatalf("Failed to start libvirt event loop: %v", err)
+	}
+
 	http.HandleFunc("/api/v1/vm", handleCreateVM)
-	log.Println("padmini-vm-service listening on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	http.HandleFunc("GET /api/v1/vm", handleListVMs)
+	http.HandleFunc("DELETE /api/v1/vm", handleBulkDeleteVMs)
+	http.HandleFunc("GET /api/v1/vm/{name}", handleGetVM)
+	http.HandleFunc("DELETE /api/v1/vm/{name}", handleDeleteVM)
+	http.HandleFunc("POST /api/v1/vm/{name}/start", handleStartVM)
+	http.HandleFunc("POST /api/v1/vm/{name}/stop", handleStopVM)
+	http.HandleFunc("POST /api/v1/vm/import", handleImportVM)
+	http.HandleFunc("POST /api/v1/vm/batch", handleBatchCreateVM)
+	http.HandleFunc("GET /api/v1/vm/{name}/disks", handleGetVMDisks)
+	http.HandleFunc("GET /api/v1/vm/{name}/addresses", handleGetVMAddresses)
+	http.HandleFunc("GET /api/v1/vm/{name}/stats", handleGetVMStats)
+	http.HandleFunc("GET /api/v1/vm/{name}/balloon", handleGetBalloon)
+	http.HandleFunc("PUT /api/v1/vm/{name}/balloon", handleSetBalloon)
+	http.HandleFunc("POST /api/v1/vm/{name}/memory", handleHotplugMemory)
+	http.HandleFunc("GET /api/v1/vm/{name}/graphics", handleGetVMGraphics)
+	http.HandleFunc("GET /api/v1/vm/{name}/console", handleGetConsole)
+	http.HandleFunc("GET /api/v1/vm/{name}/console-log", handleGetConsoleLog)
+	http.HandleFunc("GET /api/v1/console/ws", handleConsoleWebsocket)
+	http.HandleFunc("GET /api/v1/vm/{name}/agent/ping", handleAgentPing)
+	http.HandleFunc("POST /api/v1/vm/{name}/agent/exec", handleAgentExec)
+	http.HandleFunc("GET /api/v1/vm/{name}/agent/file", handleReadGuestFile)
+	http.HandleFunc("PUT /api/v1/vm/{name}/agent/file", handleWriteGuestFile)
+	http.HandleFunc("POST /api/v1/vm/{name}/clone", handleCloneVM)
+	http.HandleFunc("POST /api/v1/vm/{name}/adopt", handleAdoptVM)
+	http.HandleFunc("POST /api/v1/vm/{name}/migrate", handleMigrateVM)
+	http.HandleFunc("GET /api/v1/vm/{name}/migrations/{id}", handleGetMigration)
+	http.HandleFunc("POST /api/v1/vm/{name}/export", handleExportVM)
+	http.HandleFunc("GET /api/v1/vm/{name}/exports/{id}", handleGetExport)
+	http.HandleFunc("GET /api/v1/vm/{name}/snapshots", handleListSnapshots)
+	http.HandleFunc("POST /api/v1/vm/{name}/snapshots", handleCreateSnapshot)
+	http.HandleFunc("GET /api/v1/vm/{name}/snapshots/{snapshot}", handleGetSnapshot)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/snapshots/{snapshot}", handleDeleteSnapshot)
+	http.HandleFunc("POST /api/v1/vm/{name}/snapshots/{snapshot}/revert", handleRevertSnapshot)
+	http.HandleFunc("POST /api/v1/vm/{name}/disks/{disk}/blockcommit", handleBlockCommit)
+	http.HandleFunc("POST /api/v1/vm/{name}/disks/{disk}/blockpull", handleBlockPull)
+	http.HandleFunc("GET /api/v1/vm/{name}/blockjobs/{id}", handleGetBlockJob)
+	http.HandleFunc("GET /api/v1/vm/{name}/snapshot-policy", handleGetSnapshotPolicy)
+	http.HandleFunc("PUT /api/v1/vm/{name}/snapshot-policy", handlePutSnapshotPolicy)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/snapshot-policy", handleDeleteSnapshotPolicy)
+	http.HandleFunc("GET /api/v1/snapshot-policies", handleListSnapshotPolicies)
+	http.HandleFunc("GET /api/v1/vm/{name}/checkpoints", handleListCheckpoints)
+	http.HandleFunc("POST /api/v1/vm/{name}/checkpoints", handleCreateCheckpoint)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/checkpoints/{checkpoint}", handleDeleteCheckpoint)
+	http.HandleFunc("POST /api/v1/vm/{name}/hostdevs", handleAttachHostdev)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/hostdevs/{address}", handleDetachHostdev)
+	http.HandleFunc("POST /api/v1/vm/{name}/usb", handleAttachUSB)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/usb/{device}", handleDetachUSB)
+	http.HandleFunc("POST /api/v1/vm/{name}/backups", handleStartBackup)
+	http.HandleFunc("GET /api/v1/vm/{name}/backups/{id}", handleGetBackup)
+	http.HandleFunc("GET /api/v1/vm/{name}/port-forwards", handleListPortForwards)
+	http.HandleFunc("POST /api/v1/vm/{name}/port-forwards", handleAddPortForward)
+	http.HandleFunc("DELETE /api/v1/vm/{name}/port-forwards/{id}", handleRemovePortForward)
+	http.HandleFunc("GET /api/v1/jobs/{id}", handleGetJob)
+	http.HandleFunc("GET /api/v1/records", handleListRecords)
+
+	http.HandleFunc("GET /api/v1/images", handleListImages)
+	http.HandleFunc("POST /api/v1/images", handleRegisterImage)
+	http.HandleFunc("POST /api/v1/images/upload", handleUploadImage)
+	http.HandleFunc("GET /api/v1/images/uploads/{id}", handleGetUpload)
+	http.HandleFunc("POST /api/v1/images/convert", handleConvertImage)
+	http.HandleFunc("GET /api/v1/images/conversions/{id}", handleGetConversion)
+	http.HandleFunc("GET /api/v1/images/{name}", handleGetImage)
+	http.HandleFunc("DELETE /api/v1/images/{name}", handleDeleteImage)
+	http.HandleFunc("POST /api/v1/images/{name}/tags", handleAddImageTags)
+	http.HandleFunc("DELETE /api/v1/images/{name}/tags/{tag}", handleRemoveImageTag)
+
+	http.HandleFunc("GET /api/v1/pools", handleListPools)
+	http.HandleFunc("POST /api/v1/pools", handleCreatePool)
+	http.HandleFunc("GET /api/v1/pools/{name}", handleGetPool)
+	http.HandleFunc("POST /api/v1/pools/{name}/refresh", handleRefreshPool)
+
+	http.HandleFunc("GET /api/v1/events", handleEvents)
+	http.HandleFunc("GET /api/v1/audit", handleQueryAudit)
+	http.HandleFunc("GET /api/v1/webhooks", handleListWebhooks)
+	http.HandleFunc("POST /api/v1/webhooks", handleCreateWebhook)
+	http.HandleFunc("DELETE /api/v1/webhooks/{id}", handleDeleteWebhook)
+	http.HandleFunc("GET /api/v1/quotas", handleListQuotas)
+	http.HandleFunc("GET /api/v1/projects/{project}/quota", handleGetQuota)
+	http.HandleFunc("PUT /api/v1/projects/{project}/quota", handlePutQuota)
+	http.HandleFunc("DELETE /api/v1/projects/{project}/quota", handleDeleteQuota)
+	http.HandleFunc("GET /metrics", handleMetrics)
+	http.HandleFunc("GET /healthz", handleHealthz)
+	http.HandleFunc("GET /readyz", handleReadyz)
+	http.HandleFunc("GET /api/v1/openapi.json", handleOpenAPI)
+	http.HandleFunc("GET /api/v1/docs", handleAPIDocs)
+	http.HandleFunc("POST /vmservice.v1.VMService/{method}", handleGRPC)
+
+	http.HandleFunc("GET /api/v1/templates", handleListTemplates)
+	http.HandleFunc("GET /api/v1/flavors", handleListFlavors)
+	http.HandleFunc("GET /api/v1/flavors/{name}", handleGetFlavor)
+	http.HandleFunc("PUT /api/v1/flavors/{name}", handlePutFlavor)
+	http.HandleFunc("DELETE /api/v1/flavors/{name}", handleDeleteFlavor)
+
+	http.HandleFunc("GET /api/v1/hosts", handleListHosts)
+	http.HandleFunc("GET /api/v1/hosts/{name}", handleGetHost)
+	http.HandleFunc("GET /api/v1/host/sriov", handleListSRIOV)
+	http.HandleFunc("GET /api/v1/host/pci", handleListPCIDevices)
+
+	http.HandleFunc("GET /api/v1/networks", handleListNetworks)
+	http.HandleFunc("POST /api/v1/networks", handleCreateNetwork)
+	http.HandleFunc("GET /api/v1/networks/{name}", handleGetNetwork)
+	http.HandleFunc("POST /api/v1/networks/{name}/start", handleStartNetwork)
+	http.HandleFunc("DELETE /api/v1/networks/{name}", handleDeleteNetwork)
+
+	go runSnapshotScheduler()
+	for _, h := range hypervisorHosts {
+		eventWatchers.Add(1)
+		go watchHostEvents(h.Name)
+	}
+	go runWebhookDispatcher()
+	if tracesEndpoint != "" {
+		go runSpanExporter()
+	}
+
+	// Port forwards live in iptables, which starts out empty after a reboot
+	if err := applyPortForwards(); err != nil {
+		log.Printf("Failed to apply port forwards: %v", err)
+	}
+	go runPortForwardJanitor()
+	go runRecordReconciler()
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	srv := &http.Server{
+		Addr:      envOrDefault("VM_SERVICE_LISTEN", ":8080"),
+		Handler:   withRequestID(withAPIVersion(withTracing(withMetrics(withAudit(withAuth(withRateLimit(withRBAC(http.DefaultServeMux, withHostCheck(http.DefaultServeMux))))))))),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		log.Printf("padmini-vm-service listening on %s (HTTPS)", srv.Addr)
+		serveUntilSignalled(srv, func() error { return srv.ListenAndServeTLS("", "") })
+	} else {
+		log.Printf("padmini-vm-service listening on %s", srv.Addr)
+		serveUntilSignalled(srv, srv.ListenAndServe)
 	}
 }
 
+// handleCreateVM - POST /api/v1/vm[?dry_run=true]
 func handleCreateVM(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	logger := requestLog(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Error reading request body", "error", err)
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
 	var req RequestData
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("Error decoding JSON: %v", err)
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("Error decoding JSON", "error", err)
 		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
 		return
 	}
 
+	// A dry run starts nothing, so there is no job for a retry to answer with
+	if r.URL.Query().Get("dry_run") == "true" {
+		previewCreate(w, r, req)
+		return
+	}
+
+	// A retry of a create that already started answers with the same job
+	claim, ok := claimIdempotencyKey(w, r, body)
+	if !ok {
+		return
+	}
+	defer claim.release()
+
+	if job := startCreate(w, r, req); job != nil {
+		claim.commit(job.snapshot().ID)
+		writeCreateStarted(w, r, job)
+	}
+}
+
+// writeCreateStarted answers a create that started job, see writeJobStarted
+func writeCreateStarted(w http.ResponseWriter, r *http.Request, job *jobHandle) {
+	writeJobStarted(w, r, job, func(result interface{}) string { return result.(CreateResult).Message })
+}
+
+// startCreate checks a create request and starts the job that creates the VM. If the
+// request is refused it writes the error response and returns nil.
+func startCreate(w http.ResponseWriter, r *http.Request, req RequestData) *jobHandle {
+	plan := planCreate(w, r, req, false)
+	if plan == nil {
+		return nil
+	}
+
+	// STEP 2 onwards allocates the disks and can take minutes, so it runs as a job
+	logger := requestLog(r)
+	ctx, releaseCtx := jobContext(r.Context())
+	job := startJob("vm-create", plan.req.Project, plan.req.Name, func(j *jobHandle) (interface{}, error) {
+		defer releaseCtx()
+		defer plan.release()
+		return createVM(ctx, j, logger, plan.req, plan.specs, plan.nics, plan.cloudInit, plan.vmName, plan.schedule)
+	})
+	logger.Info("Creating VM", "vm", plan.req.Name, "host", hostName(plan.req.Host), "job", job.snapshot().ID)
+	return job
+}
+
+// createPlan - a create request that passed every check, with the disks, NICs and
+// cloud-init settled, and the name, quota and slot reservations held for it
+type createPlan struct {
+	req       RequestData
+	specs     []DiskSpec
+	nics      []NICDevice
+	cloudInit *CloudInit
+	vmName    string
+	schedule  bool
+	held      []func()
+}
+
+// release drops the plan's reservations
+func (p *createPlan) release() {
+	for _, release := range p.held {
+		release()
+	}
+}
+
+// planCreate runs every check of a create and works out what it will make, up to the
+// point where disks get allocated. With dryRun an image_url isn't downloaded, only looked
+// for in the cache. If the request is refused it writes the error response and returns nil.
+func planCreate(w http.ResponseWriter, r *http.Request, req RequestData, dryRun bool) *createPlan {
+	logger := requestLog(r)
+
+	if err := applyFlavor(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
 	// Basic validation
 	if req.Name == "" || req.MemoryMB <= 0 || req.CPUs <= 0 {
-		msg := fmt.Sprintf("Missing/invalid request fields: %+v", req)
-		log.Println(msg)
+		// Not %+v of req: it can carry passwords and disk passphrases
+		msg := fmt.Sprintf("Missing/invalid request fields: name=%q memory_mb=%d cpus=%d", req.Name, req.MemoryMB, req.CPUs)
+		logger.Warn(msg)
 		http.Error(w, msg, http.StatusBadRequest)
-		return
+		return nil
+	}
+	if err := validateVMName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
 	}
 
-	// STEP 1: Build our list of disk devices
-	// (We might create or skip creation depending on user input)
-
-	// We'll hold two potential disk devices: root (vda), optional data (vdb)
-	var disks []DiskDevice
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return nil
+	}
+	req.Project, req.Name, req.Owner = scope.project, scope.domainName(req.Name), requestUser(r)
 
-	rootDev := "vda"
-	var rootDiskPath string
+	if req.Host == "" {
+		req.Host = requestHost(r)
+	}
+	if _, ok := lookupHost(req.Host); !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Host %q not found", req.Host))
+		return nil
+	}
+	if err := validateAntiAffinity(req.AntiAffinity); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateLabels(req.Labels, req.Annotations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if _, err := lookupTemplate(req.Template); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateFirmware(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	pageKiB, err := hugepageKiB(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateCPUTune(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateNUMA(req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid numa: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateCPUModel(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateNested(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateBalloon(req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid balloon: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateMaxMemory(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	hostdevs, err := resolveHostdevs(req.Hostdevs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	// With several hosts and none named, the scheduler picks one once the disks are known
+	schedule := req.Host == "" && len(hypervisorHosts) > 1
+	usbDevs, err := resolveUSBDevices(req.USBDevices)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	// PCI addresses and USB devices are one host's, the scheduler can't move them to another
+	if schedule && len(hostdevs) > 0 {
+		http.Error(w, "hostdevs require a host", http.StatusBadRequest)
+		return nil
+	}
+	if schedule && len(usbDevs) > 0 {
+		http.Error(w, "usb_devices require a host", http.StatusBadRequest)
+		return nil
+	}
+	// The catalog and the download cache live on this machine; remote hosts take
+	// base_image/iso_image paths as they exist there
+	if !schedule && !isLocalHost(req.Host) && (req.Image != "" || req.ImageURL != "") {
+		msg := fmt.Sprintf("image and image_url are not supported on remote host %q", req.Host)
+		logger.Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil
+	}
 
-	if req.PrebuiltDiskPath != "" {
-		// Use the existing qcow2 as the root disk
-		rootDiskPath = req.PrebuiltDiskPath
-		// Don't create a new file for the root disk
-		log.Printf("User provided an existing disk for root: %s", rootDiskPath)
-	} else {
-		// If the user didn't provide a prebuilt disk, create one for root
-		rootDiskPath = fmt.Sprintf("/var/lib/libvirt/images/%s.qcow2", req.Name)
-		if err := createQcow2Disk(rootDiskPath, req.DiskSizeGB); err != nil {
-			errMsg := fmt.Sprintf("Failed to create root disk: %v", err)
-			log.Println(errMsg)
+	// A taken name would only fail at define, after the image is fetched and the disks
+	// are allocated; without a host yet, the name must be free on all of them
+	releaseName, ok := reserveVMName(req.Name)
+	if !ok {
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is already being created", scope.vmName(req.Name)))
+		return nil
+	}
+	// The name, quota and slot reservations are held by the job once it starts, and
+	// dropped here if the request is refused before that
+	var held []func()
+	defer func() {
+		for _, release := range held {
+			release()
+		}
+	}()
+	held = append(held, releaseName)
+	candidates := []string{req.Host}
+	if schedule {
+		candidates = nil
+		for _, h := range hypervisorHosts {
+			candidates = append(candidates, h.Name)
+		}
+	}
+	for _, h := range candidates {
+		exists, err := domainExists(h, req.Name)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to check whether VM %q exists: %v", req.Name, err)
+			logger.Error(errMsg)
 			writeErrorResponse(w, errMsg)
-			return
+			return nil
+		}
+		if exists {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q already exists on host %s", scope.vmName(req.Name), hostName(h)))
+			return nil
 		}
 	}
 
-	// Add root disk to the slice
-	disks = append(disks, DiskDevice{
-		Dev:  rootDev,
-		Path: rootDiskPath,
-	})
+	// Catalog images resolve to a host path used as base_image or iso_image
+	if req.Image != "" {
+		if err := applyCatalogImage(&req); err != nil {
+			msg := fmt.Sprintf("Invalid image: %v", err)
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
+		}
+	}
 
-	// If user wants an additional disk (req.DiskSizeGB > 0) AND they used a prebuilt root,
-	// we can create that new disk as "vdb". If they used a prebuilt root *and* gave a size,
-	// we interpret that as "I want a second data disk."
-	//
-	// BUT if they provided a prebuilt disk and also "disk_size_gb", we have to decide:
-	// do we treat the disk_size_gb as "root" or "data"?
-	// We'll interpret it as an extra data disk (since the user root is from prebuilt).
-	// If user is installing from ISO onto a new root, that also uses disk_size_gb above
-	// (already created for vda). So let's handle a potential second disk carefully:
-
-	// We'll do a simple rule:
-	// - If PrebuiltDiskPath != "" and DiskSizeGB > 0 => create a second disk as vdb.
-	// - If PrebuiltDiskPath == "" => we used DiskSizeGB for the root disk already (vda).
-	//   The user can specify a separate "data_size_gb" field if we wanted a second disk
-	//   but let's keep it simple for now. We'll assume they only do 1 disk in that scenario.
-
-	// For a more thorough approach, you might define an array of volumes or something similar in the API.
-	if req.PrebuiltDiskPath != "" && req.DiskSizeGB > 0 {
-		dataDiskPath := fmt.Sprintf("/var/lib/libvirt/images/%s-data.qcow2", req.Name)
-		if err := createQcow2Disk(dataDiskPath, req.DiskSizeGB); err != nil {
-			errMsg := fmt.Sprintf("Failed to create additional data disk: %v", err)
-			log.Println(errMsg)
-			writeErrorResponse(w, errMsg)
-			return
+	// Images given by URL are fetched into the local cache and then used like base_image
+	if req.ImageURL != "" {
+		if req.BaseImage != "" || req.PrebuiltDiskPath != "" {
+			msg := "image_url cannot be combined with base_image/prebuilt_disk_path"
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
+		}
+		var imagePath string
+		if dryRun {
+			imagePath, err = imageCachePath(req.ImageURL, req.ImageChecksum)
+			if err != nil {
+				msg := fmt.Sprintf("Invalid image_checksum: %v", err)
+				logger.Warn(msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return nil
+			}
+		} else {
+			_, span := startSpan(r.Context(), "fetch image", "url", req.ImageURL)
+			imagePath, err = fetchImage(r.Context(), req.ImageURL, req.ImageChecksum)
+			span.end(err)
+			if err != nil {
+				if errors.Is(err, errImageNotStandalone) {
+					msg := fmt.Sprintf("image_url is not usable: %v", err)
+					logger.Warn(msg)
+					writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+					return nil
+				}
+				errMsg := fmt.Sprintf("Failed to fetch image: %v", err)
+				logger.Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return nil
+			}
+		}
+		// A preview can't look inside an image that isn't in the cache yet
+		_, statErr := os.Stat(imagePath)
+		if !dryRun || statErr == nil {
+			if _, err := qcow2VirtualSize(imagePath); err != nil {
+				msg := fmt.Sprintf("image_url must point at a qcow2 image: %v", err)
+				logger.Warn(msg)
+				http.Error(w, msg, http.StatusBadRequest)
+				return nil
+			}
+		}
+		req.BaseImage = imagePath
+	}
+
+	// v2 dropped the single-disk fields (see resolveDiskSpecs for what v1 makes of them)
+	if apiVersion(r) >= 2 && (req.PrebuiltDiskPath != "" || req.DiskSizeGB != 0) {
+		msg := "prebuilt_disk_path and disk_size_gb are not part of /api/v2, use disks"
+		logger.Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil
+	}
+
+	// Work out which disks the VM gets before touching libvirt
+	specs, err := resolveDiskSpecs(req)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid disks: %v", err)
+		logger.Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil
+	}
+	if err := validateCreateLimits(req, specs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := validateCreatePaths(req, specs); err != nil {
+		logger.Warn("Refused host path", "error", err)
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return nil
+	}
+
+	add := QuotaUsage{VMs: 1, VCPUs: req.CPUs, MemoryMB: req.MemoryMB}
+	for _, s := range specs {
+		add.DiskGB += s.SizeGB
+	}
+	release, err := reserveQuota(req.Project, add)
+	if err != nil {
+		writeQuotaError(w, r, err)
+		return nil
+	}
+	held = append(held, release)
+
+	if schedule {
+		_, span := startSpan(r.Context(), "place VM")
+		req.Host, err = placeVM(req, specs, req.Image != "" || req.ImageURL != "")
+		span.setAttrs("host", req.Host)
+		span.end(err)
+		if err != nil {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Cannot place VM: %v", err))
+			return nil
+		}
+	} else if !preflightHost(w, r, req, specs) {
+		return nil
+	}
+
+	if req.Password != nil {
+		if !allowPasswords {
+			msg := "Password injection is disabled, set VM_SERVICE_ALLOW_PASSWORDS=true to enable it"
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusForbidden)
+			return nil
+		}
+		if err := req.Password.normalize(); err != nil {
+			msg := fmt.Sprintf("Invalid password: %v", err)
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
 		}
+	}
 
-		// Add second disk as vdb
-		disks = append(disks, DiskDevice{
-			Dev:  "vdb",
-			Path: dataDiskPath,
-		})
+	if req.XML != nil {
+		if !allowXMLOverrides {
+			msg := "XML overrides are disabled, set VM_SERVICE_ALLOW_XML_OVERRIDES=true to enable them"
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusForbidden)
+			return nil
+		}
+		if p := requestPrincipal(r); p != nil && p.Role != roleAdmin {
+			writeErrorStatus(w, http.StatusForbidden, fmt.Sprintf("XML overrides need the %s role, %s has %s", roleAdmin, p.Name, p.Role))
+			return nil
+		}
+		if err := req.XML.validate(); err != nil {
+			msg := fmt.Sprintf("Invalid xml: %v", err)
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
+		}
 	}
 
-	// STEP 2: Connect to libvirt
-	conn, err := libvirt.NewConnect("qemu:///system")
+	if req.VNC != nil {
+		if err := req.VNC.validate(); err != nil {
+			msg := fmt.Sprintf("Invalid vnc: %v", err)
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
+		}
+	}
+	if req.SPICE != nil {
+		if err := req.SPICE.validate(); err != nil {
+			msg := fmt.Sprintf("Invalid spice: %v", err)
+			logger.Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	nics, err := resolveNICs(req)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid nics: %v", err)
+		logger.Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil
+	}
+
+	// STEP 1: Connect to libvirt on the chosen host
+	conn, err := connectHost(req.Host)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
-		log.Println(errMsg)
+		logger.Error(errMsg)
 		writeErrorResponse(w, errMsg)
-		return
+		return nil
+	}
+	defer conn.Close()
+
+	// STEP 1b: Give the NICs MACs no other domain on the host uses, and SR-IOV NICs a VF
+	if err := assignMACs(conn, req.Name, nics); err != nil {
+		if errors.Is(err, errMACInUse) {
+			writeErrorStatus(w, http.StatusConflict, err.Error())
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to assign MAC addresses: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := assignVFs(conn, req.Name, nics); err != nil {
+		if errors.Is(err, errVFUnavailable) {
+			writeErrorStatus(w, http.StatusConflict, err.Error())
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to assign SR-IOV VFs: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := checkHostdevs(conn, req.Name, hostdevs); err != nil {
+		if errors.Is(err, errHostdevUnavailable) {
+			writeErrorStatus(w, http.StatusConflict, err.Error())
+			return nil
+		}
+		if errors.Is(err, errHostdevUnusable) {
+			writeErrorStatus(w, http.StatusUnprocessableEntity, err.Error())
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to check PCI devices: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := checkHugepages(conn, pageKiB, req.MemoryMB); err != nil {
+		msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+		logger.Warn(msg)
+		writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+		return nil
+	}
+
+	if err := resolveCPUTune(conn, &req); err != nil {
+		if errors.Is(err, errCPUsUnavailable) {
+			msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+			logger.Warn(msg)
+			writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to pin CPUs: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := checkNUMA(conn, req); err != nil {
+		if errors.Is(err, errNUMAUnavailable) {
+			msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+			logger.Warn(msg)
+			writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to check NUMA nodes: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := checkCPUModel(conn, req); err != nil {
+		if errors.Is(err, errCPUModelUnavailable) {
+			msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+			logger.Warn(msg)
+			writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to check CPU model: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	if err := resolveNested(conn, &req); err != nil {
+		if errors.Is(err, errNestedUnsupported) {
+			msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+			logger.Warn(msg)
+			writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+			return nil
+		}
+		errMsg := fmt.Sprintf("Failed to check nested virtualization: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return nil
+	}
+
+	// The network-config matches the first NIC by its MAC, so this waits for assignMACs
+	cloudInit, err := resolveCloudInit(req, nics[0].MAC)
+	if err != nil {
+		msg := fmt.Sprintf("Invalid cloud-init settings: %v", err)
+		logger.Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil
+	}
+
+	plan := &createPlan{req: req, specs: specs, nics: nics, cloudInit: cloudInit, vmName: scope.vmName(req.Name), schedule: schedule, held: held}
+	held = nil
+	return plan
+}
+
+// CreateResult - the result of a finished vm-create job
+type CreateResult struct {
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+	Message string `json:"message"`
+}
+
+// createVM does the slow part of a create once the request has been checked: allocates
+// the disks, builds the cloud-init seed, defines and starts the domain. Everything it
+// makes is recorded in a rollback, so a failed create leaves no volumes, seeds or
+// domains behind; so does one whose ctx is cancelled by a shutdown before the domain is defined.
+func createVM(ctx context.Context, j *jobHandle, logger *slog.Logger, req RequestData, specs []DiskSpec, nics []NICDevice, cloudInit *CloudInit, vmName string, scheduled bool) (interface{}, error) {
+	logger = logger.With("job", j.snapshot().ID)
+
+	// Waits its turn behind the other creations rather than failing
+	releaseSlot, err := acquireCreateSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+	j.setProgress(5)
+
+	conn, err := connectHost(req.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect libvirt: %v", err)
 	}
 	defer conn.Close()
 
+	// STEP 2: Allocate any new disks as volumes in the storage pool.
+	// If an ISO is attached it boots first, followed by the bootable disk(s).
+	poolName := requestPool(req)
+
+	firstDiskBootOrder := 1
+	if req.ISOImage != "" {
+		firstDiskBootOrder = 2
+	}
+	backend, err := openStorageBackend(conn, poolName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage pool: %v", err)
+	}
+	defer backend.Free()
+
+	rb := &rollback{}
+	defer rb.run()
+
+	_, span := startSpan(ctx, "prepare disks", "pool", poolName, "disks", len(specs))
+	disks, err := prepareDisks(conn, backend, req.Name, specs, firstDiskBootOrder, rb)
+	span.end(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare disks: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cancelled after preparing disks: %v", err)
+	}
+	j.setProgress(60)
+
+	// STEP 2b: Build the cloud-init seed, if asked for
+	var seedISO string
+	if cloudInit != nil {
+		_, span := startSpan(ctx, "build seed ISO")
+		seedISO, err = buildSeedISO(req.Name, *cloudInit)
+		span.end(err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build cloud-init seed: %v", err)
+		}
+		if !isLocalHost(req.Host) {
+			_, span := startSpan(ctx, "upload seed ISO")
+			seedISO, err = uploadSeedISO(conn, req.Name, seedISO)
+			span.end(err)
+			if err != nil {
+				return nil, fmt.Errorf("failed to upload cloud-init seed: %v", err)
+			}
+			seedVol := req.Name + "-seed.iso"
+			rb.add(func() { deletePoolVolume(conn, defaultStoragePool, seedVol) })
+		} else {
+			seedPath := seedISO
+			rb.add(func() { _ = os.Remove(seedPath) })
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cancelled before defining the domain: %v", err)
+	}
+	j.setProgress(70)
+
 	// STEP 3: Generate domain XML
-	xmlContent, err := generateDomainXML(req, disks)
+	_, span = startSpan(ctx, "generate domain XML")
+	xmlContent, err := generateDomainXML(req, disks, nics, seedISO)
+	span.end(err)
 	if err != nil {
-		errMsg := fmt.Sprintf("Failed to generate domain XML: %v", err)
-		log.Println(errMsg)
-		writeErrorResponse(w, errMsg)
-		return
+		return nil, fmt.Errorf("failed to generate domain XML: %v", err)
 	}
 
-	log.Printf("Domain XML:\n%s\n", xmlContent)
+	logger.Debug("Domain XML", "vm", req.Name, "xml", xmlContent)
 
 	// STEP 4: Define domain
+	_, span = startSpan(ctx, "libvirt define")
 	dom, err := conn.DomainDefineXML(xmlContent)
+	span.end(err)
 	if err != nil {
-		errMsg := fmt.Sprintf("DomainDefineXML failed: %v", err)
-		log.Println(errMsg)
-		writeErrorResponse(w, errMsg)
-		return
+		return nil, fmt.Errorf("DomainDefineXML failed: %v", err)
 	}
 	defer dom.Free()
+	// dom is freed before rb runs, so the undo looks the domain up again
+	rb.add(func() {
+		d, err := conn.LookupDomainByName(req.Name)
+		if err == nil {
+			id, _ := d.GetUUIDString()
+			err = d.UndefineFlags(libvirt.DOMAIN_UNDEFINE_NVRAM)
+			d.Free()
+			if err == nil && req.TPM {
+				removeTPMState(id)
+			}
+		}
+		if err != nil {
+			logger.Error("Failed to undefine domain", "vm", req.Name, "error", err)
+		}
+	})
+	j.setProgress(80)
+
+	// STEP 4b: Reserve the static address on the network's DHCP server, if asked for
+	if req.Network != nil && req.Network.DHCPReservation {
+		if err := addDHCPHost(conn, nics[0].Source, req.Name, nics[0].MAC, req.Network.Address); err != nil {
+			return nil, fmt.Errorf("failed to reserve address: %v", err)
+		}
+		network, mac, address := nics[0].Source, nics[0].MAC, req.Network.Address
+		rb.add(func() { _ = removeDHCPHost(conn, network, req.Name, mac, address) })
+	}
 
 	// STEP 5: Start domain
-	if err := dom.Create(); err != nil {
-		_ = dom.Undefine()
-		errMsg := fmt.Sprintf("Failed to start domain: %v", err)
-		log.Println(errMsg)
-		writeErrorResponse(w, errMsg)
-		return
+	_, span = startSpan(ctx, "libvirt start")
+	err = dom.Create()
+	span.end(err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start domain: %v", err)
 	}
 
-	writeSuccessResponse(w, "VM created and started successfully")
+	rb.done()
+	logger.Info("VM created and started", "vm", req.Name, "host", hostName(req.Host))
+	recordVM(req.Host, dom, "created", req.Owner, &req)
+
+	result := CreateResult{Name: vmName, Host: hostName(req.Host), Message: "VM created and started successfully"}
+	if scheduled {
+		result.Message = fmt.Sprintf("VM created and started successfully on host %s", req.Host)
+	}
+	if req.Password != nil && req.Password.Method == "guest-agent" {
+		go setPasswordWhenReady(req.Host, req.Name, *req.Password)
+		result.Message = "VM created and started successfully, password will be set once the guest agent connects"
+	}
+	return result, nil
 }
 
-// createQcow2Disk is a helper to call qemu-img create
-func createQcow2Disk(path string, sizeGB int) error {
-	if sizeGB <= 0 {
-		return fmt.Errorf("disk_size_gb must be > 0 to create a new disk")
+// preflightHost checks, for a create on a host the caller chose, that the host has the
+// memory, vCPUs and pool space for the VM and that its anti-affinity groups hold, so a VM
+// that can't run is refused with a 422 before any disk is made instead of failing to start.
+// It writes the response and returns false if the create can't go ahead.
+func preflightHost(w http.ResponseWriter, r *http.Request, req RequestData, specs []DiskSpec) bool {
+	logger := requestLog(r)
+
+	conn, err := connectHost(req.Host)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return false
 	}
-	sizeArg := fmt.Sprintf("%dG", sizeGB)
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", path, sizeArg)
-	output, err := cmd.CombinedOutput()
+	defer conn.Close()
+
+	hc, err := hostCapacity(conn)
 	if err != nil {
-		return fmt.Errorf("qemu-img create failed: %v, output: %s", err, string(output))
+		errMsg := fmt.Sprintf("Failed to read host capacity: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return false
 	}
-	log.Printf("Created disk %s (%s)", path, sizeArg)
-	return nil
+	if _, err := hostResourcesFit(hc, req, requestPool(req), specsBytes(specs)); err != nil {
+		msg := fmt.Sprintf("Host %s cannot take the VM: %v", hostName(req.Host), err)
+		logger.Warn(msg)
+		writeErrorStatus(w, http.StatusUnprocessableEntity, msg)
+		return false
+	}
+
+	if len(req.AntiAffinity) > 0 {
+		// The caller chose the host, but the groups still have to hold
+		vm, group, err := antiAffinityConflict(conn, req.AntiAffinity)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to check anti-affinity: %v", err)
+			logger.Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return false
+		}
+		if vm != "" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %s on this host is in anti-affinity group %s", vm, group))
+			return false
+		}
+	}
+	return true
 }
 
 // generateDomainXML populates the vm-template with the relevant fields
-func generateDomainXML(req RequestData, disks []DiskDevice) (string, error) {
+func generateDomainXML(req RequestData, disks []DiskDevice, nics []NICDevice, seedISO string) (string, error) {
+	hostdevs, err := resolveHostdevs(req.Hostdevs)
+	if err != nil {
+		return "", err
+	}
+	usbDevs, err := resolveUSBDevices(req.USBDevices)
+	if err != nil {
+		return "", err
+	}
+	pageKiB, err := hugepageKiB(req)
+	if err != nil {
+		return "", err
+	}
 	data := TemplateData{
-		Name:       req.Name,
-		UUID:       uuid.New().String(),
-		MemoryKiB:  req.MemoryMB * 1024,
-		CPUs:       req.CPUs,
-		MacAddress: generateRandomMAC(),
+		Name:      req.Name,
+		UUID:      uuid.New().String(),
+		MemoryKiB: req.MemoryMB * 1024,
+		CPUs:      req.CPUs,
+
+		Disks:   disks,
+		HasSCSI: hasBusDisk(disks, "scsi"),
 
-		Disks: disks,
+		NICs: nics,
 
 		HasISO:   (req.ISOImage != ""),
 		ISOImage: req.ISOImage,
+
+		HasSeed: (seedISO != ""),
+		SeedISO: seedISO,
+
+		VNC:   req.VNC,
+		SPICE: req.SPICE,
+
+		UEFI: uefiFirmware(req),
+		TPM:  req.TPM,
+
+		HugepageKiB: pageKiB,
+		CPUTune:     cpuTune(req),
+		NUMA:        hotplugNUMA(guestNUMA(req), req),
+		CPU:         guestCPU(req),
+		Balloon:     memBalloon(req),
+		MaxMemory:   maxMemory(req),
+
+		Hostdevs:   hostdevs,
+		USBDevices: usbDevs,
+
+		ConsoleLog: consoleLogPath(req.Name),
+
+		AntiAffinity: req.AntiAffinity,
+
+		Project: req.Project,
+
+		Labels:      req.Labels,
+		Annotations: req.Annotations,
+	}
+	if data.VNC == nil && data.SPICE == nil {
+		data.SPICE = &SPICESpec{}
+	}
+	// The virtio disks take the I/O threads in turn
+	if t := data.CPUTune; t != nil && t.IOThreads > 0 {
+		data.Disks = append([]DiskDevice(nil), disks...)
+		n := 0
+		for i := range data.Disks {
+			if data.Disks[i].Bus == "virtio" {
+				data.Disks[i].IOThread = n%t.IOThreads + 1
+				n++
+			}
+		}
 	}
 
+	// The CD-ROMs sit on SATA after any SATA/SCSI disks, install ISO first
+	cdIndex := countPrefixDisks(disks, busDevPrefix["sata"])
+	if data.HasISO {
+		isoDev, err := diskDevName(busDevPrefix["sata"], cdIndex)
+		if err != nil {
+			return "", err
+		}
+		data.ISODev = isoDev
+		cdIndex++
+	}
+	if data.HasSeed {
+		seedDev, err := diskDevName(busDevPrefix["sata"], cdIndex)
+		if err != nil {
+			return "", err
+		}
+		data.SeedDev = seedDev
+	}
+
+	tmpl, err := lookupTemplate(req.Template)
+	if err != nil {
+		return "", err
+	}
 	var outStr string
-	if err := domainXMLTemplate.Execute(newBuffer(&outStr), data); err != nil {
+	if err := tmpl.Execute(newBuffer(&outStr), data); err != nil {
 		return "", err
 	}
+	if err := checkDomainXML(outStr, data); err != nil {
+		return "", fmt.Errorf("generated XML is not what was asked for: %v", err)
+	}
+	if req.XML != nil {
+		return applyXMLOverride(outStr, req.XML, req.Name)
+	}
 	return outStr, nil
 }
 
+// checkDomainXML parses the generated XML back and checks it holds the domain and the
+// devices the template was given, no more, should escaping ever miss a value
+func checkDomainXML(desc string, data TemplateData) error {
+	def, err := parseDomainDef(desc)
+	if err != nil {
+		return err
+	}
+	if def.Name != data.Name {
+		return fmt.Errorf("domain is named %q", def.Name)
+	}
+	disks := len(data.Disks)
+	if data.HasISO {
+		disks++
+	}
+	if data.HasSeed {
+		disks++
+	}
+	if len(def.Devices.Disks) != disks {
+		return fmt.Errorf("%d disks instead of %d", len(def.Devices.Disks), disks)
+	}
+	if len(def.Devices.Interfaces) != len(data.NICs) {
+		return fmt.Errorf("%d interfaces instead of %d", len(def.Devices.Interfaces), len(data.NICs))
+	}
+	pciDevs, usbDevs := 0, 0
+	for _, hd := range def.Devices.Hostdevs {
+		switch hd.Type {
+		case "pci":
+			pciDevs++
+		case "usb":
+			usbDevs++
+		}
+	}
+	if pciDevs != len(data.Hostdevs) || usbDevs != len(data.USBDevices) || len(def.Devices.Hostdevs) != pciDevs+usbDevs {
+		return fmt.Errorf("%d host devices instead of %d PCI and %d USB ones", len(def.Devices.Hostdevs), len(data.Hostdevs), len(data.USBDevices))
+	}
+	graphics := 0
+	if data.VNC != nil {
+		graphics++
+	}
+	if data.SPICE != nil {
+		graphics++
+	}
+	if len(def.Devices.Graphics) != graphics {
+		return fmt.Errorf("%d graphics devices instead of %d", len(def.Devices.Graphics), graphics)
+	}
+	return nil
+}
+
 // Simple buffer to capture template output
 type stringBuffer struct {
 	str *string
@@ -264,6 +1327,17 @@ func generateRandomMAC() string {
 	)
 }
 
+// connectLibvirt opens a connection to the hypervisor; callers must Close it
+func connectLibvirt() (*libvirt.Connect, error) {
+	return connectHost("")
+}
+
+// isLibvirtErrorCode reports whether err is a libvirt error with the given code
+func isLibvirtErrorCode(err error, code libvirt.ErrorNumber) bool {
+	lverr, ok := err.(libvirt.Error)
+	return ok && lverr.Code == code
+}
+
 // writeSuccessResponse
 func writeSuccessResponse(w http.ResponseWriter, msg string) {
 	w.Header().Set("Content-Type", "application/json")
@@ -271,10 +1345,22 @@ func writeSuccessResponse(w http.ResponseWriter, msg string) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+// writeDataResponse - success response carrying a JSON payload
+func writeDataResponse(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := ResponseData{Status: "success", Data: data}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
 // writeErrorResponse
 func writeErrorResponse(w http.ResponseWriter, msg string) {
-	w.WriteHeader(http.StatusInternalServerError)
+	writeErrorStatus(w, http.StatusInternalServerError, msg)
+}
+
+// writeErrorStatus - error response with a specific HTTP status
+func writeErrorStatus(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	resp := ResponseData{Status: "error", Message: msg}
 	_ = json.NewEncoder(w).Encode(resp)
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "max_memory_mb" lets a VM's memory grow while it runs: the guest starts with
+// memory_mb, and POST /api/v1/vm/{name}/memory plugs DIMMs into its free slots up to
+// max_memory_mb. The guest kernel has to online the new memory, which most distributions
+// do by udev rule (or boot with memhp_default_state=online). Hotplug needs a guest NUMA
+// topology; a VM without "numa" cells gets one cell holding all its vCPUs and memory.
+
+// defaultMemorySlots - DIMM slots when max_memory_mb is set without memory_slots
+const defaultMemorySlots = 16
+
+// maxMemorySlots - QEMU's limit on DIMM slots
+const maxMemorySlots = 256
+
+// dimmAlignMB - DIMM sizes are a multiple of this, which covers the guest's memory block
+// size on x86 and arm64
+const dimmAlignMB = 128
+
+// MaxMemory - the <maxMemory> as the template writes it
+type MaxMemory struct {
+	KiB   int
+	Slots int
+}
+
+// MemoryHotplugRequest - POST /api/v1/vm/{name}/memory
+type MemoryHotplugRequest struct {
+	SizeMB int `json:"size_mb"`
+	Node   int `json:"node,omitempty"` // guest NUMA node the DIMM goes to
+}
+
+// MemoryHotplugInfo - a VM's memory after a hot-add
+type MemoryHotplugInfo struct {
+	MemoryMB    uint64 `json:"memory_mb"` // initial memory plus the DIMMs
+	MaxMemoryMB uint64 `json:"max_memory_mb"`
+	SlotsUsed   int    `json:"slots_used"`
+	Slots       int    `json:"slots"`
+}
+
+type domainMaxMemoryXML struct {
+	Slots int    `xml:"slots,attr"`
+	Value uint64 `xml:",chardata"` // KiB
+}
+
+type domainMemoryDeviceXML struct {
+	Model string `xml:"model,attr"`
+}
+
+// validateMaxMemory checks max_memory_mb and memory_slots against memory_mb
+func validateMaxMemory(req RequestData) error {
+	if req.MaxMemoryMB == 0 {
+		if req.MemorySlots != 0 {
+			return fmt.Errorf("memory_slots requires max_memory_mb")
+		}
+		return nil
+	}
+	if req.MaxMemoryMB <= req.MemoryMB {
+		return fmt.Errorf("max_memory_mb must be more than memory_mb")
+	}
+	if req.MemorySlots < 0 || req.MemorySlots > maxMemorySlots {
+		return fmt.Errorf("memory_slots must be 1-%d", maxMemorySlots)
+	}
+	return nil
+}
+
+// maxMemory - the template's <maxMemory> for the request, nil without hotplug
+func maxMemory(req RequestData) *MaxMemory {
+	if req.MaxMemoryMB == 0 {
+		return nil
+	}
+	slots := req.MemorySlots
+	if slots == 0 {
+		slots = defaultMemorySlots
+	}
+	return &MaxMemory{KiB: req.MaxMemoryMB * 1024, Slots: slots}
+}
+
+// hotplugNUMA gives a VM with hotplug and no guest NUMA cells a single one
+func hotplugNUMA(g *GuestNUMA, req RequestData) *GuestNUMA {
+	if req.MaxMemoryMB == 0 || (g != nil && len(g.Cells) > 0) {
+		return g
+	}
+	if g == nil {
+		g = &GuestNUMA{Mode: "strict"}
+	}
+	cpus := "0"
+	if req.CPUs > 1 {
+		cpus += "-" + strconv.Itoa(req.CPUs-1)
+	}
+	g.Cells = []NUMACell{{ID: 0, CPUs: cpus, MemoryKiB: req.MemoryMB * 1024}}
+	return g
+}
+
+// dimmXML - a DIMM of sizeMB on guest NUMA node
+func dimmXML(sizeMB, node int) string {
+	return fmt.Sprintf("<memory model='dimm'><target><size unit='KiB'>%d</size><node>%d</node></target></memory>", sizeMB*1024, node)
+}
+
+// handleHotplugMemory - POST /api/v1/vm/{name}/memory
+// Plugs a DIMM of size_mb into a running VM, and into its definition so it stays.
+func handleHotplugMemory(w http.ResponseWriter, r *http.Request) {
+	var req MemoryHotplugRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.SizeMB <= 0 || req.SizeMB%dimmAlignMB != 0 {
+		http.Error(w, fmt.Sprintf("size_mb must be a positive multiple of %d", dimmAlignMB), http.StatusBadRequest)
+		return
+	}
+	if req.Node < 0 {
+		http.Error(w, "node must be >= 0", http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		if state, err := domainState(dom); err == nil && state != "running" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", name))
+			return
+		}
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if def.MaxMemory == nil || def.MaxMemory.Slots == 0 {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q was not created with max_memory_mb", name))
+			return
+		}
+		// Every memory device takes a slot, the DIMMs plugged before as well as any other
+		info := MemoryHotplugInfo{
+			MemoryMB:    def.Memory / 1024,
+			MaxMemoryMB: def.MaxMemory.Value / 1024,
+			SlotsUsed:   len(def.Devices.MemoryDevices),
+			Slots:       def.MaxMemory.Slots,
+		}
+		switch {
+		case info.SlotsUsed >= info.Slots:
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("VM %q has no free memory slot, all %d are used", name, info.Slots))
+			return
+		case info.MemoryMB+uint64(req.SizeMB) > info.MaxMemoryMB:
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("VM %q has %d of its %d MiB, %d more won't fit", name, info.MemoryMB, info.MaxMemoryMB, req.SizeMB))
+			return
+		case req.Node >= len(def.CPU.NUMA.Cells):
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("VM %q has %d NUMA nodes, no node %d", name, len(def.CPU.NUMA.Cells), req.Node))
+			return
+		}
+
+		// The DIMM counts against the project's memory like the rest of the VM's
+		release, err := reserveQuota(domainProject(dom), QuotaUsage{MemoryMB: req.SizeMB})
+		if err != nil {
+			writeQuotaError(w, r, err)
+			return
+		}
+		defer release()
+
+		if err := dom.AttachDeviceFlags(dimmXML(req.SizeMB, req.Node), libvirt.DOMAIN_DEVICE_MODIFY_LIVE|libvirt.DOMAIN_DEVICE_MODIFY_CONFIG); err != nil {
+			errMsg := fmt.Sprintf("Failed to hot-add memory to VM %s: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Hot-added %d MiB to VM %s on node %d", req.SizeMB, name, req.Node))
+		info.MemoryMB += uint64(req.SizeMB)
+		info.SlotsUsed++
+		writeDataResponse(w, info)
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Prometheus metrics in the text exposition format, for the service itself and for
+// every domain on every registered host. Hand-rolled: the format is simple and the
+// service has no client library to lean on.
+
+// latencyBuckets - upper bounds (seconds) of the request duration histogram
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type requestKey struct {
+	method, route, code string
+}
+
+type latencyKey struct {
+	method, route string
+}
+
+type latencyHistogram struct {
+	buckets []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+var serviceMetrics = struct {
+	mu             sync.Mutex
+	requests       map[requestKey]uint64
+	latency        map[latencyKey]*latencyHistogram
+	createFailures map[string]uint64 // status code -> count
+}{
+	requests:       map[requestKey]uint64{},
+	latency:        map[latencyKey]*latencyHistogram{},
+	createFailures: map[string]uint64{},
+}
+
+// observeRequest records one finished HTTP request
+func observeRequest(method, route string, code int, elapsed time.Duration) {
+	serviceMetrics.mu.Lock()
+	defer serviceMetrics.mu.Unlock()
+
+	codeStr := fmt.Sprint(code)
+	serviceMetrics.requests[requestKey{method, route, codeStr}]++
+
+	lk := latencyKey{method, route}
+	h := serviceMetrics.latency[lk]
+	if h == nil {
+		h = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		serviceMetrics.latency[lk] = h
+	}
+	secs := elapsed.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, secs)
+	h.buckets[i]++
+	h.sum += secs
+	h.count++
+
+	if method == http.MethodPost && (route == "/api/v1/vm" || route == "/api/v2/vm") && code >= 400 {
+		serviceMetrics.createFailures[codeStr]++
+	}
+}
+
+// statusRecorder captures the status code a handler writes. It passes Hijack and Flush
+// through so websockets and streaming responses keep working behind it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer cannot be hijacked")
+	}
+	if s.code == 0 {
+		s.code = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// withMetrics counts requests and their latency by route pattern (not raw path, so VM
+// names don't explode the label space)
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		} else {
+			if _, path, ok := strings.Cut(route, " "); ok {
+				route = path
+			}
+			// v1 and v2 share the routes, but v1's traffic is what tells when it can go
+			route = apiPath(r, route)
+		}
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		observeRequest(r.Method, route, rec.code, time.Since(start))
+	})
+}
+
+// handleMetrics - GET /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	writeServiceMetrics(&b)
+
+	guests := newMetricFamilies()
+	for _, h := range hypervisorHosts {
+		up := 1
+		if err := collectDomainMetrics(guests, h.Name); err != nil {
+			// One unreachable host shouldn't hide the others
+			requestLog(r).Error(fmt.Sprintf("Metrics: %s: %v", h.Name, err))
+			up = 0
+		}
+		guests.add("vmsvc_host_up", fmt.Sprintf("host=%s", promLabel(h.Name)), up)
+	}
+	guests.writeTo(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func writeServiceMetrics(b *strings.Builder) {
+	serviceMetrics.mu.Lock()
+	defer serviceMetrics.mu.Unlock()
+
+	b.WriteString("# HELP vmsvc_http_requests_total HTTP requests handled, by route and status code.\n")
+	b.WriteString("# TYPE vmsvc_http_requests_total counter\n")
+	reqKeys := make([]requestKey, 0, len(serviceMetrics.requests))
+	for k := range serviceMetrics.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		a, c := reqKeys[i], reqKeys[j]
+		return a.route+a.method+a.code < c.route+c.method+c.code
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(b, "vmsvc_http_requests_total{method=%s,route=%s,code=%s} %d\n",
+			promLabel(k.method), promLabel(k.route), promLabel(k.code), serviceMetrics.requests[k])
+	}
+
+	b.WriteString("# HELP vmsvc_http_request_duration_seconds HTTP request latency, by route.\n")
+	b.WriteString("# TYPE vmsvc_http_request_duration_seconds histogram\n")
+	latKeys := make([]latencyKey, 0, len(serviceMetrics.latency))
+	for k := range serviceMetrics.latency {
+		latKeys = append(latKeys, k)
+	}
+	sort.Slice(latKeys, func(i, j int) bool {
+		return latKeys[i].route+latKeys[i].method < latKeys[j].route+latKeys[j].method
+	})
+	for _, k := range latKeys {
+		h := serviceMetrics.latency[k]
+		labels := fmt.Sprintf("method=%s,route=%s", promLabel(k.method), promLabel(k.route))
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.buckets[i]
+			fmt.Fprintf(b, "vmsvc_http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, cum)
+		}
+		fmt.Fprintf(b, "vmsvc_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(b, "vmsvc_http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(b, "vmsvc_http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	b.WriteString("# HELP vmsvc_vm_create_failures_total Failed VM create requests, by status code.\n")
+	b.WriteString("# TYPE vmsvc_vm_create_failures_total counter\n")
+	codes := make([]string, 0, len(serviceMetrics.createFailures))
+	for c := range serviceMetrics.createFailures {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for _, c := range codes {
+		fmt.Fprintf(b, "vmsvc_vm_create_failures_total{code=%s} %d\n", promLabel(c), serviceMetrics.createFailures[c])
+	}
+}
+
+// metricFamily - HELP/TYPE of a per-guest metric
+type metricFamily struct {
+	name, kind, help string
+}
+
+// guestMetricFamilies - the per-guest families, in output order
+var guestMetricFamilies = []metricFamily{
+	{"vmsvc_host_up", "gauge", "Whether the host's libvirtd answered this scrape."},
+	{"vmsvc_vm_running", "gauge", "Whether the domain is running."},
+	{"vmsvc_vm_cpu_seconds_total", "counter", "CPU time used by the domain."},
+	{"vmsvc_vm_memory_current_bytes", "gauge", "Memory currently given to the guest (balloon)."},
+	{"vmsvc_vm_memory_maximum_bytes", "gauge", "Maximum memory of the guest."},
+	{"vmsvc_vm_memory_rss_bytes", "gauge", "Resident memory of the QEMU process."},
+	{"vmsvc_vm_memory_usable_bytes", "gauge", "Memory the guest reports as usable."},
+	{"vmsvc_vm_disk_read_bytes_total", "counter", "Bytes read from the disk."},
+	{"vmsvc_vm_disk_write_bytes_total", "counter", "Bytes written to the disk."},
+	{"vmsvc_vm_disk_read_requests_total", "counter", "Read requests on the disk."},
+	{"vmsvc_vm_disk_write_requests_total", "counter", "Write requests on the disk."},
+	{"vmsvc_vm_network_receive_bytes_total", "counter", "Bytes received on the interface."},
+	{"vmsvc_vm_network_transmit_bytes_total", "counter", "Bytes sent on the interface."},
+	{"vmsvc_vm_network_receive_packets_total", "counter", "Packets received on the interface."},
+	{"vmsvc_vm_network_transmit_packets_total", "counter", "Packets sent on the interface."},
+	{"vmsvc_vm_network_receive_errors_total", "counter", "Receive errors on the interface."},
+	{"vmsvc_vm_network_transmit_errors_total", "counter", "Transmit errors on the interface."},
+}
+
+// metricFamilies gathers samples per family, as the exposition format wants each
+// family's samples in one block
+type metricFamilies map[string][]string
+
+func newMetricFamilies() metricFamilies {
+	return metricFamilies{}
+}
+
+func (m metricFamilies) add(name, labels string, value interface{}) {
+	m[name] = append(m[name], fmt.Sprintf("%s{%s} %v", name, labels, value))
+}
+
+func (m metricFamilies) writeTo(b *strings.Builder) {
+	for _, f := range guestMetricFamilies {
+		if len(m[f.name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, line := range m[f.name] {
+			b.WriteString(line + "\n")
+		}
+	}
+}
+
+// collectDomainMetrics adds guest metrics for every domain on the host, from one
+// virConnectGetAllDomainStats call
+func collectDomainMetrics(m metricFamilies, host string) error {
+	conn, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stats, err := conn.GetAllDomainStats(nil,
+		libvirt.DOMAIN_STATS_STATE|libvirt.DOMAIN_STATS_CPU_TOTAL|libvirt.DOMAIN_STATS_BALLOON|
+			libvirt.DOMAIN_STATS_INTERFACE|libvirt.DOMAIN_STATS_BLOCK,
+		libvirt.CONNECT_GET_ALL_DOMAINS_STATS_NOWAIT)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, s := range stats {
+			s.Domain.Free()
+		}
+	}()
+
+	for _, s := range stats {
+		name, err := s.Domain.GetName()
+		if err != nil {
+			continue
+		}
+		vm := fmt.Sprintf("host=%s,vm=%s", promLabel(host), promLabel(name))
+		if s.State != nil && s.State.StateSet {
+			running := 0
+			if s.State.State == libvirt.DOMAIN_RUNNING {
+				running = 1
+			}
+			m.add("vmsvc_vm_running", vm, running)
+		}
+		if s.Cpu != nil && s.Cpu.TimeSet {
+			m.add("vmsvc_vm_cpu_seconds_total", vm, float64(s.Cpu.Time)/1e9)
+		}
+		if bal := s.Balloon; bal != nil {
+			// Balloon figures are in KiB
+			if bal.CurrentSet {
+				m.add("vmsvc_vm_memory_current_bytes", vm, bal.Current*1024)
+			}
+			if bal.MaximumSet {
+				m.add("vmsvc_vm_memory_maximum_bytes", vm, bal.Maximum*1024)
+			}
+			if bal.RssSet {
+				m.add("vmsvc_vm_memory_rss_bytes", vm, bal.Rss*1024)
+			}
+			if bal.UsableSet {
+				m.add("vmsvc_vm_memory_usable_bytes", vm, bal.Usable*1024)
+			}
+		}
+		for _, blk := range s.Block {
+			disk := fmt.Sprintf("%s,disk=%s", vm, promLabel(blk.Name))
+			m.add("vmsvc_vm_disk_read_bytes_total", disk, blk.RdBytes)
+			m.add("vmsvc_vm_disk_write_bytes_total", disk, blk.WrBytes)
+			m.add("vmsvc_vm_disk_read_requests_total", disk, blk.RdReqs)
+			m.add("vmsvc_vm_disk_write_requests_total", disk, blk.WrReqs)
+		}
+		for _, nic := range s.Net {
+			iface := fmt.Sprintf("%s,interface=%s", vm, promLabel(nic.Name))
+			m.add("vmsvc_vm_network_receive_bytes_total", iface, nic.RxBytes)
+			m.add("vmsvc_vm_network_transmit_bytes_total", iface, nic.TxBytes)
+			m.add("vmsvc_vm_network_receive_packets_total", iface, nic.RxPkts)
+			m.add("vmsvc_vm_network_transmit_packets_total", iface, nic.TxPkts)
+			m.add("vmsvc_vm_network_receive_errors_total", iface, nic.RxErrs)
+			m.add("vmsvc_vm_network_transmit_errors_total", iface, nic.TxErrs)
+		}
+	}
+	return nil
+}
+
+// promLabel quotes a label value for the exposition format
+func promLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
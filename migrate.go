@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// MigrateRequest - body of POST /api/v1/vm/{name}/migrate
+type MigrateRequest struct {
+	// DestinationURI - libvirt URI of the target host, e.g. "qemu+ssh://host2/system".
+	// DestinationHost - alternatively, the name of a registered host (see GET /api/v1/hosts)
+	DestinationURI  string `json:"destination_uri,omitempty"`
+	DestinationHost string `json:"destination_host,omitempty"`
+	// MigrationURI - optional address for the migration data stream when it should not
+	// follow DestinationURI's host (e.g. "tcp://10.0.0.2" on a dedicated network)
+	MigrationURI string `json:"migration_uri,omitempty"`
+	// Live - keep the guest running while memory is copied (default true); otherwise it
+	// is paused for the duration
+	Live *bool `json:"live,omitempty"`
+	// Tunnelled - carry the data through the libvirtd connection instead of a separate one
+	Tunnelled bool `json:"tunnelled,omitempty"`
+	// CopyStorageAll - copy the disks too, for hosts that don't share storage
+	CopyStorageAll bool `json:"copy_storage_all,omitempty"`
+	// BandwidthMiBps - cap on the migration stream, 0 for unlimited
+	BandwidthMiBps uint64 `json:"bandwidth_mibps,omitempty"`
+	// KeepSource - leave the (inactive) definition on this host after migrating
+	KeepSource bool `json:"keep_source,omitempty"`
+}
+
+// handleMigrateVM - POST /api/v1/vm/{name}/migrate
+// Migrates a running VM to another host in the background; poll the returned job via
+// GET /api/v1/vm/{name}/migrations/{id}. The VM's definition moves with it.
+func handleMigrateVM(w http.ResponseWriter, r *http.Request) {
+	var req MigrateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if (req.DestinationURI == "") == (req.DestinationHost == "") {
+		http.Error(w, "exactly one of destination_uri and destination_host is required", http.StatusBadRequest)
+		return
+	}
+	if req.DestinationHost != "" {
+		dest, ok := lookupHost(req.DestinationHost)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown destination_host %q", req.DestinationHost), http.StatusBadRequest)
+			return
+		}
+		if dest.Name == hostName(requestHost(r)) {
+			http.Error(w, "destination_host is the VM's own host", http.StatusBadRequest)
+			return
+		}
+		req.DestinationURI = dest.URI
+	}
+	if strings.HasPrefix(req.DestinationURI, "qemu:///") {
+		http.Error(w, "destination_uri must name another host", http.StatusBadRequest)
+		return
+	}
+	if req.Tunnelled && req.MigrationURI != "" {
+		http.Error(w, "migration_uri cannot be combined with tunnelled", http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		state, err := domainState(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if state != "running" && state != "paused" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is %s, only running VMs can be migrated", r.PathValue("name"), state))
+			return
+		}
+
+		host := requestHost(r)
+		vmName, _ := dom.GetName()
+		job := startJob("vm-migrate", requestProject(r), vmName, func(j *jobHandle) (interface{}, error) {
+			return migrateVM(j, host, vmName, req)
+		})
+		requestLog(r).Info(fmt.Sprintf("Migrating VM %s to %s (job %s)", vmName, req.DestinationURI, job.snapshot().ID))
+		writeJobAccepted(w, job)
+	})
+}
+
+// handleGetMigration - GET /api/v1/vm/{name}/migrations/{id}
+func handleGetMigration(w http.ResponseWriter, r *http.Request) {
+	job, ok := lookupRequestJob(r, "vm-migrate")
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Migration %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, job.snapshot())
+}
+
+// migrateVM runs the migration peer-to-peer (this host's libvirtd talks to the
+// destination's) and mirrors libvirt's progress onto j while it runs
+func migrateVM(j *jobHandle, host, vmName string, req MigrateRequest) (interface{}, error) {
+	conn, err := connectHost(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up VM %q: %v", vmName, err)
+	}
+	defer dom.Free()
+
+	flags := libvirt.MIGRATE_PEER2PEER | libvirt.MIGRATE_PERSIST_DEST | libvirt.MIGRATE_ABORT_ON_ERROR
+	if req.Live == nil || *req.Live {
+		flags |= libvirt.MIGRATE_LIVE
+	}
+	if req.Tunnelled {
+		flags |= libvirt.MIGRATE_TUNNELLED
+	}
+	if req.CopyStorageAll {
+		flags |= libvirt.MIGRATE_NON_SHARED_DISK
+	}
+	if !req.KeepSource {
+		flags |= libvirt.MIGRATE_UNDEFINE_SOURCE
+	}
+	params := &libvirt.DomainMigrateParameters{}
+	if req.MigrationURI != "" {
+		params.URISet, params.URI = true, req.MigrationURI
+	}
+	if req.BandwidthMiBps > 0 {
+		params.BandwidthSet, params.Bandwidth = true, req.BandwidthMiBps
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			info, err := dom.GetJobStats(0)
+			if err != nil || info.Type == libvirt.DOMAIN_JOB_NONE {
+				continue
+			}
+			if info.DataTotalSet && info.DataTotal > 0 {
+				j.setProgress(float64(info.DataProcessed) * 100 / float64(info.DataTotal))
+			}
+		}
+	}()
+
+	start := time.Now()
+	err = dom.MigrateToURI3(req.DestinationURI, params, flags)
+	close(done)
+	if err != nil {
+		return nil, fmt.Errorf("migration to %s failed: %v", req.DestinationURI, err)
+	}
+	log.Printf("Migrated VM %s to %s", vmName, req.DestinationURI)
+	return map[string]interface{}{
+		"destination_uri":  req.DestinationURI,
+		"duration_seconds": time.Since(start).Seconds(),
+	}, nil
+}
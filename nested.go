@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "nested": true lets the guest run VMs of its own, for hypervisor development and CI
+// of virtualization stacks. The guest's CPU is made to require vmx (Intel) or svm
+// (AMD), so it won't start without them. KVM only offers them to guests with nesting
+// on (kvm_intel/kvm_amd nested=1), which QEMU's host-model CPU in the domain
+// capabilities reflects; a create for a host without it is refused.
+
+// errNestedUnsupported - the host can't give guests virtualization extensions
+var errNestedUnsupported = errors.New("nested virtualization unsupported")
+
+// nestedFeatures - the virtualization extension by CPU vendor, and the KVM module
+// nesting is turned on in
+var nestedFeatures = map[string]struct{ feature, module string }{
+	"Intel": {"vmx", "kvm_intel"},
+	"AMD":   {"svm", "kvm_amd"},
+}
+
+// domainCapabilitiesXML - the parts of virConnectGetDomainCapabilities we read
+type domainCapabilitiesXML struct {
+	CPU struct {
+		Modes []struct {
+			Name     string `xml:"name,attr"`
+			Vendor   string `xml:"vendor"`
+			Features []struct {
+				Policy string `xml:"policy,attr"`
+				Name   string `xml:"name,attr"`
+			} `xml:"feature"`
+		} `xml:"mode"`
+	} `xml:"cpu"`
+}
+
+// validateNested checks cpu_features doesn't take away what nested needs
+func validateNested(req RequestData) error {
+	if !req.Nested {
+		return nil
+	}
+	for _, f := range req.CPUFeatures {
+		if (f.Name == "vmx" || f.Name == "svm") && (f.Policy == "disable" || f.Policy == "forbid") {
+			return fmt.Errorf("nested needs %s, cpu_features cannot %s it", f.Name, f.Policy)
+		}
+	}
+	return nil
+}
+
+// resolveNested checks the host offers its virtualization extension to guests and adds
+// it to the request's cpu_features
+func resolveNested(conn *libvirt.Connect, req *RequestData) error {
+	if !req.Nested {
+		return nil
+	}
+	capsDoc, err := conn.GetDomainCapabilities("", "", "", "kvm", 0)
+	if err != nil {
+		return fmt.Errorf("failed to get domain capabilities: %v", err)
+	}
+	var caps domainCapabilitiesXML
+	if err := xml.Unmarshal([]byte(capsDoc), &caps); err != nil {
+		return fmt.Errorf("failed to parse domain capabilities: %v", err)
+	}
+
+	for _, m := range caps.CPU.Modes {
+		if m.Name != "host-model" {
+			continue
+		}
+		ext, ok := nestedFeatures[m.Vendor]
+		if !ok {
+			return fmt.Errorf("%w: the host CPU is %q, nested needs Intel VT-x or AMD-V", errNestedUnsupported, m.Vendor)
+		}
+		for _, f := range m.Features {
+			if f.Name == ext.feature && f.Policy == "require" {
+				for _, rf := range req.CPUFeatures {
+					if rf.Name == ext.feature {
+						return nil
+					}
+				}
+				req.CPUFeatures = append(append([]CPUFeatureSpec(nil), req.CPUFeatures...), CPUFeatureSpec{Name: ext.feature, Policy: "require"})
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: KVM doesn't offer %s to guests, load %s with nested=1", errNestedUnsupported, ext.feature, ext.module)
+	}
+	return fmt.Errorf("%w: the host reports no host-model CPU", errNestedUnsupported)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// NetworkSpec - static addressing for the VM's first NIC, rendered into cloud-init network-config
+type NetworkSpec struct {
+	Address string   `json:"address"`           // CIDR, e.g. "192.168.100.10/24"
+	Gateway string   `json:"gateway,omitempty"` // default route
+	DNS     []string `json:"dns,omitempty"`     // nameserver addresses
+	// DHCPReservation also adds a static host entry for the MAC/address to the libvirt
+	// network, so its DHCP server never leases the address to another VM
+	DHCPReservation bool `json:"dhcp_reservation,omitempty"`
+}
+
+// networkConfigV2 - the subset of cloud-init's network-config version 2 (netplan) we write
+type networkConfigV2 struct {
+	Version   int                        `json:"version"`
+	Ethernets map[string]netplanEthernet `json:"ethernets"`
+}
+
+type netplanEthernet struct {
+	Match       netplanMatch        `json:"match"`
+	SetName     string              `json:"set-name"`
+	Addresses   []string            `json:"addresses"`
+	Routes      []netplanRoute      `json:"routes,omitempty"`
+	Nameservers *netplanNameservers `json:"nameservers,omitempty"`
+}
+
+type netplanMatch struct {
+	MACAddress string `json:"macaddress"`
+}
+
+type netplanRoute struct {
+	To  string `json:"to"`
+	Via string `json:"via"`
+}
+
+type netplanNameservers struct {
+	Addresses []string `json:"addresses"`
+}
+
+// validate checks the addresses parse and the gateway is in the same family as the address
+func (n NetworkSpec) validate() error {
+	ip, _, err := net.ParseCIDR(n.Address)
+	if err != nil {
+		return fmt.Errorf("address %q must be in CIDR form, e.g. 192.168.100.10/24", n.Address)
+	}
+	if n.Gateway != "" {
+		gw := net.ParseIP(n.Gateway)
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %q", n.Gateway)
+		}
+		if (gw.To4() == nil) != (ip.To4() == nil) {
+			return fmt.Errorf("gateway %s and address %s are different IP versions", n.Gateway, n.Address)
+		}
+	}
+	for _, dns := range n.DNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("invalid dns server %q", dns)
+		}
+	}
+	if n.DHCPReservation && ip.To4() == nil {
+		return fmt.Errorf("dhcp_reservation is only supported for IPv4 addresses")
+	}
+	return nil
+}
+
+// networkConfig renders the spec as network-config v2 for the NIC with the given MAC.
+// Like the generated cloud-config it is JSON, which cloud-init parses as YAML.
+func (n NetworkSpec) networkConfig(mac string) (string, error) {
+	eth := netplanEthernet{
+		Match:     netplanMatch{MACAddress: mac},
+		SetName:   "eth0",
+		Addresses: []string{n.Address},
+	}
+	if n.Gateway != "" {
+		to := "0.0.0.0/0"
+		if net.ParseIP(n.Gateway).To4() == nil {
+			to = "::/0"
+		}
+		eth.Routes = []netplanRoute{{To: to, Via: n.Gateway}}
+	}
+	if len(n.DNS) > 0 {
+		eth.Nameservers = &netplanNameservers{Addresses: n.DNS}
+	}
+	cfg := networkConfigV2{Version: 2, Ethernets: map[string]netplanEthernet{"eth0": eth}}
+	doc, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(doc) + "\n", nil
+}
+
+// dhcpHostXML - a <host> entry in a libvirt network's <dhcp> section
+func dhcpHostXML(vmName, mac, address string) string {
+	ip, _, _ := net.ParseCIDR(address)
+	return fmt.Sprintf("<host mac='%s' name='%s' ip='%s'/>", xmlEscape(mac), xmlEscape(vmName), ip)
+}
+
+// addDHCPHost reserves the address for the MAC on the libvirt network, both live and in
+// its persistent config
+func addDHCPHost(conn *libvirt.Connect, network, vmName, mac, address string) error {
+	netw, err := conn.LookupNetworkByName(network)
+	if err != nil {
+		return fmt.Errorf("failed to look up network %q: %v", network, err)
+	}
+	defer netw.Free()
+
+	err = netw.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1,
+		dhcpHostXML(vmName, mac, address), libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG)
+	if err != nil {
+		return fmt.Errorf("failed to add DHCP host entry to %q: %v", network, err)
+	}
+	log.Printf("Reserved %s for %s (%s) on network %s", address, vmName, mac, network)
+	return nil
+}
+
+// removeDHCPHost drops a reservation made by addDHCPHost
+func removeDHCPHost(conn *libvirt.Connect, network, vmName, mac, address string) error {
+	netw, err := conn.LookupNetworkByName(network)
+	if err != nil {
+		return fmt.Errorf("failed to look up network %q: %v", network, err)
+	}
+	defer netw.Free()
+
+	return netw.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1,
+		dhcpHostXML(vmName, mac, address), libvirt.NETWORK_UPDATE_AFFECT_LIVE|libvirt.NETWORK_UPDATE_AFFECT_CONFIG)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// NetworkRequest - incoming JSON to define (and start) a libvirt virtual network
+type NetworkRequest struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode,omitempty"`        // "nat" (default), "route" or "isolated"
+	Bridge     string `json:"bridge,omitempty"`      // host bridge to create; libvirt picks virbrN if empty
+	ForwardDev string `json:"forward_dev,omitempty"` // host NIC to forward through, for "nat"/"route"
+	// Subnet - e.g. "192.168.50.0/24"; the host takes the first address unless the
+	// subnet is written with an address of its own, e.g. "192.168.50.254/24"
+	Subnet string `json:"subnet"`
+	// DHCPStart/DHCPEnd - address range handed out by the network's DHCP server;
+	// leave both out to run the network without DHCP
+	DHCPStart string `json:"dhcp_start,omitempty"`
+	DHCPEnd   string `json:"dhcp_end,omitempty"`
+	Autostart bool   `json:"autostart,omitempty"`
+	Start     *bool  `json:"start,omitempty"` // defaults to true
+}
+
+// NetworkInfo - what we report about a virtual network
+type NetworkInfo struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	Mode       string `json:"mode"`
+	Bridge     string `json:"bridge,omitempty"`
+	Address    string `json:"address,omitempty"` // host address and prefix, e.g. 192.168.50.1/24
+	DHCPStart  string `json:"dhcp_start,omitempty"`
+	DHCPEnd    string `json:"dhcp_end,omitempty"`
+	DHCPHosts  int    `json:"dhcp_hosts"`
+	Active     bool   `json:"active"`
+	Persistent bool   `json:"persistent"`
+	Autostart  bool   `json:"autostart"`
+}
+
+// networkXML - the subset of libvirt's <network> document we read and write
+type networkXML struct {
+	XMLName xml.Name           `xml:"network"`
+	Name    string             `xml:"name"`
+	Forward *networkForwardXML `xml:"forward,omitempty"`
+	Bridge  *networkBridgeXML  `xml:"bridge,omitempty"`
+	IPs     []networkIPXML     `xml:"ip"`
+}
+
+type networkForwardXML struct {
+	Mode string `xml:"mode,attr"`
+	Dev  string `xml:"dev,attr,omitempty"`
+}
+
+type networkBridgeXML struct {
+	Name  string `xml:"name,attr,omitempty"`
+	STP   string `xml:"stp,attr,omitempty"`
+	Delay string `xml:"delay,attr,omitempty"`
+}
+
+type networkIPXML struct {
+	Address string          `xml:"address,attr"`
+	Prefix  int             `xml:"prefix,attr,omitempty"`
+	Netmask string          `xml:"netmask,attr,omitempty"`
+	DHCP    *networkDHCPXML `xml:"dhcp,omitempty"`
+}
+
+type networkDHCPXML struct {
+	Range *networkRangeXML     `xml:"range,omitempty"`
+	Hosts []networkDHCPHostXML `xml:"host"`
+}
+
+type networkRangeXML struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type networkDHCPHostXML struct {
+	MAC  string `xml:"mac,attr,omitempty"`
+	Name string `xml:"name,attr,omitempty"`
+	IP   string `xml:"ip,attr"`
+}
+
+var supportedNetworkModes = map[string]bool{
+	"nat":      true,
+	"route":    true,
+	"isolated": true,
+}
+
+// handleListNetworks - GET /api/v1/networks
+func handleListNetworks(w http.ResponseWriter, r *http.Request) {
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to list networks: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+
+	infos := []NetworkInfo{}
+	for i := range networks {
+		info, err := describeNetwork(&networks[i])
+		networks[i].Free()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeDataResponse(w, infos)
+}
+
+// handleGetNetwork - GET /api/v1/networks/{name}
+func handleGetNetwork(w http.ResponseWriter, r *http.Request) {
+	withNetwork(w, r, func(conn *libvirt.Connect, netw *libvirt.Network) {
+		info, err := describeNetwork(netw)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleCreateNetwork - POST /api/v1/networks
+// Defines a persistent network and, unless start is false, starts it.
+func handleCreateNetwork(w http.ResponseWriter, r *http.Request) {
+	var req NetworkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "nat"
+	}
+
+	doc, err := buildNetworkXML(req)
+	if err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	if existing, err := conn.LookupNetworkByName(req.Name); err == nil {
+		existing.Free()
+		writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Network %q already exists", req.Name))
+		return
+	}
+
+	netw, err := conn.NetworkDefineXML(doc)
+	if err != nil {
+		errMsg := fmt.Sprintf("NetworkDefineXML failed: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer netw.Free()
+
+	if req.Start == nil || *req.Start {
+		if err := netw.Create(); err != nil {
+			_ = netw.Undefine()
+			errMsg := fmt.Sprintf("Failed to start network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+	}
+	if req.Autostart {
+		if err := netw.SetAutostart(true); err != nil {
+			requestLog(r).Error(fmt.Sprintf("Failed to set autostart on network %s: %v", req.Name, err))
+		}
+	}
+
+	info, err := describeNetwork(netw)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to inspect network: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Created network %s (%s, %s)", req.Name, req.Mode, req.Subnet))
+	writeDataResponse(w, info)
+}
+
+// handleStartNetwork - POST /api/v1/networks/{name}/start
+func handleStartNetwork(w http.ResponseWriter, r *http.Request) {
+	withNetwork(w, r, func(conn *libvirt.Connect, netw *libvirt.Network) {
+		active, err := netw.IsActive()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get network state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if !active {
+			if err := netw.Create(); err != nil {
+				errMsg := fmt.Sprintf("Failed to start network: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			requestLog(r).Info(fmt.Sprintf("Started network %s", r.PathValue("name")))
+		}
+		info, err := describeNetwork(netw)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleDeleteNetwork - DELETE /api/v1/networks/{name}
+// Stops and undefines the network. Refused with 409 while any VM has a NIC on it.
+func handleDeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	withNetwork(w, r, func(conn *libvirt.Connect, netw *libvirt.Network) {
+		name := r.PathValue("name")
+		users, err := networkUsers(conn, name)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to check which VMs use the network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if len(users) > 0 {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Network %q is in use by VMs %v", name, users))
+			return
+		}
+
+		active, err := netw.IsActive()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get network state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if active {
+			if err := netw.Destroy(); err != nil {
+				errMsg := fmt.Sprintf("Failed to stop network: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+		}
+		persistent, err := netw.IsPersistent()
+		if err == nil && persistent {
+			err = netw.Undefine()
+		}
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to undefine network: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Deleted network %s", name))
+		writeSuccessResponse(w, fmt.Sprintf("Network %s deleted", name))
+	})
+}
+
+// withNetwork connects to libvirt, looks up the network named in the URL and hands it to
+// fn, answering 404 if it does not exist.
+func withNetwork(w http.ResponseWriter, r *http.Request, fn func(conn *libvirt.Connect, netw *libvirt.Network)) {
+	name := r.PathValue("name")
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	netw, err := conn.LookupNetworkByName(name)
+	if err != nil {
+		if isLibvirtErrorCode(err, libvirt.ERR_NO_NETWORK) {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Network %q not found", name))
+			return
+		}
+		errMsg := fmt.Sprintf("Failed to look up network %q: %v", name, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer netw.Free()
+
+	fn(conn, netw)
+}
+
+// buildNetworkXML validates a NetworkRequest and turns it into a libvirt <network> document
+func buildNetworkXML(req NetworkRequest) (string, error) {
+	if req.Name == "" {
+		return "", fmt.Errorf("name is required")
+	}
+	if !supportedNetworkModes[req.Mode] {
+		return "", fmt.Errorf("unsupported mode %q", req.Mode)
+	}
+	if req.ForwardDev != "" && req.Mode == "isolated" {
+		return "", fmt.Errorf("forward_dev does not apply to isolated networks")
+	}
+
+	hostIP, subnet, err := net.ParseCIDR(req.Subnet)
+	if err != nil {
+		return "", fmt.Errorf("subnet %q must be in CIDR form, e.g. 192.168.50.0/24", req.Subnet)
+	}
+	if hostIP.Equal(subnet.IP) {
+		hostIP = nextIP(subnet.IP)
+	}
+	prefix, _ := subnet.Mask.Size()
+
+	ip := networkIPXML{Address: hostIP.String(), Prefix: prefix}
+	if (req.DHCPStart == "") != (req.DHCPEnd == "") {
+		return "", fmt.Errorf("dhcp_start and dhcp_end must be given together")
+	}
+	if req.DHCPStart != "" {
+		start, end := net.ParseIP(req.DHCPStart), net.ParseIP(req.DHCPEnd)
+		if start == nil || end == nil || !subnet.Contains(start) || !subnet.Contains(end) {
+			return "", fmt.Errorf("dhcp_start and dhcp_end must be addresses in %s", subnet)
+		}
+		ip.DHCP = &networkDHCPXML{Range: &networkRangeXML{Start: start.String(), End: end.String()}}
+	}
+
+	doc := networkXML{
+		Name:   req.Name,
+		Bridge: &networkBridgeXML{Name: req.Bridge, STP: "on", Delay: "0"},
+		IPs:    []networkIPXML{ip},
+	}
+	if req.Mode != "isolated" {
+		doc.Forward = &networkForwardXML{Mode: req.Mode, Dev: req.ForwardDev}
+	}
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// nextIP returns the address after ip
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// networkUsers lists the VMs with an interface on the named network
+func networkUsers(conn *libvirt.Connect, network string) ([]string, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+
+	var users []string
+	for i := range doms {
+		def, err := readDomainDef(&doms[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range def.Devices.Interfaces {
+			if iface.Type == "network" && iface.Source.Network == network {
+				users = append(users, def.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// describeNetwork gathers state, bridge and addressing of a network
+func describeNetwork(netw *libvirt.Network) (NetworkInfo, error) {
+	var info NetworkInfo
+	var err error
+
+	if info.Name, err = netw.GetName(); err != nil {
+		return info, err
+	}
+	if info.UUID, err = netw.GetUUIDString(); err != nil {
+		return info, err
+	}
+	if info.Active, err = netw.IsActive(); err != nil {
+		return info, err
+	}
+	if info.Persistent, err = netw.IsPersistent(); err != nil {
+		return info, err
+	}
+	if info.Autostart, err = netw.GetAutostart(); err != nil {
+		return info, err
+	}
+
+	desc, err := netw.GetXMLDesc(0)
+	if err != nil {
+		return info, err
+	}
+	var doc networkXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return info, fmt.Errorf("failed to parse network XML: %v", err)
+	}
+	info.Mode = "isolated"
+	if doc.Forward != nil {
+		info.Mode = doc.Forward.Mode
+	}
+	if doc.Bridge != nil {
+		info.Bridge = doc.Bridge.Name
+	}
+	if len(doc.IPs) > 0 {
+		ip := doc.IPs[0]
+		prefix := ip.Prefix
+		if ip.Netmask != "" {
+			prefix, _ = net.IPMask(net.ParseIP(ip.Netmask).To4()).Size()
+		}
+		info.Address = fmt.Sprintf("%s/%d", ip.Address, prefix)
+		if ip.DHCP != nil {
+			if ip.DHCP.Range != nil {
+				info.DHCPStart, info.DHCPEnd = ip.DHCP.Range.Start, ip.DHCP.Range.End
+			}
+			info.DHCPHosts = len(ip.DHCP.Hosts)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// defaultNetwork - the libvirt network NICs are attached to unless the request says otherwise
+const defaultNetwork = "host-only-net"
+
+// NICSpec - one network interface as given in the request. It attaches to at most one of
+// a libvirt network (NAT, isolated, ...), a host bridge, a host NIC through macvtap, or an
+// SR-IOV virtual function; with none set it goes on defaultNetwork.
+type NICSpec struct {
+	Network string `json:"network,omitempty"` // libvirt network, e.g. "default"
+	Bridge  string `json:"bridge,omitempty"`  // existing host bridge, e.g. "br0"
+	Macvtap string `json:"macvtap,omitempty"` // host NIC to share directly, e.g. "eth0"
+	// MacvtapMode - "bridge" (default), "vepa", "private" or "passthrough"
+	MacvtapMode string `json:"macvtap_mode,omitempty"`
+	// SRIOV - an SR-IOV virtual function of a host NIC, instead of the above
+	SRIOV *NICSRIOV `json:"sriov,omitempty"`
+
+	MAC   string `json:"mac,omitempty"`   // must be unused on the host; random 52:54:00:xx:xx:xx if empty
+	Model string `json:"model,omitempty"` // "virtio" (default), "e1000e", "e1000" or "rtl8139"
+	MTU   int    `json:"mtu,omitempty"`   // hypervisor default if 0
+
+	VLAN      *NICVLAN      `json:"vlan,omitempty"`
+	Bandwidth *NICBandwidth `json:"bandwidth,omitempty"`
+	// OVS marks a bridge (or network) NIC as an Open vSwitch port
+	OVS *NICOVS `json:"ovs,omitempty"`
+}
+
+// NICOVS - <virtualport type='openvswitch'> parameters, for OVS bridges managed by an SDN
+// controller that identifies ports by interface-id
+type NICOVS struct {
+	InterfaceID string `json:"interface_id,omitempty"` // a UUID; libvirt generates one if empty
+	ProfileID   string `json:"profile_id,omitempty"`
+}
+
+// NICVLAN - 802.1Q tagging for a NIC on an Open vSwitch bridge or OVS-backed network.
+// ID alone makes an access port; Trunk passes the listed VLANs through tagged, with ID
+// (if also set) as the untagged native VLAN.
+type NICVLAN struct {
+	ID    int   `json:"id,omitempty"`
+	Trunk []int `json:"trunk,omitempty"`
+}
+
+// NICBandwidth - traffic shaping, rendered as <bandwidth>. Inbound is traffic to the
+// guest, outbound from it.
+type NICBandwidth struct {
+	Inbound  *BandwidthLimit `json:"inbound,omitempty"`
+	Outbound *BandwidthLimit `json:"outbound,omitempty"`
+}
+
+// BandwidthLimit - as in libvirt, rates are in KiB/s and burst in KiB. Average is required;
+// peak and burst are optional and let the guest exceed it briefly.
+type BandwidthLimit struct {
+	Average uint64 `json:"average"`
+	Peak    uint64 `json:"peak,omitempty"`
+	Burst   uint64 `json:"burst,omitempty"`
+}
+
+func (b *NICBandwidth) validate() error {
+	if b.Inbound == nil && b.Outbound == nil {
+		return fmt.Errorf("inbound or outbound is required")
+	}
+	for dir, l := range map[string]*BandwidthLimit{"inbound": b.Inbound, "outbound": b.Outbound} {
+		if l == nil {
+			continue
+		}
+		if l.Average == 0 {
+			return fmt.Errorf("%s: average is required", dir)
+		}
+		if l.Peak != 0 && l.Peak < l.Average {
+			return fmt.Errorf("%s: peak must not be below average", dir)
+		}
+	}
+	return nil
+}
+
+// NICDevice - represents an interface in the final domain XML
+type NICDevice struct {
+	Type   string         // interface type: "network", "bridge", "direct" (macvtap) or "hostdev"
+	Source string         // network, bridge or host device name
+	PCI    *pciAddressXML // VF handed to the guest, for "hostdev"
+	Mode   string         // macvtap mode, for "direct"
+	MAC    string
+	Model  string
+	MTU    int
+
+	// VirtualPort is "openvswitch" for NICs on an OVS bridge, with optional parameters
+	VirtualPort string
+	InterfaceID string
+	ProfileID   string
+	VLAN        *NICVLAN
+	Bandwidth   *NICBandwidth
+
+	// SRIOV is set until assignVFs has picked the VF (Source or PCI)
+	SRIOV *NICSRIOV
+}
+
+var supportedMacvtapModes = map[string]bool{
+	"bridge":      true,
+	"vepa":        true,
+	"private":     true,
+	"passthrough": true,
+}
+
+var supportedNICModels = map[string]bool{
+	"virtio":  true,
+	"e1000e":  true,
+	"e1000":   true,
+	"rtl8139": true,
+}
+
+// resolveNICs returns the interfaces the request asks for, with defaults filled in. MACs
+// not pinned by the caller are left empty for assignMACs. Without a nics array the VM
+// gets the single virtio NIC on the default network it always had.
+func resolveNICs(req RequestData) ([]NICDevice, error) {
+	specs := req.NICs
+	if len(specs) == 0 {
+		specs = []NICSpec{{}}
+	}
+
+	nics := make([]NICDevice, len(specs))
+	seen := map[string]bool{}
+	for i, spec := range specs {
+		nic := NICDevice{MAC: strings.ToLower(spec.MAC), Model: spec.Model, MTU: spec.MTU}
+		attachments := 0
+		for _, source := range []string{spec.Network, spec.Bridge, spec.Macvtap} {
+			if source != "" {
+				attachments++
+			}
+		}
+		if spec.SRIOV != nil {
+			attachments++
+		}
+		switch {
+		case attachments > 1:
+			return nil, fmt.Errorf("nic %d: only one of network, bridge, macvtap and sriov may be set", i)
+		case spec.SRIOV != nil:
+			sriov := *spec.SRIOV
+			if sriov.PF == "" {
+				return nil, fmt.Errorf("nic %d: sriov.pf is required", i)
+			}
+			switch sriov.Mode {
+			case "", "hostdev":
+				sriov.Mode = "hostdev"
+				nic.Type = "hostdev"
+				if spec.Model != "" || spec.MTU != 0 {
+					return nil, fmt.Errorf("nic %d: model and mtu do not apply to hostdev VFs", i)
+				}
+			case "macvtap":
+				nic.Type, nic.Mode = "direct", "passthrough"
+			default:
+				return nil, fmt.Errorf("nic %d: unsupported sriov.mode %q", i, sriov.Mode)
+			}
+			nic.SRIOV = &sriov
+		case spec.Bridge != "":
+			nic.Type, nic.Source = "bridge", spec.Bridge
+		case spec.Macvtap != "":
+			nic.Type, nic.Source, nic.Mode = "direct", spec.Macvtap, spec.MacvtapMode
+			if nic.Mode == "" {
+				nic.Mode = "bridge"
+			}
+			if !supportedMacvtapModes[nic.Mode] {
+				return nil, fmt.Errorf("nic %d: unsupported macvtap_mode %q", i, nic.Mode)
+			}
+		case spec.Network != "":
+			nic.Type, nic.Source = "network", spec.Network
+		default:
+			nic.Type, nic.Source = "network", defaultNetwork
+		}
+		if spec.MacvtapMode != "" && nic.Type != "direct" {
+			return nil, fmt.Errorf("nic %d: macvtap_mode requires macvtap", i)
+		}
+		if spec.VLAN != nil {
+			if err := spec.VLAN.validate(); err != nil {
+				return nil, fmt.Errorf("nic %d: vlan: %v", i, err)
+			}
+			if nic.Type == "direct" {
+				return nil, fmt.Errorf("nic %d: vlan is not supported on macvtap NICs", i)
+			}
+			// Linux bridges cannot tag, so a bridge with VLANs is taken to be an OVS one
+			if nic.Type == "bridge" {
+				nic.VirtualPort = "openvswitch"
+			}
+			nic.VLAN = spec.VLAN
+		}
+		if spec.OVS != nil {
+			if nic.Type != "bridge" && nic.Type != "network" {
+				return nil, fmt.Errorf("nic %d: ovs requires a bridge or network NIC", i)
+			}
+			if spec.OVS.InterfaceID != "" {
+				if _, err := uuid.Parse(spec.OVS.InterfaceID); err != nil {
+					return nil, fmt.Errorf("nic %d: ovs.interface_id must be a UUID", i)
+				}
+			}
+			nic.VirtualPort = "openvswitch"
+			nic.InterfaceID, nic.ProfileID = spec.OVS.InterfaceID, spec.OVS.ProfileID
+		}
+		if spec.Bandwidth != nil {
+			if err := spec.Bandwidth.validate(); err != nil {
+				return nil, fmt.Errorf("nic %d: bandwidth: %v", i, err)
+			}
+			// Shaping is done on the host's tap/macvtap device, which a hostdev VF doesn't have
+			if nic.Type == "hostdev" {
+				return nil, fmt.Errorf("nic %d: bandwidth is not supported on hostdev VFs", i)
+			}
+			nic.Bandwidth = spec.Bandwidth
+		}
+		// A VF handed to the guest is its own device model
+		if nic.Model == "" && nic.Type != "hostdev" {
+			nic.Model = "virtio"
+		}
+		if nic.Model != "" && !supportedNICModels[nic.Model] {
+			return nil, fmt.Errorf("nic %d: unsupported model %q", i, nic.Model)
+		}
+		if nic.MTU != 0 && (nic.MTU < 68 || nic.MTU > 65535) {
+			return nil, fmt.Errorf("nic %d: mtu must be between 68 and 65535", i)
+		}
+		if nic.MAC != "" {
+			if err := validateMAC(nic.MAC); err != nil {
+				return nil, fmt.Errorf("nic %d: %v", i, err)
+			}
+			if seen[nic.MAC] {
+				return nil, fmt.Errorf("nic %d: mac %s is used twice", i, nic.MAC)
+			}
+			seen[nic.MAC] = true
+		}
+		nics[i] = nic
+	}
+
+	// Only libvirt networks have a DHCP server the service can add reservations to
+	if req.Network != nil && req.Network.DHCPReservation && nics[0].Type != "network" {
+		return nil, fmt.Errorf("nic 0: dhcp_reservation requires the first NIC to be on a libvirt network")
+	}
+	return nics, nil
+}
+
+func (v *NICVLAN) validate() error {
+	if v.ID == 0 && len(v.Trunk) == 0 {
+		return fmt.Errorf("id or trunk is required")
+	}
+	for _, id := range append([]int{v.ID}, v.Trunk...) {
+		if id < 0 || id > 4094 {
+			return fmt.Errorf("VLAN id %d is outside 1-4094", id)
+		}
+	}
+	for _, id := range v.Trunk {
+		if id == 0 {
+			return fmt.Errorf("VLAN id 0 is not valid in trunk")
+		}
+	}
+	return nil
+}
+
+// validateMAC checks mac is a colon-separated unicast Ethernet address
+func validateMAC(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 || !strings.Contains(mac, ":") {
+		return fmt.Errorf("invalid mac %q, expected the form 52:54:00:12:34:56", mac)
+	}
+	if hw[0]&1 != 0 {
+		return fmt.Errorf("mac %s is a multicast address", mac)
+	}
+	return nil
+}
+
+// errMACInUse - a pinned MAC already belongs to an interface of another domain
+var errMACInUse = errors.New("mac address already in use")
+
+// hostMACs returns every MAC address on the host's domains, mapped to the domain's name
+func hostMACs(conn *libvirt.Connect) (map[string]string, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+
+	// libvirt writes MACs in lower case, as resolveNICs normalises pinned ones
+	used := map[string]string{}
+	for i := range doms {
+		def, err := readDomainDef(&doms[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range def.Devices.Interfaces {
+			used[iface.MAC.Address] = def.Name
+		}
+	}
+	return used, nil
+}
+
+// uniqueMAC generates a MAC not yet in used and records it there for owner
+func uniqueMAC(used map[string]string, owner string) string {
+	for {
+		mac := generateRandomMAC()
+		if _, taken := used[mac]; !taken {
+			used[mac] = owner
+			return mac
+		}
+	}
+}
+
+// assignMACs checks pinned MACs against the host's domains and gives every other NIC a
+// random one no domain uses
+func assignMACs(conn *libvirt.Connect, vmName string, nics []NICDevice) error {
+	used, err := hostMACs(conn)
+	if err != nil {
+		return err
+	}
+	for i, nic := range nics {
+		if nic.MAC == "" {
+			continue
+		}
+		if owner, taken := used[nic.MAC]; taken {
+			return fmt.Errorf("nic %d: %w: %s belongs to VM %q", i, errMACInUse, nic.MAC, owner)
+		}
+		used[nic.MAC] = vmName
+	}
+	for i := range nics {
+		if nics[i].MAC == "" {
+			nics[i].MAC = uniqueMAC(used, vmName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// "numa" gives a large VM a guest NUMA topology, so its kernel and applications place
+// memory next to the vCPUs using it, and binds its memory to host NUMA nodes. Without
+// it the guest sees one node and its memory lands wherever the host puts it, which
+// costs VMs spanning host nodes a good part of their memory bandwidth. Pin the vCPUs of
+// each cell onto the host node its memory is on with cputune.
+
+// NUMASpec - guest NUMA nodes and host memory binding for a create
+type NUMASpec struct {
+	// Cells - the guest nodes; their cpus must cover every vCPU once and their memory
+	// add up to memory_mb
+	Cells []NUMACellSpec `json:"cells,omitempty"`
+	// HostNodes - host nodeset the VM's memory is bound to, e.g. "0" or "0-1"
+	HostNodes string `json:"host_nodes,omitempty"`
+	// Mode - how the binding holds: "strict" (default), "preferred", "interleave" or
+	// "restrictive"
+	Mode string `json:"mode,omitempty"`
+}
+
+// NUMACellSpec - a guest NUMA node
+type NUMACellSpec struct {
+	CPUs     string `json:"cpus"` // guest vCPUs, e.g. "0-3"
+	MemoryMB int    `json:"memory_mb"`
+	// HostNode - host node this cell's memory is bound to, overriding host_nodes
+	HostNode *int `json:"host_node,omitempty"`
+}
+
+// GuestNUMA - the NUMA topology and binding as the template writes them
+type GuestNUMA struct {
+	Cells     []NUMACell
+	HostNodes string
+	Mode      string
+	Bind      bool // whether there is a <numatune>
+}
+
+// NUMACell - a guest NUMA node; HostNode is empty when the cell isn't bound by itself
+type NUMACell struct {
+	ID        int
+	CPUs      string
+	MemoryKiB int
+	HostNode  string
+}
+
+var numaModes = map[string]bool{
+	"strict":      true,
+	"preferred":   true,
+	"interleave":  true,
+	"restrictive": true,
+}
+
+// errNUMAUnavailable - the host hasn't the NUMA nodes the binding names
+var errNUMAUnavailable = errors.New("host NUMA nodes unavailable")
+
+// validateNUMA checks the request's numa against its vCPUs and memory
+func validateNUMA(req RequestData) error {
+	n := req.NUMA
+	if n == nil {
+		return nil
+	}
+	if len(n.Cells) == 0 && n.HostNodes == "" {
+		return fmt.Errorf("numa needs cells or host_nodes")
+	}
+	if n.Mode != "" && !numaModes[n.Mode] {
+		return fmt.Errorf("unsupported numa mode %q, must be strict, preferred, interleave or restrictive", n.Mode)
+	}
+	if n.HostNodes != "" {
+		if _, err := parseCPUSet(n.HostNodes); err != nil {
+			return fmt.Errorf("host_nodes: %v", err)
+		}
+	}
+	if len(n.Cells) == 0 {
+		return nil
+	}
+
+	owner := map[int]int{}
+	memoryMB := 0
+	for i, c := range n.Cells {
+		cpus, err := parseCPUSet(c.CPUs)
+		if err != nil {
+			return fmt.Errorf("cell %d: %v", i, err)
+		}
+		for _, cpu := range cpus {
+			if cpu >= req.CPUs {
+				return fmt.Errorf("cell %d: the VM has no vCPU %d", i, cpu)
+			}
+			if other, taken := owner[cpu]; taken {
+				return fmt.Errorf("cell %d: vCPU %d is in cell %d already", i, cpu, other)
+			}
+			owner[cpu] = i
+		}
+		if c.MemoryMB <= 0 {
+			return fmt.Errorf("cell %d: memory_mb must be > 0", i)
+		}
+		if c.HostNode != nil && *c.HostNode < 0 {
+			return fmt.Errorf("cell %d: host_node must be >= 0", i)
+		}
+		memoryMB += c.MemoryMB
+	}
+	if len(owner) != req.CPUs {
+		return fmt.Errorf("the cells have %d of the %d vCPUs, each vCPU must be in one", len(owner), req.CPUs)
+	}
+	if memoryMB != req.MemoryMB {
+		return fmt.Errorf("the cells have %d MiB, memory_mb is %d", memoryMB, req.MemoryMB)
+	}
+	return nil
+}
+
+// checkNUMA checks the host has the nodes the request binds memory to
+func checkNUMA(conn *libvirt.Connect, req RequestData) error {
+	n := req.NUMA
+	if n == nil {
+		return nil
+	}
+	nodes := []int{}
+	if n.HostNodes != "" {
+		nodes, _ = parseCPUSet(n.HostNodes)
+	}
+	for _, c := range n.Cells {
+		if c.HostNode != nil {
+			nodes = append(nodes, *c.HostNode)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	cells, _, err := hostCPUCells(conn)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node >= len(cells) {
+			return fmt.Errorf("%w: the host has %d NUMA nodes, no node %d", errNUMAUnavailable, len(cells), node)
+		}
+	}
+	return nil
+}
+
+// guestNUMA - the template's NUMA data for the request, nil without numa
+func guestNUMA(req RequestData) *GuestNUMA {
+	n := req.NUMA
+	if n == nil {
+		return nil
+	}
+	g := &GuestNUMA{HostNodes: n.HostNodes, Mode: n.Mode, Bind: n.HostNodes != ""}
+	if g.Mode == "" {
+		g.Mode = "strict"
+	}
+	for i, c := range n.Cells {
+		cell := NUMACell{ID: i, CPUs: c.CPUs, MemoryKiB: c.MemoryMB * 1024}
+		if c.HostNode != nil {
+			cell.HostNode = strconv.Itoa(*c.HostNode)
+			g.Bind = true
+		}
+		g.Cells = append(g.Cells, cell)
+	}
+	return g
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC bearer tokens: JWTs signed by the SSO's keys, published as a JWKS. Set
+// VM_SERVICE_OIDC_ISSUER to turn it on; the JWKS URL is discovered from the issuer's
+// /.well-known/openid-configuration unless VM_SERVICE_OIDC_JWKS_URL names it.
+//
+//	VM_SERVICE_OIDC_AUDIENCE       required "aud", unchecked if unset
+//	VM_SERVICE_OIDC_USER_CLAIM     claim naming the caller, default "sub"
+//	VM_SERVICE_OIDC_PROJECT_CLAIM  claim naming the caller's project, default "project"
+//	VM_SERVICE_OIDC_ROLE_CLAIM     claim listing the caller's roles, default "roles"
+var oidcConfig = struct {
+	issuer, audience, jwksURL          string
+	userClaim, projectClaim, roleClaim string
+}{
+	issuer:       strings.TrimSuffix(envOrDefault("VM_SERVICE_OIDC_ISSUER", ""), "/"),
+	audience:     envOrDefault("VM_SERVICE_OIDC_AUDIENCE", ""),
+	jwksURL:      envOrDefault("VM_SERVICE_OIDC_JWKS_URL", ""),
+	userClaim:    envOrDefault("VM_SERVICE_OIDC_USER_CLAIM", "sub"),
+	projectClaim: envOrDefault("VM_SERVICE_OIDC_PROJECT_CLAIM", "project"),
+	roleClaim:    envOrDefault("VM_SERVICE_OIDC_ROLE_CLAIM", "roles"),
+}
+
+const (
+	jwksMaxAge      = time.Hour
+	jwksMinInterval = time.Minute // between refreshes forced by an unknown key ID
+	jwtLeeway       = time.Minute // clock skew allowed on exp and nbf
+)
+
+func oidcEnabled() bool {
+	return oidcConfig.issuer != ""
+}
+
+// jwksCache - the issuer's signing keys by key ID
+var jwksCache = struct {
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}{}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// signingKey returns the key with the ID, refreshing the JWKS when it is stale or doesn't
+// have the key (the issuer may have rotated), but not more than once a minute
+func signingKey(kid string) (crypto.PublicKey, error) {
+	jwksCache.mu.Lock()
+	defer jwksCache.mu.Unlock()
+
+	key, ok := jwksCache.keys[kid]
+	age := time.Since(jwksCache.fetched)
+	if (ok && age < jwksMaxAge) || (!ok && age < jwksMinInterval) {
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := fetchJWKS()
+	if err != nil {
+		if ok {
+			// Keep using the key we have while the issuer is unreachable
+			return key, nil
+		}
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	jwksCache.keys, jwksCache.fetched = keys, time.Now()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS downloads the issuer's RSA and EC signing keys. Keys of other types, and
+// encryption keys, are skipped.
+func fetchJWKS() (map[string]crypto.PublicKey, error) {
+	url := oidcConfig.jwksURL
+	if url == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(oidcConfig.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != oidcConfig.issuer || discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+		}
+		url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(url, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS at %s holds no usable signing keys", url)
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err1 := b64.DecodeString(k.N)
+		e, err2 := b64.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, fmt.Errorf("bad RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err1 := b64.DecodeString(k.X)
+		y, err2 := b64.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("bad EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("EC point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwtAlgs - the signature algorithms accepted; "none" and the HMAC ones never are
+var jwtAlgs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384,
+}
+
+var errNotJWT = errors.New("not a JWT")
+
+// looksLikeJWT tells bearer JWTs apart from API keys
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verifyJWT checks the token's signature against the issuer's keys, and its issuer,
+// audience and validity period, and maps its claims onto a principal
+func verifyJWT(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNotJWT
+	}
+	b64 := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := b64.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+	hash, ok := jwtAlgs[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	key, err := signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(header.Alg, "RS") || rsa.VerifyPKCS1v15(pub, hash, digest, sig) != nil {
+			return nil, fmt.Errorf("bad signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(sig) != 2*size {
+			return nil, fmt.Errorf("bad signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, fmt.Errorf("bad signature")
+		}
+	default:
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	raw, err = b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != oidcConfig.issuer {
+		return nil, fmt.Errorf("issued by %q", iss)
+	}
+	if oidcConfig.audience != "" && !claimHas(claims["aud"], oidcConfig.audience) {
+		return nil, fmt.Errorf("not issued for audience %q", oidcConfig.audience)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("not valid yet")
+	}
+
+	user, _ := claims[oidcConfig.userClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("no %q claim", oidcConfig.userClaim)
+	}
+	project, _ := claims[oidcConfig.projectClaim].(string)
+	p := &Principal{Name: user, Method: "oidc", Project: project}
+	assignRole(p, claimStrings(claims[oidcConfig.roleClaim]))
+	assignProject(p)
+	if p.Project != "" && !projectPattern.MatchString(p.Project) {
+		return nil, fmt.Errorf("invalid %q claim %q", oidcConfig.projectClaim, p.Project)
+	}
+	return p, nil
+}
+
+// claimStrings reads a claim that is either a string or an array of them
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// claimHas says whether a string-or-array claim such as aud contains want
+func claimHas(claim interface{}, want string) bool {
+	for _, s := range claimStrings(claim) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
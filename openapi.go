@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI 3 description of the API, served at GET /api/v1/openapi.json for client SDK
+// generators, with a Swagger UI over it at GET /api/v1/docs (and both under /api/v2 for
+// the v2 description, see versioning.go). The operations are listed in
+// apiOperations by their mux pattern; their schemas are worked out from the Go request and
+// response types, so they follow the types as fields are added.
+
+// swaggerUIURL - where the docs page loads Swagger UI's script and stylesheet from,
+// overridable with VM_SERVICE_SWAGGER_UI_URL for hosts that can't reach the CDN
+var swaggerUIURL = envOrDefault("VM_SERVICE_SWAGGER_UI_URL", "https://unpkg.com/swagger-ui-dist@5")
+
+// apiOperation - the parts of one endpoint the spec is built from
+type apiOperation struct {
+	Summary  string
+	Query    []string    // query parameters
+	Request  interface{} // the JSON body, as a value of its type
+	Body     string      // content type of a body that isn't JSON
+	Response interface{} // what "data" holds in the answer, nil for a message only
+	Produces string      // content type of an answer that isn't the JSON envelope
+	Async    bool        // answered with 202 and the Job to poll; a Response is then a 200 some requests get instead
+	SyncV1   bool        // Async in v2 only, v1 answers once the job is done (see writeJobStarted)
+}
+
+// hostScopedPrefixes - paths whose handlers act on the hypervisor named by ?host=
+var hostScopedPrefixes = []string{"/api/v1/vm", "/api/v1/pools", "/api/v1/networks", "/api/v1/host/", "/api/v1/events"}
+
+// apiOperations - every route registered in main, by its pattern; keep the two in step
+var apiOperations = map[string]apiOperation{
+	"POST /api/v1/vm":                                    {Summary: "Create a VM; with dry_run=true, check the request and answer with the domain XML instead", Query: []string{"dry_run"}, Request: RequestData{}, Response: CreatePreview{}, Async: true, SyncV1: true},
+	"GET /api/v1/vm":                                     {Summary: "List VMs", Query: []string{"state", "label", "name-prefix", "sort", "limit", "offset"}, Response: []VMInfo{}},
+	"DELETE /api/v1/vm":                                  {Summary: "Delete the VMs matching a label selector or name prefix", Query: []string{"selector", "prefix", "dry_run"}, Response: []DeletedVM{}},
+	"GET /api/v1/vm/{name}":                              {Summary: "Get a VM", Response: VMInfo{}},
+	"DELETE /api/v1/vm/{name}":                           {Summary: "Delete a VM", Response: DeletedVM{}},
+	"POST /api/v1/vm/{name}/start":                       {Summary: "Start a VM"},
+	"POST /api/v1/vm/{name}/stop":                        {Summary: "Shut down a VM, or power it off with force", Query: []string{"force"}},
+	"POST /api/v1/vm/import":                             {Summary: "Import a VM from an export bundle", Query: []string{"name", "storage_pool"}, Request: ImportRequest{}, Body: "application/x-tar"},
+	"POST /api/v1/vm/batch":                              {Summary: "Create several VMs", Request: BatchRequest{}, Response: []BatchResult{}},
+	"GET /api/v1/vm/{name}/disks":                        {Summary: "Get a VM's disk usage", Response: []DiskUsage{}},
+	"GET /api/v1/vm/{name}/addresses":                    {Summary: "Get a VM's IP addresses", Response: []GuestInterface{}},
+	"GET /api/v1/vm/{name}/stats":                        {Summary: "Get a VM's resource usage", Query: []string{"interval"}, Response: VMStats{}},
+	"GET /api/v1/vm/{name}/balloon":                      {Summary: "Get a VM's memory balloon and guest memory stats", Response: BalloonInfo{}},
+	"PUT /api/v1/vm/{name}/balloon":                      {Summary: "Inflate or deflate a running VM's memory balloon", Request: BalloonRequest{}},
+	"POST /api/v1/vm/{name}/memory":                      {Summary: "Hot-add a DIMM to a running VM", Request: MemoryHotplugRequest{}, Response: MemoryHotplugInfo{}},
+	"GET /api/v1/vm/{name}/graphics":                     {Summary: "Get a VM's graphical consoles", Response: []GraphicsInfo{}},
+	"GET /api/v1/vm/{name}/console":                      {Summary: "Get a token for a VM's console websocket", Query: []string{"type"}, Response: ConsoleInfo{}},
+	"GET /api/v1/vm/{name}/console-log":                  {Summary: "Read a VM's serial console log", Query: []string{"tail", "offset"}, Produces: "text/plain"},
+	"GET /api/v1/console/ws":                             {Summary: "Open a console websocket", Query: []string{"token"}, Produces: "application/octet-stream"},
+	"GET /api/v1/vm/{name}/agent/ping":                   {Summary: "Check a VM's guest agent", Response: AgentStatus{}},
+	"POST /api/v1/vm/{name}/agent/exec":                  {Summary: "Run a command in a VM through the guest agent", Request: AgentExecRequest{}, Response: AgentExecResult{}},
+	"GET /api/v1/vm/{name}/agent/file":                   {Summary: "Read a file in a VM through the guest agent", Query: []string{"path"}, Produces: "application/octet-stream"},
+	"PUT /api/v1/vm/{name}/agent/file":                   {Summary: "Write a file in a VM through the guest agent", Query: []string{"path", "append"}, Body: "application/octet-stream"},
+	"POST /api/v1/vm/{name}/clone":                       {Summary: "Clone a VM", Request: CloneRequest{}, Async: true, SyncV1: true},
+	"POST /api/v1/vm/{name}/adopt":                       {Summary: "Bring an existing domain under management", Request: AdoptRequest{}, Response: VMInfo{}},
+	"POST /api/v1/vm/{name}/migrate":                     {Summary: "Migrate a VM to another host", Request: MigrateRequest{}, Async: true},
+	"GET /api/v1/vm/{name}/migrations/{id}":              {Summary: "Get a migration job", Response: Job{}},
+	"POST /api/v1/vm/{name}/export":                      {Summary: "Export a VM as a bundle", Request: ExportRequest{}, Produces: "application/x-tar", Async: true},
+	"GET /api/v1/vm/{name}/exports/{id}":                 {Summary: "Get an export job", Response: Job{}},
+	"GET /api/v1/vm/{name}/snapshots":                    {Summary: "List a VM's snapshots", Response: []SnapshotInfo{}},
+	"POST /api/v1/vm/{name}/snapshots":                   {Summary: "Take a snapshot", Request: SnapshotRequest{}, Response: SnapshotInfo{}},
+	"GET /api/v1/vm/{name}/snapshots/{snapshot}":         {Summary: "Get a snapshot", Response: SnapshotInfo{}},
+	"DELETE /api/v1/vm/{name}/snapshots/{snapshot}":      {Summary: "Delete a snapshot", Query: []string{"children", "metadata_only"}},
+	"POST /api/v1/vm/{name}/snapshots/{snapshot}/revert": {Summary: "Revert a VM to a snapshot", Request: RevertRequest{}},
+	"POST /api/v1/vm/{name}/disks/{disk}/blockcommit":    {Summary: "Commit a disk's overlays into its backing image", Request: BlockCommitRequest{}, Async: true},
+	"POST /api/v1/vm/{name}/disks/{disk}/blockpull":      {Summary: "Pull a disk's backing images into it", Request: BlockPullRequest{}, Async: true},
+	"GET /api/v1/vm/{name}/blockjobs/{id}":               {Summary: "Get a block job", Response: Job{}},
+	"GET /api/v1/vm/{name}/snapshot-policy":              {Summary: "Get a VM's snapshot policy", Response: SnapshotPolicy{}},
+	"PUT /api/v1/vm/{name}/snapshot-policy":              {Summary: "Set a VM's snapshot policy", Request: SnapshotPolicyRequest{}, Response: SnapshotPolicy{}},
+	"DELETE /api/v1/vm/{name}/snapshot-policy":           {Summary: "Remove a VM's snapshot policy"},
+	"GET /api/v1/snapshot-policies":                      {Summary: "List snapshot policies", Response: []SnapshotPolicy{}},
+	"GET /api/v1/vm/{name}/checkpoints":                  {Summary: "List a VM's checkpoints", Response: []CheckpointInfo{}},
+	"POST /api/v1/vm/{name}/checkpoints":                 {Summary: "Create a checkpoint", Request: CheckpointRequest{}, Response: CheckpointInfo{}},
+	"DELETE /api/v1/vm/{name}/checkpoints/{checkpoint}":  {Summary: "Delete a checkpoint"},
+	"POST /api/v1/vm/{name}/hostdevs":                    {Summary: "Pass a host PCI device through", Request: HostdevSpec{}, Response: HostdevSpec{}},
+	"DELETE /api/v1/vm/{name}/hostdevs/{address}":        {Summary: "Detach a passed-through PCI device"},
+	"POST /api/v1/vm/{name}/usb":                         {Summary: "Pass a host USB device through", Request: USBDeviceSpec{}, Response: USBDeviceSpec{}},
+	"DELETE /api/v1/vm/{name}/usb/{device}":              {Summary: "Detach a passed-through USB device"},
+	"POST /api/v1/vm/{name}/backups":                     {Summary: "Start a backup", Request: BackupRequest{}, Async: true},
+	"GET /api/v1/vm/{name}/backups/{id}":                 {Summary: "Get a backup job", Response: Job{}},
+	"GET /api/v1/vm/{name}/port-forwards":                {Summary: "List a VM's port forwards", Response: []PortForward{}},
+	"POST /api/v1/vm/{name}/port-forwards":               {Summary: "Add a port forward", Request: PortForwardRequest{}, Response: PortForward{}},
+	"DELETE /api/v1/vm/{name}/port-forwards/{id}":        {Summary: "Remove a port forward"},
+	"GET /api/v1/jobs/{id}":                              {Summary: "Get a job", Response: Job{}},
+	"GET /api/v1/records":                                {Summary: "List managed VM records and drift", Query: []string{"drift"}, Response: RecordsStatus{}},
+
+	"GET /api/v1/images":                      {Summary: "List catalog images", Query: []string{"tag"}, Response: []Image{}},
+	"POST /api/v1/images":                     {Summary: "Register an image", Request: ImageRequest{}, Response: Image{}},
+	"POST /api/v1/images/upload":              {Summary: "Upload an image", Query: []string{"upload_id", "name", "kind", "format", "os_family", "default_login", "min_disk_gb"}, Body: "application/octet-stream", Response: UploadProgress{}},
+	"GET /api/v1/images/uploads/{id}":         {Summary: "Get an upload's progress", Response: UploadProgress{}},
+	"POST /api/v1/images/convert":             {Summary: "Convert an image", Request: ConvertRequest{}, Async: true},
+	"GET /api/v1/images/conversions/{id}":     {Summary: "Get a conversion job", Response: Job{}},
+	"GET /api/v1/images/{name}":               {Summary: "Get a catalog image", Response: Image{}},
+	"DELETE /api/v1/images/{name}":            {Summary: "Remove a catalog image", Query: []string{"purge"}},
+	"POST /api/v1/images/{name}/tags":         {Summary: "Tag an image", Request: TagsRequest{}, Response: Image{}},
+	"DELETE /api/v1/images/{name}/tags/{tag}": {Summary: "Untag an image", Response: Image{}},
+
+	"GET /api/v1/pools":                 {Summary: "List storage pools", Response: []PoolInfo{}},
+	"POST /api/v1/pools":                {Summary: "Create a storage pool", Request: PoolRequest{}, Response: PoolInfo{}},
+	"GET /api/v1/pools/{name}":          {Summary: "Get a storage pool", Response: PoolInfo{}},
+	"POST /api/v1/pools/{name}/refresh": {Summary: "Refresh a storage pool", Response: PoolInfo{}},
+
+	"GET /api/v1/events":                      {Summary: "Stream lifecycle events", Query: []string{"vm", "type"}, Produces: "text/event-stream"},
+	"GET /api/v1/audit":                       {Summary: "Query the audit log", Query: []string{"since", "until", "user", "vm", "method", "limit"}, Response: []AuditRecord{}},
+	"GET /api/v1/webhooks":                    {Summary: "List webhooks", Response: []Webhook{}},
+	"POST /api/v1/webhooks":                   {Summary: "Register a webhook", Request: WebhookRequest{}, Response: Webhook{}},
+	"DELETE /api/v1/webhooks/{id}":            {Summary: "Remove a webhook"},
+	"GET /api/v1/quotas":                      {Summary: "List project quotas", Response: []Quota{}},
+	"GET /api/v1/projects/{project}/quota":    {Summary: "Get a project's quota and usage", Response: QuotaStatus{}},
+	"PUT /api/v1/projects/{project}/quota":    {Summary: "Set a project's quota", Request: Quota{}, Response: Quota{}},
+	"DELETE /api/v1/projects/{project}/quota": {Summary: "Remove a project's quota"},
+	"GET /metrics":                            {Summary: "Prometheus metrics", Produces: "text/plain"},
+	"GET /healthz":                            {Summary: "Liveness probe: the default host's libvirt answers", Response: []HealthCheck{}},
+	"GET /readyz":                             {Summary: "Readiness probe: every host, the template and the writable directories", Response: []HealthCheck{}},
+	"GET /api/v1/openapi.json":                {Summary: "This OpenAPI description", Produces: "application/json"},
+	"GET /api/v1/docs":                        {Summary: "Swagger UI over the OpenAPI description", Produces: "text/html"},
+	"POST /vmservice.v1.VMService/{method}":   {Summary: "gRPC API, see proto/vmservice/v1/vmservice.proto", Body: "application/grpc", Produces: "application/grpc"},
+
+	"GET /api/v1/templates":         {Summary: "List domain templates", Response: []DomainTemplate{}},
+	"GET /api/v1/flavors":           {Summary: "List flavors", Response: []Flavor{}},
+	"GET /api/v1/flavors/{name}":    {Summary: "Get a flavor", Response: Flavor{}},
+	"PUT /api/v1/flavors/{name}":    {Summary: "Create or replace a flavor", Request: Flavor{}, Response: Flavor{}},
+	"DELETE /api/v1/flavors/{name}": {Summary: "Remove a flavor"},
+
+	"GET /api/v1/hosts":        {Summary: "List hypervisor hosts", Response: []HypervisorHost{}},
+	"GET /api/v1/hosts/{name}": {Summary: "Get a host's capacity", Response: HostCapacity{}},
+	"GET /api/v1/host/sriov":   {Summary: "List SR-IOV virtual functions", Response: []SRIOVFunction{}},
+	"GET /api/v1/host/pci":     {Summary: "List host PCI devices with their IOMMU groups", Response: []PCIDevice{}},
+
+	"GET /api/v1/networks":               {Summary: "List networks", Response: []NetworkInfo{}},
+	"POST /api/v1/networks":              {Summary: "Create a network", Request: NetworkRequest{}, Response: NetworkInfo{}},
+	"GET /api/v1/networks/{name}":        {Summary: "Get a network", Response: NetworkInfo{}},
+	"POST /api/v1/networks/{name}/start": {Summary: "Start a network", Response: NetworkInfo{}},
+	"DELETE /api/v1/networks/{name}":     {Summary: "Delete a network"},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDocs = map[int][]byte{} // by API version
+)
+
+// handleOpenAPI - GET /api/v1/openapi.json
+// The v2 document describes the same operations under /api/v2
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		for _, version := range []int{1, 2} {
+			doc, err := json.MarshalIndent(buildOpenAPISpec(version), "", "  ")
+			if err != nil {
+				requestLog(r).Error(fmt.Sprintf("Failed to build OpenAPI spec: %v", err))
+				return
+			}
+			openAPIDocs[version] = doc
+		}
+	})
+	openAPIDoc := openAPIDocs[apiVersion(r)]
+	if openAPIDoc == nil {
+		writeErrorResponse(w, "Failed to build OpenAPI spec")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDoc)
+}
+
+var swaggerUIPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>vm-service API</title>
+<link rel="stylesheet" href="{{.Assets}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.Assets}}/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "{{.Spec}}", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`))
+
+// handleAPIDocs - GET /api/v1/docs
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = swaggerUIPage.Execute(w, map[string]string{
+		"Assets": strings.TrimSuffix(swaggerUIURL, "/"),
+		"Spec":   apiPath(r, "/api/v1/openapi.json"),
+	})
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// buildOpenAPISpec assembles the OpenAPI document of an API version from apiOperations.
+// In v1's the /api/v1 operations are marked deprecated.
+func buildOpenAPISpec(version int) map[string]interface{} {
+	g := &schemaGen{schemas: map[string]interface{}{}}
+	envelope := g.schema(reflect.TypeOf(ResponseData{}))
+
+	patterns := make([]string, 0, len(apiOperations))
+	for p := range apiOperations {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+
+	paths := map[string]map[string]interface{}{}
+	for _, pattern := range patterns {
+		op := apiOperations[pattern]
+		method, path, _ := strings.Cut(pattern, " ")
+		if op.SyncV1 && version == 1 {
+			op.Async = false
+		}
+
+		var params []interface{}
+		for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		query := op.Query
+		for _, prefix := range hostScopedPrefixes {
+			if strings.HasPrefix(path, prefix) {
+				query = append([]string{"host"}, query...)
+				break
+			}
+		}
+		for _, q := range query {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query", "schema": map[string]string{"type": "string"},
+			})
+		}
+
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": operationID(method, path),
+			"tags":        []string{operationTag(path)},
+			"responses":   g.responses(op, envelope),
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if body := g.requestBody(op); body != nil {
+			operation["requestBody"] = body
+		}
+		if unauthenticatedPaths[path] {
+			operation["security"] = []interface{}{}
+		}
+		versioned := strings.HasPrefix(path, apiV1Prefix+"/")
+		if versioned && version == 1 {
+			operation["deprecated"] = true
+		}
+		if versioned && version == 2 {
+			path = apiV2Prefix + strings.TrimPrefix(path, apiV1Prefix)
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":       "vm-service",
+			"description": "Manages libvirt/KVM virtual machines",
+			"version":     fmt.Sprintf("v%d", version),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []interface{}{
+			map[string][]string{"bearer": {}},
+			map[string][]string{"apiKey": {}},
+		},
+	}
+}
+
+func (g *schemaGen) requestBody(op apiOperation) map[string]interface{} {
+	content := map[string]interface{}{}
+	if op.Request != nil {
+		content["application/json"] = map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Request))}
+	}
+	if op.Body != "" {
+		content[op.Body] = map[string]interface{}{"schema": map[string]string{"type": "string", "format": "binary"}}
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"content": content}
+}
+
+func (g *schemaGen) responses(op apiOperation, envelope map[string]interface{}) map[string]interface{} {
+	resp := map[string]interface{}{
+		"400": map[string]interface{}{
+			"description": "Invalid request",
+			"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]string{"type": "string"}}},
+		},
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": envelope}},
+		},
+	}
+	if op.Async {
+		resp["202"] = map[string]interface{}{
+			"description": "Accepted, poll the job for the result",
+			"headers":     map[string]interface{}{"Location": map[string]interface{}{"schema": map[string]string{"type": "string"}}},
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": g.wrapped(envelope, Job{})}},
+		}
+	}
+	switch {
+	case op.Produces != "":
+		format := "binary"
+		if strings.HasPrefix(op.Produces, "text/") || op.Produces == "application/json" {
+			format = ""
+		}
+		schema := map[string]string{"type": "string"}
+		if format != "" {
+			schema["format"] = format
+		}
+		resp["200"] = map[string]interface{}{
+			"description": "OK",
+			"content":     map[string]interface{}{op.Produces: map[string]interface{}{"schema": schema}},
+		}
+	case !op.Async || op.Response != nil:
+		resp["200"] = map[string]interface{}{
+			"description": "OK",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": g.wrapped(envelope, op.Response)}},
+		}
+	}
+	return resp
+}
+
+// wrapped is the ResponseData envelope with data of the given type
+func (g *schemaGen) wrapped(envelope map[string]interface{}, data interface{}) map[string]interface{} {
+	if data == nil {
+		return envelope
+	}
+	return map[string]interface{}{"allOf": []interface{}{
+		envelope,
+		map[string]interface{}{"properties": map[string]interface{}{"data": g.schema(reflect.TypeOf(data))}},
+	}}
+}
+
+// operationID makes an identifier like "getVmNameSnapshots" from the method and path
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '{' || r == '}' || r == '-' || r == '.' }) {
+		if part == "api" || part == "v1" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// operationTag groups operations by the first path segment after the version
+func operationTag(path string) string {
+	tag, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(path, "/api/v1"), "/"), "/")
+	return tag
+}
+
+// schemaGen turns Go types into JSON schemas the way encoding/json marshals them,
+// collecting named structs under components/schemas
+type schemaGen struct {
+	schemas map[string]interface{}
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t.Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // placeholder, for types that refer to themselves
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// object is the schema of a struct's JSON fields, embedded structs' fields included
+func (g *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	g.addFields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
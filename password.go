@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// allowPasswords - password injection is off unless VM_SERVICE_ALLOW_PASSWORDS is true;
+// keys are the better choice wherever the image supports them
+var allowPasswords, _ = strconv.ParseBool(envOrDefault("VM_SERVICE_ALLOW_PASSWORDS", "false"))
+
+// passwordAgentTimeout - how long to wait for the guest agent of a new VM to come up
+const passwordAgentTimeout = 10 * time.Minute
+
+// PasswordSpec - initial password for a guest user, for images without SSH key support
+// such as Windows templates. Give either Password or Hash.
+type PasswordSpec struct {
+	User     string `json:"user,omitempty"`     // defaults to "root"
+	Password string `json:"password,omitempty"` // plaintext, never written to disk as-is
+	Hash     string `json:"hash,omitempty"`     // a crypt(3) hash, e.g. "$6$salt$..."
+	// Method is "cloud-init" (default), which writes the hash into the seed, or
+	// "guest-agent", which sets it through qemu-guest-agent once the VM has booted.
+	// Windows guests need the guest agent and a plaintext password.
+	Method string `json:"method,omitempty"`
+}
+
+// normalize fills in defaults and checks the spec is usable
+func (p *PasswordSpec) normalize() error {
+	if p.User == "" {
+		p.User = "root"
+	}
+	if p.Method == "" {
+		p.Method = "cloud-init"
+	}
+	if p.Method != "cloud-init" && p.Method != "guest-agent" {
+		return fmt.Errorf("method must be \"cloud-init\" or \"guest-agent\"")
+	}
+	if (p.Password == "") == (p.Hash == "") {
+		return fmt.Errorf("exactly one of password and hash is required")
+	}
+	if p.Hash != "" && !strings.HasPrefix(p.Hash, "$") {
+		return fmt.Errorf("hash must be a crypt(3) string such as $6$salt$...")
+	}
+	if strings.ContainsAny(p.User, ":\n") {
+		return fmt.Errorf("invalid user %q", p.User)
+	}
+	return nil
+}
+
+// hashed returns the crypt(3) hash of the password, generating a SHA-512 one from a
+// plaintext password
+func (p PasswordSpec) hashed() (string, error) {
+	if p.Hash != "" {
+		return p.Hash, nil
+	}
+	salt, err := cryptSalt(16)
+	if err != nil {
+		return "", err
+	}
+	return sha512Crypt(p.Password, salt), nil
+}
+
+// setPasswordWhenReady waits for the VM's guest agent and sets the password through it.
+// It runs in the background after create, so failures can only be logged.
+func setPasswordWhenReady(host, vmName string, p PasswordSpec) {
+	err := func() error {
+		conn, err := connectHost(host)
+		if err != nil {
+			return fmt.Errorf("failed to connect libvirt: %v", err)
+		}
+		defer conn.Close()
+		dom, err := conn.LookupDomainByName(vmName)
+		if err != nil {
+			return fmt.Errorf("failed to look up VM: %v", err)
+		}
+		defer dom.Free()
+
+		deadline := time.Now().Add(passwordAgentTimeout)
+		for {
+			def, err := readDomainDef(dom)
+			if err != nil {
+				return fmt.Errorf("failed to read domain XML: %v", err)
+			}
+			if def.guestAgentConnected() {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("guest agent did not connect within %v", passwordAgentTimeout)
+			}
+			time.Sleep(5 * time.Second)
+		}
+
+		if p.Hash != "" {
+			return dom.SetUserPassword(p.User, p.Hash, libvirt.DOMAIN_PASSWORD_ENCRYPTED)
+		}
+		return dom.SetUserPassword(p.User, p.Password, 0)
+	}()
+	if err != nil {
+		log.Printf("Failed to set password for %s on VM %s: %v", p.User, vmName, err)
+		return
+	}
+	log.Printf("Set password for %s on VM %s via guest agent", p.User, vmName)
+}
+
+// cryptAlphabet - the base64 variant crypt(3) uses, for salts and hashes
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func cryptSalt(n int) (string, error) {
+	salt := make([]byte, n)
+	for i := range salt {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(cryptAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		salt[i] = cryptAlphabet[idx.Int64()]
+	}
+	return string(salt), nil
+}
+
+// sha512Crypt implements glibc's SHA-512 crypt ("$6$", default 5000 rounds), the hash
+// format cloud-init and the guest agent hand to chpasswd
+func sha512Crypt(password, salt string) string {
+	pw, s := []byte(password), []byte(salt)
+	if len(s) > 16 {
+		s = s[:16]
+	}
+
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(s)
+	b.Write(pw)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(s)
+	n := len(pw)
+	for ; n > 64; n -= 64 {
+		a.Write(sumB)
+	}
+	a.Write(sumB[:n])
+	for n = len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeatTo(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sp := repeatTo(ds.Sum(nil), len(s))
+
+	sum := sumA
+	for i := 0; i < 5000; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(sp)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	// The digest bytes are emitted in this fixed, interleaved order
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54},
+		{34, 55, 13}, {56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60},
+		{40, 61, 19}, {62, 20, 41},
+	}
+	var out strings.Builder
+	out.WriteString("$6$" + string(s) + "$")
+	encode := func(v uint, chars int) {
+		for ; chars > 0; chars-- {
+			out.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, o := range order {
+		encode(uint(sum[o[0]])<<16|uint(sum[o[1]])<<8|uint(sum[o[2]]), 4)
+	}
+	encode(uint(sum[63]), 2)
+	return out.String()
+}
+
+// repeatTo repeats b until it is n bytes long
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// placementNamespace - URI of the placement element in the domain <metadata>
+const placementNamespace = "https://github.com/rockybhanu/ramanuj-vm-service/placement"
+
+// cpuOvercommit - vCPUs the scheduler allows per host CPU, from VM_SERVICE_CPU_OVERCOMMIT
+var cpuOvercommit, _ = strconv.ParseFloat(envOrDefault("VM_SERVICE_CPU_OVERCOMMIT", "4"), 64)
+
+var groupPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// placementXML - our element in the domain <metadata>
+type placementXML struct {
+	XMLName      xml.Name `xml:"placement"`
+	AntiAffinity []struct {
+		Group string `xml:"group,attr"`
+	} `xml:"anti-affinity"`
+}
+
+// validateAntiAffinity checks anti-affinity group names before they go into the XML
+func validateAntiAffinity(groups []string) error {
+	for _, g := range groups {
+		if !groupPattern.MatchString(g) {
+			return fmt.Errorf("invalid anti-affinity group %q", g)
+		}
+	}
+	return nil
+}
+
+// placeVM picks the host for a new VM when the caller names none: of the hosts with
+// enough free memory, vCPU headroom and space in the pool, and no VM sharing one of its
+// anti-affinity groups, the one left with the least free memory (best fit, so large
+// VMs still find room later). localOnly restricts the choice to local hosts.
+func placeVM(req RequestData, specs []DiskSpec, localOnly bool) (string, error) {
+	poolName := requestPool(req)
+	diskBytes := specsBytes(specs)
+
+	var best string
+	var bestLeft uint64
+	var reasons []string
+	for _, h := range hypervisorHosts {
+		if localOnly && !isLocalHost(h.Name) {
+			continue
+		}
+		left, err := hostFit(h.Name, req, poolName, diskBytes)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", h.Name, err))
+			continue
+		}
+		if best == "" || left < bestLeft {
+			best, bestLeft = h.Name, left
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no host can take the VM (%v)", reasons)
+	}
+	log.Printf("Placed VM %s on host %s", req.Name, best)
+	return best, nil
+}
+
+// hostFit checks whether the VM fits on the host and returns the memory (MiB) left after it
+func hostFit(host string, req RequestData, poolName string, diskBytes uint64) (uint64, error) {
+	conn, err := connectHost(host)
+	if err != nil {
+		return 0, fmt.Errorf("unreachable: %v", err)
+	}
+	defer conn.Close()
+
+	hc, err := hostCapacity(conn)
+	if err != nil {
+		return 0, err
+	}
+	left, err := hostResourcesFit(hc, req, poolName, diskBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(req.AntiAffinity) > 0 {
+		if vm, group, err := antiAffinityConflict(conn, req.AntiAffinity); err != nil {
+			return 0, err
+		} else if vm != "" {
+			return 0, fmt.Errorf("VM %s is in anti-affinity group %s", vm, group)
+		}
+	}
+	return left, nil
+}
+
+// hostResourcesFit checks the VM against what the host has left: free memory, vCPUs
+// within cpuOvercommit and free space in the pool. It returns the memory (MiB) left
+// after the VM, or an error saying what is short.
+func hostResourcesFit(hc HostCapacity, req RequestData, poolName string, diskBytes uint64) (uint64, error) {
+	need := uint64(req.MemoryMB)
+	avail := hc.Memory.FreeMB
+	if hc.Memory.TotalMB > hc.Memory.AllocatedMB {
+		avail = min(avail, hc.Memory.TotalMB-hc.Memory.AllocatedMB)
+	} else {
+		avail = 0
+	}
+	if avail < need {
+		return 0, fmt.Errorf("%d MiB of memory available, %d needed", avail, need)
+	}
+	if limit := int(float64(hc.CPU.CPUs) * cpuOvercommit); hc.AllocatedVCPUs+req.CPUs > limit {
+		return 0, fmt.Errorf("%d of %d vCPUs allocated, %d more needed", hc.AllocatedVCPUs, limit, req.CPUs)
+	}
+	for _, p := range hc.Pools {
+		if p.Name == poolName {
+			if p.AvailableBytes < diskBytes {
+				return 0, fmt.Errorf("pool %s has %d bytes free, %d needed", poolName, p.AvailableBytes, diskBytes)
+			}
+			return avail - need, nil
+		}
+	}
+	return 0, fmt.Errorf("no active pool %q", poolName)
+}
+
+// requestPool - the pool a create request's new disks go into
+func requestPool(req RequestData) string {
+	if req.StoragePool != "" {
+		return req.StoragePool
+	}
+	return defaultStoragePool
+}
+
+// specsBytes - the space the new disks ask for; disks sized by their base image count as 0
+func specsBytes(specs []DiskSpec) uint64 {
+	var n uint64
+	for _, s := range specs {
+		if s.SizeGB > 0 {
+			n += uint64(s.SizeGB) << 30
+		}
+	}
+	return n
+}
+
+// antiAffinityConflict finds a domain on the host that shares one of groups
+func antiAffinityConflict(conn *libvirt.Connect, groups []string) (string, string, error) {
+	want := map[string]bool{}
+	for _, g := range groups {
+		want[g] = true
+	}
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list domains: %v", err)
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+	for i := range doms {
+		for _, g := range domainAntiAffinity(&doms[i]) {
+			if want[g] {
+				name, _ := doms[i].GetName()
+				return name, g, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// domainAntiAffinity reads a domain's anti-affinity groups from its metadata
+func domainAntiAffinity(dom *libvirt.Domain) []string {
+	doc, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, placementNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		if !isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN_METADATA) {
+			log.Printf("Failed to read placement metadata: %v", err)
+		}
+		return nil
+	}
+	var p placementXML
+	if err := xml.Unmarshal([]byte(doc), &p); err != nil {
+		log.Printf("Failed to parse placement metadata: %v", err)
+		return nil
+	}
+	var groups []string
+	for _, a := range p.AntiAffinity {
+		groups = append(groups, a.Group)
+	}
+	return groups
+}
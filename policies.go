@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// stateDir - where the service keeps its own state, overridable with VM_SERVICE_STATE_DIR
+var stateDir = envOrDefault("VM_SERVICE_STATE_DIR", "/var/lib/vm-service")
+
+// SnapshotPolicy - takes internal snapshots of a VM on a cron schedule and keeps the newest
+// Retention of them. Only snapshots named with the policy's prefix are ever pruned, so
+// snapshots taken by hand are left alone.
+type SnapshotPolicy struct {
+	VM        string     `json:"vm"`
+	Schedule  string     `json:"schedule"` // cron expression, e.g. "0 */6 * * *" or "@daily"
+	Retention int        `json:"retention"`
+	Prefix    string     `json:"prefix,omitempty"` // defaults to "auto-"
+	Quiesce   bool       `json:"quiesce,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// SnapshotPolicyRequest - body of PUT /api/v1/vm/{name}/snapshot-policy
+type SnapshotPolicyRequest struct {
+	Schedule  string `json:"schedule"`
+	Retention int    `json:"retention"`
+	Prefix    string `json:"prefix,omitempty"`
+	Quiesce   bool   `json:"quiesce,omitempty"`
+	Enabled   *bool  `json:"enabled,omitempty"` // defaults to true
+}
+
+// policyStore - snapshot policies by VM name, persisted as JSON in the state directory
+type policyStore struct {
+	mu       sync.Mutex
+	path     string
+	policies map[string]*SnapshotPolicy
+}
+
+var snapshotPolicies = &policyStore{
+	path:     filepath.Join(stateDir, "snapshot-policies.json"),
+	policies: map[string]*SnapshotPolicy{},
+}
+
+// load reads the policy file; a missing file means no policies
+func (s *policyStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var policies []*SnapshotPolicy
+	if err := json.Unmarshal(content, &policies); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, p := range policies {
+		s.policies[p.VM] = p
+	}
+	return nil
+}
+
+// saveLocked writes the policies atomically; s.mu must be held
+func (s *policyStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *policyStore) listLocked() []SnapshotPolicy {
+	out := []SnapshotPolicy{}
+	for _, p := range s.policies {
+		out = append(out, *p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].VM < out[j].VM })
+	return out
+}
+
+func (s *policyStore) list() []SnapshotPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *policyStore) get(vm string) (SnapshotPolicy, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.policies[vm]
+	if !ok {
+		return SnapshotPolicy{}, false
+	}
+	return *p, true
+}
+
+// put adds or replaces the VM's policy
+func (s *policyStore) put(p SnapshotPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[p.VM] = &p
+	return s.saveLocked()
+}
+
+func (s *policyStore) remove(vm string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.policies[vm]; !ok {
+		return false, nil
+	}
+	delete(s.policies, vm)
+	return true, s.saveLocked()
+}
+
+// recordRun notes the outcome of a scheduled run, unless the policy was removed meanwhile
+func (s *policyStore) recordRun(vm string, at time.Time, runErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.policies[vm]
+	if !ok {
+		return
+	}
+	p.LastRun = &at
+	p.LastError = ""
+	if runErr != nil {
+		p.LastError = runErr.Error()
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Printf("Failed to save snapshot policies: %v", err)
+	}
+}
+
+// handleListSnapshotPolicies - GET /api/v1/snapshot-policies
+// Callers in a project only get the policies of the project's VMs.
+func handleListSnapshotPolicies(w http.ResponseWriter, r *http.Request) {
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	policies := []SnapshotPolicy{}
+	for _, p := range snapshotPolicies.list() {
+		if scope.ownsName(p.VM) {
+			policies = append(policies, p)
+		}
+	}
+	writeDataResponse(w, policies)
+}
+
+// handleGetSnapshotPolicy - GET /api/v1/vm/{name}/snapshot-policy
+func handleGetSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	vm, ok := requestVMName(w, r)
+	if !ok {
+		return
+	}
+	p, ok := snapshotPolicies.get(vm)
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no snapshot policy", r.PathValue("name")))
+		return
+	}
+	writeDataResponse(w, p)
+}
+
+// handlePutSnapshotPolicy - PUT /api/v1/vm/{name}/snapshot-policy
+func handlePutSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	if !isDefaultHost(requestHost(r)) {
+		http.Error(w, "Snapshot policies are only supported on the default host", http.StatusBadRequest)
+		return
+	}
+	var req SnapshotPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseCron(req.Schedule); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Retention < 1 {
+		http.Error(w, "retention must be at least 1", http.StatusBadRequest)
+		return
+	}
+	if req.Prefix == "" {
+		req.Prefix = "auto-"
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		vm, _ := dom.GetName()
+		p := SnapshotPolicy{
+			VM:        vm,
+			Schedule:  req.Schedule,
+			Retention: req.Retention,
+			Prefix:    req.Prefix,
+			Quiesce:   req.Quiesce,
+			Enabled:   req.Enabled == nil || *req.Enabled,
+			CreatedAt: time.Now().UTC(),
+		}
+		if existing, ok := snapshotPolicies.get(p.VM); ok {
+			p.CreatedAt, p.LastRun, p.LastError = existing.CreatedAt, existing.LastRun, existing.LastError
+		}
+		if err := snapshotPolicies.put(p); err != nil {
+			errMsg := fmt.Sprintf("Failed to save snapshot policy: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Set snapshot policy for VM %s: %q, keep %d", p.VM, p.Schedule, p.Retention))
+		writeDataResponse(w, p)
+	})
+}
+
+// handleDeleteSnapshotPolicy - DELETE /api/v1/vm/{name}/snapshot-policy
+// Stops scheduled snapshots; the snapshots already taken are kept.
+func handleDeleteSnapshotPolicy(w http.ResponseWriter, r *http.Request) {
+	vm, ok := requestVMName(w, r)
+	if !ok {
+		return
+	}
+	removed, err := snapshotPolicies.remove(vm)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to save snapshot policies: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no snapshot policy", r.PathValue("name")))
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Removed snapshot policy for VM %s", r.PathValue("name")))
+	writeSuccessResponse(w, fmt.Sprintf("Snapshot policy for %s removed", r.PathValue("name")))
+}
+
+// runSnapshotScheduler wakes at the start of every minute and runs the policies whose
+// schedule matches it. Runs for different VMs proceed in parallel.
+func runSnapshotScheduler() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+
+		for _, p := range snapshotPolicies.list() {
+			if !p.Enabled {
+				continue
+			}
+			sched, err := parseCron(p.Schedule)
+			if err != nil || !sched.matches(next) {
+				continue
+			}
+			go func(p SnapshotPolicy) {
+				err := runSnapshotPolicy(p)
+				if err != nil {
+					log.Printf("Scheduled snapshot of VM %s failed: %v", p.VM, err)
+				}
+				snapshotPolicies.recordRun(p.VM, next.UTC(), err)
+			}(p)
+		}
+	}
+}
+
+// runSnapshotPolicy takes one scheduled snapshot and prunes the policy's oldest ones
+func runSnapshotPolicy(p SnapshotPolicy) error {
+	conn, err := connectLibvirt()
+	if err != nil {
+		return fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(p.VM)
+	if err != nil {
+		return fmt.Errorf("failed to look up VM: %v", err)
+	}
+	defer dom.Free()
+
+	info, err := createSnapshot(dom, SnapshotRequest{
+		Name:        p.Prefix + timestampName(),
+		Description: "scheduled by snapshot policy",
+		Quiesce:     p.Quiesce,
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Scheduled snapshot %s of VM %s taken", info.Name, p.VM)
+
+	snaps, err := dom.ListAllSnapshots(0)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots for pruning: %v", err)
+	}
+	var owned []SnapshotInfo
+	for i := range snaps {
+		info, err := describeSnapshot(&snaps[i])
+		snaps[i].Free()
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot for pruning: %v", err)
+		}
+		if strings.HasPrefix(info.Name, p.Prefix) {
+			owned = append(owned, info)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].CreatedAt.Before(owned[j].CreatedAt) })
+
+	for len(owned) > p.Retention {
+		oldest := owned[0]
+		owned = owned[1:]
+		snap, err := dom.SnapshotLookupByName(oldest.Name, 0)
+		if err != nil {
+			return fmt.Errorf("failed to look up snapshot %s for pruning: %v", oldest.Name, err)
+		}
+		err = snap.Delete(0)
+		snap.Free()
+		if err != nil {
+			return fmt.Errorf("failed to prune snapshot %s: %v", oldest.Name, err)
+		}
+		log.Printf("Pruned snapshot %s of VM %s", oldest.Name, p.VM)
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// PoolRequest - incoming JSON to define (and start) a new storage pool
+type PoolRequest struct {
+	Name         string `json:"name"`
+	Type         string `json:"type,omitempty"`          // "dir" (default), "fs", "logical", "netfs", ...
+	TargetPath   string `json:"target_path,omitempty"`   // where volumes live on the host, e.g. /data/pools/fast
+	SourceDevice string `json:"source_device,omitempty"` // block device for "fs"/"logical" pools
+	SourceHost   string `json:"source_host,omitempty"`   // server for "netfs" pools
+	SourceDir    string `json:"source_dir,omitempty"`    // export path for "netfs" pools
+	SourceName   string `json:"source_name,omitempty"`   // volume group for "logical" pools, Ceph pool for "rbd" pools
+	Autostart    bool   `json:"autostart,omitempty"`
+
+	// "rbd" pools: Ceph monitors ("host" or "host:port") and the cephx identity to use.
+	// CephKey is the base64 key as printed by `ceph auth get-key`; it is stored as a libvirt secret.
+	Monitors []string `json:"monitors,omitempty"`
+	CephUser string   `json:"ceph_user,omitempty"`
+	CephKey  string   `json:"ceph_key,omitempty"`
+}
+
+// PoolInfo - what we report about a storage pool
+type PoolInfo struct {
+	Name            string `json:"name"`
+	UUID            string `json:"uuid"`
+	Type            string `json:"type"`
+	State           string `json:"state"`
+	TargetPath      string `json:"target_path,omitempty"`
+	Persistent      bool   `json:"persistent"`
+	Autostart       bool   `json:"autostart"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	AvailableBytes  uint64 `json:"available_bytes"`
+}
+
+// poolXML - the subset of libvirt's <pool> document we read and write
+type poolXML struct {
+	XMLName xml.Name       `xml:"pool"`
+	Type    string         `xml:"type,attr"`
+	Name    string         `xml:"name"`
+	Source  *poolSourceXML `xml:"source,omitempty"`
+	Target  *poolTargetXML `xml:"target,omitempty"`
+}
+
+type poolSourceXML struct {
+	Device *poolPathXML  `xml:"device,omitempty"`
+	Hosts  []poolHostXML `xml:"host,omitempty"`
+	Dir    *poolPathXML  `xml:"dir,omitempty"`
+	Name   string        `xml:"name,omitempty"`
+	Auth   *poolAuthXML  `xml:"auth,omitempty"`
+}
+
+type poolPathXML struct {
+	Path string `xml:"path,attr"`
+}
+
+type poolHostXML struct {
+	Name string `xml:"name,attr"`
+	Port string `xml:"port,attr,omitempty"`
+}
+
+type poolAuthXML struct {
+	Type     string         `xml:"type,attr"`
+	Username string         `xml:"username,attr"`
+	Secret   *poolSecretXML `xml:"secret"`
+}
+
+type poolSecretXML struct {
+	UUID string `xml:"uuid,attr"`
+}
+
+type poolTargetXML struct {
+	Path string `xml:"path"`
+}
+
+var poolStateNames = map[libvirt.StoragePoolState]string{
+	libvirt.STORAGE_POOL_INACTIVE:     "inactive",
+	libvirt.STORAGE_POOL_BUILDING:     "building",
+	libvirt.STORAGE_POOL_RUNNING:      "running",
+	libvirt.STORAGE_POOL_DEGRADED:     "degraded",
+	libvirt.STORAGE_POOL_INACCESSIBLE: "inaccessible",
+}
+
+// handleListPools - GET /api/v1/pools
+func handleListPools(w http.ResponseWriter, r *http.Request) {
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	pools, err := conn.ListAllStoragePools(0)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to list storage pools: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+
+	infos := []PoolInfo{}
+	for i := range pools {
+		info, err := describePool(&pools[i])
+		pools[i].Free()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect storage pool: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeDataResponse(w, infos)
+}
+
+// handleGetPool - GET /api/v1/pools/{name}
+func handleGetPool(w http.ResponseWriter, r *http.Request) {
+	withPool(w, r, func(pool *libvirt.StoragePool) {
+		info, err := describePool(pool)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect storage pool: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleRefreshPool - POST /api/v1/pools/{name}/refresh
+// Rescans the pool so volumes added or removed outside libvirt show up.
+func handleRefreshPool(w http.ResponseWriter, r *http.Request) {
+	withPool(w, r, func(pool *libvirt.StoragePool) {
+		if err := pool.Refresh(0); err != nil {
+			errMsg := fmt.Sprintf("Failed to refresh storage pool: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		info, err := describePool(pool)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to inspect storage pool: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleCreatePool - POST /api/v1/pools
+// Defines a persistent pool, builds it (e.g. creates the target directory) and starts it.
+func handleCreatePool(w http.ResponseWriter, r *http.Request) {
+	var req PoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if req.Type == "" {
+		req.Type = "dir"
+	}
+
+	if err := validatePoolRequest(req); err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	// rbd pools authenticate to Ceph with a key libvirt keeps as a secret
+	var cephSecretUUID string
+	if req.CephKey != "" {
+		cephSecretUUID, err = defineCephSecret(conn, req.Name, req.CephUser, req.CephKey)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to store Ceph key: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+	}
+
+	pool, err := conn.StoragePoolDefineXML(buildPoolXML(req, cephSecretUUID), 0)
+	if err != nil {
+		undefineSecret(conn, cephSecretUUID)
+		errMsg := fmt.Sprintf("StoragePoolDefineXML failed: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer pool.Free()
+
+	if err := pool.Create(libvirt.STORAGE_POOL_CREATE_WITH_BUILD); err != nil {
+		_ = pool.Undefine()
+		undefineSecret(conn, cephSecretUUID)
+		errMsg := fmt.Sprintf("Failed to start storage pool: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if req.Autostart {
+		if err := pool.SetAutostart(true); err != nil {
+			requestLog(r).Error(fmt.Sprintf("Failed to set autostart on pool %s: %v", req.Name, err))
+		}
+	}
+
+	info, err := describePool(pool)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to inspect storage pool: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Created storage pool %s (%s)", req.Name, req.Type))
+	writeDataResponse(w, info)
+}
+
+// withPool connects to libvirt, looks up the pool named in the URL and hands it to fn,
+// answering 404 if it does not exist.
+func withPool(w http.ResponseWriter, r *http.Request, fn func(pool *libvirt.StoragePool)) {
+	name := r.PathValue("name")
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	pool, err := conn.LookupStoragePoolByName(name)
+	if err != nil {
+		if isLibvirtErrorCode(err, libvirt.ERR_NO_STORAGE_POOL) {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Storage pool %q not found", name))
+			return
+		}
+		errMsg := fmt.Sprintf("Failed to look up storage pool %q: %v", name, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer pool.Free()
+
+	fn(pool)
+}
+
+// validatePoolRequest checks the fields each pool type needs
+func validatePoolRequest(req PoolRequest) error {
+	if req.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch req.Type {
+	case "dir":
+		if req.TargetPath == "" {
+			return fmt.Errorf("target_path is required for dir pools")
+		}
+	case "netfs":
+		if req.SourceHost == "" || req.SourceDir == "" || req.TargetPath == "" {
+			return fmt.Errorf("source_host, source_dir and target_path are required for netfs pools")
+		}
+	case "rbd":
+		if len(req.Monitors) == 0 || req.SourceName == "" {
+			return fmt.Errorf("monitors and source_name are required for rbd pools")
+		}
+		if (req.CephUser == "") != (req.CephKey == "") {
+			return fmt.Errorf("ceph_user and ceph_key must be given together")
+		}
+	}
+	return nil
+}
+
+// buildPoolXML turns a validated PoolRequest into a libvirt <pool> document.
+// cephSecretUUID is the secret holding the Ceph key for rbd pools, "" if none.
+func buildPoolXML(req PoolRequest, cephSecretUUID string) string {
+	doc := poolXML{Type: req.Type, Name: req.Name}
+	if req.TargetPath != "" {
+		doc.Target = &poolTargetXML{Path: req.TargetPath}
+	}
+
+	src := &poolSourceXML{Name: req.SourceName}
+	if req.SourceDevice != "" {
+		src.Device = &poolPathXML{Path: req.SourceDevice}
+	}
+	if req.SourceHost != "" {
+		src.Hosts = append(src.Hosts, poolHostXML{Name: req.SourceHost})
+	}
+	for _, mon := range req.Monitors {
+		host := poolHostXML{Name: mon}
+		if h, port, err := net.SplitHostPort(mon); err == nil {
+			host = poolHostXML{Name: h, Port: port}
+		}
+		src.Hosts = append(src.Hosts, host)
+	}
+	if req.SourceDir != "" {
+		src.Dir = &poolPathXML{Path: req.SourceDir}
+	}
+	if cephSecretUUID != "" {
+		src.Auth = &poolAuthXML{Type: "ceph", Username: req.CephUser, Secret: &poolSecretXML{UUID: cephSecretUUID}}
+	}
+	if src.Device != nil || len(src.Hosts) > 0 || src.Dir != nil || src.Name != "" {
+		doc.Source = src
+	}
+
+	out, _ := xml.Marshal(doc)
+	return string(out)
+}
+
+// describePool gathers name, state, capacity and layout of a pool
+func describePool(pool *libvirt.StoragePool) (PoolInfo, error) {
+	var info PoolInfo
+	var err error
+
+	if info.Name, err = pool.GetName(); err != nil {
+		return info, err
+	}
+	if info.UUID, err = pool.GetUUIDString(); err != nil {
+		return info, err
+	}
+	if info.Persistent, err = pool.IsPersistent(); err != nil {
+		return info, err
+	}
+	if info.Autostart, err = pool.GetAutostart(); err != nil {
+		return info, err
+	}
+
+	stats, err := pool.GetInfo()
+	if err != nil {
+		return info, err
+	}
+	info.State = poolStateNames[stats.State]
+	info.CapacityBytes = stats.Capacity
+	info.AllocationBytes = stats.Allocation
+	info.AvailableBytes = stats.Available
+
+	desc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return info, err
+	}
+	var doc poolXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return info, fmt.Errorf("failed to parse pool XML: %v", err)
+	}
+	info.Type = doc.Type
+	if doc.Target != nil {
+		info.TargetPath = doc.Target.Path
+	}
+	return info, nil
+}
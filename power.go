@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// handleStartVM - POST /api/v1/vm/{name}/start
+func handleStartVM(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		active, err := dom.IsActive()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if active {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is already running", name))
+			return
+		}
+		if err := dom.Create(); err != nil {
+			errMsg := fmt.Sprintf("Failed to start VM: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Started VM %s", name))
+		writeSuccessResponse(w, fmt.Sprintf("VM %s started", name))
+	})
+}
+
+// handleStopVM - POST /api/v1/vm/{name}/stop[?force=true]
+// Asks the guest to shut down, which it does in its own time (or not at all, without
+// ACPI support); with force the VM is powered off at once.
+func handleStopVM(w http.ResponseWriter, r *http.Request) {
+	force := r.URL.Query().Get("force") == "true"
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		active, err := dom.IsActive()
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if !active {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", name))
+			return
+		}
+		if force {
+			if err := dom.Destroy(); err != nil {
+				errMsg := fmt.Sprintf("Failed to power off VM: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			requestLog(r).Info(fmt.Sprintf("Powered off VM %s", name))
+			writeSuccessResponse(w, fmt.Sprintf("VM %s powered off", name))
+			return
+		}
+		if err := dom.Shutdown(); err != nil {
+			errMsg := fmt.Sprintf("Failed to shut down VM: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Asked VM %s to shut down", name))
+		writeSuccessResponse(w, fmt.Sprintf("VM %s is shutting down", name))
+	})
+}
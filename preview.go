@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// CreatePreview - what a dry-run create answers with: the domain XML the create would
+// define, for debugging templates and requests
+type CreatePreview struct {
+	Name      string `json:"name"`
+	Host      string `json:"host"`
+	DomainXML string `json:"domain_xml"`
+}
+
+// previewCreate - POST /api/v1/vm?dry_run=true
+// Runs every check of a create, including quota and host capacity, and renders the domain
+// XML without allocating disks, building the cloud-init seed or defining anything. Disk
+// paths are where the volumes would be created; a generated MAC, a chosen VF or a
+// scheduled host may differ when the create is then made for real.
+func previewCreate(w http.ResponseWriter, r *http.Request, req RequestData) {
+	logger := requestLog(r)
+
+	plan := planCreate(w, r, req, true)
+	if plan == nil {
+		return
+	}
+	defer plan.release()
+
+	xmlContent, err := previewDomainXML(plan)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to render domain XML: %v", err)
+		logger.Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, CreatePreview{Name: plan.vmName, Host: hostName(plan.req.Host), DomainXML: xmlContent})
+}
+
+// previewDomainXML renders the domain XML createVM would define for plan
+func previewDomainXML(plan *createPlan) (string, error) {
+	req := plan.req
+
+	conn, err := connectHost(req.Host)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect libvirt: %v", err)
+	}
+	defer conn.Close()
+
+	firstDiskBootOrder := 1
+	if req.ISOImage != "" {
+		firstDiskBootOrder = 2
+	}
+	backend, err := openStorageBackend(conn, requestPool(req))
+	if err != nil {
+		return "", fmt.Errorf("failed to open storage pool: %v", err)
+	}
+	defer backend.Free()
+
+	disks, err := planDisks(backend, req.Name, plan.specs, firstDiskBootOrder)
+	if err != nil {
+		return "", fmt.Errorf("failed to plan disks: %v", err)
+	}
+
+	// Remote hosts get the seed uploaded into their default pool, see uploadSeedISO
+	var seedISO string
+	if plan.cloudInit != nil {
+		if isLocalHost(req.Host) {
+			seedISO = seedISOFile(req.Name)
+		} else {
+			seedBackend, err := openStorageBackend(conn, defaultStoragePool)
+			if err != nil {
+				return "", fmt.Errorf("failed to open storage pool: %v", err)
+			}
+			defer seedBackend.Free()
+			seed, err := seedBackend.plannedVolume(req.Name+"-seed.iso", DiskSpec{Format: "raw"})
+			if err != nil {
+				return "", err
+			}
+			seedISO = seed.Path
+		}
+	}
+
+	return generateDomainXML(req, disks, plan.nics, seedISO)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A protobuf wire-format codec for the gRPC API, driven by `pb:"N"` field number tags so
+// the messages in proto/vmservice.proto can be plain Go structs, the REST types included.
+// It covers what those messages use: strings, bytes, bools, integers, doubles, nested
+// and repeated messages, map<string, string>, and google.protobuf.Timestamp for
+// time.Time. An interface{} field is carried as bytes holding its JSON.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// marshalProto encodes the struct v points to (or is)
+func marshalProto(v interface{}) []byte {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	return appendMessage(nil, rv)
+}
+
+func appendMessage(b []byte, v reflect.Value) []byte {
+	t := v.Type()
+	if t == timeType {
+		ts := v.Interface().(time.Time)
+		b = appendVarintField(b, 1, uint64(ts.Unix()))
+		return appendVarintField(b, 2, uint64(ts.Nanosecond()))
+	}
+	for i := 0; i < t.NumField(); i++ {
+		n, ok := protoFieldNumber(t.Field(i))
+		if !ok {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.IsZero() {
+			continue
+		}
+		switch {
+		case fv.Kind() == reflect.Map:
+			keys := fv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, k := range keys {
+				var entry []byte
+				entry = appendValue(entry, 1, k)
+				entry = appendValue(entry, 2, fv.MapIndex(k))
+				b = appendBytesField(b, n, entry)
+			}
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8:
+			for j := 0; j < fv.Len(); j++ {
+				b = appendValue(b, n, fv.Index(j))
+			}
+		default:
+			b = appendValue(b, n, fv)
+		}
+	}
+	return b
+}
+
+// appendValue encodes one value as field n, zero or not
+func appendValue(b []byte, n int, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return b
+		}
+		return appendValue(b, n, v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return b
+		}
+		data, _ := json.Marshal(v.Interface())
+		return appendBytesField(b, n, data)
+	case reflect.String:
+		return appendBytesField(b, n, []byte(v.String()))
+	case reflect.Slice:
+		return appendBytesField(b, n, v.Bytes())
+	case reflect.Bool:
+		if v.Bool() {
+			return appendVarintField(b, n, 1)
+		}
+		return appendVarintField(b, n, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarintField(b, n, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendVarintField(b, n, v.Uint())
+	case reflect.Float32:
+		b = binary.AppendUvarint(b, uint64(n)<<3|wireFixed32)
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		b = binary.AppendUvarint(b, uint64(n)<<3|wireFixed64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+	case reflect.Struct:
+		return appendBytesField(b, n, appendMessage(nil, v))
+	}
+	return b
+}
+
+func appendVarintField(b []byte, n int, x uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(n)<<3|wireVarint)
+	return binary.AppendUvarint(b, x)
+}
+
+func appendBytesField(b []byte, n int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(n)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func protoFieldNumber(f reflect.StructField) (int, bool) {
+	n, err := strconv.Atoi(f.Tag.Get("pb"))
+	return n, err == nil && n > 0 && f.IsExported()
+}
+
+// unmarshalProto decodes data into the struct v points to. Fields it doesn't know are
+// skipped, as protobuf requires.
+func unmarshalProto(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("unmarshalProto needs a pointer to a struct, not %T", v)
+	}
+	return decodeMessage(data, rv.Elem())
+}
+
+func decodeMessage(data []byte, v reflect.Value) error {
+	if v.Type() == timeType {
+		var sec, nanos int64
+		err := forEachField(data, func(n, wt int, x uint64, raw []byte) error {
+			switch n {
+			case 1:
+				sec = int64(x)
+			case 2:
+				nanos = int64(x)
+			}
+			return nil
+		})
+		v.Set(reflect.ValueOf(time.Unix(sec, nanos).UTC()))
+		return err
+	}
+
+	fields := map[int]int{}
+	for i := 0; i < v.NumField(); i++ {
+		if n, ok := protoFieldNumber(v.Type().Field(i)); ok {
+			fields[n] = i
+		}
+	}
+	return forEachField(data, func(n, wt int, x uint64, raw []byte) error {
+		i, ok := fields[n]
+		if !ok {
+			return nil
+		}
+		if err := decodeField(v.Field(i), wt, x, raw); err != nil {
+			return fmt.Errorf("field %d: %v", n, err)
+		}
+		return nil
+	})
+}
+
+// forEachField walks the fields of an encoded message. For varint and fixed fields x is
+// the value; for length-delimited ones raw is the content.
+func forEachField(data []byte, fn func(n, wt int, x uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, k := binary.Uvarint(data)
+		if k <= 0 {
+			return errProtoTruncated
+		}
+		data = data[k:]
+		n, wt := int(key>>3), int(key&7)
+		var x uint64
+		var raw []byte
+		switch wt {
+		case wireVarint:
+			x, k = binary.Uvarint(data)
+			if k <= 0 {
+				return errProtoTruncated
+			}
+			data = data[k:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errProtoTruncated
+			}
+			x, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errProtoTruncated
+			}
+			x, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			l, k := binary.Uvarint(data)
+			if k <= 0 || uint64(len(data)-k) < l {
+				return errProtoTruncated
+			}
+			raw, data = data[k:k+int(l)], data[k+int(l):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wt)
+		}
+		if err := fn(n, wt, x, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeField(v reflect.Value, wt int, x uint64, raw []byte) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeField(v.Elem(), wt, x, raw)
+	case reflect.Interface:
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(decoded))
+	case reflect.String:
+		v.SetString(string(raw))
+	case reflect.Bool:
+		v.SetBool(x != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(int64(x))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(x)
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(uint32(x))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(x))
+	case reflect.Struct:
+		return decodeMessage(raw, v)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), raw...))
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if wt == wireBytes && isProtoScalar(elem.Kind()) {
+			// Packed repeated scalars: varints, or fixed-size floats
+			for len(raw) > 0 {
+				var x uint64
+				switch elem.Kind() {
+				case reflect.Float32:
+					if len(raw) < 4 {
+						return errProtoTruncated
+					}
+					x, raw = uint64(binary.LittleEndian.Uint32(raw)), raw[4:]
+				case reflect.Float64:
+					if len(raw) < 8 {
+						return errProtoTruncated
+					}
+					x, raw = binary.LittleEndian.Uint64(raw), raw[8:]
+				default:
+					var k int
+					x, k = binary.Uvarint(raw)
+					if k <= 0 {
+						return errProtoTruncated
+					}
+					raw = raw[k:]
+				}
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := decodeField(elem, wireVarint, x, nil); err != nil {
+					return err
+				}
+				v.Set(reflect.Append(v, elem))
+			}
+			return nil
+		}
+		if err := decodeField(elem, wt, x, raw); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		val := reflect.New(v.Type().Elem()).Elem()
+		err := forEachField(raw, func(n, wt int, x uint64, raw []byte) error {
+			switch n {
+			case 1:
+				return decodeField(key, wt, x, raw)
+			case 2:
+				return decodeField(val, wt, x, raw)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+	default:
+		return fmt.Errorf("can't decode into %s", v.Type())
+	}
+	return nil
+}
+
+func isProtoScalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type protoInner struct {
+	Name string `pb:"1"`
+}
+
+type protoSample struct {
+	ID       uint64            `pb:"1"`
+	Name     string            `pb:"2"`
+	Enabled  bool              `pb:"3"`
+	Count    int32             `pb:"4"`
+	Offset   int64             `pb:"5"`
+	Ratio    float64           `pb:"6"`
+	Weight   float32           `pb:"7"`
+	Data     []byte            `pb:"8"`
+	Tags     []string          `pb:"9"`
+	Labels   map[string]string `pb:"10"`
+	Inner    protoInner        `pb:"11"`
+	Items    []protoInner      `pb:"12"`
+	Parent   *protoInner       `pb:"13"`
+	Created  time.Time         `pb:"14"`
+	Finished *time.Time        `pb:"15"`
+	Result   interface{}       `pb:"16"`
+	Ports    []int             `pb:"17"`
+	Loads    []float64         `pb:"18"`
+	Untagged string
+}
+
+func TestMarshalProtoWire(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  interface{}
+		want string // hex
+	}{
+		{"varint", protoSample{ID: 150}, "089601"},
+		{"string", protoSample{Name: "testing"}, "120774657374696e67"},
+		{"bool", protoSample{Enabled: true}, "1801"},
+		{"negative int32 takes ten bytes", protoSample{Count: -1}, "20ffffffffffffffffff01"},
+		{"double", protoSample{Ratio: 1}, "31000000000000f03f"},
+		{"float", protoSample{Weight: 1}, "3d0000803f"},
+		{"repeated strings", protoSample{Tags: []string{"a", "b"}}, "4a01614a0162"},
+		{"map entries sorted by key", protoSample{Labels: map[string]string{"b": "2", "a": "1"}}, "52060a016112013152060a0162120132"},
+		{"nested message", protoSample{Inner: protoInner{Name: "x"}}, "5a030a0178"},
+		{"timestamp", protoSample{Created: time.Unix(1, 5)}, "720408011005"},
+		{"zero fields are left out", protoSample{Untagged: "not sent"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(marshalProto(tt.msg)); got != tt.want {
+				t.Errorf("marshalProto = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	finished := time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+	tests := []struct {
+		name string
+		msg  protoSample
+	}{
+		{"empty", protoSample{}},
+		{"scalars", protoSample{ID: 1 << 40, Name: "vm-1", Enabled: true, Count: -7, Offset: -1 << 40, Ratio: -2.5, Weight: 0.25}},
+		{"bytes and lists", protoSample{Data: []byte{0, 1, 2}, Tags: []string{"x", "", "z"}, Ports: []int{22, 8080}, Loads: []float64{0.5, 1.5}}},
+		{"map", protoSample{Labels: map[string]string{"env": "prod", "empty": ""}}},
+		{"messages", protoSample{Inner: protoInner{Name: "a"}, Items: []protoInner{{Name: "b"}, {}}, Parent: &protoInner{}}},
+		{"times", protoSample{Created: time.Unix(1700000000, 123).UTC(), Finished: &finished}},
+		{"interface as JSON", protoSample{Result: map[string]interface{}{"path": "/x", "n": 2.0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got protoSample
+			if err := unmarshalProto(marshalProto(&tt.msg), &got); err != nil {
+				t.Fatalf("unmarshalProto: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("round trip =\n%#v\nwant\n%#v", got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestUnmarshalProto(t *testing.T) {
+	tests := []struct {
+		name string
+		data string // hex
+		want protoSample
+	}{
+		{"packed varints", "8a010603" + "8e029ea705", protoSample{Ports: []int{3, 270, 86942}}},
+		{"packed doubles", "9201" + "10" + "000000000000f03f" + "0000000000000040", protoSample{Loads: []float64{1, 2}}},
+		{"unknown fields are skipped", "f80101" + "fa0102ffff" + "f90100000000000000ff" + "fd0100000000" + "089601", protoSample{ID: 150}},
+		{"last value of a field wins", "1201611201" + "62", protoSample{Name: "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			var got protoSample
+			if err := unmarshalProto(data, &got); err != nil {
+				t.Fatalf("unmarshalProto: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unmarshalProto =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalProtoErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string // hex
+		truncated bool
+	}{
+		{"truncated key", "ff", true},
+		{"truncated varint", "0896", true},
+		{"truncated fixed64", "310000", true},
+		{"truncated fixed32", "3d00", true},
+		{"length past the end", "1205616263", true},
+		{"truncated packed varint", "8a010196", true},
+		{"group wire type", "0b", false},
+		{"invalid JSON in an interface field", "82010178", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			var got protoSample
+			err := unmarshalProto(data, &got)
+			if err == nil {
+				t.Fatalf("unmarshalProto(%s) = %#v, want an error", tt.data, got)
+			}
+			// Errors inside a field are wrapped with its number
+			if tt.truncated && !strings.Contains(err.Error(), errProtoTruncated.Error()) {
+				t.Errorf("unmarshalProto(%s) = %v, want %v", tt.data, err, errProtoTruncated)
+			}
+		})
+	}
+	if err := unmarshalProto(nil, protoSample{}); err == nil {
+		t.Error("unmarshalProto into a non-pointer succeeded")
+	}
+}
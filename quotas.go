@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Quota - limits on what a project's VMs may add up to, across all hosts. Zero means
+// no limit.
+type Quota struct {
+	Project     string `json:"project"`
+	MaxVMs      int    `json:"max_vms,omitempty"`
+	MaxVCPUs    int    `json:"max_vcpus,omitempty"`
+	MaxMemoryMB int    `json:"max_memory_mb,omitempty"`
+	MaxDiskGB   int    `json:"max_disk_gb,omitempty"`
+}
+
+// QuotaUsage - what a project's VMs use, or what a request would add
+type QuotaUsage struct {
+	VMs      int `json:"vms"`
+	VCPUs    int `json:"vcpus"`
+	MemoryMB int `json:"memory_mb"`
+	DiskGB   int `json:"disk_gb"` // virtual size of the disks, rounded up
+}
+
+// QuotaStatus - body of GET /api/v1/projects/{project}/quota
+type QuotaStatus struct {
+	Quota Quota      `json:"quota"`
+	Usage QuotaUsage `json:"usage"`
+}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// quotaStore - quotas by project, persisted as JSON in the state directory
+type quotaStore struct {
+	mu     sync.Mutex
+	path   string
+	quotas map[string]Quota
+}
+
+var quotas = &quotaStore{
+	path:   filepath.Join(stateDir, "quotas.json"),
+	quotas: map[string]Quota{},
+}
+
+// load reads the quotas file; a missing file means no quotas
+func (s *quotaStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []Quota
+	if err := json.Unmarshal(content, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, q := range list {
+		s.quotas[q.Project] = q
+	}
+	return nil
+}
+
+// saveLocked writes the quotas atomically; s.mu must be held
+func (s *quotaStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns the quotas ordered by project
+func (s *quotaStore) listLocked() []Quota {
+	out := []Quota{}
+	for _, q := range s.quotas {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Project < out[j].Project })
+	return out
+}
+
+func (s *quotaStore) list() []Quota {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+// get returns the project's quota; projects without one are unlimited
+func (s *quotaStore) get(project string) Quota {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.quotas[project]; ok {
+		return q
+	}
+	return Quota{Project: project}
+}
+
+func (s *quotaStore) put(q Quota) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas[q.Project] = q
+	return s.saveLocked()
+}
+
+func (s *quotaStore) remove(project string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quotas[project]; !ok {
+		return false, nil
+	}
+	delete(s.quotas, project)
+	return true, s.saveLocked()
+}
+
+// quotaReservations - what creations in progress will add, per project. They count
+// towards the quota until the VM is defined and shows up in the project's usage, so
+// concurrent creations can't all squeeze in under it.
+var quotaReservations = struct {
+	mu      sync.Mutex
+	pending map[string]QuotaUsage
+}{pending: map[string]QuotaUsage{}}
+
+func (u QuotaUsage) plus(o QuotaUsage) QuotaUsage {
+	return QuotaUsage{VMs: u.VMs + o.VMs, VCPUs: u.VCPUs + o.VCPUs, MemoryMB: u.MemoryMB + o.MemoryMB, DiskGB: u.DiskGB + o.DiskGB}
+}
+
+func (u QuotaUsage) minus(o QuotaUsage) QuotaUsage {
+	return QuotaUsage{VMs: u.VMs - o.VMs, VCPUs: u.VCPUs - o.VCPUs, MemoryMB: u.MemoryMB - o.MemoryMB, DiskGB: u.DiskGB - o.DiskGB}
+}
+
+// exceeded describes the first limit that usage goes over, "" if none
+func (q Quota) exceeded(usage, add QuotaUsage) string {
+	after := usage.plus(add)
+	switch {
+	case q.MaxVMs > 0 && after.VMs > q.MaxVMs:
+		return fmt.Sprintf("%d of %d VMs in use, %d more requested", usage.VMs, q.MaxVMs, add.VMs)
+	case q.MaxVCPUs > 0 && after.VCPUs > q.MaxVCPUs:
+		return fmt.Sprintf("%d of %d vCPUs in use, %d more requested", usage.VCPUs, q.MaxVCPUs, add.VCPUs)
+	case q.MaxMemoryMB > 0 && after.MemoryMB > q.MaxMemoryMB:
+		return fmt.Sprintf("%d of %d MiB of memory in use, %d more requested", usage.MemoryMB, q.MaxMemoryMB, add.MemoryMB)
+	case q.MaxDiskGB > 0 && after.DiskGB > q.MaxDiskGB:
+		return fmt.Sprintf("%d of %d GiB of disk in use, %d more requested", usage.DiskGB, q.MaxDiskGB, add.DiskGB)
+	}
+	return ""
+}
+
+// reserveQuota checks that add fits in the project's quota, on top of its VMs and the
+// creations already in progress, and reserves it. The caller must call release once
+// the VM is defined or the creation failed. Callers outside projects aren't limited.
+func reserveQuota(project string, add QuotaUsage) (release func(), err error) {
+	if project == "" {
+		return func() {}, nil
+	}
+	q := quotas.get(project)
+	if q.MaxVMs == 0 && q.MaxVCPUs == 0 && q.MaxMemoryMB == 0 && q.MaxDiskGB == 0 {
+		return func() {}, nil
+	}
+
+	// Held across the usage scan so two requests can't both see the same headroom
+	quotaReservations.mu.Lock()
+	defer quotaReservations.mu.Unlock()
+	usage, err := projectUsage(project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to work out the project's usage: %v", err)
+	}
+	usage = usage.plus(quotaReservations.pending[project])
+	if msg := q.exceeded(usage, add); msg != "" {
+		return nil, fmt.Errorf("%w for project %s: %s", errQuotaExceeded, project, msg)
+	}
+	quotaReservations.pending[project] = quotaReservations.pending[project].plus(add)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaReservations.mu.Lock()
+			defer quotaReservations.mu.Unlock()
+			quotaReservations.pending[project] = quotaReservations.pending[project].minus(add)
+		})
+	}, nil
+}
+
+// projectUsage adds up the project's VMs on every host
+func projectUsage(project string) (QuotaUsage, error) {
+	var usage QuotaUsage
+	for _, h := range hypervisorHosts {
+		conn, err := connectHost(h.Name)
+		if err != nil {
+			return usage, fmt.Errorf("host %s: %v", h.Name, err)
+		}
+		doms, err := conn.ListAllDomains(0)
+		if err != nil {
+			conn.Close()
+			return usage, fmt.Errorf("host %s: %v", h.Name, err)
+		}
+		for i := range doms {
+			if domainProject(&doms[i]) == project {
+				if u, err := domainUsage(&doms[i]); err == nil {
+					usage = usage.plus(u)
+				}
+			}
+			doms[i].Free()
+		}
+		conn.Close()
+	}
+	return usage, nil
+}
+
+// domainUsage - what the domain counts towards its project's quota
+func domainUsage(dom *libvirt.Domain) (QuotaUsage, error) {
+	info, err := dom.GetInfo()
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	u := QuotaUsage{VMs: 1, VCPUs: int(info.NrVirtCpu), MemoryMB: int(info.MaxMem / 1024)}
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return QuotaUsage{}, err
+	}
+	var diskBytes uint64
+	for _, d := range def.Devices.Disks {
+		if d.Device != "disk" {
+			continue
+		}
+		if bi, err := dom.GetBlockInfo(d.Target.Dev, 0); err == nil {
+			diskBytes += bi.Capacity
+		}
+	}
+	u.DiskGB = int((diskBytes + 1<<30 - 1) >> 30)
+	return u, nil
+}
+
+// writeQuotaError answers a failed reserveQuota, 403 if the quota is what stopped it
+func writeQuotaError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	errMsg := fmt.Sprintf("Failed to check quota: %v", err)
+	requestLog(r).Error(errMsg)
+	writeErrorResponse(w, errMsg)
+}
+
+// handleListQuotas - GET /api/v1/quotas
+func handleListQuotas(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, quotas.list())
+}
+
+// projectFromPath reads {project}, answering 403 to callers of other projects and 400
+// to names that can't be projects
+func projectFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	project := r.PathValue("project")
+	if !projectPattern.MatchString(project) {
+		http.Error(w, fmt.Sprintf("Invalid project %q", project), http.StatusBadRequest)
+		return "", false
+	}
+	scope, err := requestScope(r)
+	if err == nil && !scope.all && scope.project != project {
+		err = fmt.Errorf("not a member of project %s", project)
+	}
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return "", false
+	}
+	return project, true
+}
+
+// handleGetQuota - GET /api/v1/projects/{project}/quota
+// The project's quota and what it currently uses.
+func handleGetQuota(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromPath(w, r)
+	if !ok {
+		return
+	}
+	usage, err := projectUsage(project)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to work out the project's usage: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, QuotaStatus{Quota: quotas.get(project), Usage: usage})
+}
+
+// handlePutQuota - PUT /api/v1/projects/{project}/quota
+// Lowering a limit below current usage stops new VMs, it doesn't touch existing ones.
+func handlePutQuota(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromPath(w, r)
+	if !ok {
+		return
+	}
+	var q Quota
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if q.MaxVMs < 0 || q.MaxVCPUs < 0 || q.MaxMemoryMB < 0 || q.MaxDiskGB < 0 {
+		http.Error(w, "Quota limits cannot be negative", http.StatusBadRequest)
+		return
+	}
+	q.Project = project
+	if err := quotas.put(q); err != nil {
+		errMsg := fmt.Sprintf("Failed to save quotas: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Set quota for project %s: %d VMs, %d vCPUs, %d MiB, %d GiB", project, q.MaxVMs, q.MaxVCPUs, q.MaxMemoryMB, q.MaxDiskGB))
+	writeDataResponse(w, q)
+}
+
+// handleDeleteQuota - DELETE /api/v1/projects/{project}/quota
+// Leaves the project unlimited.
+func handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	project, ok := projectFromPath(w, r)
+	if !ok {
+		return
+	}
+	removed, err := quotas.remove(project)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to save quotas: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Project %q has no quota", project))
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Removed quota for project %s", project))
+	writeSuccessResponse(w, fmt.Sprintf("Quota for project %s removed", project))
+}
+
+// checkImportQuota checks a just-defined imported VM against its project's quota. Its
+// usage already includes the VM, so the check is whether the usage without it has room.
+func checkImportQuota(project string, dom *libvirt.Domain) error {
+	add, err := domainUsage(dom)
+	if err != nil {
+		return err
+	}
+	q := quotas.get(project)
+	quotaReservations.mu.Lock()
+	defer quotaReservations.mu.Unlock()
+	usage, err := projectUsage(project)
+	if err != nil {
+		return fmt.Errorf("failed to work out the project's usage: %v", err)
+	}
+	usage = usage.minus(add).plus(quotaReservations.pending[project])
+	if msg := q.exceeded(usage, add); msg != "" {
+		return fmt.Errorf("%w for project %s: %s", errQuotaExceeded, project, msg)
+	}
+	return nil
+}
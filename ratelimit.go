@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request rate limiting, per client: the authenticated principal, or the remote address
+// when the API is open. Each client gets a token bucket refilled at VM_SERVICE_RATE_LIMIT
+// requests per second (0 turns limiting off) holding up to VM_SERVICE_RATE_BURST.
+var (
+	rateLimit, _ = strconv.ParseFloat(envOrDefault("VM_SERVICE_RATE_LIMIT", "20"), 64)
+	rateBurst, _ = strconv.ParseFloat(envOrDefault("VM_SERVICE_RATE_BURST", "40"), 64)
+)
+
+// maxConcurrentCreates - VMs that may be created, cloned or imported at once, from
+// VM_SERVICE_MAX_CONCURRENT_CREATES. Creating disks runs qemu-img and copies images, and a
+// burst of creations doing that all at once starves the host.
+var maxConcurrentCreates, _ = strconv.Atoi(envOrDefault("VM_SERVICE_MAX_CONCURRENT_CREATES", "4"))
+
+// rateBucketIdle - buckets unused this long are full again and are dropped
+const rateBucketIdle = 10 * time.Minute
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateBuckets = struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}{buckets: map[string]*rateBucket{}}
+
+// takeToken takes a token from the client's bucket, or says how long until one is there
+func takeToken(client string, now time.Time) (bool, time.Duration) {
+	rateBuckets.mu.Lock()
+	defer rateBuckets.mu.Unlock()
+
+	if now.Sub(rateBuckets.swept) > rateBucketIdle {
+		for k, b := range rateBuckets.buckets {
+			if now.Sub(b.last) > rateBucketIdle {
+				delete(rateBuckets.buckets, k)
+			}
+		}
+		rateBuckets.swept = now
+	}
+
+	b, ok := rateBuckets.buckets[client]
+	if !ok {
+		b = &rateBucket{tokens: rateBurst, last: now}
+		rateBuckets.buckets[client] = b
+	}
+	b.tokens = math.Min(rateBurst, b.tokens+now.Sub(b.last).Seconds()*rateLimit)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rateLimit * float64(time.Second))
+}
+
+// rateClient - who a request's rate is counted against
+func rateClient(r *http.Request) string {
+	if p := requestPrincipal(r); p != nil {
+		return p.Method + ":" + p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withRateLimit answers 429, with Retry-After, to clients over their request rate
+func withRateLimit(next http.Handler) http.Handler {
+	if rateLimit <= 0 {
+		return next
+	}
+	if rateBurst < 1 {
+		rateBurst = 1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := rateClient(r)
+		if ok, wait := takeToken(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			requestLog(r).Warn("Rate limited", "client", client)
+			writeErrorStatus(w, http.StatusTooManyRequests, "Too many requests, slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createSlots - the semaphore behind maxConcurrentCreates
+var createSlots = make(chan struct{}, max(maxConcurrentCreates, 1))
+
+// acquireCreateSlot waits for one of the creation slots, giving up if the client does.
+// The returned func gives the slot back.
+func acquireCreateSlot(ctx context.Context) (func(), error) {
+	select {
+	case createSlots <- struct{}{}:
+		return func() { <-createSlots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting for one of the %d creation slots: %v", cap(createSlots), ctx.Err())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Roles, each allowed everything the ones below it are:
+//
+//	viewer    list and get
+//	operator  create VMs and act on them (power, snapshots, consoles, guest agent, ...)
+//	admin     delete anything, manage networks, pools, webhooks, quotas and flavors, read the audit log
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// principalRoles - roles given by name, from VM_SERVICE_ROLES ("name=role,name=role,...").
+// They apply to API key identities, OIDC users and client certificate names alike, and
+// win over roles from a token. Anyone else gets VM_SERVICE_DEFAULT_ROLE (viewer).
+var (
+	principalRoles map[string]string
+	defaultRole    = envOrDefault("VM_SERVICE_DEFAULT_ROLE", roleViewer)
+)
+
+// routeRoles - endpoints that don't follow the method rule in requiredRole: reads that
+// hand out access (consoles, guest files) or expose other callers' activity or VMs,
+// changes that reach across projects, and gRPC, whose POSTs include reads
+var routeRoles = map[string]string{
+	"GET /api/v1/vm/{name}/console":         roleOperator,
+	"GET /api/v1/vm/{name}/agent/file":      roleOperator,
+	"GET /api/v1/audit":                     roleAdmin,
+	"GET /api/v1/webhooks":                  roleAdmin,
+	"GET /metrics":                          roleAdmin, // every project's VMs
+	"GET /api/v1/quotas":                    roleAdmin,
+	"POST /api/v1/vm/{name}/adopt":          roleAdmin,  // can move the VM into any project
+	"POST /vmservice.v1.VMService/{method}": roleViewer, // each call is checked as the REST request it makes
+}
+
+// adminPrefixes - changes under these paths are for admins only
+var adminPrefixes = []string{"/api/v1/networks", "/api/v1/pools", "/api/v1/webhooks", "/api/v1/hosts", "/api/v1/projects", "/api/v1/flavors"}
+
+// loadRoles parses VM_SERVICE_ROLES into principalRoles
+func loadRoles() error {
+	if roleRank[defaultRole] == 0 {
+		return fmt.Errorf("VM_SERVICE_DEFAULT_ROLE %q is not viewer, operator or admin", defaultRole)
+	}
+	roles := map[string]string{}
+	for _, entry := range strings.Split(envOrDefault("VM_SERVICE_ROLES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, role, ok := strings.Cut(entry, "=")
+		name, role = strings.TrimSpace(name), strings.TrimSpace(role)
+		if !ok || name == "" || roleRank[role] == 0 {
+			return fmt.Errorf("VM_SERVICE_ROLES entry %q is not name=viewer|operator|admin", entry)
+		}
+		roles[name] = role
+	}
+	principalRoles = roles
+	return nil
+}
+
+// assignRole settles the principal's role: a configured one for its name, else the
+// highest recognised role among those its token grants, else the default
+func assignRole(p *Principal, tokenRoles []string) {
+	if role, ok := principalRoles[p.Name]; ok {
+		p.Role = role
+		return
+	}
+	p.Role = ""
+	for _, r := range tokenRoles {
+		if roleRank[r] > roleRank[p.Role] {
+			p.Role = r
+		}
+	}
+	if p.Role == "" {
+		p.Role = defaultRole
+	}
+}
+
+// requiredRole is the least role that may call the route: reads need viewer, deletes
+// and changes to networks, pools, webhooks, hosts, projects and flavors need admin, other
+// changes operator
+func requiredRole(method, pattern string) string {
+	if role, ok := routeRoles[pattern]; ok {
+		return role
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return roleViewer
+	}
+	if method == http.MethodDelete {
+		return roleAdmin
+	}
+	path := pattern
+	if _, p, ok := strings.Cut(pattern, " "); ok {
+		path = p
+	}
+	for _, prefix := range adminPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return roleAdmin
+		}
+	}
+	return roleOperator
+}
+
+// withRBAC refuses requests whose caller's role is below the one the route needs. It
+// looks the route up in mux itself, as it runs before the mux does. Without
+// authentication there's no caller to check and everything is allowed.
+func withRBAC(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := requestPrincipal(r)
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = r.URL.Path
+		}
+		need := requiredRole(r.Method, pattern)
+		if roleRank[p.Role] < roleRank[need] {
+			writeErrorStatus(w, http.StatusForbidden, fmt.Sprintf("%s %s needs the %s role, %s has %s", r.Method, r.URL.Path, need, p.Name, p.Role))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
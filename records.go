@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// reconcileInterval - how often the records are checked against libvirt, from
+// VM_SERVICE_RECONCILE_INTERVAL
+var reconcileInterval, _ = time.ParseDuration(envOrDefault("VM_SERVICE_RECONCILE_INTERVAL", "1m"))
+
+// Drift between a record and its domain, as found by the reconciler
+const (
+	driftDeleted = "deleted" // the domain is gone, but wasn't deleted through the API
+	driftCrashed = "crashed"
+)
+
+// VMRecord - what the service knows about a VM it manages, kept whatever happens to the
+// domain itself
+type VMRecord struct {
+	Name      string       `json:"name"` // domain name
+	Host      string       `json:"host"`
+	Project   string       `json:"project,omitempty"`
+	UUID      string       `json:"uuid"`
+	Owner     string       `json:"owner,omitempty"` // who created it, see requestUser
+	Source    string       `json:"source"`          // "created", "cloned", "imported" or "adopted"
+	Spec      *RequestData `json:"spec,omitempty"`  // the create request, without secrets
+	Disks     []string     `json:"disks,omitempty"` // disk sources
+	State     string       `json:"state,omitempty"` // as last seen by the reconciler
+	Drift     string       `json:"drift,omitempty"` // see driftDeleted
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	CheckedAt *time.Time   `json:"checked_at,omitempty"`
+}
+
+// RecordsStatus - body of GET /api/v1/records
+type RecordsStatus struct {
+	Records []VMRecord `json:"records"`
+	// Unmanaged - domains by host that have no record, e.g. defined with virsh; only
+	// shown to callers that see every project
+	Unmanaged map[string][]string `json:"unmanaged,omitempty"`
+}
+
+// recordStore - VM records by host and domain name, persisted as JSON in the state
+// directory
+type recordStore struct {
+	mu        sync.Mutex
+	path      string
+	records   map[string]VMRecord
+	unmanaged map[string][]string // by host, from the last reconcile
+}
+
+var vmRecords = &recordStore{
+	path:      filepath.Join(stateDir, "vms.json"),
+	records:   map[string]VMRecord{},
+	unmanaged: map[string][]string{},
+}
+
+func recordKey(host, name string) string {
+	return host + "/" + name
+}
+
+// load reads the records file; a missing file means no records
+func (s *recordStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []VMRecord
+	if err := json.Unmarshal(content, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, rec := range list {
+		s.records[recordKey(rec.Host, rec.Name)] = rec
+	}
+	return nil
+}
+
+// saveLocked writes the records atomically; s.mu must be held. Specs can name
+// users and keys, so the file is only readable by the service.
+func (s *recordStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns the records ordered by host and name
+func (s *recordStore) listLocked() []VMRecord {
+	out := []VMRecord{}
+	for _, rec := range s.records {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func (s *recordStore) list() []VMRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *recordStore) get(host, name string) (VMRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[recordKey(host, name)]
+	return rec, ok
+}
+
+func (s *recordStore) put(rec VMRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[recordKey(rec.Host, rec.Name)] = rec
+	return s.saveLocked()
+}
+
+func (s *recordStore) remove(host, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[recordKey(host, name)]; !ok {
+		return nil
+	}
+	delete(s.records, recordKey(host, name))
+	return s.saveLocked()
+}
+
+// recordVM records a domain the service has just created, cloned, imported or adopted.
+// A record that can't be written is logged; the VM exists either way and the reconciler
+// lists it as unmanaged.
+func recordVM(host string, dom *libvirt.Domain, source, owner string, spec *RequestData) {
+	host = hostName(host)
+	def, err := readDomainDef(dom)
+	if err != nil {
+		log.Printf("Failed to record VM: %v", err)
+		return
+	}
+	var disks []string
+	for _, d := range def.Devices.Disks {
+		if d.Device == "disk" {
+			disks = append(disks, d.sourcePath())
+		}
+	}
+	now := time.Now().UTC()
+	rec := VMRecord{
+		Name:      def.Name,
+		Host:      host,
+		Project:   domainProject(dom),
+		UUID:      def.UUID,
+		Owner:     owner,
+		Source:    source,
+		Spec:      sanitizeSpec(spec),
+		Disks:     disks,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := vmRecords.put(rec); err != nil {
+		log.Printf("Failed to record VM %s: %v", def.Name, err)
+	}
+}
+
+// forgetVM drops the record of a VM deleted through the API
+func forgetVM(host, name string) {
+	if err := vmRecords.remove(hostName(host), name); err != nil {
+		log.Printf("Failed to remove the record of VM %s: %v", name, err)
+	}
+}
+
+// sanitizeSpec copies a create request without the password, cloud-init documents and
+// disk passphrases, which have no business on disk
+func sanitizeSpec(spec *RequestData) *RequestData {
+	if spec == nil {
+		return nil
+	}
+	out := *spec
+	out.Password = nil
+	out.CloudInit = nil
+	out.Disks = append([]DiskSpec(nil), spec.Disks...)
+	for i, d := range out.Disks {
+		if d.Encryption != nil {
+			enc := *d.Encryption
+			enc.Passphrase = ""
+			out.Disks[i].Encryption = &enc
+		}
+	}
+	return &out
+}
+
+// handleListRecords - GET /api/v1/records[?drift=]
+// Lists the records of the caller's VMs on every host, with the drift the reconciler
+// found; drift=any keeps only records with some.
+func handleListRecords(w http.ResponseWriter, r *http.Request) {
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	drift := r.URL.Query().Get("drift")
+
+	status := RecordsStatus{Records: []VMRecord{}}
+	for _, rec := range vmRecords.list() {
+		if !scope.all && rec.Project != scope.project {
+			continue
+		}
+		if drift != "" && (rec.Drift == "" || (drift != "any" && rec.Drift != drift)) {
+			continue
+		}
+		rec.Name = scope.vmName(rec.Name)
+		status.Records = append(status.Records, rec)
+	}
+	if scope.all {
+		vmRecords.mu.Lock()
+		status.Unmanaged = map[string][]string{}
+		for host, names := range vmRecords.unmanaged {
+			status.Unmanaged[host] = names
+		}
+		vmRecords.mu.Unlock()
+	}
+	writeDataResponse(w, status)
+}
+
+// runRecordReconciler checks the records against every host's domains each
+// reconcileInterval
+func runRecordReconciler() {
+	if reconcileInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(reconcileInterval)
+		for _, h := range hypervisorHosts {
+			if err := reconcileHost(h.Name); err != nil {
+				log.Printf("Reconcile of host %s failed: %v", h.Name, err)
+			}
+		}
+	}
+}
+
+// reconcileHost flags records of the host whose domain is gone or crashed, and notes the
+// host's domains that have no record
+func reconcileHost(host string) error {
+	conn, err := connectHost(host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return fmt.Errorf("failed to list domains: %v", err)
+	}
+	states := map[string]string{}
+	for i := range doms {
+		name, err := doms[i].GetName()
+		state, serr := domainState(&doms[i])
+		doms[i].Free()
+		if err != nil || serr != nil {
+			continue
+		}
+		states[name] = state
+	}
+
+	now := time.Now().UTC()
+	vmRecords.mu.Lock()
+	defer vmRecords.mu.Unlock()
+	changed := false
+	for key, rec := range vmRecords.records {
+		if rec.Host != host {
+			continue
+		}
+		state, ok := states[rec.Name]
+		delete(states, rec.Name)
+		drift := ""
+		switch {
+		case !ok:
+			drift, state = driftDeleted, ""
+		case state == "crashed":
+			drift = driftCrashed
+		}
+		if drift != rec.Drift {
+			log.Printf("VM %s on host %s: drift %q (was %q)", rec.Name, host, drift, rec.Drift)
+			rec.UpdatedAt = now
+			changed = true
+		}
+		rec.State, rec.Drift, rec.CheckedAt = state, drift, &now
+		vmRecords.records[key] = rec
+	}
+	var unmanaged []string
+	for name := range states {
+		unmanaged = append(unmanaged, name)
+	}
+	sort.Strings(unmanaged)
+	vmRecords.unmanaged[host] = unmanaged
+	if changed {
+		return vmRecords.saveLocked()
+	}
+	return nil
+}
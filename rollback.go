@@ -0,0 +1,25 @@
+package main
+
+// rollback - undo steps for what a multi-step operation has created so far. They run in
+// reverse order when the operation fails part way; once it has succeeded, done drops them.
+type rollback struct {
+	steps []func()
+}
+
+// add records how to undo a step that has just succeeded
+func (rb *rollback) add(undo func()) {
+	rb.steps = append(rb.steps, undo)
+}
+
+// done marks the operation as finished, so run has nothing left to undo
+func (rb *rollback) done() {
+	rb.steps = nil
+}
+
+// run undoes the recorded steps, last first; meant to be deferred
+func (rb *rollback) run() {
+	for i := len(rb.steps) - 1; i >= 0; i-- {
+		rb.steps[i]()
+	}
+	rb.steps = nil
+}
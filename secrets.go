@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// secretXML - libvirt <secret> document for a passphrase or key kept by libvirtd
+type secretXML struct {
+	XMLName     xml.Name        `xml:"secret"`
+	Ephemeral   string          `xml:"ephemeral,attr"`
+	Private     string          `xml:"private,attr"`
+	UUID        string          `xml:"uuid"`
+	Description string          `xml:"description"`
+	Usage       *secretUsageXML `xml:"usage,omitempty"`
+}
+
+type secretUsageXML struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name"`
+}
+
+// diskSecretDescription - how the description of a secret defineDiskSecret made starts
+const diskSecretDescription = "disk encryption passphrase for VM "
+
+// defineDiskSecret registers the passphrase protecting a VM's encrypted disks in libvirt's
+// secret store and returns the secret UUID. The secret is private, so libvirt never hands
+// the value back out over the API; it only feeds it to QEMU when the disks are opened.
+func defineDiskSecret(conn *libvirt.Connect, vmName string, passphrase []byte) (string, error) {
+	doc := secretXML{
+		Ephemeral:   "no",
+		Private:     "yes",
+		UUID:        uuid.New().String(),
+		Description: diskSecretDescription + vmName,
+	}
+	secretDoc, err := xml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := conn.SecretDefineXML(string(secretDoc), 0)
+	if err != nil {
+		return "", fmt.Errorf("SecretDefineXML failed: %v", err)
+	}
+	defer secret.Free()
+
+	if err := secret.SetValue(passphrase, 0); err != nil {
+		_ = secret.Undefine()
+		return "", fmt.Errorf("failed to set secret value: %v", err)
+	}
+
+	log.Printf("Defined disk encryption secret %s for VM %s", doc.UUID, vmName)
+	return doc.UUID, nil
+}
+
+// defineCephSecret stores the cephx key an rbd pool (and the disks in it) authenticate with.
+// key is base64 as printed by `ceph auth get-key`; libvirt wants the raw bytes.
+func defineCephSecret(conn *libvirt.Connect, poolName, user, key string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("ceph_key is not valid base64: %v", err)
+	}
+
+	doc := secretXML{
+		Ephemeral:   "no",
+		Private:     "yes",
+		UUID:        uuid.New().String(),
+		Description: fmt.Sprintf("ceph client.%s key for storage pool %s", user, poolName),
+		Usage:       &secretUsageXML{Type: "ceph", Name: fmt.Sprintf("client.%s pool %s", user, poolName)},
+	}
+	secretDoc, err := xml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := conn.SecretDefineXML(string(secretDoc), 0)
+	if err != nil {
+		return "", fmt.Errorf("SecretDefineXML failed: %v", err)
+	}
+	defer secret.Free()
+
+	if err := secret.SetValue(raw, 0); err != nil {
+		_ = secret.Undefine()
+		return "", fmt.Errorf("failed to set secret value: %v", err)
+	}
+
+	log.Printf("Defined ceph secret %s for storage pool %s", doc.UUID, poolName)
+	return doc.UUID, nil
+}
+
+// undefineSecret removes a secret we defined, for cleaning up after a failed operation.
+// An empty secretUUID is a no-op.
+func undefineSecret(conn *libvirt.Connect, secretUUID string) {
+	if secretUUID == "" {
+		return
+	}
+	secret, err := conn.LookupSecretByUUIDString(secretUUID)
+	if err != nil {
+		log.Printf("Failed to look up secret %s for cleanup: %v", secretUUID, err)
+		return
+	}
+	defer secret.Free()
+	if err := secret.Undefine(); err != nil {
+		log.Printf("Failed to undefine secret %s: %v", secretUUID, err)
+	}
+}
+
+// removeDiskSecret undefines a deleted VM's disk secret, unless another domain still
+// refers to it (a full clone or a same-host import keeps the source's secret, since its
+// disks are encrypted with the same passphrase) or defineDiskSecret didn't make it (an
+// adopted VM's secret belongs to whoever defined it). When in doubt the secret is kept.
+func removeDiskSecret(logger *slog.Logger, conn *libvirt.Connect, secretUUID string) {
+	secret, err := conn.LookupSecretByUUIDString(secretUUID)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to look up secret %s for cleanup: %v", secretUUID, err))
+		return
+	}
+	defer secret.Free()
+	desc, err := secret.GetXMLDesc(0)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read secret %s, keeping it: %v", secretUUID, err))
+		return
+	}
+	var doc secretXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil || doc.Usage != nil || !strings.HasPrefix(doc.Description, diskSecretDescription) {
+		logger.Info(fmt.Sprintf("Keeping secret %s, the service didn't define it", secretUUID))
+		return
+	}
+
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to list domains, keeping secret %s: %v", secretUUID, err))
+		return
+	}
+	user := ""
+	for i := range doms {
+		if user == "" {
+			def, err := readDomainDef(&doms[i])
+			if err != nil {
+				user = "an unreadable domain"
+			} else if def.usesSecret(secretUUID) {
+				user = def.Name
+			}
+		}
+		doms[i].Free()
+	}
+	if user != "" {
+		logger.Info(fmt.Sprintf("Keeping secret %s, %s still uses it", secretUUID, user))
+		return
+	}
+	if err := secret.Undefine(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to undefine secret %s: %v", secretUUID, err))
+	}
+}
+
+// generatePassphrase - random passphrase for volumes whose spec doesn't bring one
+func generatePassphrase() ([]byte, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(raw)), nil
+}
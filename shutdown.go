@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM (or SIGINT) the service stops taking requests, lets the ones in flight
+// finish, waits for running jobs, and closes its long-lived libvirt connections before
+// exiting. Creates still running when VM_SERVICE_SHUTDOWN_TIMEOUT is up are cancelled
+// and roll back what they made at their next step, rather than being cut off half-way.
+// A second signal exits at once.
+
+// shutdownTimeout - how long a shutdown waits for requests and jobs
+var shutdownTimeout, _ = time.ParseDuration(envOrDefault("VM_SERVICE_SHUTDOWN_TIMEOUT", "2m"))
+
+// rollbackGrace - how long cancelled jobs get to clean up after shutdownTimeout
+const rollbackGrace = 30 * time.Second
+
+// jobDrainInterval - how often a shutdown looks whether the jobs are done
+const jobDrainInterval = 500 * time.Millisecond
+
+var (
+	// serverStopping is closed when a shutdown starts; event streams, consoles and the
+	// event watchers end on it
+	serverStopping = make(chan struct{})
+
+	// jobsCtx is cancelled when a shutdown stops waiting for jobs, see jobContext
+	jobsCtx, cancelJobs = context.WithCancel(context.Background())
+
+	// eventWatchers - the watchHostEvents goroutines, each holding a connection open
+	eventWatchers sync.WaitGroup
+)
+
+// jobContext - the context for a job started by a request: it keeps the request's
+// values (logger, trace) but not its cancellation, and is cancelled instead when a
+// shutdown gives up on the job. The job calls release when it is done.
+func jobContext(parent context.Context) (ctx context.Context, release func()) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stop := context.AfterFunc(jobsCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// serveUntilSignalled runs serve, which is srv's ListenAndServe(TLS), until a signal
+// asks the service to stop, and then shuts it down
+func serveUntilSignalled(srv *http.Server, serve func() error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	s := <-sig
+	signal.Stop(sig)
+	log.Printf("Received %s, shutting down", s)
+	close(serverStopping)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Requests still open at shutdown: %v", err)
+	}
+	if n := waitForJobs(ctx); n > 0 {
+		log.Printf("Cancelling %d jobs still running after %s", n, shutdownTimeout)
+		cancelJobs()
+		grace, cancel := context.WithTimeout(context.Background(), rollbackGrace)
+		defer cancel()
+		if n := waitForJobs(grace); n > 0 {
+			log.Printf("Exiting with %d jobs still running", n)
+		}
+	}
+	eventWatchers.Wait()
+	log.Printf("Shutdown complete")
+}
+
+// waitForJobs waits until no job is running or ctx is done, returning how many still are
+func waitForJobs(ctx context.Context) int {
+	ticker := time.NewTicker(jobDrainInterval)
+	defer ticker.Stop()
+	for {
+		n := runningJobs()
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// SnapshotRequest - incoming JSON for POST /api/v1/vm/{name}/snapshots
+type SnapshotRequest struct {
+	Name        string `json:"name,omitempty"` // defaults to a timestamp
+	Description string `json:"description,omitempty"`
+	// Type is "internal" (default) or "external". External snapshots turn each qcow2 disk's
+	// current image into a read-only backing file and continue on a new overlay next to it,
+	// which works for running VMs without pausing them.
+	Type string `json:"type,omitempty"`
+	// Memory also saves the RAM of a running VM with an external snapshot, next to the
+	// first disk as <vm>-<snapshot>.mem. Without it the snapshot is disk-only.
+	Memory bool `json:"memory,omitempty"`
+	// Quiesce freezes the guest's filesystems through the guest agent while the snapshot
+	// is taken, so it is application-consistent. Needs a running VM with the agent up.
+	Quiesce bool `json:"quiesce,omitempty"`
+}
+
+// errGuestAgentUnavailable - a quiesced snapshot was asked for but no agent answers
+var errGuestAgentUnavailable = errors.New("guest agent is not connected, it is needed to quiesce")
+
+// RevertRequest - optional JSON for POST /api/v1/vm/{name}/snapshots/{snapshot}/revert
+type RevertRequest struct {
+	// State overrides the state the VM is left in: "running" or "paused". By default it
+	// is whatever the VM was in when the snapshot was taken.
+	State string `json:"state,omitempty"`
+	// Force reverts even where libvirt considers it risky, e.g. to a snapshot taken with a
+	// different device configuration
+	Force bool `json:"force,omitempty"`
+}
+
+// SnapshotInfo - one snapshot as reported by the API; listing nests them as a tree
+type SnapshotInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Type        string          `json:"type"`  // "internal" or "external"
+	State       string          `json:"state"` // VM state when the snapshot was taken
+	Parent      string          `json:"parent,omitempty"`
+	Current     bool            `json:"current"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Children    []*SnapshotInfo `json:"children,omitempty"`
+}
+
+type snapshotXML struct {
+	XMLName      xml.Name           `xml:"domainsnapshot"`
+	Name         string             `xml:"name"`
+	Description  string             `xml:"description,omitempty"`
+	State        string             `xml:"state,omitempty"`
+	CreationTime int64              `xml:"creationTime,omitempty"`
+	Parent       *snapshotParentXML `xml:"parent,omitempty"`
+	Memory       *snapshotMemoryXML `xml:"memory,omitempty"`
+	Disks        []snapshotDiskXML  `xml:"disks>disk,omitempty"`
+}
+
+type snapshotMemoryXML struct {
+	Snapshot string `xml:"snapshot,attr"` // "no", "internal" or "external"
+	File     string `xml:"file,attr,omitempty"`
+}
+
+type snapshotDiskXML struct {
+	Name     string `xml:"name,attr"`
+	Snapshot string `xml:"snapshot,attr"` // "no", "internal" or "external"
+}
+
+type snapshotParentXML struct {
+	Name string `xml:"name"`
+}
+
+// handleListSnapshots - GET /api/v1/vm/{name}/snapshots
+// Returns the root snapshots with their descendants nested under "children".
+func handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		snaps, err := dom.ListAllSnapshots(libvirt.DOMAIN_SNAPSHOT_LIST_TOPOLOGICAL)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to list snapshots: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		// Topological order lists parents before children, so each parent is already known
+		byName := map[string]*SnapshotInfo{}
+		roots := []*SnapshotInfo{}
+		for i := range snaps {
+			info, err := describeSnapshot(&snaps[i])
+			snaps[i].Free()
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to read snapshot: %v", err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			byName[info.Name] = &info
+			if parent, ok := byName[info.Parent]; ok {
+				parent.Children = append(parent.Children, &info)
+			} else {
+				roots = append(roots, &info)
+			}
+		}
+		writeDataResponse(w, roots)
+	})
+}
+
+// handleGetSnapshot - GET /api/v1/vm/{name}/snapshots/{snapshot}
+func handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	withSnapshot(w, r, func(dom *libvirt.Domain, snap *libvirt.DomainSnapshot) {
+		info, err := describeSnapshot(snap)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read snapshot: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, info)
+	})
+}
+
+// handleCreateSnapshot - POST /api/v1/vm/{name}/snapshots
+// Internal snapshots live inside the VM's qcow2 disks; for a running VM they include the
+// memory state, so reverting resumes the VM where it was. External snapshots are made for
+// running VMs and are flattened again with the blockcommit/blockpull endpoints (libvirt
+// can't revert to them).
+func handleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Type {
+	case "", "internal":
+		if req.Memory {
+			http.Error(w, "memory only applies to external snapshots", http.StatusBadRequest)
+			return
+		}
+	case "external":
+		if req.Memory && req.Quiesce {
+			http.Error(w, "quiesce applies to internal and disk-only snapshots", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid snapshot type %q, use internal or external", req.Type), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		info, err := createSnapshot(dom, req)
+		if errors.Is(err, errGuestAgentUnavailable) {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q: %v", r.PathValue("name"), err))
+			return
+		}
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to create snapshot: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Created snapshot %s of VM %s", info.Name, r.PathValue("name")))
+		writeDataResponse(w, info)
+	})
+}
+
+// handleRevertSnapshot - POST /api/v1/vm/{name}/snapshots/{snapshot}/revert
+func handleRevertSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req RevertRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			requestLog(r).Warn("Error decoding JSON", "error", err)
+			http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var flags libvirt.DomainSnapshotRevertFlags
+	switch req.State {
+	case "":
+	case "running":
+		flags |= libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING
+	case "paused":
+		flags |= libvirt.DOMAIN_SNAPSHOT_REVERT_PAUSED
+	default:
+		http.Error(w, fmt.Sprintf("Invalid state %q, use running or paused", req.State), http.StatusBadRequest)
+		return
+	}
+	if req.Force {
+		flags |= libvirt.DOMAIN_SNAPSHOT_REVERT_FORCE
+	}
+
+	withSnapshot(w, r, func(dom *libvirt.Domain, snap *libvirt.DomainSnapshot) {
+		if err := snap.RevertToSnapshot(flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to revert to snapshot %q: %v", r.PathValue("snapshot"), err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Reverted VM %s to snapshot %s", r.PathValue("name"), r.PathValue("snapshot")))
+		writeSuccessResponse(w, fmt.Sprintf("VM %s reverted to snapshot %s", r.PathValue("name"), r.PathValue("snapshot")))
+	})
+}
+
+// handleDeleteSnapshot - DELETE /api/v1/vm/{name}/snapshots/{snapshot}
+// With ?children=true the snapshot's descendants are deleted as well; otherwise they are
+// reparented to the snapshot's parent. ?metadata_only=true forgets the snapshot without
+// touching the disks, which is how external snapshots are dropped once their overlays
+// have been merged with blockcommit or blockpull.
+func handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	var flags libvirt.DomainSnapshotDeleteFlags
+	if r.URL.Query().Get("children") == "true" {
+		flags |= libvirt.DOMAIN_SNAPSHOT_DELETE_CHILDREN
+	}
+	if r.URL.Query().Get("metadata_only") == "true" {
+		flags |= libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY
+	}
+
+	withSnapshot(w, r, func(dom *libvirt.Domain, snap *libvirt.DomainSnapshot) {
+		if err := snap.Delete(flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to delete snapshot %q: %v", r.PathValue("snapshot"), err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Deleted snapshot %s of VM %s", r.PathValue("snapshot"), r.PathValue("name")))
+		writeSuccessResponse(w, fmt.Sprintf("Snapshot %s deleted", r.PathValue("snapshot")))
+	})
+}
+
+// withSnapshot looks up the VM and snapshot named in the URL, answering 404 if either is missing
+func withSnapshot(w http.ResponseWriter, r *http.Request, fn func(dom *libvirt.Domain, snap *libvirt.DomainSnapshot)) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("snapshot")
+		snap, err := dom.SnapshotLookupByName(name, 0)
+		if err != nil {
+			if isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN_SNAPSHOT) {
+				writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Snapshot %q not found", name))
+				return
+			}
+			errMsg := fmt.Sprintf("Failed to look up snapshot %q: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		defer snap.Free()
+
+		fn(dom, snap)
+	})
+}
+
+// createSnapshot takes a snapshot of dom as described by req and describes it
+func createSnapshot(dom *libvirt.Domain, req SnapshotRequest) (SnapshotInfo, error) {
+	if req.Name == "" {
+		req.Name = timestampName()
+	}
+	snapDoc := snapshotXML{Name: req.Name, Description: req.Description}
+
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if req.Quiesce && !def.guestAgentConnected() {
+		return SnapshotInfo{}, errGuestAgentUnavailable
+	}
+
+	var flags libvirt.DomainSnapshotCreateFlags
+	if req.Type == "external" {
+		// Only qcow2 disks can take an overlay; leave the rest (and CD-ROMs) alone.
+		// libvirt names each overlay after the snapshot, next to the disk's image.
+		var memDir string
+		for _, disk := range def.Devices.Disks {
+			if disk.Device != "disk" {
+				continue
+			}
+			mode := "no"
+			if disk.Driver.Type == "qcow2" && disk.Type == "file" {
+				mode = "external"
+				if memDir == "" {
+					memDir = filepath.Dir(disk.Source.File)
+				}
+			}
+			snapDoc.Disks = append(snapDoc.Disks, snapshotDiskXML{Name: disk.Target.Dev, Snapshot: mode})
+		}
+		if memDir == "" {
+			return SnapshotInfo{}, fmt.Errorf("VM %q has no file-backed qcow2 disks for an external snapshot", def.Name)
+		}
+
+		flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC
+		if req.Memory {
+			snapDoc.Memory = &snapshotMemoryXML{
+				Snapshot: "external",
+				File:     filepath.Join(memDir, def.Name+"-"+req.Name+".mem"),
+			}
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_LIVE
+		} else {
+			snapDoc.Memory = &snapshotMemoryXML{Snapshot: "no"}
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY
+			if req.Quiesce {
+				// libvirt freezes and thaws around disk-only snapshots itself
+				flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_QUIESCE
+			}
+		}
+	} else if req.Quiesce {
+		// Internal snapshots have no quiesce flag, so freeze by hand
+		if err := dom.FSFreeze(nil, 0); err != nil {
+			return SnapshotInfo{}, fmt.Errorf("failed to freeze guest filesystems: %v", err)
+		}
+		defer func() {
+			if err := dom.FSThaw(nil, 0); err != nil {
+				log.Printf("Failed to thaw guest filesystems of %s: %v", def.Name, err)
+			}
+		}()
+	}
+
+	doc, err := xml.Marshal(snapDoc)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	snap, err := dom.CreateSnapshotXML(string(doc), flags)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer snap.Free()
+	return describeSnapshot(snap)
+}
+
+func describeSnapshot(snap *libvirt.DomainSnapshot) (SnapshotInfo, error) {
+	desc, err := snap.GetXMLDesc(0)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	var doc snapshotXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return SnapshotInfo{}, err
+	}
+	current, err := snap.IsCurrent(0)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info := SnapshotInfo{
+		Name:        doc.Name,
+		Description: doc.Description,
+		Type:        "internal",
+		State:       doc.State,
+		Current:     current,
+		CreatedAt:   time.Unix(doc.CreationTime, 0).UTC(),
+	}
+	if doc.Parent != nil {
+		info.Parent = doc.Parent.Name
+	}
+	for _, d := range doc.Disks {
+		if d.Snapshot == "external" {
+			info.Type = "external"
+		}
+	}
+	return info, nil
+}
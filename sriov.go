@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// NICSRIOV - attaches a NIC to an SR-IOV virtual function of a host NIC
+type NICSRIOV struct {
+	PF string `json:"pf"`           // physical function's interface name, e.g. "enp59s0f0"
+	VF string `json:"vf,omitempty"` // VF PCI address, e.g. "0000:3b:10.1"; first free VF if empty
+	// Mode - "hostdev" (default) hands the VF to the guest as a PCI device; "macvtap"
+	// keeps the VF's host driver and attaches through macvtap passthrough, which
+	// allows live migration at some cost in throughput
+	Mode string `json:"mode,omitempty"`
+}
+
+// SRIOVFunction - a virtual function in the host inventory
+type SRIOVFunction struct {
+	PF        string `json:"pf"`
+	PFAddress string `json:"pf_address"`
+	Address   string `json:"address"`
+	Interface string `json:"interface,omitempty"` // VF netdev, if bound to a host network driver
+	UsedBy    string `json:"used_by,omitempty"`   // VM the VF is attached to
+}
+
+// errVFUnavailable - the requested VF is taken, or the PF has none free
+var errVFUnavailable = errors.New("no SR-IOV virtual function available")
+
+// pciAddressXML - a PCI address as libvirt writes it in device XML (hex attributes)
+type pciAddressXML struct {
+	Domain   string `xml:"domain,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+}
+
+// String formats the address as "dddd:bb:ss.f"
+func (a pciAddressXML) String() string {
+	var v [4]uint64
+	for i, s := range []string{a.Domain, a.Bus, a.Slot, a.Function} {
+		v[i], _ = strconv.ParseUint(s, 0, 32)
+	}
+	return fmt.Sprintf("%04x:%02x:%02x.%x", v[0], v[1], v[2], v[3])
+}
+
+// parsePCIAddress parses "dddd:bb:ss.f" (or "bb:ss.f", domain 0)
+func parsePCIAddress(s string) (pciAddressXML, error) {
+	var d, b, sl, f uint
+	if _, err := fmt.Sscanf(s, "%x:%x:%x.%x", &d, &b, &sl, &f); err != nil {
+		d = 0
+		if _, err := fmt.Sscanf(s, "%x:%x.%x", &b, &sl, &f); err != nil {
+			return pciAddressXML{}, fmt.Errorf("invalid PCI address %q, expected the form 0000:3b:10.1", s)
+		}
+	}
+	return pciAddressXML{
+		Domain:   fmt.Sprintf("0x%04x", d),
+		Bus:      fmt.Sprintf("0x%02x", b),
+		Slot:     fmt.Sprintf("0x%02x", sl),
+		Function: fmt.Sprintf("0x%x", f),
+	}, nil
+}
+
+// nodeDeviceXML - the parts of a libvirt node device document we read
+type nodeDeviceXML struct {
+	Name   string `xml:"name"`
+	Parent string `xml:"parent"`
+	Driver struct {
+		Name string `xml:"name"`
+	} `xml:"driver"`
+	Capabilities []nodeDeviceCapXML `xml:"capability"`
+}
+
+type nodeDeviceCapXML struct {
+	Type string `xml:"type,attr"`
+	// type='net'
+	Interface string `xml:"interface"`
+	// type='pci', in decimal
+	Domain   int `xml:"domain"`
+	Bus      int `xml:"bus"`
+	Slot     int `xml:"slot"`
+	Function int `xml:"function"`
+	// type='pci' too
+	Vendor     string `xml:"vendor"`
+	Product    string `xml:"product"`
+	Class      string `xml:"class"`
+	IOMMUGroup *struct {
+		Number    int             `xml:"number,attr"`
+		Addresses []pciAddressXML `xml:"address"`
+	} `xml:"iommuGroup"`
+	// type='virt_functions' (nested in 'pci')
+	Addresses    []pciAddressXML    `xml:"address"`
+	Capabilities []nodeDeviceCapXML `xml:"capability"`
+}
+
+// handleListSRIOV - GET /api/v1/host/sriov
+func handleListSRIOV(w http.ResponseWriter, r *http.Request) {
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	vfs, err := sriovInventory(conn)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to read SR-IOV inventory: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	writeDataResponse(w, vfs)
+}
+
+// sriovInventory lists the virtual functions of every SR-IOV capable NIC on the host and
+// which VM, if any, each one is attached to
+func sriovInventory(conn *libvirt.Connect) ([]SRIOVFunction, error) {
+	netDevs, err := listNodeDevices(conn, libvirt.CONNECT_LIST_NODE_DEVICES_CAP_NET)
+	if err != nil {
+		return nil, err
+	}
+	// Network interfaces are children of their PCI device
+	netByParent := map[string]string{}
+	for _, dev := range netDevs {
+		for _, c := range dev.Capabilities {
+			if c.Type == "net" {
+				netByParent[dev.Parent] = c.Interface
+			}
+		}
+	}
+
+	pciDevs, err := listNodeDevices(conn, libvirt.CONNECT_LIST_NODE_DEVICES_CAP_PCI_DEV)
+	if err != nil {
+		return nil, err
+	}
+	used, err := hostPCIUsers(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	vfs := []SRIOVFunction{}
+	for _, dev := range pciDevs {
+		for _, c := range dev.Capabilities {
+			if c.Type != "pci" {
+				continue
+			}
+			pfAddr := fmt.Sprintf("%04x:%02x:%02x.%x", c.Domain, c.Bus, c.Slot, c.Function)
+			for _, sub := range c.Capabilities {
+				if sub.Type != "virt_functions" {
+					continue
+				}
+				for _, a := range sub.Addresses {
+					vf := SRIOVFunction{PF: netByParent[dev.Name], PFAddress: pfAddr, Address: a.String()}
+					vf.Interface = netByParent[nodeDeviceName(a)]
+					vf.UsedBy = used[vf.Address]
+					if vf.UsedBy == "" && vf.Interface != "" {
+						vf.UsedBy = used[vf.Interface]
+					}
+					vfs = append(vfs, vf)
+				}
+			}
+		}
+	}
+	sort.Slice(vfs, func(i, j int) bool { return vfs[i].Address < vfs[j].Address })
+	return vfs, nil
+}
+
+// nodeDeviceName is libvirt's node device name for a PCI address, e.g. pci_0000_3b_10_1
+func nodeDeviceName(a pciAddressXML) string {
+	return "pci_" + strings.NewReplacer(":", "_", ".", "_").Replace(a.String())
+}
+
+func listNodeDevices(conn *libvirt.Connect, flags libvirt.ConnectListAllNodeDeviceFlags) ([]nodeDeviceXML, error) {
+	devs, err := conn.ListAllNodeDevices(flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node devices: %v", err)
+	}
+	defer func() {
+		for i := range devs {
+			devs[i].Free()
+		}
+	}()
+
+	out := make([]nodeDeviceXML, 0, len(devs))
+	for i := range devs {
+		desc, err := devs[i].GetXMLDesc(0)
+		if err != nil {
+			return nil, err
+		}
+		var doc nodeDeviceXML
+		if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse node device XML: %v", err)
+		}
+		out = append(out, doc)
+	}
+	return out, nil
+}
+
+// hostPCIUsers maps the PCI addresses given to domains (as hostdev NICs or <hostdev>s),
+// and the host interfaces they use in macvtap passthrough mode, to the domain's name
+func hostPCIUsers(conn *libvirt.Connect) (map[string]string, error) {
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %v", err)
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+
+	used := map[string]string{}
+	for i := range doms {
+		def, err := readDomainDef(&doms[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range def.Devices.Interfaces {
+			if iface.Source.Address != nil {
+				used[iface.Source.Address.String()] = def.Name
+			}
+			if iface.Type == "direct" && iface.Source.Mode == "passthrough" {
+				used[iface.Source.Dev] = def.Name
+			}
+		}
+		for _, hd := range def.Devices.Hostdevs {
+			if hd.Type == "pci" && hd.Source.Address != nil {
+				used[hd.Source.Address.String()] = def.Name
+			}
+		}
+	}
+	return used, nil
+}
+
+// assignVFs picks a virtual function for every SR-IOV NIC: the pinned one if it is free,
+// otherwise the first free VF of the PF
+func assignVFs(conn *libvirt.Connect, vmName string, nics []NICDevice) error {
+	var inventory []SRIOVFunction
+	for i := range nics {
+		nic := &nics[i]
+		if nic.SRIOV == nil {
+			continue
+		}
+		if inventory == nil {
+			var err error
+			if inventory, err = sriovInventory(conn); err != nil {
+				return err
+			}
+		}
+
+		var pinned string
+		if nic.SRIOV.VF != "" {
+			addr, err := parsePCIAddress(nic.SRIOV.VF)
+			if err != nil {
+				return fmt.Errorf("nic %d: %v", i, err)
+			}
+			pinned = addr.String()
+		}
+		var chosen *SRIOVFunction
+		for j := range inventory {
+			vf := &inventory[j]
+			if vf.PF != nic.SRIOV.PF || (pinned != "" && vf.Address != pinned) {
+				continue
+			}
+			if pinned != "" && vf.UsedBy != "" {
+				return fmt.Errorf("nic %d: %w: %s is attached to VM %q", i, errVFUnavailable, pinned, vf.UsedBy)
+			}
+			if vf.UsedBy == "" && (nic.Type != "direct" || vf.Interface != "") {
+				chosen = vf
+				break
+			}
+		}
+		if chosen == nil {
+			if pinned != "" {
+				return fmt.Errorf("nic %d: %s is not a usable VF of %q", i, pinned, nic.SRIOV.PF)
+			}
+			return fmt.Errorf("nic %d: %w on %q", i, errVFUnavailable, nic.SRIOV.PF)
+		}
+
+		chosen.UsedBy = vmName
+		if nic.Type == "direct" {
+			nic.Source = chosen.Interface
+		} else {
+			addr, _ := parsePCIAddress(chosen.Address)
+			nic.PCI = &addr
+		}
+		log.Printf("Assigned VF %s of %s to %s", chosen.Address, chosen.PF, vmName)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const (
+	defaultStatsInterval = time.Second
+	maxStatsInterval     = time.Minute
+)
+
+// VMStats - live figures for a running VM. Counters are totals since the guest started;
+// the per-second rates and CPU utilization are averaged over the sampling interval.
+type VMStats struct {
+	Name            string           `json:"name"`
+	IntervalSeconds float64          `json:"interval_seconds"`
+	CPU             CPUStats         `json:"cpu"`
+	Memory          MemoryStats      `json:"memory"`
+	Disks           []DiskStats      `json:"disks"`
+	Interfaces      []InterfaceStats `json:"interfaces"`
+}
+
+type CPUStats struct {
+	VCPUs              int     `json:"vcpus"`
+	TimeSeconds        float64 `json:"time_seconds"`
+	UtilizationPercent float64 `json:"utilization_percent"` // of all vCPUs, 0-100
+}
+
+// MemoryStats - balloon figures; the guest-reported ones need the virtio balloon driver
+type MemoryStats struct {
+	ActualMB  uint64 `json:"actual_mb"` // what the balloon currently gives the guest
+	MaximumMB uint64 `json:"maximum_mb"`
+	UsableMB  uint64 `json:"usable_mb,omitempty"`
+	UnusedMB  uint64 `json:"unused_mb,omitempty"`
+	RssMB     uint64 `json:"rss_mb,omitempty"` // resident size of the QEMU process
+}
+
+type DiskStats struct {
+	Name                string  `json:"name"`
+	Path                string  `json:"path,omitempty"`
+	ReadBytes           uint64  `json:"read_bytes"`
+	WriteBytes          uint64  `json:"write_bytes"`
+	ReadBytesPerSecond  float64 `json:"read_bytes_per_second"`
+	WriteBytesPerSecond float64 `json:"write_bytes_per_second"`
+}
+
+type InterfaceStats struct {
+	Name             string  `json:"name"`
+	RxBytes          uint64  `json:"rx_bytes"`
+	TxBytes          uint64  `json:"tx_bytes"`
+	RxBytesPerSecond float64 `json:"rx_bytes_per_second"`
+	TxBytesPerSecond float64 `json:"tx_bytes_per_second"`
+}
+
+// handleGetVMStats - GET /api/v1/vm/{name}/stats[?interval=2s]
+// Takes two samples of the domain's stats interval apart (default 1s, at most 1m) and
+// returns CPU utilization, memory, and per-disk and per-NIC throughput between them.
+// interval=0 takes a single sample and leaves the rates at zero.
+func handleGetVMStats(w http.ResponseWriter, r *http.Request) {
+	interval := defaultStatsInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxStatsInterval {
+			http.Error(w, fmt.Sprintf("interval must be a duration between 0s and %s", maxStatsInterval), http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name, _ := dom.GetName()
+		if state, err := domainState(dom); err == nil && state != "running" {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q is not running", name))
+			return
+		}
+
+		first, err := sampleDomainStats(conn, dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get stats for VM %s: %v", name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		last, elapsed := first, time.Duration(0)
+		if interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+			last, err = sampleDomainStats(conn, dom)
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to get stats for VM %s: %v", name, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			elapsed = last.taken.Sub(first.taken)
+		}
+
+		writeDataResponse(w, buildVMStats(name, first, last, elapsed))
+	})
+}
+
+// domainSample - one GetAllDomainStats reading and when it was taken
+type domainSample struct {
+	stats libvirt.DomainStats
+	taken time.Time
+}
+
+func sampleDomainStats(conn *libvirt.Connect, dom *libvirt.Domain) (domainSample, error) {
+	stats, err := conn.GetAllDomainStats([]*libvirt.Domain{dom},
+		libvirt.DOMAIN_STATS_CPU_TOTAL|libvirt.DOMAIN_STATS_BALLOON|libvirt.DOMAIN_STATS_VCPU|
+			libvirt.DOMAIN_STATS_INTERFACE|libvirt.DOMAIN_STATS_BLOCK, 0)
+	if err != nil {
+		return domainSample{}, err
+	}
+	taken := time.Now()
+	for _, s := range stats {
+		s.Domain.Free()
+	}
+	if len(stats) == 0 {
+		return domainSample{}, fmt.Errorf("no stats returned")
+	}
+	return domainSample{stats: stats[0], taken: taken}, nil
+}
+
+// buildVMStats reports the last sample's counters, with rates over the time since the first
+func buildVMStats(name string, first, last domainSample, elapsed time.Duration) VMStats {
+	secs := elapsed.Seconds()
+	rate := func(from, to uint64) float64 {
+		if secs <= 0 || to < from {
+			return 0
+		}
+		return float64(to-from) / secs
+	}
+
+	out := VMStats{
+		Name:            name,
+		IntervalSeconds: secs,
+		Disks:           []DiskStats{},
+		Interfaces:      []InterfaceStats{},
+	}
+
+	out.CPU.VCPUs = len(last.stats.Vcpu)
+	if cpu := last.stats.Cpu; cpu != nil && cpu.TimeSet {
+		out.CPU.TimeSeconds = float64(cpu.Time) / 1e9
+		if prev := first.stats.Cpu; prev != nil && prev.TimeSet && out.CPU.VCPUs > 0 {
+			// cpu.time is nanoseconds of host CPU, summed over all vCPU and emulator threads
+			out.CPU.UtilizationPercent = min(100, rate(prev.Time, cpu.Time)/1e9/float64(out.CPU.VCPUs)*100)
+		}
+	}
+
+	if bal := last.stats.Balloon; bal != nil {
+		// Balloon figures are in KiB
+		out.Memory.ActualMB = bal.Current / 1024
+		out.Memory.MaximumMB = bal.Maximum / 1024
+		if bal.UsableSet {
+			out.Memory.UsableMB = bal.Usable / 1024
+		}
+		if bal.UnusedSet {
+			out.Memory.UnusedMB = bal.Unused / 1024
+		}
+		if bal.RssSet {
+			out.Memory.RssMB = bal.Rss / 1024
+		}
+	}
+
+	prevDisks := map[string]libvirt.DomainStatsBlock{}
+	for _, blk := range first.stats.Block {
+		prevDisks[blk.Name] = blk
+	}
+	for _, blk := range last.stats.Block {
+		d := DiskStats{Name: blk.Name, Path: blk.Path, ReadBytes: blk.RdBytes, WriteBytes: blk.WrBytes}
+		if prev, ok := prevDisks[blk.Name]; ok {
+			d.ReadBytesPerSecond = rate(prev.RdBytes, blk.RdBytes)
+			d.WriteBytesPerSecond = rate(prev.WrBytes, blk.WrBytes)
+		}
+		out.Disks = append(out.Disks, d)
+	}
+
+	prevNICs := map[string]libvirt.DomainStatsNet{}
+	for _, nic := range first.stats.Net {
+		prevNICs[nic.Name] = nic
+	}
+	for _, nic := range last.stats.Net {
+		n := InterfaceStats{Name: nic.Name, RxBytes: nic.RxBytes, TxBytes: nic.TxBytes}
+		if prev, ok := prevNICs[nic.Name]; ok {
+			n.RxBytesPerSecond = rate(prev.RxBytes, nic.RxBytes)
+			n.TxBytesPerSecond = rate(prev.TxBytes, nic.TxBytes)
+		}
+		out.Interfaces = append(out.Interfaces, n)
+	}
+	return out
+}
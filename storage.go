@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"path"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// defaultStoragePool - pool new disks land in when the request doesn't name one
+const defaultStoragePool = "default"
+
+// storageBackend - allocates new disks in one storage pool and says how the domain XML
+// should reference them. Which backend a pool gets depends on its libvirt pool type.
+type storageBackend interface {
+	// createVolume allocates a new disk for spec and returns a DiskDevice with only the
+	// source fields (Type, Path or network source) filled in
+	createVolume(volName string, spec DiskSpec, secretUUID string) (DiskDevice, error)
+	// plannedVolume - what createVolume would return for the volume, without creating it
+	plannedVolume(volName string, spec DiskSpec) (DiskDevice, error)
+	// name - the pool the volumes are created in
+	name() string
+	Free()
+}
+
+// openStorageBackend looks up the named pool and picks the backend matching its type
+func openStorageBackend(conn *libvirt.Connect, poolName string) (storageBackend, error) {
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("storage pool %q not found: %v", poolName, err)
+	}
+
+	doc, err := readPoolXML(pool)
+	if err != nil {
+		pool.Free()
+		return nil, fmt.Errorf("failed to read storage pool %q: %v", poolName, err)
+	}
+
+	if doc.Type == "rbd" {
+		return newRBDBackend(conn, pool, poolName, doc)
+	}
+	b := &localPoolBackend{conn: conn, pool: pool, poolName: poolName, poolType: doc.Type}
+	if doc.Target != nil {
+		b.target = doc.Target.Path
+	}
+	return b, nil
+}
+
+// readPoolXML fetches and parses the pool's XML definition
+func readPoolXML(pool *libvirt.StoragePool) (poolXML, error) {
+	var doc poolXML
+	desc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return doc, err
+	}
+	err = xml.Unmarshal([]byte(desc), &doc)
+	return doc, err
+}
+
+// localPoolBackend - pools whose volumes show up as files or block devices on the
+// hypervisor host (dir, fs, netfs, logical, ...)
+type localPoolBackend struct {
+	conn     *libvirt.Connect
+	pool     *libvirt.StoragePool
+	poolName string
+	poolType string
+	target   string // the pool's target directory
+}
+
+// blockPoolTypes - local pool types whose volumes are block devices rather than files
+var blockPoolTypes = map[string]bool{"logical": true, "disk": true, "zfs": true}
+
+func (b *localPoolBackend) Free() {
+	b.pool.Free()
+}
+
+func (b *localPoolBackend) name() string {
+	return b.poolName
+}
+
+func (b *localPoolBackend) createVolume(volName string, spec DiskSpec, secretUUID string) (DiskDevice, error) {
+	sv, err := createPoolVolume(b.conn, b.pool, b.poolName, volName, spec, secretUUID)
+	if err != nil {
+		return DiskDevice{}, err
+	}
+	defer sv.Free()
+
+	path, err := sv.GetPath()
+	if err != nil {
+		return DiskDevice{}, fmt.Errorf("failed to get path of volume %s: %v", volName, err)
+	}
+	info, err := sv.GetInfo()
+	if err != nil {
+		return DiskDevice{}, fmt.Errorf("failed to inspect volume %s: %v", volName, err)
+	}
+
+	disk := DiskDevice{Type: "file", Path: path}
+	if info.Type == libvirt.STORAGE_VOL_BLOCK {
+		disk.Type = "block"
+	}
+	return disk, nil
+}
+
+func (b *localPoolBackend) plannedVolume(volName string, spec DiskSpec) (DiskDevice, error) {
+	disk := DiskDevice{Type: "file", Path: path.Join(b.target, volName)}
+	if blockPoolTypes[b.poolType] {
+		disk.Type = "block"
+	}
+	return disk, nil
+}
+
+// rbdBackend - a libvirt "rbd" pool backed by a Ceph pool. Volumes are RBD images that
+// QEMU opens over the network, so the domain references them as <disk type='network'>
+// with the monitors and cephx credentials taken from the pool definition.
+type rbdBackend struct {
+	conn     *libvirt.Connect
+	pool     *libvirt.StoragePool
+	poolName string
+	cephPool string
+	hosts    []DiskHost
+	auth     *DiskAuth
+}
+
+func newRBDBackend(conn *libvirt.Connect, pool *libvirt.StoragePool, poolName string, doc poolXML) (*rbdBackend, error) {
+	b := &rbdBackend{conn: conn, pool: pool, poolName: poolName}
+	if doc.Source != nil {
+		b.cephPool = doc.Source.Name
+		for _, h := range doc.Source.Hosts {
+			b.hosts = append(b.hosts, DiskHost{Name: h.Name, Port: h.Port})
+		}
+		if a := doc.Source.Auth; a != nil && a.Secret != nil {
+			b.auth = &DiskAuth{Username: a.Username, SecretUUID: a.Secret.UUID}
+		}
+	}
+	if len(b.hosts) == 0 {
+		pool.Free()
+		return nil, fmt.Errorf("rbd storage pool %q has no monitor hosts", poolName)
+	}
+	return b, nil
+}
+
+func (b *rbdBackend) Free() {
+	b.pool.Free()
+}
+
+func (b *rbdBackend) name() string {
+	return b.poolName
+}
+
+// checkSpec refuses what an RBD image can't be
+func (b *rbdBackend) checkSpec(spec DiskSpec) error {
+	if spec.BackingFile != "" {
+		return fmt.Errorf("base_image is not supported on rbd pools")
+	}
+	if spec.Encryption != nil {
+		return fmt.Errorf("encryption is not supported on rbd pools")
+	}
+	if spec.Format != "raw" {
+		return fmt.Errorf("rbd pools only hold raw images, set format to raw")
+	}
+	if spec.Preallocation != "" && spec.Preallocation != "off" {
+		return fmt.Errorf("preallocation is not supported on rbd pools")
+	}
+	return nil
+}
+
+func (b *rbdBackend) createVolume(volName string, spec DiskSpec, secretUUID string) (DiskDevice, error) {
+	if err := b.checkSpec(spec); err != nil {
+		return DiskDevice{}, err
+	}
+
+	sv, err := createPoolVolume(b.conn, b.pool, b.poolName, volName, spec, secretUUID)
+	if err != nil {
+		return DiskDevice{}, err
+	}
+	defer sv.Free()
+
+	// For rbd volumes the "path" is "<ceph pool>/<image>", which is exactly the source name
+	name, err := sv.GetPath()
+	if err != nil {
+		return DiskDevice{}, fmt.Errorf("failed to get name of volume %s: %v", volName, err)
+	}
+
+	return DiskDevice{
+		Type:       "network",
+		Protocol:   "rbd",
+		SourceName: name,
+		Hosts:      b.hosts,
+		Auth:       b.auth,
+	}, nil
+}
+
+func (b *rbdBackend) plannedVolume(volName string, spec DiskSpec) (DiskDevice, error) {
+	if err := b.checkSpec(spec); err != nil {
+		return DiskDevice{}, err
+	}
+	return DiskDevice{
+		Type:       "network",
+		Protocol:   "rbd",
+		SourceName: b.cephPool + "/" + volName,
+		Hosts:      b.hosts,
+		Auth:       b.auth,
+	}, nil
+}
+
+// volumeXML - the subset of libvirt's <volume> document we need to create a disk
+type volumeXML struct {
+	XMLName      xml.Name          `xml:"volume"`
+	Name         string            `xml:"name"`
+	Capacity     volumeSize        `xml:"capacity"`
+	Allocation   volumeSize        `xml:"allocation"`
+	Target       volumeTarget      `xml:"target"`
+	BackingStore *volumeBackingXML `xml:"backingStore,omitempty"`
+}
+
+type volumeSize struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+type volumeFormat struct {
+	Type string `xml:"type,attr"`
+}
+
+type volumeTarget struct {
+	Format     volumeFormat         `xml:"format"`
+	Encryption *volumeEncryptionXML `xml:"encryption,omitempty"`
+}
+
+type volumeEncryptionXML struct {
+	Format string          `xml:"format,attr"`
+	Secret volumeSecretXML `xml:"secret"`
+}
+
+type volumeSecretXML struct {
+	Type string `xml:"type,attr"`
+	UUID string `xml:"uuid,attr"`
+}
+
+type volumeBackingXML struct {
+	Path   string       `xml:"path"`
+	Format volumeFormat `xml:"format"`
+}
+
+// createPoolVolume allocates a new volume for spec in pool; the caller frees it.
+// spec.Format is the on-disk format of the new volume ("qcow2" or "raw").
+// With a BackingFile the new volume is a qcow2 copy-on-write overlay of it; SizeGB may be 0
+// to inherit the backing image's capacity (see volumeCapacityByPath).
+// Encrypted volumes are formatted with the passphrase held by secretUUID.
+//
+// spec.Preallocation maps onto what libvirt can express: "metadata" is the PREALLOC_METADATA
+// flag, while "falloc" and "full" both ask for allocation == capacity, which libvirt satisfies
+// with fallocate() where the filesystem supports it and by writing zeroes otherwise.
+func createPoolVolume(conn *libvirt.Connect, pool *libvirt.StoragePool, poolName, volName string, spec DiskSpec, secretUUID string) (*libvirt.StorageVol, error) {
+	sizeGB, format, backingFile := spec.SizeGB, spec.Format, spec.BackingFile
+
+	capacity := uint64(sizeGB) << 30
+	if backingFile != "" && sizeGB <= 0 {
+		var err error
+		capacity, err = volumeCapacityByPath(conn, backingFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine size of %s (set size_gb): %v", backingFile, err)
+		}
+	}
+	if capacity == 0 {
+		return nil, fmt.Errorf("size_gb must be > 0 to create a new disk")
+	}
+
+	var allocation uint64
+	var flags libvirt.StorageVolCreateFlags
+	switch spec.Preallocation {
+	case "metadata":
+		flags |= libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+	case "falloc", "full":
+		allocation = capacity
+	}
+
+	vol := volumeXML{
+		Name:       volName,
+		Capacity:   volumeSize{Unit: "bytes", Value: capacity},
+		Allocation: volumeSize{Unit: "bytes", Value: allocation},
+		Target:     volumeTarget{Format: volumeFormat{Type: format}},
+	}
+	if backingFile != "" {
+		vol.BackingStore = &volumeBackingXML{Path: backingFile, Format: volumeFormat{Type: "qcow2"}}
+	}
+	if spec.Encryption != nil {
+		vol.Target.Encryption = &volumeEncryptionXML{
+			Format: spec.Encryption.Format,
+			Secret: volumeSecretXML{Type: "passphrase", UUID: secretUUID},
+		}
+	}
+
+	volDoc, err := xml.Marshal(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	sv, err := pool.StorageVolCreateXML(string(volDoc), flags)
+	if err != nil {
+		return nil, fmt.Errorf("StorageVolCreateXML failed: %v", err)
+	}
+
+	if backingFile != "" {
+		log.Printf("Created volume %s in pool %s (%d bytes, backed by %s)", volName, poolName, capacity, backingFile)
+	} else {
+		log.Printf("Created volume %s in pool %s (%d bytes)", volName, poolName, capacity)
+	}
+	return sv, nil
+}
+
+// deletePoolVolume removes a volume we created, for cleaning up after a failed operation
+func deletePoolVolume(conn *libvirt.Connect, poolName, volName string) {
+	pool, err := conn.LookupStoragePoolByName(poolName)
+	if err != nil {
+		log.Printf("Failed to look up pool %s for cleanup: %v", poolName, err)
+		return
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(volName)
+	if err != nil {
+		log.Printf("Failed to look up volume %s for cleanup: %v", volName, err)
+		return
+	}
+	defer vol.Free()
+	if err := vol.Delete(0); err != nil {
+		log.Printf("Failed to remove volume %s: %v", volName, err)
+		return
+	}
+	log.Printf("Removed volume %s from pool %s", volName, poolName)
+}
+
+// volumeCapacityByPath - virtual size of an image, asking libvirt if it tracks it in some
+// pool and otherwise reading the qcow2 header directly (e.g. for the local image cache)
+func volumeCapacityByPath(conn *libvirt.Connect, path string) (uint64, error) {
+	vol, err := conn.LookupStorageVolByPath(path)
+	if err != nil {
+		if size, herr := qcow2VirtualSize(path); herr == nil {
+			return size, nil
+		}
+		return 0, err
+	}
+	defer vol.Free()
+
+	info, err := vol.GetInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.Capacity, nil
+}
+
+// copiedVolume - a volume made for a new VM from one of another VM's disks (clone, import),
+// with the disk source it replaces in the domain XML
+type copiedVolume struct {
+	source string
+	path   string
+	vol    *libvirt.StorageVol
+}
+
+// sourceMap - old disk source -> new volume path, for replaceDiskSources
+func sourceMap(vols []copiedVolume) map[string]string {
+	sources := map[string]string{}
+	for _, v := range vols {
+		sources[v.source] = v.path
+	}
+	return sources
+}
+
+// deleteCopiedVolumes removes the volumes of a VM that couldn't be defined
+func deleteCopiedVolumes(vols []copiedVolume) {
+	for _, v := range vols {
+		if err := v.vol.Delete(0); err != nil {
+			log.Printf("Failed to remove volume %s: %v", v.path, err)
+		}
+		v.vol.Free()
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Besides the default domain template (VM_SERVICE_TEMPLATE) the service loads every
+// <name>.xml in VM_SERVICE_TEMPLATE_DIR as a named variant, e.g. windows-uefi or arm64,
+// and a create picks one with its "template" field. Each variant is a whole domain
+// template taking the same TemplateData, so it must render every disk, NIC and console
+// the request asks for; generateDomainXML checks it does.
+
+// defaultTemplateName - the name the default template is listed under; a request may
+// also leave "template" out
+const defaultTemplateName = "default"
+
+// defaultTemplateDir - the template directory when VM_SERVICE_TEMPLATE_DIR is unset;
+// relative like the default template, and it may be missing
+const defaultTemplateDir = "templates"
+
+// templateDir - the directory of template variants
+var templateDir = envOrDefault("VM_SERVICE_TEMPLATE_DIR", defaultTemplateDir)
+
+// domainTemplates - the parsed templates by name, the default one under ""
+var domainTemplates map[string]*template.Template
+
+// DomainTemplate - entry of GET /api/v1/templates
+type DomainTemplate struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// loadTemplates reads the default template and the variants in templateDir
+func loadTemplates() error {
+	templates := map[string]*template.Template{}
+	tmpl, err := parseDomainTemplate(templatePath)
+	if err != nil {
+		return err
+	}
+	templates[""] = tmpl
+
+	entries, err := os.ReadDir(templateDir)
+	if err != nil && !(templateDir == defaultTemplateDir && os.IsNotExist(err)) {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".xml")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if name == defaultTemplateName {
+			return fmt.Errorf("%s: %q is the name of VM_SERVICE_TEMPLATE", filepath.Join(templateDir, e.Name()), name)
+		}
+		if err := validateTemplateName(name); err != nil {
+			return fmt.Errorf("%s: %v", filepath.Join(templateDir, e.Name()), err)
+		}
+		tmpl, err := parseDomainTemplate(filepath.Join(templateDir, e.Name()))
+		if err != nil {
+			return err
+		}
+		templates[name] = tmpl
+	}
+	domainTemplates = templates
+	return nil
+}
+
+// parseDomainTemplate reads and parses one template file
+func parseDomainTemplate(path string) (*template.Template, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("domainXML").Funcs(domainTemplateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s as template: %v", path, err)
+	}
+	return tmpl, nil
+}
+
+// validateTemplateName checks a template name, which template file names share with VM names
+func validateTemplateName(name string) error {
+	if !vmNamePattern.MatchString(name) {
+		return fmt.Errorf("template name %q must be 1-63 letters, digits, '.', '_' or '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// lookupTemplate finds a template by name; "" and "default" are the default template
+func lookupTemplate(name string) (*template.Template, error) {
+	if name == defaultTemplateName {
+		name = ""
+	}
+	tmpl, ok := domainTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q, see GET /api/v1/templates", name)
+	}
+	return tmpl, nil
+}
+
+// templateNames - the names of the loaded templates, the default one first
+func templateNames() []DomainTemplate {
+	list := []DomainTemplate{{Name: defaultTemplateName, Default: true}}
+	names := make([]string, 0, len(domainTemplates))
+	for name := range domainTemplates {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list = append(list, DomainTemplate{Name: name})
+	}
+	return list
+}
+
+// handleListTemplates - GET /api/v1/templates
+func handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, templateNames())
+}
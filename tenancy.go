@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// Projects let teams share the hypervisors. A caller in a project only sees and manages
+// the project's VMs, under names that are unique within it: the libvirt domain behind
+// VM "web1" of project "team-a" is "team-a.web1", and its <metadata> records the
+// project, which is what ownership is checked against.
+//
+// A caller's project comes from VM_SERVICE_PROJECTS ("name=project,...") or else from
+// its OIDC token's project claim. Admins without a project see every VM under its
+// libvirt name; other callers without one may not touch VMs at all. With authentication
+// off there are no callers to tell apart and nothing is scoped.
+
+// projectNamespace - URI of the project element in the domain <metadata>
+const projectNamespace = "https://github.com/rockybhanu/ramanuj-vm-service/project"
+
+// projectSeparator joins project and VM name into the domain name. Project names can't
+// contain it, so a project's domain names never collide with another's.
+const projectSeparator = "."
+
+var projectPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// projectXML - our element in the domain <metadata>
+type projectXML struct {
+	XMLName xml.Name `xml:"project"`
+	Name    string   `xml:"name,attr"`
+}
+
+// principalProjects - projects given by name, from VM_SERVICE_PROJECTS. They win over a
+// token's project claim.
+var principalProjects map[string]string
+
+// loadProjects parses VM_SERVICE_PROJECTS into principalProjects
+func loadProjects() error {
+	projects := map[string]string{}
+	for _, entry := range strings.Split(envOrDefault("VM_SERVICE_PROJECTS", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, project, ok := strings.Cut(entry, "=")
+		name, project = strings.TrimSpace(name), strings.TrimSpace(project)
+		if !ok || name == "" || !projectPattern.MatchString(project) {
+			return fmt.Errorf("VM_SERVICE_PROJECTS entry %q is not name=project (project: lowercase letters, digits and dashes)", entry)
+		}
+		projects[name] = project
+	}
+	principalProjects = projects
+	return nil
+}
+
+// assignProject applies the configured project for the principal's name, if any
+func assignProject(p *Principal) {
+	if project, ok := principalProjects[p.Name]; ok {
+		p.Project = project
+	}
+}
+
+// tenantScope - the VMs a request may see: those of one project, or all of them
+type tenantScope struct {
+	project string
+	all     bool
+}
+
+// requestScope works out the caller's scope, failing for callers that are in no
+// project and not admins
+func requestScope(r *http.Request) (tenantScope, error) {
+	p := requestPrincipal(r)
+	switch {
+	case p == nil:
+		return tenantScope{all: true}, nil
+	case p.Project != "":
+		return tenantScope{project: p.Project}, nil
+	case p.Role == roleAdmin:
+		return tenantScope{all: true}, nil
+	}
+	return tenantScope{}, fmt.Errorf("%s is not in any project", p.Name)
+}
+
+// requestProject - the project a request acts in, "" for admins and the open API
+func requestProject(r *http.Request) string {
+	scope, _ := requestScope(r)
+	return scope.project
+}
+
+// domainName is the libvirt name of the scope's VM name
+func (s tenantScope) domainName(name string) string {
+	if s.all {
+		return name
+	}
+	return s.project + projectSeparator + name
+}
+
+// vmName is the name the scope knows the domain by, the inverse of domainName
+func (s tenantScope) vmName(domain string) string {
+	if s.all {
+		return domain
+	}
+	return strings.TrimPrefix(domain, s.project+projectSeparator)
+}
+
+// ownsName says whether the domain name is one of the scope's. It goes by name only,
+// for records kept after the domain itself is gone; ownsDomain also checks the metadata.
+func (s tenantScope) ownsName(domain string) bool {
+	return s.all || strings.HasPrefix(domain, s.project+projectSeparator)
+}
+
+// ownsDomain says whether the domain belongs to the scope
+func (s tenantScope) ownsDomain(dom *libvirt.Domain) bool {
+	if s.all {
+		return true
+	}
+	name, err := dom.GetName()
+	return err == nil && s.ownsName(name) && domainProject(dom) == s.project
+}
+
+// requestVMName resolves the request's {name} to a domain name, answering 403 for
+// callers that may not touch VMs
+func requestVMName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return "", false
+	}
+	return scope.domainName(r.PathValue("name")), true
+}
+
+// domainProject reads the domain's project from its metadata, "" if it has none
+func domainProject(dom *libvirt.Domain) string {
+	doc, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, projectNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		if !isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN_METADATA) {
+			log.Printf("Failed to read project metadata: %v", err)
+		}
+		return ""
+	}
+	var p projectXML
+	if err := xml.Unmarshal([]byte(doc), &p); err != nil {
+		log.Printf("Failed to parse project metadata: %v", err)
+		return ""
+	}
+	return p.Name
+}
+
+// setDomainProject records the project in the domain's persistent metadata, for domains
+// defined from XML the service didn't generate (imports, clones)
+func setDomainProject(dom *libvirt.Domain, project string) error {
+	doc, err := xml.Marshal(projectXML{Name: project})
+	if err != nil {
+		return err
+	}
+	return dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(doc), "vmsvc", projectNamespace, libvirt.DOMAIN_AFFECT_CONFIG)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// HTTPS for the API listener, set up from the environment:
+//
+//	VM_SERVICE_TLS_CERT, VM_SERVICE_TLS_KEY  PEM certificate (chain) and key; both or neither
+//	VM_SERVICE_TLS_CLIENT_CA                 PEM CA bundle client certificates are verified against
+//	VM_SERVICE_TLS_CLIENT_AUTH               "require" (the default with a client CA) or "optional"
+//
+// With a client CA, a verified client certificate authenticates the caller as its
+// subject's common name, alongside API keys and OIDC tokens. SIGHUP reloads the server
+// certificate, for rotation without a restart.
+var tlsSettings = struct {
+	certFile, keyFile, clientCA, clientAuth string
+}{
+	certFile:   envOrDefault("VM_SERVICE_TLS_CERT", ""),
+	keyFile:    envOrDefault("VM_SERVICE_TLS_KEY", ""),
+	clientCA:   envOrDefault("VM_SERVICE_TLS_CLIENT_CA", ""),
+	clientAuth: envOrDefault("VM_SERVICE_TLS_CLIENT_AUTH", "require"),
+}
+
+// clientCertAuth says whether client certificates are verified, and so can authenticate
+func clientCertAuth() bool {
+	return tlsSettings.clientCA != ""
+}
+
+// certReloader serves the current server certificate, swapping in a fresh one on SIGHUP
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(tlsSettings.certFile, tlsSettings.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := c.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate, keeping the old one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", tlsSettings.certFile)
+	}
+}
+
+// serverTLSConfig builds the listener's TLS configuration, nil if TLS isn't configured
+func serverTLSConfig() (*tls.Config, error) {
+	if tlsSettings.certFile == "" && tlsSettings.keyFile == "" {
+		if tlsSettings.clientCA != "" {
+			return nil, fmt.Errorf("VM_SERVICE_TLS_CLIENT_CA needs VM_SERVICE_TLS_CERT and VM_SERVICE_TLS_KEY")
+		}
+		return nil, nil
+	}
+	if tlsSettings.certFile == "" || tlsSettings.keyFile == "" {
+		return nil, fmt.Errorf("VM_SERVICE_TLS_CERT and VM_SERVICE_TLS_KEY must be set together")
+	}
+
+	reloader := &certReloader{}
+	if err := reloader.load(); err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	go reloader.watch()
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if tlsSettings.clientCA != "" {
+		pem, err := os.ReadFile(tlsSettings.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", tlsSettings.clientCA)
+		}
+		cfg.ClientCAs = pool
+		switch tlsSettings.clientAuth {
+		case "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("VM_SERVICE_TLS_CLIENT_AUTH must be \"require\" or \"optional\"")
+		}
+	}
+	return cfg, nil
+}
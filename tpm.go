@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// "tpm": true gives the VM a TPM 2.0 emulated by swtpm, which Windows 11 and measured
+// boot need. libvirt starts swtpm with the VM and keeps its state in a directory named
+// after the domain's UUID, so a clone, getting a new UUID, starts with a TPM of its own.
+// The state goes when the VM is deleted, see removeTPMState.
+
+// swtpmStateDir - where libvirt keeps the swtpm state, VM_SERVICE_SWTPM_DIR
+var swtpmStateDir = envOrDefault("VM_SERVICE_SWTPM_DIR", "/var/lib/libvirt/swtpm")
+
+type domainTPMXML struct {
+	Model   string `xml:"model,attr"`
+	Backend struct {
+		Type    string `xml:"type,attr"`
+		Version string `xml:"version,attr"`
+	} `xml:"backend"`
+}
+
+// removeTPMState removes the swtpm state of an undefined domain. libvirt 8.9 and later
+// remove it on undefine themselves; this covers older ones, whose state would otherwise
+// pile up. It only reaches this machine's hypervisor, where a remote host's domain has
+// no directory.
+func removeTPMState(uuid string) {
+	if uuid == "" {
+		return
+	}
+	dir := filepath.Join(swtpmStateDir, uuid)
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove TPM state %s: %v", dir, err)
+	}
+}
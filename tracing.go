@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry tracing, exported as OTLP/HTTP with JSON encoding. Like the metrics it is
+// hand-rolled: spans, W3C traceparent propagation and a batching exporter are all the
+// service needs, and it has no SDK to lean on.
+//
+// Tracing is off unless OTEL_EXPORTER_OTLP_ENDPOINT (e.g. "http://collector:4318") or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full /v1/traces URL) is set. OTEL_SERVICE_NAME
+// names the service in the exported resource.
+
+var (
+	tracesEndpoint = otlpTracesEndpoint()
+	serviceName    = envOrDefault("OTEL_SERVICE_NAME", "vm-service")
+)
+
+const (
+	spanBatchSize     = 256
+	spanQueueSize     = 4096
+	spanFlushInterval = 5 * time.Second
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+func otlpTracesEndpoint() string {
+	if v := envOrDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", ""); v != "" {
+		return v
+	}
+	if v := envOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""); v != "" {
+		return strings.TrimSuffix(v, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// span - one timed operation. A nil *span is valid and does nothing, which is what
+// startSpan hands out while tracing is off.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	mu       sync.Mutex
+	attrs    map[string]interface{}
+	errMsg   string
+	ended    bool
+}
+
+type spanKey struct{}
+
+// startSpan starts a span as a child of the one in ctx, if any, and returns a context
+// carrying it
+func startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, *span) {
+	return startSpanKind(ctx, name, spanKindInternal, attrs...)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int, attrs ...interface{}) (context.Context, *span) {
+	if tracesEndpoint == "" {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(traceParent); ok {
+		s.traceID = remote.traceID
+		s.parentID = remote.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	s.setAttrs(attrs...)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// setAttrs records key, value pairs on the span
+func (s *span) setAttrs(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			s.attrs[k] = kv[i+1]
+		}
+	}
+}
+
+// end finishes the span, marking it failed if err is set, and queues it for export
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	if err != nil {
+		s.errMsg = err.Error()
+	}
+	s.mu.Unlock()
+
+	select {
+	case spanQueue <- exportedSpan(s, time.Now()):
+	default:
+		// The collector is down or slow; losing spans beats blocking requests
+	}
+}
+
+// traceParent - the parent span named by an incoming W3C traceparent header
+type traceParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+type remoteParentKey struct{}
+
+// parseTraceParent reads "00-<trace id>-<span id>-<flags>"
+func parseTraceParent(h string) (traceParent, bool) {
+	var tp traceParent
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return tp, false
+	}
+	if _, err := hex.Decode(tp.traceID[:], []byte(parts[1])); err != nil {
+		return tp, false
+	}
+	if _, err := hex.Decode(tp.spanID[:], []byte(parts[2])); err != nil {
+		return tp, false
+	}
+	if tp.traceID == [16]byte{} || tp.spanID == [8]byte{} {
+		return tp, false
+	}
+	return tp, true
+}
+
+// withTracing wraps each request in a server span, continuing the caller's trace if it
+// sent a traceparent header. The trace ID is returned in a traceresponse header.
+func withTracing(next http.Handler) http.Handler {
+	if tracesEndpoint == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if tp, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, remoteParentKey{}, tp)
+		}
+		ctx, s := startSpanKind(ctx, r.Method, spanKindServer,
+			"http.request.method", r.Method,
+			"url.path", r.URL.Path,
+			"request_id", requestID(r))
+		w.Header().Set("traceresponse", fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		if r.Pattern != "" {
+			_, route, _ := strings.Cut(r.Pattern, " ")
+			if route == "" {
+				route = r.Pattern
+			}
+			// Span names go by route, not path, so VM names don't make every span unique
+			s.mu.Lock()
+			s.name = r.Method + " " + route
+			s.mu.Unlock()
+			s.setAttrs("http.route", route)
+		}
+		s.setAttrs("http.response.status_code", rec.code)
+		var err error
+		if rec.code >= 500 {
+			err = fmt.Errorf("%s", http.StatusText(rec.code))
+		}
+		s.end(err)
+	})
+}
+
+// OTLP/JSON shapes, as much of them as the service fills in
+
+type otlpAttr struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 as a decimal string, per the JSON mapping
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"` // 2 is error
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpValue(v interface{}) otlpAnyValue {
+	switch t := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &t}
+	case bool:
+		return otlpAnyValue{BoolValue: &t}
+	case int:
+		s := strconv.Itoa(t)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		return otlpAnyValue{IntValue: &s}
+	case uint64:
+		s := strconv.FormatUint(t, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &t}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
+
+func exportedSpan(s *span, end time.Time) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for k, v := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr{Key: k, Value: otlpValue(v)})
+	}
+	if s.errMsg != "" {
+		out.Status.Code = 2
+		out.Status.Message = s.errMsg
+	}
+	return out
+}
+
+var spanQueue = make(chan otlpSpan, spanQueueSize)
+
+// runSpanExporter sends finished spans to the collector in batches. It never returns.
+func runSpanExporter() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := postSpans(client, batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func postSpans(client *http.Client, spans []otlpSpan) error {
+	name := serviceName
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttr{{Key: "service.name", Value: otlpAnyValue{StringValue: &name}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "vm-service"},
+				"spans": spans,
+			}},
+		}},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(tracesEndpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
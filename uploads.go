@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadProgress - state of one image upload, polled via GET /api/v1/images/uploads/{id}
+type UploadProgress struct {
+	ID            string     `json:"id"`
+	Project       string     `json:"project,omitempty"`
+	FileName      string     `json:"file_name"`
+	BytesReceived int64      `json:"bytes_received"`
+	TotalBytes    int64      `json:"total_bytes"` // -1 when the client didn't say (chunked)
+	State         string     `json:"state"`       // "uploading", "done" or "failed"
+	Error         string     `json:"error,omitempty"`
+	Path          string     `json:"path,omitempty"` // set once done
+	StartedAt     time.Time  `json:"started_at"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+}
+
+// upload - server-side tracking of an UploadProgress; received is updated while streaming
+type upload struct {
+	mu       sync.Mutex
+	progress UploadProgress
+	received atomic.Int64
+}
+
+func (u *upload) snapshot() UploadProgress {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	p := u.progress
+	p.BytesReceived = u.received.Load()
+	return p
+}
+
+func (u *upload) finish(path string, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now().UTC()
+	u.progress.FinishedAt = &now
+	if err != nil {
+		u.progress.State = "failed"
+		u.progress.Error = err.Error()
+		return
+	}
+	u.progress.State = "done"
+	u.progress.Path = path
+}
+
+// imageUploadDir - where uploaded images are kept. It is apart from the download cache,
+// whose files fetchImage trusts by name, so an upload can't stand in for a download.
+var imageUploadDir = filepath.Join(imageCacheDir, "uploads")
+
+var (
+	uploadsMu    sync.Mutex
+	uploads      = map[string]*upload{}
+	uploadsSwept time.Time
+)
+
+// countingWriter counts bytes on their way to the image file
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// handleUploadImage - POST /api/v1/images/upload
+//
+// Accepts either a multipart/form-data body (metadata fields first, then a "file" part) or a
+// raw (possibly chunked) body with metadata in the query string. Recognised fields are
+// file_name plus the ImageRequest fields name, kind, format, os_family, default_login,
+// min_disk_gb; when name is given the finished upload is registered in the image catalog.
+// Clients that want to watch progress pass their own upload_id and poll
+// GET /api/v1/images/uploads/{id} while the upload runs; finished uploads are forgotten
+// after jobTTL, like jobs.
+func handleUploadImage(w http.ResponseWriter, r *http.Request) {
+	fields := map[string]string{}
+	for key := range r.URL.Query() {
+		fields[key] = r.URL.Query().Get(key)
+	}
+
+	var body io.Reader = r.Body
+	total := r.ContentLength
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid multipart body: %v", err), http.StatusBadRequest)
+			return
+		}
+		body = nil
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid multipart body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if part.FormName() == "file" {
+				if fields["file_name"] == "" {
+					fields["file_name"] = part.FileName()
+				}
+				body = part
+				total = -1 // the part's size isn't known up front
+				break
+			}
+			value, err := io.ReadAll(io.LimitReader(part, 4096))
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid multipart body: %v", err), http.StatusBadRequest)
+				return
+			}
+			fields[part.FormName()] = string(value)
+		}
+		if body == nil {
+			http.Error(w, "Multipart body has no \"file\" part", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fileName := sanitizeFileName(filepath.Base(fields["file_name"]))
+	if fields["file_name"] == "" {
+		http.Error(w, "file_name is required", http.StatusBadRequest)
+		return
+	}
+
+	var imgReq *ImageRequest
+	if fields["name"] != "" {
+		minDisk, _ := strconv.Atoi(fields["min_disk_gb"])
+		imgReq = &ImageRequest{
+			Name:         fields["name"],
+			Kind:         fields["kind"],
+			Format:       fields["format"],
+			OSFamily:     fields["os_family"],
+			DefaultLogin: fields["default_login"],
+			MinDiskGB:    minDisk,
+		}
+		if imgReq.Kind == "" && filepath.Ext(fileName) == ".iso" {
+			imgReq.Kind = "iso"
+		}
+		if err := validateImageRequest(imgReq); err != nil {
+			msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+			requestLog(r).Warn(msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if _, exists := imageCatalog.get(imgReq.Name); exists {
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Image %q already exists", imgReq.Name))
+			return
+		}
+	}
+
+	id := fields["upload_id"]
+	if id == "" {
+		id = uuid.New().String()
+	}
+	up := &upload{progress: UploadProgress{
+		ID:         id,
+		Project:    requestProject(r),
+		FileName:   fileName,
+		TotalBytes: total,
+		State:      "uploading",
+		StartedAt:  time.Now().UTC(),
+	}}
+	uploadsMu.Lock()
+	if now := time.Now(); now.Sub(uploadsSwept) > time.Hour {
+		for oldID, old := range uploads {
+			if p := old.snapshot(); p.FinishedAt != nil && now.Sub(*p.FinishedAt) > jobTTL {
+				delete(uploads, oldID)
+			}
+		}
+		uploadsSwept = now
+	}
+	if existing, ok := uploads[id]; ok {
+		if p := existing.snapshot(); p.State == "uploading" || p.Project != up.progress.Project {
+			uploadsMu.Unlock()
+			writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("Upload ID %s is taken", id))
+			return
+		}
+	}
+	uploads[id] = up
+	uploadsMu.Unlock()
+
+	dest := filepath.Join(imageUploadDir, fileName)
+	err := receiveUpload(body, dest, &up.received)
+	up.finish(dest, err)
+	if err != nil {
+		if errors.Is(err, errImageNotStandalone) {
+			writeErrorStatus(w, http.StatusUnprocessableEntity, fmt.Sprintf("Upload refused: %v", err))
+			return
+		}
+		errMsg := fmt.Sprintf("Upload failed: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Uploaded image %s (%d bytes)", dest, up.received.Load()))
+
+	if imgReq != nil {
+		img := Image{
+			Name:         imgReq.Name,
+			Kind:         imgReq.Kind,
+			Path:         dest,
+			Format:       imgReq.Format,
+			OSFamily:     imgReq.OSFamily,
+			DefaultLogin: imgReq.DefaultLogin,
+			MinDiskGB:    imgReq.MinDiskGB,
+			CreatedAt:    time.Now().UTC(),
+		}
+		if err := imageCatalog.add(img); err != nil {
+			errMsg := fmt.Sprintf("Uploaded to %s but failed to register image: %v", dest, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+	}
+
+	writeDataResponse(w, up.snapshot())
+}
+
+// handleGetUpload - GET /api/v1/images/uploads/{id}
+func handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	uploadsMu.Lock()
+	up, ok := uploads[r.PathValue("id")]
+	uploadsMu.Unlock()
+	if ok {
+		if scope, err := requestScope(r); err != nil || (!scope.all && up.snapshot().Project != scope.project) {
+			ok = false
+		}
+	}
+	if !ok {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Upload %q not found", r.PathValue("id")))
+		return
+	}
+	writeDataResponse(w, up.snapshot())
+}
+
+// receiveUpload streams body into dest via a temporary file, so a broken upload never
+// leaves a half-written image where a VM could pick it up, nor a qcow2 image naming a
+// backing or data file on the host. The file is linked into place rather than renamed,
+// so of two uploads to the same name only the first one lands.
+func receiveUpload(body io.Reader, dest string, received *atomic.Int64) error {
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return fmt.Errorf("failed to create image directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(countingWriter{w: tmp, n: received}, body); err != nil {
+		return fmt.Errorf("failed to receive upload: %v", err)
+	}
+	// CreateTemp makes the file 0600, QEMU needs to be able to read it
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := checkQcow2Standalone(tmp.Name()); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), dest); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists", dest)
+		}
+		return err
+	}
+	return nil
+}
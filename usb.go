@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// USB passthrough: a create's "usb_devices", or POST /api/v1/vm/{name}/usb on a running
+// VM, give it host USB devices such as license dongles or boards to flash. A device is
+// named by vendor:product, which keeps finding it when it's replugged, or by the bus and
+// device numbers lsusb shows, which tell apart two devices of the same model but change
+// on every replug.
+
+// USBDeviceSpec - a host USB device, either by Vendor and Product or by Bus and Device
+type USBDeviceSpec struct {
+	Vendor  string `json:"vendor,omitempty"`  // hex ID, e.g. "0529"
+	Product string `json:"product,omitempty"` // hex ID, e.g. "0001"
+	Bus     int    `json:"bus,omitempty"`
+	Device  int    `json:"device,omitempty"`
+}
+
+// USBDevice - a USB device as the template writes it: Vendor and Product as 0x-prefixed
+// IDs, or Bus and Device
+type USBDevice struct {
+	Vendor  string
+	Product string
+	Bus     int
+	Device  int
+}
+
+// String - "0529:0001" for vendor:product, "001.004" for bus and device, as
+// DELETE /api/v1/vm/{name}/usb/{device} takes it
+func (d USBDevice) String() string {
+	if d.Vendor != "" {
+		return strings.TrimPrefix(d.Vendor, "0x") + ":" + strings.TrimPrefix(d.Product, "0x")
+	}
+	return fmt.Sprintf("%03d.%03d", d.Bus, d.Device)
+}
+
+// spec - the device as the API gives it back
+func (d USBDevice) spec() USBDeviceSpec {
+	return USBDeviceSpec{Vendor: strings.TrimPrefix(d.Vendor, "0x"), Product: strings.TrimPrefix(d.Product, "0x"), Bus: d.Bus, Device: d.Device}
+}
+
+// resolve checks the spec names the device one way, and only one
+func (s USBDeviceSpec) resolve() (USBDevice, error) {
+	byID := s.Vendor != "" || s.Product != ""
+	byAddress := s.Bus != 0 || s.Device != 0
+	switch {
+	case byID && byAddress:
+		return USBDevice{}, fmt.Errorf("give vendor and product or bus and device, not both")
+	case byID:
+		vendor, err := parseUSBID(s.Vendor)
+		if err != nil {
+			return USBDevice{}, fmt.Errorf("vendor: %v", err)
+		}
+		product, err := parseUSBID(s.Product)
+		if err != nil {
+			return USBDevice{}, fmt.Errorf("product: %v", err)
+		}
+		return USBDevice{Vendor: vendor, Product: product}, nil
+	case s.Bus <= 0 || s.Device <= 0:
+		return USBDevice{}, fmt.Errorf("vendor and product, or bus and device, are required")
+	case s.Bus > 255 || s.Device > 127:
+		return USBDevice{}, fmt.Errorf("bus must be 1-255 and device 1-127")
+	}
+	return USBDevice{Bus: s.Bus, Device: s.Device}, nil
+}
+
+// parseUSBID parses a 16-bit hex vendor or product ID, with or without 0x
+func parseUSBID(s string) (string, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid USB ID %q, expected 4 hex digits such as 0529", s)
+	}
+	return fmt.Sprintf("0x%04x", id), nil
+}
+
+// parseUSBDevice parses the String form of a USB device
+func parseUSBDevice(s string) (USBDevice, error) {
+	if vendor, product, ok := strings.Cut(s, ":"); ok {
+		return USBDeviceSpec{Vendor: vendor, Product: product}.resolve()
+	}
+	if bus, device, ok := strings.Cut(s, "."); ok {
+		b, errB := strconv.Atoi(bus)
+		d, errD := strconv.Atoi(device)
+		if errB == nil && errD == nil {
+			return USBDeviceSpec{Bus: b, Device: d}.resolve()
+		}
+	}
+	return USBDevice{}, fmt.Errorf("invalid USB device %q, expected vendor:product (0529:0001) or bus.device (001.004)", s)
+}
+
+// resolveUSBDevices resolves the request's USB devices, refusing duplicates
+func resolveUSBDevices(specs []USBDeviceSpec) ([]USBDevice, error) {
+	devs := make([]USBDevice, len(specs))
+	seen := map[string]bool{}
+	for i, s := range specs {
+		d, err := s.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("usb device %d: %v", i, err)
+		}
+		if seen[d.String()] {
+			return nil, fmt.Errorf("usb device %d: %s is listed twice", i, d)
+		}
+		seen[d.String()] = true
+		devs[i] = d
+	}
+	return devs, nil
+}
+
+// domainUSBDevice - the USB device of a domain's <hostdev type='usb'>
+func domainUSBDevice(hd domainHostdevXML) (USBDevice, bool) {
+	if hd.Type != "usb" {
+		return USBDevice{}, false
+	}
+	if hd.Source.Vendor != nil && hd.Source.Product != nil {
+		d, err := USBDeviceSpec{Vendor: hd.Source.Vendor.ID, Product: hd.Source.Product.ID}.resolve()
+		return d, err == nil
+	}
+	if a := hd.Source.Address; a != nil {
+		bus, errB := strconv.Atoi(a.Bus)
+		device, errD := strconv.Atoi(a.Device)
+		return USBDevice{Bus: bus, Device: device}, errB == nil && errD == nil
+	}
+	return USBDevice{}, false
+}
+
+// usbHostdevXML - the <hostdev> element for a USB device, as the template writes it
+func usbHostdevXML(d USBDevice) string {
+	if d.Vendor != "" {
+		return fmt.Sprintf("<hostdev mode='subsystem' type='usb'><source><vendor id='%s'/><product id='%s'/></source></hostdev>", d.Vendor, d.Product)
+	}
+	return fmt.Sprintf("<hostdev mode='subsystem' type='usb'><source><address bus='%d' device='%d'/></source></hostdev>", d.Bus, d.Device)
+}
+
+// handleAttachUSB - POST /api/v1/vm/{name}/usb
+// Passes a host USB device through, hot-plugging it if the VM runs.
+func handleAttachUSB(w http.ResponseWriter, r *http.Request) {
+	var spec USBDeviceSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	dev, err := spec.resolve()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		for _, hd := range def.Devices.Hostdevs {
+			if d, ok := domainUSBDevice(hd); ok && d == dev {
+				writeErrorStatus(w, http.StatusConflict, fmt.Sprintf("VM %q already has USB device %s", name, dev))
+				return
+			}
+		}
+		flags, err := hostdevModifyFlags(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if err := dom.AttachDeviceFlags(usbHostdevXML(dev), flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to attach USB device %s: %v", dev, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Attached USB device %s to VM %s", dev, name))
+		writeDataResponse(w, dev.spec())
+	})
+}
+
+// handleDetachUSB - DELETE /api/v1/vm/{name}/usb/{device}
+// {device} is vendor:product or bus.device, as the device was attached by.
+func handleDetachUSB(w http.ResponseWriter, r *http.Request) {
+	dev, err := parseUSBDevice(r.PathValue("device"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		name := r.PathValue("name")
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		attached := false
+		for _, hd := range def.Devices.Hostdevs {
+			if d, ok := domainUSBDevice(hd); ok && d == dev {
+				attached = true
+			}
+		}
+		if !attached {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q has no USB device %s", name, dev))
+			return
+		}
+		flags, err := hostdevModifyFlags(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to get VM state: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		if err := dom.DetachDeviceFlags(usbHostdevXML(dev), flags); err != nil {
+			errMsg := fmt.Sprintf("Failed to detach USB device %s: %v", dev, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		requestLog(r).Info(fmt.Sprintf("Detached USB device %s from VM %s", dev, name))
+		writeSuccessResponse(w, fmt.Sprintf("USB device %s detached from VM %s", dev, name))
+	})
+}
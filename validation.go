@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// vmNamePattern - VM names become file names (disk volumes, seed ISOs, console logs) and
+// go into the domain XML, so they are kept to characters that are safe in both
+var vmNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// allowedPathDirs - the only directories host paths in requests (existing disks, ISOs,
+// base images, catalog images, conversion sources, export bundles and backup targets) may
+// be under, from VM_SERVICE_ALLOWED_PATHS (colon-separated). The image cache is always
+// allowed.
+var allowedPathDirs = loadAllowedPathDirs()
+
+// Caps on a single VM, from VM_SERVICE_MAX_MEMORY_MB, VM_SERVICE_MAX_CPUS and
+// VM_SERVICE_MAX_DISK_GB (per disk); 0 means no cap
+var (
+	maxVMMemoryMB, _ = strconv.Atoi(envOrDefault("VM_SERVICE_MAX_MEMORY_MB", "262144"))
+	maxVMCPUs, _     = strconv.Atoi(envOrDefault("VM_SERVICE_MAX_CPUS", "64"))
+	maxDiskGB, _     = strconv.Atoi(envOrDefault("VM_SERVICE_MAX_DISK_GB", "4096"))
+)
+
+func loadAllowedPathDirs() []string {
+	dirs := []string{filepath.Clean(imageCacheDir)}
+	for _, d := range strings.Split(envOrDefault("VM_SERVICE_ALLOWED_PATHS", "/var/lib/libvirt/images"), ":") {
+		if d = strings.TrimSpace(d); d != "" {
+			dirs = append(dirs, filepath.Clean(d))
+		}
+	}
+	return dirs
+}
+
+// validateVMName checks a VM name given in a request
+func validateVMName(name string) error {
+	if !vmNamePattern.MatchString(name) {
+		return fmt.Errorf("name %q must be 1-63 letters, digits, '.', '_' or '-', starting with a letter or digit", name)
+	}
+	return nil
+}
+
+// validatePath checks that a host path from a request is under one of allowedPathDirs.
+// When the path is on this machine its symlinks are resolved first, so a link in an
+// allowed directory can't point the guest at a file outside them.
+func validatePath(field, path string, local bool) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%s must be an absolute path", field)
+	}
+	resolved := filepath.Clean(path)
+	if local {
+		if real, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = real
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+	for _, dir := range allowedPathDirs {
+		if rel, err := filepath.Rel(dir, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %q is outside the allowed directories (%s)", field, path, strings.Join(allowedPathDirs, ", "))
+}
+
+// validateCreateLimits checks the VM's size against the configured caps
+func validateCreateLimits(req RequestData, specs []DiskSpec) error {
+	if maxVMMemoryMB > 0 && req.MemoryMB > maxVMMemoryMB {
+		return fmt.Errorf("memory_mb %d is over the maximum of %d", req.MemoryMB, maxVMMemoryMB)
+	}
+	if maxVMCPUs > 0 && req.CPUs > maxVMCPUs {
+		return fmt.Errorf("cpus %d is over the maximum of %d", req.CPUs, maxVMCPUs)
+	}
+	for i, s := range specs {
+		if maxDiskGB > 0 && s.SizeGB > maxDiskGB {
+			return fmt.Errorf("disk %d: size_gb %d is over the maximum of %d", i, s.SizeGB, maxDiskGB)
+		}
+	}
+	return nil
+}
+
+// validateCreatePaths checks every host path the create request attaches to the guest
+func validateCreatePaths(req RequestData, specs []DiskSpec) error {
+	local := isLocalHost(req.Host)
+	if req.ISOImage != "" {
+		if err := validatePath("iso_image", req.ISOImage, local); err != nil {
+			return err
+		}
+	}
+	for i, s := range specs {
+		if s.Path != "" {
+			if err := validatePath(fmt.Sprintf("disk %d: path", i), s.Path, local); err != nil {
+				return err
+			}
+		}
+		if s.BackingFile != "" {
+			if err := validatePath("base_image", s.BackingFile, local); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The REST API is versioned by path prefix. Every route is registered once, under
+// /api/v1, and withAPIVersion serves /api/v2 from the same handlers; a handler whose
+// answer differs between the versions looks at apiVersion(r). Changes that would break
+// existing automation go into v2 only, e.g. v2 creates take disks only through the
+// disks array. v1 keeps working but is deprecated, and says so in its headers.
+
+const (
+	apiV1Prefix = "/api/v1"
+	apiV2Prefix = "/api/v2"
+)
+
+// v1DeprecatedAt - when v2 was introduced, sent as v1's Deprecation header
+var v1DeprecatedAt = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+// v1Sunset - when v1 is going away, set with VM_SERVICE_V1_SUNSET (YYYY-MM-DD). Until
+// that is decided no Sunset header is sent.
+var v1Sunset time.Time
+
+type apiVersionKey struct{}
+
+// loadAPIVersioning reads the v1 sunset date
+func loadAPIVersioning() error {
+	s := envOrDefault("VM_SERVICE_V1_SUNSET", "")
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return fmt.Errorf("VM_SERVICE_V1_SUNSET must be a YYYY-MM-DD date: %v", err)
+	}
+	v1Sunset = t
+	return nil
+}
+
+// withAPIVersion serves /api/v2 paths from the /api/v1 routes, rewriting the path before
+// anything else looks at it, and sends the deprecation headers on v1 answers
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := r.URL.Path; {
+		case path == apiV2Prefix || strings.HasPrefix(path, apiV2Prefix+"/"):
+			r = r.Clone(context.WithValue(r.Context(), apiVersionKey{}, 2))
+			r.URL.Path = apiV1Prefix + strings.TrimPrefix(path, apiV2Prefix)
+			if r.URL.RawPath != "" {
+				r.URL.RawPath = apiV1Prefix + strings.TrimPrefix(r.URL.RawPath, apiV2Prefix)
+			}
+			w = &versionedWriter{ResponseWriter: w}
+		case path == apiV1Prefix || strings.HasPrefix(path, apiV1Prefix+"/"):
+			h := w.Header()
+			h.Set("Deprecation", fmt.Sprintf("@%d", v1DeprecatedAt.Unix()))
+			if !v1Sunset.IsZero() {
+				h.Set("Sunset", v1Sunset.Format(http.TimeFormat))
+			}
+			h.Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", apiV2Prefix+strings.TrimPrefix(r.URL.EscapedPath(), apiV1Prefix)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiVersion - the API version a request came in on; requests made inside the service
+// that don't go through withAPIVersion count as v1
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return 1
+}
+
+// apiPath turns an /api/v1 path into the one for the version r came in on, for URLs
+// handed back to the client
+func apiPath(r *http.Request, path string) string {
+	if apiVersion(r) == 2 && strings.HasPrefix(path, apiV1Prefix) {
+		return apiV2Prefix + strings.TrimPrefix(path, apiV1Prefix)
+	}
+	return path
+}
+
+// versionedWriter points a Location header set by a handler at the v2 path. It passes
+// Hijack and Flush through like statusRecorder.
+type versionedWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (v *versionedWriter) WriteHeader(code int) {
+	if !v.wroteHeader {
+		v.wroteHeader = true
+		h := v.Header()
+		if loc := h.Get("Location"); strings.HasPrefix(loc, apiV1Prefix+"/") {
+			h.Set("Location", apiV2Prefix+strings.TrimPrefix(loc, apiV1Prefix))
+		}
+	}
+	v.ResponseWriter.WriteHeader(code)
+}
+
+func (v *versionedWriter) Write(b []byte) (int, error) {
+	if !v.wroteHeader {
+		v.WriteHeader(http.StatusOK)
+	}
+	return v.ResponseWriter.Write(b)
+}
+
+func (v *versionedWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (v *versionedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := v.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer cannot be hijacked")
+	}
+	return hj.Hijack()
+}
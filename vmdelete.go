@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// DeletedVM - one VM of a bulk delete, and what was (or would be) removed with it
+type DeletedVM struct {
+	Name    string   `json:"name" pb:"1"`
+	Volumes []string `json:"volumes,omitempty" pb:"2"`
+	Deleted bool     `json:"deleted" pb:"3"`
+	Error   string   `json:"error,omitempty" pb:"4"`
+}
+
+// handleBulkDeleteVMs - DELETE /api/v1/vm?selector=&prefix=[&dry_run=true][&host=]
+//
+// Deletes every VM of the caller's on the host whose labels match the selector (see
+// parseLabelSelector) and whose name starts with the prefix; at least one of the two is
+// required. Running VMs are powered off. The volumes the service created for a VM go
+// with it, as do its cloud-init seed, DHCP reservations, port forwards, snapshot policy
+// and disk secret if no other VM shares it; disks that were attached by path are left
+// alone. With dry_run the VMs are only listed.
+func handleBulkDeleteVMs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	var selector labelSelector
+	if s := q.Get("selector"); s != "" {
+		var err error
+		if selector, err = parseLabelSelector(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if selector == nil && prefix == "" {
+		http.Error(w, "selector or prefix is required", http.StatusBadRequest)
+		return
+	}
+	dryRun := q.Get("dry_run") == "true"
+
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to list domains: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+
+	results := []DeletedVM{}
+	for i := range doms {
+		dom := &doms[i]
+		name, err := dom.GetName()
+		if err != nil || !scope.ownsDomain(dom) || !strings.HasPrefix(scope.vmName(name), prefix) {
+			continue
+		}
+		if selector != nil && !selector.matches(domainLabels(dom)) {
+			continue
+		}
+		res := DeletedVM{Name: scope.vmName(name)}
+		def, err := readDomainDef(dom)
+		if err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.Volumes = ownedVolumes(conn, def)
+		if !dryRun {
+			if err := deleteVM(requestLog(r), conn, dom, def); err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Deleted = true
+				forgetVM(requestHost(r), def.Name)
+			}
+		}
+		results = append(results, res)
+	}
+	if !dryRun {
+		requestLog(r).Info(fmt.Sprintf("Bulk delete (selector=%q prefix=%q) removed %d VMs", q.Get("selector"), prefix, len(results)))
+	}
+	writeDataResponse(w, results)
+}
+
+// handleDeleteVM - DELETE /api/v1/vm/{name}
+// Deletes one VM, with what the service created for it, as the bulk delete does
+func handleDeleteVM(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		res := DeletedVM{Name: r.PathValue("name"), Volumes: ownedVolumes(conn, def)}
+		if err := deleteVM(requestLog(r), conn, dom, def); err != nil {
+			errMsg := fmt.Sprintf("Failed to delete VM %s: %v", res.Name, err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		res.Deleted = true
+		forgetVM(requestHost(r), def.Name)
+		requestLog(r).Info(fmt.Sprintf("Deleted VM %s", def.Name))
+		writeDataResponse(w, res)
+	})
+}
+
+// ownedVolumes - paths of the VM's disks that are volumes the service made for it:
+// newVolumeName volumes and its seed ISO, in any pool
+func ownedVolumes(conn *libvirt.Connect, def domainDefXML) []string {
+	var paths []string
+	for _, disk := range def.Devices.Disks {
+		path := disk.sourcePath()
+		if disk.Type == "network" {
+			if disk.Source.Protocol != "rbd" {
+				continue
+			}
+			// libvirt knows rbd volumes by "<ceph pool>/<image>"
+			path = disk.Source.Name
+		}
+		if path == "" {
+			continue
+		}
+		if ownsVolumeName(def.Name, filepath.Base(path)) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ownsVolumeName says whether a volume name is one newVolumeName or the seed ISO gives
+// the VM's volumes
+func ownsVolumeName(vmName, volName string) bool {
+	if volName == vmName+"-seed.iso" {
+		return true
+	}
+	pattern := `^` + regexp.QuoteMeta(vmName) + `(-disk[0-9]+)?\.(qcow2|raw)$`
+	return regexp.MustCompile(pattern).MatchString(volName)
+}
+
+// deleteVM powers the VM off, undefines it and removes what the service made for it
+// (see handleBulkDeleteVMs). Failures to remove the leftovers are logged; the VM itself
+// is gone once the undefine succeeds.
+func deleteVM(logger *slog.Logger, conn *libvirt.Connect, dom *libvirt.Domain, def domainDefXML) error {
+	if active, err := dom.IsActive(); err == nil && active {
+		if err := dom.Destroy(); err != nil {
+			return fmt.Errorf("failed to power off: %v", err)
+		}
+	}
+
+	flags := libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE | libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA |
+		libvirt.DOMAIN_UNDEFINE_CHECKPOINTS_METADATA | libvirt.DOMAIN_UNDEFINE_NVRAM
+	if err := dom.UndefineFlags(flags); err != nil {
+		return fmt.Errorf("failed to undefine: %v", err)
+	}
+	logger.Info(fmt.Sprintf("Deleted VM %s", def.Name))
+	if len(def.Devices.TPMs) > 0 {
+		removeTPMState(def.UUID)
+	}
+
+	for _, path := range ownedVolumes(conn, def) {
+		vol, err := conn.LookupStorageVolByPath(path)
+		if err != nil {
+			// Seeds on this host are plain files outside any pool
+			if filepath.Dir(path) == filepath.Clean(cloudInitDir) {
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					logger.Error(fmt.Sprintf("Failed to remove %s: %v", path, err))
+				}
+			} else {
+				logger.Error(fmt.Sprintf("Failed to look up volume %s for cleanup: %v", path, err))
+			}
+			continue
+		}
+		if err := vol.Delete(0); err != nil {
+			logger.Error(fmt.Sprintf("Failed to remove volume %s: %v", path, err))
+		}
+		vol.Free()
+	}
+
+	secrets := map[string]bool{}
+	for _, disk := range def.Devices.Disks {
+		if disk.Encryption != nil && disk.Encryption.Secret.UUID != "" && !secrets[disk.Encryption.Secret.UUID] {
+			secrets[disk.Encryption.Secret.UUID] = true
+			removeDiskSecret(logger, conn, disk.Encryption.Secret.UUID)
+		}
+	}
+
+	for _, iface := range def.Devices.Interfaces {
+		if iface.Type == "network" {
+			removeDHCPHostsFor(logger, conn, iface.Source.Network, def.Name, iface.MAC.Address)
+		}
+	}
+
+	if err := removeVMPortForwards(def.Name); err != nil {
+		logger.Error(fmt.Sprintf("Failed to remove port forwards of %s: %v", def.Name, err))
+	}
+	if _, err := snapshotPolicies.remove(def.Name); err != nil {
+		logger.Error(fmt.Sprintf("Failed to remove snapshot policy of %s: %v", def.Name, err))
+	}
+	return nil
+}
+
+// removeDHCPHostsFor drops the network's DHCP reservations for the VM's MAC
+func removeDHCPHostsFor(logger *slog.Logger, conn *libvirt.Connect, network, vmName, mac string) {
+	netw, err := conn.LookupNetworkByName(network)
+	if err != nil {
+		return
+	}
+	desc, err := netw.GetXMLDesc(0)
+	netw.Free()
+	if err != nil {
+		return
+	}
+	var doc networkXML
+	if err := xml.Unmarshal([]byte(desc), &doc); err != nil {
+		return
+	}
+	for _, ip := range doc.IPs {
+		if ip.DHCP == nil {
+			continue
+		}
+		for _, h := range ip.DHCP.Hosts {
+			if !strings.EqualFold(h.MAC, mac) {
+				continue
+			}
+			// dhcpHostXML takes the address as CIDR and drops the prefix
+			if err := removeDHCPHost(conn, network, h.Name, h.MAC, h.IP+"/32"); err != nil {
+				logger.Error(fmt.Sprintf("Failed to remove DHCP reservation of %s on %s: %v", vmName, network, err))
+			}
+		}
+	}
+}
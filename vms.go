@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// domainDefXML - the parts of a live domain definition we read back
+type domainDefXML struct {
+	XMLName xml.Name `xml:"domain"`
+	Name    string   `xml:"name"`
+	UUID    string   `xml:"uuid"`
+	// Memory - KiB, with any hot-added DIMMs
+	Memory    uint64              `xml:"memory"`
+	MaxMemory *domainMaxMemoryXML `xml:"maxMemory"`
+	CPU       struct {
+		NUMA struct {
+			Cells []struct {
+				ID int `xml:"id,attr"`
+			} `xml:"cell"`
+		} `xml:"numa"`
+	} `xml:"cpu"`
+	Devices struct {
+		Disks      []domainDiskXML      `xml:"disk"`
+		Interfaces []domainInterfaceXML `xml:"interface"`
+		Channels   []domainChannelXML   `xml:"channel"`
+		Hostdevs   []domainHostdevXML   `xml:"hostdev"`
+		Graphics   []domainGraphicsXML  `xml:"graphics"`
+		Serials    []domainSerialXML    `xml:"serial"`
+		TPMs       []domainTPMXML       `xml:"tpm"`
+		Memballoon *domainMemballoonXML `xml:"memballoon"`
+		// MemoryDevices - DIMMs and other memory modules
+		MemoryDevices []domainMemoryDeviceXML `xml:"memory"`
+	} `xml:"devices"`
+	CPUTune struct {
+		VCPUPins     []cpusetXML `xml:"vcpupin"`
+		EmulatorPin  *cpusetXML  `xml:"emulatorpin"`
+		IOThreadPins []cpusetXML `xml:"iothreadpin"`
+	} `xml:"cputune"`
+}
+
+type cpusetXML struct {
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type domainInterfaceXML struct {
+	Type string `xml:"type,attr"`
+	MAC  struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Network string         `xml:"network,attr"`
+		Bridge  string         `xml:"bridge,attr"`
+		Dev     string         `xml:"dev,attr"`
+		Mode    string         `xml:"mode,attr"`
+		Address *pciAddressXML `xml:"address"` // type='hostdev'
+	} `xml:"source"`
+}
+
+type domainHostdevXML struct {
+	Type   string `xml:"type,attr"`
+	Source struct {
+		Address *hostdevAddressXML `xml:"address"`
+		// type='usb' by vendor:product
+		Vendor  *usbIDXML `xml:"vendor"`
+		Product *usbIDXML `xml:"product"`
+	} `xml:"source"`
+}
+
+// hostdevAddressXML - a PCI address, or for type='usb' the bus and device number
+type hostdevAddressXML struct {
+	pciAddressXML
+	Device string `xml:"device,attr"`
+}
+
+type usbIDXML struct {
+	ID string `xml:"id,attr"`
+}
+
+type domainDiskXML struct {
+	Type   string `xml:"type,attr"`
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File     string `xml:"file,attr"`
+		Dev      string `xml:"dev,attr"`
+		Protocol string `xml:"protocol,attr"`
+		Name     string `xml:"name,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+	Encryption *struct {
+		Format string `xml:"format,attr"`
+		Secret struct {
+			UUID string `xml:"uuid,attr"`
+		} `xml:"secret"`
+	} `xml:"encryption"`
+}
+
+type domainChannelXML struct {
+	Target struct {
+		Name  string `xml:"name,attr"`
+		State string `xml:"state,attr"` // only in the live XML: "connected" or "disconnected"
+	} `xml:"target"`
+}
+
+// guestAgentChannel - name of the virtio channel the QEMU guest agent listens on
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+// guestAgentConnected says whether the guest agent is running in the guest, going by
+// the channel state libvirt reports in the live XML
+func (def domainDefXML) guestAgentConnected() bool {
+	for _, ch := range def.Devices.Channels {
+		if ch.Target.Name == guestAgentChannel && ch.Target.State == "connected" {
+			return true
+		}
+	}
+	return false
+}
+
+// usesSecret - whether any of the domain's disks is encrypted with the secret
+func (def domainDefXML) usesSecret(secretUUID string) bool {
+	for _, disk := range def.Devices.Disks {
+		if disk.Encryption != nil && disk.Encryption.Secret.UUID == secretUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// sourcePath - what the disk points at, whatever its type
+func (d domainDiskXML) sourcePath() string {
+	switch {
+	case d.Source.File != "":
+		return d.Source.File
+	case d.Source.Dev != "":
+		return d.Source.Dev
+	case d.Source.Name != "":
+		return d.Source.Protocol + ":" + d.Source.Name
+	}
+	return ""
+}
+
+// Patterns for rewriting domain XML as libvirt formats it, see setDomainName and friends
+var (
+	domainNamePattern = regexp.MustCompile(`<name>[^<]*</name>`)
+	domainUUIDPattern = regexp.MustCompile(`\s*<uuid>[^<]*</uuid>`)
+	macAddressPattern = regexp.MustCompile(`<mac address='([^']*)'/>`)
+	logFilePattern    = regexp.MustCompile(`<log file='[^']*'`)
+	nvramPattern      = regexp.MustCompile(`<nvram([^>]*)>[^<]*</nvram>`)
+)
+
+var domainStateNames = map[libvirt.DomainState]string{
+	libvirt.DOMAIN_NOSTATE:     "nostate",
+	libvirt.DOMAIN_RUNNING:     "running",
+	libvirt.DOMAIN_BLOCKED:     "blocked",
+	libvirt.DOMAIN_PAUSED:      "paused",
+	libvirt.DOMAIN_SHUTDOWN:    "shutdown",
+	libvirt.DOMAIN_SHUTOFF:     "shutoff",
+	libvirt.DOMAIN_CRASHED:     "crashed",
+	libvirt.DOMAIN_PMSUSPENDED: "pmsuspended",
+}
+
+// DiskUsage - virtual vs. actual size of one VM disk
+type DiskUsage struct {
+	Target         string `json:"target"`
+	Source         string `json:"source"`
+	Format         string `json:"format"`
+	VirtualBytes   uint64 `json:"virtual_bytes"`   // size the guest sees
+	AllocatedBytes uint64 `json:"allocated_bytes"` // host storage actually in use
+	PhysicalBytes  uint64 `json:"physical_bytes"`  // size of the file/device on the host
+}
+
+// VMInfo - summary of one VM, as listed
+type VMInfo struct {
+	Name     string `json:"name" pb:"1"`
+	Project  string `json:"project,omitempty" pb:"2"`
+	Host     string `json:"host" pb:"3"`
+	UUID     string `json:"uuid" pb:"4"`
+	State    string `json:"state" pb:"5"`
+	CPUs     int    `json:"cpus" pb:"6"`
+	MemoryMB uint64 `json:"memory_mb" pb:"7"`
+
+	Labels      map[string]string `json:"labels,omitempty" pb:"8"`
+	Annotations map[string]string `json:"annotations,omitempty" pb:"9"`
+}
+
+// describeVM summarises the domain, under the name scope knows it by
+func describeVM(scope tenantScope, host string, dom *libvirt.Domain) (VMInfo, error) {
+	name, err := dom.GetName()
+	if err != nil {
+		return VMInfo{}, err
+	}
+	id, err := dom.GetUUIDString()
+	if err != nil {
+		return VMInfo{}, err
+	}
+	info, err := dom.GetInfo()
+	if err != nil {
+		return VMInfo{}, err
+	}
+	return VMInfo{
+		Name:     scope.vmName(name),
+		Project:  domainProject(dom),
+		Host:     hostName(host),
+		UUID:     id,
+		State:    domainStateNames[info.State],
+		CPUs:     int(info.NrVirtCpu),
+		MemoryMB: info.MaxMem / 1024, // KiB
+
+		Labels:      domainLabels(dom),
+		Annotations: domainAnnotations(dom),
+	}, nil
+}
+
+// handleListVMs - GET /api/v1/vm[?host=&state=&label=&name-prefix=&sort=&limit=&offset=]
+// Lists the VMs on the host, only the caller's project's if it is in one. label is a
+// selector as for bulk delete; sort is name, state, cpus or memory_mb, with a leading
+// "-" for descending order (default name). Without limit every VM is returned; the
+// X-Total-Count header has the number matching before limit and offset.
+func handleListVMs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state, prefix := q.Get("state"), q.Get("name-prefix")
+	var selector labelSelector
+	if v := q.Get("label"); v != "" {
+		var err error
+		if selector, err = parseLabelSelector(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sortKey := q.Get("sort")
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	if !vmSortKeys[strings.TrimPrefix(sortKey, "-")] {
+		http.Error(w, fmt.Sprintf("sort must be one of name, state, cpus or memory_mb, optionally with a leading -, not %q", sortKey), http.StatusBadRequest)
+		return
+	}
+	limit, offset := -1, 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to list domains: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer func() {
+		for i := range doms {
+			doms[i].Free()
+		}
+	}()
+	vms := []VMInfo{}
+	for i := range doms {
+		if !scope.ownsDomain(&doms[i]) {
+			continue
+		}
+		vm, err := describeVM(scope, requestHost(r), &doms[i])
+		if err != nil {
+			// Domains can be undefined between listing and describing
+			continue
+		}
+		if (state != "" && vm.State != state) || !strings.HasPrefix(vm.Name, prefix) {
+			continue
+		}
+		if selector != nil && !selector.matches(vm.Labels) {
+			continue
+		}
+		vms = append(vms, vm)
+	}
+
+	sortVMs(vms, sortKey)
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(vms)))
+	vms = vms[min(offset, len(vms)):]
+	if limit >= 0 && limit < len(vms) {
+		vms = vms[:limit]
+	}
+	writeDataResponse(w, vms)
+}
+
+// maxListLimit - the largest page GET /api/v1/vm hands out
+const maxListLimit = 1000
+
+var vmSortKeys = map[string]bool{"name": true, "state": true, "cpus": true, "memory_mb": true}
+
+// sortVMs orders the list by key, descending if it starts with "-". Ties go by name, so
+// pages stay stable between requests.
+func sortVMs(vms []VMInfo, key string) {
+	key, desc := strings.CutPrefix(key, "-")
+	sort.SliceStable(vms, func(i, j int) bool {
+		a, b := vms[i], vms[j]
+		if desc {
+			a, b = b, a
+		}
+		switch key {
+		case "state":
+			if a.State != b.State {
+				return a.State < b.State
+			}
+		case "cpus":
+			if a.CPUs != b.CPUs {
+				return a.CPUs < b.CPUs
+			}
+		case "memory_mb":
+			if a.MemoryMB != b.MemoryMB {
+				return a.MemoryMB < b.MemoryMB
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+// handleGetVM - GET /api/v1/vm/{name}
+func handleGetVM(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		scope, _ := requestScope(r)
+		vm, err := describeVM(scope, requestHost(r), dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to describe VM: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+		writeDataResponse(w, vm)
+	})
+}
+
+// handleGetVMDisks - GET /api/v1/vm/{name}/disks
+// Reports how much of each thin disk is really allocated, e.g. to check that guest
+// fstrim with discard=unmap actually gives space back.
+func handleGetVMDisks(w http.ResponseWriter, r *http.Request) {
+	withDomain(w, r, func(conn *libvirt.Connect, dom *libvirt.Domain) {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			errMsg := fmt.Sprintf("Failed to read domain XML: %v", err)
+			requestLog(r).Error(errMsg)
+			writeErrorResponse(w, errMsg)
+			return
+		}
+
+		usage := []DiskUsage{}
+		for _, disk := range def.Devices.Disks {
+			if disk.Device != "disk" {
+				continue
+			}
+			info, err := dom.GetBlockInfo(disk.Target.Dev, 0)
+			if err != nil {
+				errMsg := fmt.Sprintf("Failed to get block info for %s: %v", disk.Target.Dev, err)
+				requestLog(r).Error(errMsg)
+				writeErrorResponse(w, errMsg)
+				return
+			}
+			usage = append(usage, DiskUsage{
+				Target:         disk.Target.Dev,
+				Source:         disk.sourcePath(),
+				Format:         disk.Driver.Type,
+				VirtualBytes:   info.Capacity,
+				AllocatedBytes: info.Allocation,
+				PhysicalBytes:  info.Physical,
+			})
+		}
+		writeDataResponse(w, usage)
+	})
+}
+
+// withDomain connects to libvirt, looks up the domain named in the URL and hands it
+// (and the connection) to fn, answering 404 if it does not exist or belongs to another
+// project than the caller's.
+func withDomain(w http.ResponseWriter, r *http.Request, fn func(conn *libvirt.Connect, dom *libvirt.Domain)) {
+	scope, err := requestScope(r)
+	if err != nil {
+		writeErrorStatus(w, http.StatusForbidden, err.Error())
+		return
+	}
+	name := r.PathValue("name")
+
+	conn, err := connectHost(requestHost(r))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to connect libvirt: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer conn.Close()
+
+	dom, err := conn.LookupDomainByName(scope.domainName(name))
+	if err != nil {
+		if isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN) {
+			writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q not found", name))
+			return
+		}
+		errMsg := fmt.Sprintf("Failed to look up VM %q: %v", name, err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	defer dom.Free()
+	if !scope.ownsDomain(dom) {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("VM %q not found", name))
+		return
+	}
+
+	fn(conn, dom)
+}
+
+// creatingVMs - names of VMs being created, which another request can't take until the
+// domain is defined (and the existence check sees it) or the creation fails
+var creatingVMs = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// reserveVMName claims the name for a creation, false if another one has it
+func reserveVMName(name string) (release func(), ok bool) {
+	creatingVMs.Lock()
+	defer creatingVMs.Unlock()
+	if creatingVMs.names[name] {
+		return nil, false
+	}
+	creatingVMs.names[name] = true
+	return func() {
+		creatingVMs.Lock()
+		defer creatingVMs.Unlock()
+		delete(creatingVMs.names, name)
+	}, true
+}
+
+// domainExists says whether a domain with the name is defined on the host
+func domainExists(host, name string) (bool, error) {
+	conn, err := connectHost(host)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	dom, err := conn.LookupDomainByName(name)
+	if err != nil {
+		if isLibvirtErrorCode(err, libvirt.ERR_NO_DOMAIN) {
+			return false, nil
+		}
+		return false, err
+	}
+	dom.Free()
+	return true, nil
+}
+
+// readDomainDef fetches and parses the domain's current XML definition
+func readDomainDef(dom *libvirt.Domain) (domainDefXML, error) {
+	var def domainDefXML
+	desc, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return def, err
+	}
+	return parseDomainDef(desc)
+}
+
+// parseDomainDef parses a domain XML document
+func parseDomainDef(desc string) (domainDefXML, error) {
+	var def domainDefXML
+	err := xml.Unmarshal([]byte(desc), &def)
+	return def, err
+}
+
+// domainState - the domain's state as one of the domainStateNames
+func domainState(dom *libvirt.Domain) (string, error) {
+	state, _, err := dom.GetState()
+	if err != nil {
+		return "", err
+	}
+	return domainStateNames[state], nil
+}
+
+// setDomainName replaces the domain's own <name>, the first one in the document
+func setDomainName(desc, name string) string {
+	var nameBuf bytes.Buffer
+	_ = xml.EscapeText(&nameBuf, []byte(name))
+	replaced := false
+	return domainNamePattern.ReplaceAllStringFunc(desc, func(m string) string {
+		if replaced {
+			return m
+		}
+		replaced = true
+		return "<name>" + nameBuf.String() + "</name>"
+	})
+}
+
+// stripDomainUUID removes the <uuid> so libvirt generates a new one on define
+func stripDomainUUID(desc string) string {
+	return domainUUIDPattern.ReplaceAllString(desc, "")
+}
+
+// replaceMACs swaps every MAC address that match accepts for a freshly generated one that
+// is not in used (MAC -> domain, see hostMACs); the new MACs are added to used for owner
+func replaceMACs(desc string, used map[string]string, owner string, match func(mac string) bool) string {
+	return macAddressPattern.ReplaceAllStringFunc(desc, func(m string) string {
+		if !match(macAddressPattern.FindStringSubmatch(m)[1]) {
+			return m
+		}
+		return fmt.Sprintf("<mac address='%s'/>", uniqueMAC(used, owner))
+	})
+}
+
+// replaceConsoleLog points the serial console log at the file for VM name
+func replaceConsoleLog(desc, name string) string {
+	var pathBuf bytes.Buffer
+	_ = xml.EscapeText(&pathBuf, []byte(consoleLogPath(name)))
+	return logFilePattern.ReplaceAllLiteralString(desc, "<log file='"+pathBuf.String()+"'")
+}
+
+// replaceDiskSources points disks at new paths, keyed by their current file or dev source
+func replaceDiskSources(desc string, sources map[string]string) string {
+	for oldPath, newPath := range sources {
+		for _, attr := range []string{"file", "dev"} {
+			desc = strings.ReplaceAll(desc,
+				fmt.Sprintf("<source %s='%s'", attr, oldPath),
+				fmt.Sprintf("<source %s='%s'", attr, newPath))
+		}
+	}
+	return desc
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// webhookEvents - the events a webhook can subscribe to
+var webhookEvents = map[string]bool{"created": true, "started": true, "stopped": true, "crashed": true, "deleted": true}
+
+// Delivery is retried with backoff this many times before it is given up on
+const (
+	webhookAttempts = 4
+	webhookTimeout  = 10 * time.Second
+)
+
+// Webhook - an HTTP endpoint notified of VM lifecycle events. Each delivery is a JSON
+// POST carrying X-Webhook-Timestamp and X-Webhook-Signature headers; the signature is
+// "sha256=" and the hex HMAC-SHA256, keyed with the secret, of "<timestamp>.<body>".
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`           // empty means all of them
+	Secret    string    `json:"secret,omitempty"` // only shown when the webhook is created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookRequest - body of POST /api/v1/webhooks
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"` // generated if empty
+}
+
+// WebhookPayload - what is POSTed to a webhook
+type WebhookPayload struct {
+	ID     string    `json:"id"` // unique per delivery, the same across retries
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Host   string    `json:"host"`
+	VM     string    `json:"vm"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// webhookStore - webhooks by ID, persisted as JSON in the state directory. The file holds
+// the signing secrets, so it is written readable by the service only.
+type webhookStore struct {
+	mu    sync.Mutex
+	path  string
+	hooks map[string]*Webhook
+}
+
+var webhooks = &webhookStore{
+	path:  filepath.Join(stateDir, "webhooks.json"),
+	hooks: map[string]*Webhook{},
+}
+
+// load reads the webhooks file; a missing file means no webhooks
+func (s *webhookStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var hooks []*Webhook
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	for _, h := range hooks {
+		s.hooks[h.ID] = h
+	}
+	return nil
+}
+
+// saveLocked writes the webhooks atomically; s.mu must be held
+func (s *webhookStore) saveLocked() error {
+	content, err := json.MarshalIndent(s.listLocked(true), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// listLocked returns the webhooks oldest first, with their secrets if withSecrets
+func (s *webhookStore) listLocked(withSecrets bool) []Webhook {
+	out := []Webhook{}
+	for _, h := range s.hooks {
+		c := *h
+		if !withSecrets {
+			c.Secret = ""
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (s *webhookStore) list(withSecrets bool) []Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked(withSecrets)
+}
+
+func (s *webhookStore) add(h Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[h.ID] = &h
+	return s.saveLocked()
+}
+
+func (s *webhookStore) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.hooks[id]; !ok {
+		return false, nil
+	}
+	delete(s.hooks, id)
+	return true, s.saveLocked()
+}
+
+// handleListWebhooks - GET /api/v1/webhooks
+func handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeDataResponse(w, webhooks.list(false))
+}
+
+// handleCreateWebhook - POST /api/v1/webhooks
+// The response is the only place the secret is returned.
+func handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		requestLog(r).Warn("Error decoding JSON", "error", err)
+		http.Error(w, "Invalid JSON input", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		msg := fmt.Sprintf("Missing/invalid request fields: %v", err)
+		requestLog(r).Warn(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	h := Webhook{
+		ID:        uuid.New().String(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if h.Events == nil {
+		h.Events = []string{}
+	}
+	if h.Secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			writeErrorResponse(w, fmt.Sprintf("Failed to generate secret: %v", err))
+			return
+		}
+		h.Secret = hex.EncodeToString(buf)
+	}
+	if err := webhooks.add(h); err != nil {
+		errMsg := fmt.Sprintf("Failed to save webhooks: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	requestLog(r).Info(fmt.Sprintf("Added webhook %s for %s", h.ID, h.URL))
+	writeDataResponse(w, h)
+}
+
+// handleDeleteWebhook - DELETE /api/v1/webhooks/{id}
+func handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	removed, err := webhooks.remove(r.PathValue("id"))
+	if err != nil {
+		errMsg := fmt.Sprintf("Failed to save webhooks: %v", err)
+		requestLog(r).Error(errMsg)
+		writeErrorResponse(w, errMsg)
+		return
+	}
+	if !removed {
+		writeErrorStatus(w, http.StatusNotFound, fmt.Sprintf("Webhook %q not found", r.PathValue("id")))
+		return
+	}
+	writeSuccessResponse(w, fmt.Sprintf("Webhook %s removed", r.PathValue("id")))
+}
+
+func (req WebhookRequest) validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	for _, e := range req.Events {
+		if !webhookEvents[e] {
+			return fmt.Errorf("unknown event %q, expected created, started, stopped, crashed or deleted", e)
+		}
+	}
+	return nil
+}
+
+// webhookEvent maps a lifecycle event onto the webhook event it triggers, if any
+func webhookEvent(ev VMEvent) string {
+	switch {
+	case ev.Type == "defined" && ev.Reason == "added":
+		return "created"
+	case ev.Type == "undefined" && ev.Reason == "removed":
+		return "deleted"
+	case ev.Type == "started" || ev.Type == "stopped" || ev.Type == "crashed":
+		return ev.Type
+	}
+	return ""
+}
+
+func (h *Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// runWebhookDispatcher delivers lifecycle events to the webhooks subscribed to them.
+// It never returns.
+func runWebhookDispatcher() {
+	ch, _ := subscribeEvents(0)
+	for ev := range ch {
+		event := webhookEvent(ev)
+		if event == "" {
+			continue
+		}
+		payload := WebhookPayload{
+			ID:     uuid.New().String(),
+			Event:  event,
+			Time:   ev.Time,
+			Host:   ev.Host,
+			VM:     ev.VM,
+			Reason: ev.Reason,
+		}
+		for _, h := range webhooks.list(true) {
+			if h.wants(event) {
+				go deliverWebhook(h, payload)
+			}
+		}
+	}
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// deliverWebhook POSTs the payload, retrying with exponential backoff (1s, 4s, 16s) on
+// network errors and non-2xx responses
+func deliverWebhook(h Webhook, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Webhook %s: %v", h.ID, err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(h, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Webhook %s: giving up on %s event for VM %s after %d attempts: %v", h.ID, payload.Event, payload.VM, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 4
+	}
+}
+
+func postWebhook(h Webhook, body []byte) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", h.URL, resp.Status)
+	}
+	return nil
+}
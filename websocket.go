@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Minimal RFC 6455 server side, enough to carry console byte streams to browsers
+
+// websocketGUID - the fixed key suffix from RFC 6455 section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebsocketMessage - largest message accepted from a client
+const maxWebsocketMessage = 1 << 20
+
+// Websocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsConn - an upgraded websocket connection. Reads must come from one goroutine;
+// writes may come from several.
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// upgradeWebsocket answers the websocket handshake on r and takes over the connection.
+// If the client offers one of protocols (e.g. "binary" for noVNC) it is selected.
+// On failure an HTTP error has already been written.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request, protocols ...string) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "Expected a websocket upgrade", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	var protocol string
+	for _, p := range protocols {
+		if headerContains(r.Header, "Sec-WebSocket-Protocol", p) {
+			protocol = p
+			break
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Websockets are not supported here", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response writer cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// headerContains says whether a comma-separated header has token (case-insensitively)
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, part := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message, answering pings along the way.
+// It returns io.EOF once the client closes the connection.
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			_ = c.writeFrame(wsClose, payload)
+			return nil, io.EOF
+		}
+		msg = append(msg, payload...)
+		if len(msg) > maxWebsocketMessage {
+			return nil, fmt.Errorf("websocket message larger than %d bytes", maxWebsocketMessage)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebsocketMessage {
+		err = fmt.Errorf("websocket frame larger than %d bytes", maxWebsocketMessage)
+		return
+	}
+	if !masked {
+		// Clients must mask every frame (RFC 6455 section 5.1)
+		err = fmt.Errorf("unmasked websocket frame from client")
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// WriteMessage sends data as one binary message
+func (c *wsConn) WriteMessage(data []byte) error {
+	return c.writeFrame(wsBinary, data)
+}
+
+// writeFrame sends one unmasked, final frame
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	head := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(head); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// Close sends a normal-closure frame and closes the connection
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xe8})
+	return c.conn.Close()
+}
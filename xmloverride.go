@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// allowXMLOverrides - raw domain XML in creates is off unless VM_SERVICE_ALLOW_XML_OVERRIDES
+// is true. It gets past every check the structured fields have (allowed paths, host
+// devices, projects), so with authentication only admins may use it.
+var allowXMLOverrides, _ = strconv.ParseBool(envOrDefault("VM_SERVICE_ALLOW_XML_OVERRIDES", "false"))
+
+// xmlOverridesAllowed - whether the request may use XML overrides: they are enabled and,
+// with authentication, the caller is an admin
+func xmlOverridesAllowed(r *http.Request) bool {
+	if !allowXMLOverrides {
+		return false
+	}
+	p := requestPrincipal(r)
+	return p == nil || p.Role == roleAdmin
+}
+
+// qemuNamespace - the namespace of <qemu:commandline> and friends; fragments may use
+// the qemu: prefix without declaring it
+const qemuNamespace = "http://libvirt.org/schemas/domain/qemu/1.0"
+
+// XMLOverride - raw domain XML for what the structured API doesn't model yet. Devices
+// are appended to <devices> and Elements to <domain>, e.g. <qemu:commandline>. Domain
+// replaces the generated document altogether; a dry run gives the document to start
+// from, including the paths of the disks the create allocates.
+type XMLOverride struct {
+	Devices  []string `json:"devices,omitempty"`
+	Elements []string `json:"elements,omitempty"`
+	Domain   string   `json:"domain,omitempty"`
+}
+
+// validate checks each fragment is well-formed and the override is one kind or the other
+func (o *XMLOverride) validate() error {
+	if o.Domain != "" {
+		if len(o.Devices) > 0 || len(o.Elements) > 0 {
+			return fmt.Errorf("domain replaces the whole document, it cannot be combined with devices or elements")
+		}
+		if _, err := parseDomainDef(o.Domain); err != nil {
+			return fmt.Errorf("domain: %v", err)
+		}
+		return nil
+	}
+	for i, frag := range o.Devices {
+		if err := checkXMLFragment(frag); err != nil {
+			return fmt.Errorf("devices %d: %v", i, err)
+		}
+	}
+	for i, frag := range o.Elements {
+		if err := checkXMLFragment(frag); err != nil {
+			return fmt.Errorf("elements %d: %v", i, err)
+		}
+	}
+	if len(o.Devices) == 0 && len(o.Elements) == 0 {
+		return fmt.Errorf("one of devices, elements or domain is required")
+	}
+	return nil
+}
+
+// checkXMLFragment checks that frag is one or more complete elements and nothing else,
+// so it can't close the element it is put into
+func checkXMLFragment(frag string) error {
+	d := xml.NewDecoder(strings.NewReader("<fragment xmlns:qemu='" + qemuNamespace + "'>" + frag + "</fragment>"))
+	depth, elements, closed := 0, 0, false
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if closed {
+			return fmt.Errorf("closes an element it didn't open")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				elements++
+			}
+		case xml.EndElement:
+			depth--
+			closed = depth == 0
+		case xml.CharData:
+			if depth == 1 && len(bytes.TrimSpace(t)) > 0 {
+				return fmt.Errorf("text outside an element")
+			}
+		case xml.ProcInst, xml.Directive:
+			return fmt.Errorf("only elements are allowed")
+		}
+	}
+	if elements == 0 {
+		return fmt.Errorf("no element")
+	}
+	return nil
+}
+
+// applyXMLOverride merges the override into the generated document desc, declaring the
+// qemu namespace if the fragments use it. The result must still be the named domain.
+func applyXMLOverride(desc string, o *XMLOverride, name string) (string, error) {
+	if o.Domain != "" {
+		desc = o.Domain
+	} else {
+		if len(o.Devices) > 0 {
+			i := strings.LastIndex(desc, "</devices>")
+			if i < 0 {
+				return "", fmt.Errorf("the template has no <devices> to add to")
+			}
+			desc = desc[:i] + strings.Join(o.Devices, "\n") + "\n" + desc[i:]
+		}
+		if len(o.Elements) > 0 {
+			i := strings.LastIndex(desc, "</domain>")
+			if i < 0 {
+				return "", fmt.Errorf("the template has no </domain>")
+			}
+			desc = desc[:i] + strings.Join(o.Elements, "\n") + "\n" + desc[i:]
+		}
+		if strings.Contains(strings.Join(o.Devices, "")+strings.Join(o.Elements, ""), "<qemu:") {
+			start := strings.Index(desc, "<domain")
+			end := strings.Index(desc[start:], ">") + start
+			if !strings.Contains(desc[start:end], "xmlns:qemu=") {
+				desc = desc[:start+len("<domain")] + " xmlns:qemu='" + qemuNamespace + "'" + desc[start+len("<domain"):]
+			}
+		}
+	}
+
+	def, err := parseDomainDef(desc)
+	if err != nil {
+		return "", fmt.Errorf("XML with the override doesn't parse: %v", err)
+	}
+	if def.Name != name {
+		return "", fmt.Errorf("the domain must be named %q, not %q", name, def.Name)
+	}
+	return desc, nil
+}